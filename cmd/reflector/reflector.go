@@ -3,30 +3,90 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
-	"os/signal"
-	"syscall"
 
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/cli"
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/loader"
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
 )
 
+// the watcher and the capture have to be done with the handle before it's closed
+type watchedFD struct {
+	handle interface{ Close() }
+	stop   func()
+	done   []chan struct{}
+}
+
+func (w watchedFD) Close() {
+	w.stop()
+	for _, done := range w.done {
+		<-done
+	}
+	w.handle.Close()
+}
+
 func main() {
 	// parse and validate args, get a struct with the stuff we will need
 	// reflector and sender use the same struct, so for reflector many of args fields will be zero - be careful
 	args := cli.ParseReflectorArgs()
 
 	// Load the compiled eBPF ELF and load it into the kernel.
-	bpf := loader.LoadReflector(args)
+	bpf, err := loader.LoadReflector(args)
+	if err != nil {
+		if vlog, ok := loader.VerifierLog(err); ok == true {
+			log.Fatalf("Verifier error: %s\n", vlog)
+		}
+		log.Fatal(err)
+	}
 	args.OutputMap = bpf.Objs.Output
-	defer bpf.Close()
+	args.ArrivalsMap = bpf.Objs.Arrivals
+	args.ErrorEstimate = bpf.ErrorEstimate
+	args.SessionsMap = bpf.Objs.Sessions
+	args.Failed = append(args.Failed, bpf.Failed...)
+	for _, err := range args.Failed {
+		log.Printf("Skipping: %v", err)
+	}
+
+	// does nothing without --output or --auth-key, with either it runs until we're stopped
+	go stamp.RefSession(args)
+
+	// --watch-interfaces: new interfaces matching the wildcard get picked up as they come up
+	// cancelling ctx stops that and --capture below
+	ctx, stop := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+	if args.WatchInterfaces == true {
+		go func() {
+			defer close(watching)
+			if err := bpf.WatchAndReattach(ctx); err != nil {
+				log.Printf("Stopped watching interfaces: %v", err)
+			}
+		}()
+	} else {
+		close(watching)
+	}
+
+	// --capture: the frames go into the file as they come, stopping it only waits for whatever's still in the ring
+	capturing := make(chan struct{})
+	if args.Capture > 0 {
+		go func() {
+			defer close(capturing)
+			n, err := loader.DumpPacketsFile(ctx, bpf, int(args.Capture), args.CapturePath)
+			if err != nil {
+				log.Printf("Error capturing frames: %v", err)
+			}
+			log.Printf("Captured %d frames to %s", n, args.CapturePath)
+		}()
+	} else {
+		close(capturing)
+	}
 
-	// does nothing without the --output flag
-	stamp.RefSession(args)
+	// hang up until we're told to stop, then take everything off the interfaces
+	loader.Run(context.Background(), watchedFD{bpf, stop, []chan struct{}{watching, capturing}})
 
-	// hang up
-	stopper := make(chan os.Signal, 1)
-	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
-	<-stopper
+	// with --keep-going we still ran, but whoever started us has to know not everything did
+	if len(args.Failed) > 0 {
+		os.Exit(cli.ExitPartial)
+	}
 }
@@ -3,6 +3,10 @@
 package main
 
 import (
+	"context"
+	"log"
+	"os"
+
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/cli"
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/loader"
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
@@ -11,12 +15,78 @@ import (
 func main() {
 	//parse and validate args, get a struct with the stuff we will need
 	args := cli.ParseSenderArgs()
+	// stdout is only for the results in JSON mode, everything else we print goes to stderr
+	if args.JSON == true {
+		args.JSONOut = os.Stdout
+		os.Stdout = os.Stderr
+	}
+	// same for the CSV rows, the live report goes along with everything else
+	csvOut := os.Stdout
+	if args.CSV == true {
+		os.Stdout = os.Stderr
+	}
 
 	// Load the compiled eBPF ELF and load it into the kernel
-	bpf := loader.LoadSender(args)
+	bpf, err := loader.LoadSender(args)
+	if err != nil {
+		if vlog, ok := loader.VerifierLog(err); ok == true {
+			log.Fatalf("Verifier error: %s\n", vlog)
+		}
+		log.Fatal(err)
+	}
 	args.OutputMap = bpf.Objs.Output
-	defer bpf.Close()
+	args.RecentMap = bpf.Objs.Recent
+	args.ProbesMap = bpf.Objs.Probes
+	args.ArrivalsMap = bpf.Objs.Arrivals
+	args.ErrorEstimate = bpf.ErrorEstimate
+	// events have to be on before the first probe goes out
+	csvDone := make(chan struct{})
+	if args.CSV == true {
+		events := bpf.Events()
+		go func() {
+			defer close(csvDone)
+			if err := loader.WriteCSV(csvOut, events); err != nil {
+				log.Printf("Error writing CSV: %v", err)
+			}
+		}()
+	} else {
+		close(csvDone)
+	}
+
+	// --capture: the frames go into the file as they come, stopping it only waits for whatever's still in the ring
+	captureCtx, stopCapture := context.WithCancel(context.Background())
+	captureDone := make(chan struct{})
+	if args.Capture > 0 {
+		go func() {
+			defer close(captureDone)
+			n, err := loader.DumpPacketsFile(captureCtx, bpf, int(args.Capture), args.CapturePath)
+			if err != nil {
+				log.Printf("Error capturing frames: %v", err)
+			}
+			log.Printf("Captured %d frames to %s", n, args.CapturePath)
+		}()
+	} else {
+		close(captureDone)
+	}
 
 	// start the STAMP session, all gofuncs are managed in this func
 	stamp.StartSession(args)
+
+	// programs come off the interface first so the maps don't change under us while we read them
+	bpf.Detach()
+	stopCapture()
+	<-captureDone
+	if args.DumpMaps == true {
+		if err := stamp.DumpRecent(os.Stdout, args.RecentMap); err != nil {
+			log.Fatalf("Error dumping recent measurements: %v", err)
+		}
+	}
+	// closing the handle closes the events channel, the last rows go out after that
+	bpf.CloseObjects()
+	<-csvDone
+
+	// with --keep-going we still ran, but whoever started us has to know not everything did
+	if len(args.Failed) > 0 {
+		os.Exit(cli.ExitPartial)
+	}
 }
@@ -15,6 +15,14 @@
 
 char __license[] SEC("license")="GPL";
 
+volatile uint16_t refl_mode; // stateless or stateful(RFC 8762 4.3)
+volatile uint32_t max_reply_pps; // --max-reply-pps: replies a second every CPU gets to send, 0 for no limit; userspace splits the limit over --queues
+
+enum refl_modes {
+  REFL_STATELESS,
+  REFL_STATEFUL,
+};
+
 struct sample{
   uint32_t seq;
   uint64_t sam;
@@ -27,90 +35,423 @@ struct {
   __type(value, struct sample);
 } output SEC(".maps");
 
+//stateful mode: next reflector seq for every session-sender
+//a session-sender is the source IP+port, the sender runs its own sessions towards every reflector from the same port anyway
+struct sess_key{
+  uint8_t raddr[16]; //see load_raddr()
+  uint16_t port; //host order
+  uint16_t mbz;
+};
+
+//LRU so that senders that went away don't take up room forever
+//when the map fills up the least recently seen session goes, if it comes back it starts over from 0
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 4096);
+  __type(key, struct sess_key);
+  __type(value, uint32_t);
+} sessions SEC(".maps");
+
+//hands out the next reflector seq for whoever sent the packet, has to be called before the turnaround swaps the addresses
+static __always_inline int session_seq(struct __sk_buff *skb, uint32_t *seq){
+  struct sess_key key = { .mbz=0 };
+  uint16_t port;
+  if (load_raddr(skb, l2len(skb), FORME_INBOUND, key.raddr) != 0 ||
+      bpf_skb_load_bytes(skb, l2len(skb)+l3len(skb)+offsetof(struct udphdr, source), &port, sizeof(port)) != 0)
+    return -1;
+  key.port=bpf_ntohs(port);
+  uint32_t *next = bpf_map_lookup_elem(&sessions, &key);
+  if (!next) {
+    //new session or one that got evicted
+    uint32_t first=1;
+    bpf_map_update_elem(&sessions, &key, &first, BPF_ANY);
+    *seq=0;
+    return 0;
+  }
+  *seq=__sync_fetch_and_add(next, 1);
+  return 0;
+}
+
+//--max-reply-pps: a token bucket per CPU so they never contend, holds up to a second's worth
+//tokens are in billionths of a reply so every nanosecond adds max_reply_pps of them
+struct rate_bucket{
+  uint64_t last; //bpf_ktime_get_ns() of the last request
+  uint64_t tokens;
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, uint32_t);
+  __type(value, struct rate_bucket);
+} rate SEC(".maps");
+
+//takes a token if there's one, always does with no limit
+static __always_inline int reply_allowed(void){
+  uint32_t limit = max_reply_pps;
+  if (limit == 0) return 1;
+  uint32_t key = 0;
+  struct rate_bucket *b = bpf_map_lookup_elem(&rate, &key);
+  if (!b) return 1;
+  uint64_t now = bpf_ktime_get_ns();
+  //anything past a second fills it up anyway, capping it first keeps the multiplication from overflowing
+  uint64_t elapsed = now - b->last;
+  if (elapsed > 1000000000) elapsed = 1000000000;
+  uint64_t tokens = b->tokens + elapsed * limit;
+  if (tokens > (uint64_t)limit * 1000000000) tokens = (uint64_t)limit * 1000000000;
+  b->last = now;
+  if (tokens < 1000000000) {
+    b->tokens = tokens;
+    return 0;
+  }
+  b->tokens = tokens - 1000000000;
+  return 1;
+}
+
+//follow-up telemetry: the last reply that went out to every session-sender
+struct follow_up_rec{
+  uint32_t seq; //network order, as it was in the reply
+  struct ntp_ts ts;
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 4096);
+  __type(key, struct sess_key);
+  __type(value, struct follow_up_rec);
+} followups SEC(".maps");
+
+//tell the sender when our previous reply to it left and remember this one for next time, t3 is what we just stamped this one with
+//there's nothing to fill in if the sender didn't make room for the TLV
+static __always_inline void fill_follow_up(struct __sk_buff *skb, struct ntp_ts *t3){
+  struct follow_up_tlv tlv;
+  uint32_t offset=stampoffset(skb, sizeof(struct reflectorpkt));
+  if (bpf_skb_load_bytes(skb, offset, &tlv, sizeof(tlv)) != 0) return;
+  if (tlv.type != TLV_FOLLOW_UP || tlv.len != bpf_htons(sizeof(tlv)-4)) return;
+  //this is a reply so the session-sender is the destination, its port stays the source with keep_ports
+  struct sess_key key = { .mbz=0 };
+  uint16_t port;
+  uint32_t port_off = keep_ports != 0 ? offsetof(struct udphdr, source) : offsetof(struct udphdr, dest);
+  struct follow_up_rec cur = { .ts=*t3 };
+  if (load_raddr(skb, l2len(skb), FORME_OUTBOUND, key.raddr) != 0 ||
+      bpf_skb_load_bytes(skb, l2len(skb)+l3len(skb)+port_off, &port, sizeof(port)) != 0 ||
+      bpf_skb_load_bytes(skb, stampoffset(skb, offsetof(struct reflectorpkt, seq)), &cur.seq, sizeof(cur.seq)) != 0)
+    return;
+  key.port=bpf_ntohs(port);
+  //the first reply of a session has nothing to follow up on and goes out with zeroes
+  struct follow_up_rec *prev = bpf_map_lookup_elem(&followups, &key);
+  if (prev) {
+    tlv.seq=prev->seq;
+    tlv.ts=prev->ts;
+    tlv.mode=TS_SW_LOCAL;
+    store_csum(skb, offset, &tlv, sizeof(tlv));
+  }
+  bpf_map_update_elem(&followups, &key, &cur, BPF_ANY);
+}
+
+//the address sub-TLVs are all the same size so there's no telling the verifier it's 4 or 16 bytes otherwise
+static __always_inline int copy_addr(struct __sk_buff *skb, uint32_t from, uint32_t to, int v6){
+  uint8_t addr[16];
+  if (v6) {
+    if (bpf_skb_load_bytes(skb, from, addr, 16) != 0) return -1;
+    return store_csum(skb, to, addr, 16);
+  }
+  if (bpf_skb_load_bytes(skb, from, addr, 4) != 0) return -1;
+  return store_csum(skb, to, addr, 4);
+}
+
+//location TLV: fill in the ports and addresses the request came in with, has to happen before we turn it around
+//the sender decides which sub-TLVs there are, we fill in the two we know of and leave everything else alone
+static __always_inline void fill_location(struct __sk_buff *skb){
+  uint32_t off=stampoffset(skb, sizeof(struct reflectorpkt));
+  struct tlv_hdr hdr;
+  if (bpf_skb_load_bytes(skb, off, &hdr, sizeof(hdr)) != 0) return;
+  //the Follow-Up TLV goes first
+  if (hdr.type == TLV_FOLLOW_UP && hdr.len == bpf_htons(sizeof(struct follow_up_tlv)-4)) {
+    off+=sizeof(struct follow_up_tlv);
+    if (bpf_skb_load_bytes(skb, off, &hdr, sizeof(hdr)) != 0) return;
+  }
+  if (hdr.type != TLV_LOCATION) return;
+  uint32_t l4=l2len(skb)+l3len(skb);
+  struct udphdr udp;
+  if (bpf_skb_load_bytes(skb, l4, &udp, sizeof(udp)) != 0) return;
+  struct location_ports ports = { .dport=udp.dest, .sport=udp.source };
+  off+=sizeof(hdr);
+  store_csum(skb, off, &ports, sizeof(ports));
+  off+=sizeof(ports);
+  //addresses straight off the IP header
+  int v6 = pkt_family(skb) == IPFAM_V6;
+  uint32_t l2 = l2len(skb);
+  uint32_t saddr = l2 + (v6 ? offsetof(struct ipv6hdr, saddr) : offsetof(struct iphdr, saddr));
+  uint32_t daddr = l2 + (v6 ? offsetof(struct ipv6hdr, daddr) : offsetof(struct iphdr, daddr));
+  uint16_t alen = v6 ? 16 : 4;
+#pragma unroll
+  for (int i = 0; i < 2; i++) {
+    if (bpf_skb_load_bytes(skb, off, &hdr, sizeof(hdr)) != 0) return;
+    //the other family's sub-TLVs don't have room for our addresses
+    if (hdr.len != bpf_htons(alen)) return;
+    if (hdr.type == (v6 ? SUBTLV_DST_IPV6 : SUBTLV_DST_IPV4)) copy_addr(skb, daddr, off+sizeof(hdr), v6);
+    else if (hdr.type == (v6 ? SUBTLV_SRC_IPV6 : SUBTLV_SRC_IPV4)) copy_addr(skb, saddr, off+sizeof(hdr), v6);
+    else return;
+    off+=sizeof(hdr)+alen;
+  }
+}
+
+//authenticated mode: arrivals userspace hasn't answered yet, keyed by who sent it
+struct refl_key{
+  uint8_t raddr[16]; //see load_raddr()
+  uint32_t seq; //network order
+  uint16_t port; //host order
+  uint16_t mbz;
+};
+
+//what userspace can't see from the socket with the same precision: T2 and the TTL the packet came in with
+struct refl_arrival{
+  struct ntp_ts t2;
+  uint8_t ttl;
+  uint8_t mbz[3];
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 4096);
+  __type(key, struct refl_key);
+  __type(value, struct refl_arrival);
+} arrivals SEC(".maps");
+
+//--allow-from: prefixes we answer, addresses go the same way as load_raddr() has them so IPv4 prefixes are 96 bits longer
+struct allow_key{
+  uint32_t prefixlen;
+  uint8_t addr[16];
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 1024);
+  __type(key, struct allow_key);
+  __type(value, uint8_t);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allowed SEC(".maps");
+
+static __always_inline int sender_allowed(struct __sk_buff *skb){
+  if (allow_from == 0) return 1;
+  struct allow_key key = { .prefixlen=128 };
+  if (load_raddr(skb, l2len(skb), FORME_INBOUND, key.addr) != 0) return 0;
+  return bpf_map_lookup_elem(&allowed, &key) != NULL;
+}
+
+//timestamp information TLV: what our clock is synced to and how T2 and T3 were taken
+//src is where T2 came from, T3 is always ours
+static __always_inline void fill_ts_info(struct __sk_buff *skb, uint8_t src){
+  int64_t off=find_tlv(skb, stampoffset(skb, sizeof(struct reflectorpkt)), TLV_TS_INFO);
+  if (off < 0) return;
+  struct ts_info_tlv tlv;
+  if (bpf_skb_load_bytes(skb, off, &tlv, sizeof(tlv)) != 0 || tlv.len != bpf_htons(sizeof(tlv)-sizeof(struct tlv_hdr))) return;
+  tlv.sync_in=sync_src;
+  tlv.ts_in=src == TS_HW ? TS_HW_ASSIST : TS_SW_LOCAL;
+  tlv.sync_out=sync_src;
+  tlv.ts_out=TS_SW_LOCAL;
+  store_csum(skb, off, &tlv, sizeof(tlv));
+}
+
 SEC("tcx/ingress")
 int reflector_in(struct __sk_buff *skb){
   //lots of work here - convert senderpkt into reflectorpkt
   //Save the receive timestamp ASAP
+  //it only goes into the sender's format once we know what that is
   struct ntp_ts rec_ts;
-  timestamp(&rec_ts);
+  uint64_t rec_ns;
+  uint8_t src = rx_timestamp(skb, &rec_ns);
+  if (health_probe(skb)) {
+    stat_inc(STAT_HEALTH_IN);
+    return TCX_DROP;
+  }
 
   //for-me check
   if (!for_me(skb, FORME_INBOUND)) return TCX_PASS;
+  //it's ours but nobody we answer to, the stack would only send back a port unreachable
+  if (!sender_allowed(skb)) {
+    stat_inc(STAT_DENIED);
+    //a passive one isn't in a position to drop anybody's traffic
+    if (passive != 0) return TCX_PASS;
+    return TCX_DROP;
+  }
+  //over --max-reply-pps, authenticated ones too since userspace would answer them; passive doesn't answer anything
+  if (passive == 0 && !reply_allowed()) {
+    stat_inc(STAT_RATE_LIMITED);
+    return TCX_DROP;
+  }
+  //the request the way it came in, we're about to turn it into the reply
+  capture_frame(skb);
   
   //grab the actual packet
   void *data = (void *)(long)skb->data;
   void *data_end = (void *)(long)skb->data_end;
 
   //IP header
-  struct iphdr *iph = data+sizeof(struct ethhdr);
+  uint32_t l2 = l2len(skb);
+  uint32_t l3 = l3len(skb);
   //these kinds of checks are mandated by the eBPF verifier, without them the program won't get loaded
-  if (data + sizeof(struct iphdr) + sizeof(struct ethhdr) > data_end)
+  if (data + l3 + l2 > data_end)
+    return TCX_PASS;
+  //TTL is hop limit in IPv6, same thing
+  uint8_t ttl;
+  if (pkt_family(skb) == IPFAM_V6) {
+    struct ipv6hdr *ip6h = data+l2;
+    if (data + sizeof(struct ipv6hdr) + l2 > data_end)
+      return TCX_PASS;
+    ttl=ip6h->hop_limit;
+  } else {
+    struct iphdr *iph = data+l2;
+    if (data + sizeof(struct iphdr) + l2 > data_end)
+      return TCX_PASS;
+    ttl=iph->ttl;
+  }
+
+  //we can't sign the reply here so userspace answers it, we just leave it what it can't get itself
+  //T2 goes as NTP, userspace converts it if the request wants PTP
+  if (auth == AUTH_ON) {
+    struct refl_key key = { .mbz=0 };
+    struct refl_arrival arr = { .ttl=ttl };
+    timestamp_at(rec_ns, src, &arr.t2, TS_FMT_NTP);
+    uint16_t port;
+    if (load_raddr(skb, l2, FORME_INBOUND, key.raddr) != 0 ||
+        bpf_skb_load_bytes(skb, stampoffset(skb, offsetof(struct senderpkt_auth, seq)), &key.seq, sizeof(key.seq)) != 0 ||
+        bpf_skb_load_bytes(skb, l2+l3+offsetof(struct udphdr, source), &port, sizeof(port)) != 0) {
+      stat_inc(STAT_DROPPED);
+      return TCX_PASS;
+    }
+    key.port=bpf_ntohs(port);
+    bpf_map_update_elem(&arrivals, &key, &arr, BPF_ANY);
     return TCX_PASS;
+  }
   
   //Strip sender packet
-  struct senderpkt *sn = data + sizeof(struct iphdr) + sizeof(struct ethhdr) + sizeof(struct udphdr);
-  if(data + sizeof(struct iphdr) + sizeof(struct ethhdr) + sizeof(struct udphdr) + sizeof(struct senderpkt) > data_end)
+  struct senderpkt *sn = data + l3 + l2 + sizeof(struct udphdr);
+  if(data + l3 + l2 + sizeof(struct udphdr) + sizeof(struct senderpkt) > data_end){
+    stat_inc(STAT_DROPPED);
     return TCX_PASS;
+  }
   uint32_t seq=sn->seq;
+  uint16_t s_err=sn->err;
   struct ntp_ts sn_ts;
   sn_ts.ntp_secs=sn->t1_s;
   sn_ts.ntp_fracs=sn->t1_f;
-  uint8_t ttl=iph->ttl;
+  //the reply goes out in whatever format the sender used, its Z bit says which
+  uint8_t fmt=ts_fmt_of(s_err);
+  timestamp_at(rec_ns, src, &rec_ts, fmt);
 
   //output available metrics to userspace
   uint64_t timestamps[2];
-  timestamps[0]=untimestamp(&sn_ts);
-  timestamps[1]=untimestamp(&rec_ts);
+  timestamps[0]=untimestamp(&sn_ts, fmt);
+  timestamps[1]=untimestamp(&rec_ts, fmt);
   struct sample s;
   s.seq=bpf_ntohl(seq);
   s.sam=timestamps[1]-timestamps[0];
   bpf_ringbuf_output(&output, &s, sizeof(struct sample), 0);
+
+  //--passive: we've seen it and that's all, it goes on to wherever it was going untouched
+  if (passive != 0) {
+    uint32_t rseq;
+    if (refl_mode == REFL_STATEFUL) session_seq(skb, &rseq);
+    stat_inc(STAT_OBSERVED);
+    return TCX_PASS;
+  }
   
   //Populate receivepkt(they're the same size so it's legal)
-  if(data + sizeof(struct iphdr) + sizeof(struct ethhdr) + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end)
+  if(data + l3 + l2 + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end)
     return TCX_PASS;
   uint32_t offset; //we'll use this a lot
-  //going from top to bottom - seq stays the same
+  //--zero-udp-csum: no checksum at all and every store below leaves it that way, IPv6 has to have one
+  if (zero_csum != 0 && pkt_family(skb) == IPFAM_V4) {
+    uint16_t zero=0;
+    bpf_skb_store_bytes(skb, csum_offset(skb), &zero, sizeof(zero), 0);
+  }
+  //going from top to bottom - seq stays the same unless we're stateful, see below
   //populate t2
-  offset=stampoffset(offsetof(struct reflectorpkt, t2_s));
-  bpf_skb_store_bytes(skb,offset,&rec_ts,sizeof(rec_ts),0);
+  offset=stampoffset(skb, offsetof(struct reflectorpkt, t2_s));
+  store_csum(skb,offset,&rec_ts,sizeof(rec_ts));
   //populate sender seq
-  offset=stampoffset(offsetof(struct reflectorpkt, s_seq));
-  bpf_skb_store_bytes(skb,offset,&seq,sizeof(uint32_t),0);
+  offset=stampoffset(skb, offsetof(struct reflectorpkt, s_seq));
+  store_csum(skb,offset,&seq,sizeof(uint32_t));
   //populate sender ts
-  offset=stampoffset(offsetof(struct reflectorpkt, t1_s));
-  bpf_skb_store_bytes(skb,offset,&sn_ts,sizeof(struct ntp_ts),0);
+  offset=stampoffset(skb, offsetof(struct reflectorpkt, t1_s));
+  store_csum(skb,offset,&sn_ts,sizeof(struct ntp_ts));
+  //populate sender error estimate and ours, T3 only comes in on the way out but it's the same clock
+  offset=stampoffset(skb, offsetof(struct reflectorpkt, s_err));
+  store_csum16(skb,offset,s_err);
+  uint16_t err=err_est_for(fmt);
+  offset=stampoffset(skb, offsetof(struct reflectorpkt, err));
+  store_csum16(skb,offset,err);
   //populate sender TTL
-  if(data+sizeof(struct ethhdr) + sizeof(struct iphdr) + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end)
+  if(data+l2 + l3 + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end)
      return TCX_PASS;
-  offset=stampoffset(offsetof(struct reflectorpkt, ttl));
-  bpf_skb_store_bytes(skb,offset,&ttl,sizeof(ttl),0);
+  //it's a checksum word with the MBZ octet behind it
+  uint8_t ttl_word[2] = { ttl, 0 };
+  uint16_t ttl16;
+  __builtin_memcpy(&ttl16, ttl_word, sizeof(ttl16));
+  offset=stampoffset(skb, offsetof(struct reflectorpkt, ttl));
+  store_csum16(skb,offset,ttl16);
+  //stateless reflector leaves the sender's seq in, stateful one puts its own there
+  if (refl_mode == REFL_STATEFUL) {
+    uint32_t rseq;
+    if (session_seq(skb, &rseq) != 0) {
+      stat_inc(STAT_DROPPED);
+      return TCX_PASS;
+    }
+    rseq=bpf_htonl(rseq);
+    offset=stampoffset(skb, offsetof(struct reflectorpkt, seq));
+    store_csum(skb,offset,&rseq,sizeof(rseq));
+  }
   
+  //what the request looked like when it got here, the turnaround swaps it all
+  if (location != 0) fill_location(skb);
+  if (ts_info != 0) fill_ts_info(skb, src);
+
   //we attempt to redirect the packet
   //this may quietly fail, check this in case of unexplainable packet loss
-  return pkt_turnaround(skb);
+  uint64_t ret = pkt_turnaround(skb);
+  if (ret == TCX_PASS) stat_inc(STAT_DROPPED);
+  else stat_inc(STAT_REFLECTED);
+  return ret;
 } 
 
 SEC("tcx/egress")
 int reflector_out(struct __sk_buff *skb){
   //light work - stamp a packet and send it on its way
+  if (health_probe(skb)) return health_turnaround(skb);
+  //nothing of ours goes out in passive mode, whatever looks like a reply is somebody else's
+  if (passive != 0) return TCX_PASS;
 
   //for-me check
   if (!for_me(skb, FORME_OUTBOUND)) return TCX_PASS;
+  //userspace reply, already stamped and signed - touching it would break the HMAC
+  if (auth == AUTH_ON) {
+    stat_inc(STAT_REFLECTED);
+    capture_frame(skb);
+    return TCX_PASS;
+  }
 
   //grab the actual packet
   void *data = (void *)(long)skb->data;
   void *data_end = (void *)(long)skb->data_end;
   
   //populate t3  
-  if(data + sizeof(struct iphdr) + sizeof(struct ethhdr) + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end)
+  if(data + l3len(skb) + l2len(skb) + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end)
     return TCX_PASS;
   uint32_t offset;
-  offset=stampoffset(offsetof(struct reflectorpkt,t3_s));
+  offset=stampoffset(skb, offsetof(struct reflectorpkt,t3_s));
+  //ingress put our Error Estimate in already, its Z bit says which format the sender wants
+  uint16_t err;
+  if (bpf_skb_load_bytes(skb, stampoffset(skb, offsetof(struct reflectorpkt, err)), &err, sizeof(err)) != 0)
+    return TCX_PASS;
   //timestamp at the last possible moment
   struct ntp_ts ts;
-  timestamp(&ts);
-  bpf_skb_store_bytes(skb, offset, &ts, sizeof(ts),0);
+  timestamp(&ts, ts_fmt_of(err));
+  store_csum(skb, offset, &ts, sizeof(ts));
+  if (follow_up != 0) fill_follow_up(skb, &ts);
+  //the reply the way it leaves
+  capture_frame(skb);
   
   return TCX_PASS;
 }
@@ -20,9 +20,18 @@ char __license[] SEC("license")="GPL";
 /*   uint64_t ts[4]; //0-1 are outbound journey, 2-3 are inbound */
 /* }__attribute__((packed)); */
 
+//result of checking the reflected sender block against what we actually sent
+enum echo_check {
+  ECHO_OK,
+  ECHO_BAD_TS, //reflector mangled the sender timestamp
+  ECHO_UNKNOWN_SEQ, //reflector mangled the sender seq(or we've never sent it)
+};
+
 struct sample{
   uint32_t seq;
   uint64_t near,far,rt;
+  uint8_t echo; //enum echo_check
+  uint8_t raddr[16]; //reflector that sent it back, we can talk to several at once; see load_raddr()
 }__attribute__((packed));
   
 //packet info - for output
@@ -32,67 +41,594 @@ struct {
   __type(value, struct sample);
 } output SEC(".maps");
 
+//every reflector runs its own sequence so we key by both
+struct probe_key{
+  uint8_t raddr[16];
+  uint32_t seq; //network order
+};
+
+//what we know about a probe we sent
+struct sent_probe{
+  struct ntp_ts wire; //T1 as it went out in the packet, this is what the reflector has to echo back
+  uint64_t t1; //T1 in ns that we do the math with, same thing as wire unless we're in cgroup mode
+};
+
+//outstanding probes: reflector+sender seq -> T1 we stamped it with
+//LRU so that lost packets don't clog it up, that means we can only verify up to 4096 packets in flight
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 4096);
+  __type(key, struct probe_key);
+  __type(value, struct sent_probe);
+} probes SEC(".maps");
+
+//last-N raw measurements for on-demand dumps, already converted to unix ns
+struct raw_measurement{
+  uint32_t seq;
+  uint64_t t1,t2,t3,t4;
+}__attribute__((packed));
+
+//ring of recent measurements, userspace resizes this at load time(it can't be 0 so 1 is a placeholder)
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, uint32_t);
+  __type(value, struct raw_measurement);
+} recent SEC(".maps");
+volatile uint32_t recent_len; // amount of slots in the ring, 0 disables it
+volatile uint32_t recent_idx; // monotonic write counter, slot is idx % len
+
+//every reply with all four timestamps, for whoever wants to do their own analysis off of the loader
+struct event{
+  uint32_t seq;
+  uint64_t t1,t2,t3,t4; //unix ns
+  uint8_t saddr[16]; //us, see load_raddr()
+  uint8_t daddr[16]; //the reflector
+  uint32_t fu_seq; //follow-up telemetry: reflector seq of its previous reply...
+  uint64_t fu_t3; //...and when it actually left in unix ns, both 0 when there's none
+  uint8_t t4_src; //enum ts_source, T1 is always TS_KERNEL
+  uint16_t t3_err, t1_err; //error estimates as they came back: the reflector's own and ours echoed, 0 if it doesn't fill them in
+  uint16_t loc_dport, loc_sport; //location TLV: the ports the reflector saw the probe come in with...
+  uint8_t loc_daddr[16], loc_saddr[16]; //...and the addresses, see load_raddr(); all 0 when there's none
+  uint8_t ts_sync_in, ts_in, ts_sync_out, ts_out; //timestamp information TLV as the reflector filled it in, 0 when there's none
+  uint64_t event_seq; //which reply this is out of all the ones that could've been an event, with sample_rate the gaps say how many got skipped
+}__attribute__((packed));
+
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 1 << 16);
+  __type(value, struct event);
+} events SEC(".maps");
+volatile uint16_t events_on; // userspace flips this once somebody reads the events, until then we don't bother
+volatile uint32_t sample_rate; // --sample-rate: only every Nth reply goes to the events ring, 0 and 1 send them all; the stats count every one regardless
+volatile uint64_t event_seq; // replies that could've been events so far
+
+//our own IP in the same 16-byte form as load_raddr()
+static __always_inline void load_laddr(uint8_t *addr){
+  if (ip_family == IPFAM_V6) {
+#pragma unroll
+    for (int i = 0; i < 16; i++) addr[i]=laddr6[i];
+    return;
+  }
+  uint32_t ip=laddr;
+  __builtin_memset(addr, 0, 10);
+  addr[10]=0xff;
+  addr[11]=0xff;
+  __builtin_memcpy(addr+12, &ip, 4);
+}
+
+//authenticated mode: T4 of replies we let through to userspace, it takes them out once it's checked the HMAC
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 4096);
+  __type(key, struct probe_key);
+  __type(value, uint64_t);
+} arrivals SEC(".maps");
+
+//shared by TCX and cgroup egress: note down what we sent
+static __always_inline void remember_probe(uint8_t *raddr, uint32_t seq, struct ntp_ts *wire, uint64_t t1){
+  struct probe_key key = { .seq=seq };
+  __builtin_memcpy(key.raddr, raddr, sizeof(key.raddr));
+  struct sent_probe probe = { .wire=*wire, .t1=t1 };
+  bpf_map_update_elem(&probes, &key, &probe, BPF_ANY);
+}
+
+//gap detection: the next reflector seq we expect from every reflector and which of the 64 before it we've seen
+//bit i of seen is next-1-i
+struct seq_track{
+  uint32_t next;
+  uint64_t seen;
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 1024);
+  __type(key, uint8_t[16]); //see load_raddr()
+  __type(value, struct seq_track);
+} seqtrack SEC(".maps");
+
+//the reflector's seq is the sender's in stateless mode so gaps are round-trip loss, in stateful mode it counts its own replies so they're return-path loss only
+//seqs are compared by signed 32-bit difference so wrapping around 2^32 is just the next one
+//replies to the same reflector can race each other on different CPUs, the counts are a best effort
+static __always_inline void track_seq(uint8_t *raddr, uint32_t seq){
+  struct seq_track *t = bpf_map_lookup_elem(&seqtrack, raddr);
+  if (!t) {
+    //nothing to compare the first one to
+    struct seq_track first = { .next=seq+1, .seen=1 };
+    bpf_map_update_elem(&seqtrack, raddr, &first, BPF_ANY);
+    return;
+  }
+  int32_t diff = (int32_t)(seq - t->next);
+  if (diff >= 0) {
+    //everything we skipped over is lost until it turns up
+    if (diff > 0) stat_add(STAT_LOST, diff);
+    t->seen = diff >= 64 ? 1 : (t->seen << diff) << 1 | 1;
+    t->next = seq+1;
+    return;
+  }
+  uint32_t idx = -(diff+1);
+  if (idx >= 64) {
+    //too far back to tell a late one from a duplicate
+    stat_inc(STAT_REORDERED);
+    return;
+  }
+  if (t->seen & (1ULL << idx)) return; //duplicate
+  t->seen |= 1ULL << idx;
+  stat_inc(STAT_REORDERED);
+  //counted as lost when we skipped it, per-CPU slots can go "negative" but the sum comes out right
+  stat_add(STAT_LOST, -1ULL);
+}
+
+//the reflector's Follow-Up Telemetry TLV if we asked for one, off is where it starts; zeroes if there's nothing to read
+static __always_inline void load_follow_up(struct __sk_buff *skb, uint32_t off, struct follow_up_tlv *tlv){
+  __builtin_memset(tlv, 0, sizeof(*tlv));
+  if (follow_up == 0) return;
+  if (bpf_skb_load_bytes(skb, off, tlv, sizeof(*tlv)) != 0 || tlv->type != TLV_FOLLOW_UP)
+    __builtin_memset(tlv, 0, sizeof(*tlv));
+}
+
+//what the reflector filled into the location TLV
+struct location_info{
+  uint16_t dport, sport;
+  uint8_t daddr[16], saddr[16];
+};
+
+//the reflector's Location TLV if we asked for one, off is where the TLVs start; zeroes if there's nothing to read
+//a reflector that doesn't know it sends it back as is(or flagged), either way there's no port in it
+static __always_inline void load_location(struct __sk_buff *skb, uint32_t off, struct location_info *loc){
+  __builtin_memset(loc, 0, sizeof(*loc));
+  if (location == 0) return;
+  if (follow_up != 0) off+=sizeof(struct follow_up_tlv);
+  struct tlv_hdr hdr;
+  struct location_ports ports;
+  if (bpf_skb_load_bytes(skb, off, &hdr, sizeof(hdr)) != 0 || hdr.type != TLV_LOCATION || (hdr.flags & TLV_FLAG_U) != 0 ||
+      bpf_skb_load_bytes(skb, off+sizeof(hdr), &ports, sizeof(ports)) != 0 || ports.dport == 0)
+    return;
+  loc->dport=bpf_ntohs(ports.dport);
+  loc->sport=bpf_ntohs(ports.sport);
+  //the sub-TLVs are ours, destination then source
+  off+=sizeof(hdr)+sizeof(ports)+sizeof(hdr);
+  if (ip_family == IPFAM_V6) {
+    bpf_skb_load_bytes(skb, off, loc->daddr, 16);
+    bpf_skb_load_bytes(skb, off+16+sizeof(hdr), loc->saddr, 16);
+    return;
+  }
+  loc->daddr[10]=loc->daddr[11]=0xff;
+  loc->saddr[10]=loc->saddr[11]=0xff;
+  bpf_skb_load_bytes(skb, off, loc->daddr+12, 4);
+  bpf_skb_load_bytes(skb, off+4+sizeof(hdr), loc->saddr+12, 4);
+}
+
+//the reflector's Timestamp Information TLV if we asked for one, off is where the TLVs start; zeroes if there's nothing to read
+//or the reflector flagged it as unrecognized
+static __always_inline void load_ts_info(struct __sk_buff *skb, uint32_t off, struct ts_info_tlv *tlv){
+  __builtin_memset(tlv, 0, sizeof(*tlv));
+  if (ts_info == 0) return;
+  int64_t at=find_tlv(skb, off, TLV_TS_INFO);
+  if (at < 0) return;
+  if (bpf_skb_load_bytes(skb, at, tlv, sizeof(*tlv)) != 0 || (tlv->flags & TLV_FLAG_U) != 0)
+    __builtin_memset(tlv, 0, sizeof(*tlv));
+}
+
+//shared by TCX and cgroup ingress: turn a reflected packet into a sample and ship it to userspace
+//rf has to be bounds-checked already, raddr is the reflector's IP, fu, loc and ti are whatever load_follow_up(), load_location()
+//and load_ts_info() found, src is where last_ts came from
+static __always_inline void handle_reply(struct reflectorpkt *rf, uint8_t *raddr, uint64_t last_ts, uint8_t src, struct follow_up_tlv *fu, struct location_info *loc, struct ts_info_tlv *ti){
+  /* struct packet_ts timestamps; */
+  uint64_t timestamps[4];
+  struct sample s;
+  struct ntp_ts ntpts;
+  //grab seq - we go by the sender seq from the reflected sender block since that's what we actually sent
+  //stateless reflector copies it into its own seq as well, stateful one won't
+  s.seq=bpf_ntohl(rf->s_seq);
+  //which reflector is it from
+  __builtin_memcpy(s.raddr, raddr, sizeof(s.raddr));
+  //grab sender timestamp
+  ntpts.ntp_secs=rf->t1_s;
+  ntpts.ntp_fracs=rf->t1_f;
+  timestamps[0]=untimestamp(&ntpts, ts_format);
+  //verify the reflector didn't mangle the sender block
+  struct probe_key key = { .seq=rf->s_seq };
+  __builtin_memcpy(key.raddr, raddr, sizeof(key.raddr));
+  struct sent_probe *sent=bpf_map_lookup_elem(&probes, &key);
+  if (!sent) {
+    s.echo=ECHO_UNKNOWN_SEQ;
+    stat_inc(STAT_SEQ_ERR);
+  } else {
+    if (sent->wire.ntp_secs!=rf->t1_s || sent->wire.ntp_fracs!=rf->t1_f) s.echo=ECHO_BAD_TS;
+    else s.echo=ECHO_OK;
+    //in cgroup mode the wire T1 comes from userspace, the one we noted on egress is more precise
+    timestamps[0]=sent->t1;
+    bpf_map_delete_elem(&probes, &key);
+  }
+  //grab reflector stamps
+  //the reflector says which format it answered in, it should be ours
+  uint8_t rfmt=ts_fmt_of(rf->err);
+  ntpts.ntp_secs=rf->t2_s;
+  ntpts.ntp_fracs=rf->t2_f;
+  timestamps[1]=untimestamp(&ntpts, rfmt);
+  ntpts.ntp_secs=rf->t3_s;
+  ntpts.ntp_fracs=rf->t3_f;
+  timestamps[2]=untimestamp(&ntpts, rfmt);
+  //save the last one we saved earlier
+  timestamps[3]=last_ts;
+  //calculate samples
+  s.near=timestamps[1]-timestamps[0];
+  s.far=timestamps[3]-timestamps[2];
+  s.rt=timestamps[3]-timestamps[0];
+  //send it
+  bpf_ringbuf_output(&output, &s, sizeof(struct sample), 0);
+  stat_inc(STAT_REFLECTED);
+  track_seq(raddr, bpf_ntohl(rf->seq));
+  //save it to the recent ring
+  if (recent_len!=0) {
+    uint32_t slot = __sync_fetch_and_add(&recent_idx, 1) % recent_len;
+    struct raw_measurement raw = {
+      .seq=s.seq,
+      .t1=timestamps[0], .t2=timestamps[1], .t3=timestamps[2], .t4=timestamps[3],
+    };
+    bpf_map_update_elem(&recent, &slot, &raw, BPF_ANY);
+  }
+  //and the events ring, a full ring just loses the event
+  uint64_t eseq = 0;
+  if (events_on!=0) eseq=__sync_fetch_and_add(&event_seq, 1);
+  if (events_on!=0 && (sample_rate <= 1 || eseq % sample_rate == 0)) {
+    struct event ev = {
+      .event_seq=eseq,
+      .seq=s.seq,
+      .t1=timestamps[0], .t2=timestamps[1], .t3=timestamps[2], .t4=timestamps[3],
+      .t4_src=src,
+      .t3_err=bpf_ntohs(rf->err), .t1_err=bpf_ntohs(rf->s_err),
+    };
+    load_laddr(ev.saddr);
+    __builtin_memcpy(ev.daddr, raddr, sizeof(ev.daddr));
+    if (fu->ts.ntp_secs != 0) {
+      ev.fu_seq=bpf_ntohl(fu->seq);
+      ev.fu_t3=untimestamp(&fu->ts, rfmt);
+    }
+    ev.loc_dport=loc->dport;
+    ev.loc_sport=loc->sport;
+    __builtin_memcpy(ev.loc_daddr, loc->daddr, sizeof(ev.loc_daddr));
+    __builtin_memcpy(ev.loc_saddr, loc->saddr, sizeof(ev.loc_saddr));
+    ev.ts_sync_in=ti->sync_in;
+    ev.ts_in=ti->ts_in;
+    ev.ts_sync_out=ti->sync_out;
+    ev.ts_out=ti->ts_out;
+    bpf_ringbuf_output(&events, &ev, sizeof(ev), 0);
+  }
+}
+
+//shared by TCX and cgroup programs in authenticated mode: note down when the reply arrived and leave the rest to userspace
+static __always_inline void note_arrival(struct __sk_buff *skb, uint32_t l2, uint64_t last_ts){
+  struct probe_key key;
+  if (load_raddr(skb, l2, FORME_INBOUND, key.raddr) != 0 ||
+      bpf_skb_load_bytes(skb, l2+l3len(skb)+sizeof(struct udphdr)+offsetof(struct reflectorpkt_auth, s_seq), &key.seq, sizeof(key.seq)) != 0){
+    stat_inc(STAT_DROPPED);
+    return;
+  }
+  bpf_map_update_elem(&arrivals, &key, &last_ts, BPF_ANY);
+}
+
+volatile uint16_t dscp; // DSCP to mark probes with, 0 leaves them alone
+
+//rewrite the DSCP bits of the IP header and keep the ECN ones
+//the first two bytes are all we touch: IPv4 has ToS in the second one, IPv6 has the traffic class straddling both
+static __always_inline void set_dscp(struct __sk_buff *skb){
+  if (dscp == 0) return;
+  uint8_t old[2], new[2];
+  uint32_t l3=l2len(skb);
+  if (bpf_skb_load_bytes(skb, l3, old, sizeof(old)) != 0) return;
+  if (pkt_family(skb) == IPFAM_V6) {
+    uint8_t tc = (old[0] << 4) | (old[1] >> 4);
+    tc = (dscp << 2) | (tc & 0x3);
+    new[0] = (old[0] & 0xf0) | (tc >> 4);
+    new[1] = (tc << 4) | (old[1] & 0x0f);
+    //no header checksum in IPv6
+    bpf_skb_store_bytes(skb, l3, new, sizeof(new), 0);
+    return;
+  }
+  new[0] = old[0];
+  new[1] = (dscp << 2) | (old[1] & 0x3);
+  uint16_t from, to;
+  __builtin_memcpy(&from, old, sizeof(from));
+  __builtin_memcpy(&to, new, sizeof(to));
+  bpf_l3_csum_replace(skb, l3+offsetof(struct iphdr, check), from, to, sizeof(to));
+  bpf_skb_store_bytes(skb, l3, new, sizeof(new), 0);
+}
+
+volatile uint16_t rewrite_src; // --rewrite-source: probes that left from another address(routing picked it) get laddr as their source
+
+//probes from any of our addresses look like ours once they're ours, so this has to go before the for-me check
+//same port checks as for_me, then the source address and both checksums it's in get swapped; a probe from laddr is left alone
+static __always_inline void rewrite_source(struct __sk_buff *skb){
+  if (rewrite_src == 0) return;
+  uint32_t l3=l2len(skb);
+  uint32_t l4=l3+l3len(skb);
+  struct udphdr udph;
+  if (bpf_skb_load_bytes(skb, l4, &udph, sizeof(udph)) != 0) return;
+  if (udph.source != bpf_htons(out_port()) || (d_port != 0 && udph.dest != bpf_htons(d_port))) return;
+  if (pkt_family(skb) == IPFAM_V6) {
+    struct ipv6hdr ip6h;
+    if (bpf_skb_load_bytes(skb, l3, &ip6h, sizeof(ip6h)) != 0 || ip6h.version != 6 || ip6h.nexthdr != IPPROTO_UDP) return;
+    if (is_laddr6(ip6h.saddr.s6_addr)) return;
+    uint8_t new[16];
+#pragma unroll
+    for (int i = 0; i < 16; i++) new[i]=laddr6[i];
+    //no header checksum in IPv6, only the pseudo-header in UDP's
+    int64_t diff = bpf_csum_diff((__be32 *)ip6h.saddr.s6_addr, 16, (__be32 *)new, 16, 0);
+    if (diff < 0) return;
+    bpf_l4_csum_replace(skb, l4+offsetof(struct udphdr, check), 0, diff, BPF_F_PSEUDO_HDR);
+    bpf_skb_store_bytes(skb, l3+offsetof(struct ipv6hdr, saddr), new, sizeof(new), 0);
+    return;
+  }
+  struct iphdr iph;
+  if (bpf_skb_load_bytes(skb, l3, &iph, sizeof(iph)) != 0 || iph.version != 4 || iph.protocol != IPPROTO_UDP) return;
+  uint32_t old=iph.saddr, new=laddr;
+  if (old == new) return;
+  bpf_l3_csum_replace(skb, l3+offsetof(struct iphdr, check), old, new, sizeof(new));
+  //a 0 UDP checksum means there's none and has to stay that way
+  bpf_l4_csum_replace(skb, l4+offsetof(struct udphdr, check), old, new, BPF_F_PSEUDO_HDR | BPF_F_MARK_MANGLED_0 | sizeof(new));
+  bpf_skb_store_bytes(skb, l3+offsetof(struct iphdr, saddr), &new, sizeof(new), 0);
+}
+
+//--seq-start: userspace counts the seqs, we keep track of how far it got for Stats()
+volatile uint32_t next_seq; // host order: the one after the furthest probe that went out, userspace starts it at --seq-start
+
+//serial(RFC 1982) so it goes on past 2^32, a probe that went out behind a later one doesn't set it back
+static __always_inline void note_seq(uint32_t seq){
+  uint32_t next = bpf_ntohl(seq)+1;
+  if ((int32_t)(next - next_seq) > 0) next_seq=next;
+}
+
+//bounded runs: userspace stops sending on its own, this is the backstop in case it doesn't
+volatile uint16_t probe_limit; // --count: only probes_left more probes go out
+volatile int64_t probes_left; // signed so probes racing past 0 on other CPUs can't wrap it around
+volatile uint64_t deadline; // --duration: bpf_ktime_get_ns() past which nothing goes out, 0 for none
+volatile uint16_t stopped; // Drain(): no more probes go out, the replies to the ones already out still come in
+
+static __always_inline int probe_allowed(){
+  if (stopped != 0) return 0;
+  if (deadline != 0 && bpf_ktime_get_ns() > deadline) return 0;
+  if (probe_limit == 0) return 1;
+  return __sync_fetch_and_sub(&probes_left, 1) > 0;
+}
+
 SEC("tcx/egress")
 int sender_out(struct __sk_buff *skb){
-  //RETURN VALUE: ALWAYS TCX_PASS
+  //RETURN VALUE: FOR-ME && OVER THE LIMIT ? TCX_DROP : TCX_PASS
+  if (health_probe(skb)) return health_turnaround(skb);
 
   //for-me check
+  rewrite_source(skb);
   if ( ! for_me(skb, FORME_OUTBOUND) ) return TCX_PASS;
+  if (!probe_allowed()) return TCX_DROP;
+  stat_inc(STAT_SENT);
+  set_dscp(skb);
   
-  // T1
-  uint32_t offset=stampoffset(offsetof(struct senderpkt, t1_s));
   //timestamp at the last possible moment
   struct ntp_ts ts;
-  timestamp(&ts);
+  timestamp(&ts, ts_format);
+  uint8_t raddr[16];
+  uint32_t seq;
+  //T1 is under the HMAC so userspace wrote it, we just note the precise time same as cgroup mode
+  if (auth == AUTH_ON) {
+    struct ntp_ts wire;
+    if (load_raddr(skb, l2len(skb), FORME_OUTBOUND, raddr) == 0 &&
+        bpf_skb_load_bytes(skb, stampoffset(skb, offsetof(struct senderpkt_auth, seq)), &seq, sizeof(seq)) == 0 &&
+        bpf_skb_load_bytes(skb, stampoffset(skb, offsetof(struct senderpkt_auth, t1_s)), &wire, sizeof(wire)) == 0) {
+      remember_probe(raddr, seq, &wire, untimestamp(&ts, ts_format));
+      note_seq(seq);
+    }
+    capture_frame(skb);
+    return TCX_PASS;
+  }
+  // T1
+  uint32_t offset=stampoffset(skb, offsetof(struct senderpkt, t1_s));
   bpf_skb_store_bytes(skb, offset, &ts, sizeof(ts),0);
+  uint16_t err=err_est_for(ts_format);
+  bpf_skb_store_bytes(skb, stampoffset(skb, offsetof(struct senderpkt, err)), &err, sizeof(err), 0);
+  //remember what we sent so we can check the reflector echoes it back correctly
+  if (load_raddr(skb, l2len(skb), FORME_OUTBOUND, raddr) == 0 &&
+      bpf_skb_load_bytes(skb, stampoffset(skb, offsetof(struct senderpkt, seq)), &seq, sizeof(seq)) == 0) {
+    remember_probe(raddr, seq, &ts, untimestamp(&ts, ts_format));
+    note_seq(seq);
+  }
+  //the probe the way it leaves
+  capture_frame(skb);
   return TCX_PASS;
 } 
 
 SEC("tcx/ingress")
 int sender_in(struct __sk_buff *skb){
-  //RETURN VALUE: FOR-ME ? TCX_DROP : TCX_PASS
+  //RETURN VALUE: FOR-ME && !AUTH ? TCX_DROP : TCX_PASS
   
   //timestamp as soon as we get the packet
-  uint64_t last_ts = bpf_ktime_get_tai_ns();
+  uint64_t last_ts;
+  uint8_t src = rx_timestamp(skb, &last_ts);
+  if (health_probe(skb)) {
+    stat_inc(STAT_HEALTH_IN);
+    return TCX_DROP;
+  }
 
   //for-me check
   if (!for_me(skb, FORME_INBOUND)) return TCX_PASS;
+  //the reply the way it came in
+  capture_frame(skb);
+  //userspace has to check the HMAC so the reply goes on to the socket
+  if (auth == AUTH_ON) {
+    note_arrival(skb, l2len(skb), last_ts);
+    return TCX_PASS;
+  }
   
   // grab the actual packet
   void *data = (void *)(long)skb->data;
   void *data_end = (void *)(long)skb->data_end;
     
   //Grab three stamps+seq
-  struct reflectorpkt *rf = data + sizeof(struct iphdr) + sizeof(struct ethhdr) + sizeof(struct udphdr);
-  if(data + sizeof(struct iphdr) + sizeof(struct ethhdr) + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end)
+  uint32_t l2 = l2len(skb);
+  uint32_t l3 = l3len(skb);
+  struct reflectorpkt *rf = data + l3 + l2 + sizeof(struct udphdr);
+  if(data + l3 + l2 + sizeof(struct udphdr) + sizeof(struct reflectorpkt) > data_end){
+    stat_inc(STAT_DROPPED);
     return TCX_PASS;
-  
-  /* struct packet_ts timestamps; */
-  uint64_t timestamps[4];
-  struct sample s;
-  struct ntp_ts ntpts;
-  //grab seq
-  s.seq=bpf_ntohl(rf->seq);
-  //grab sender timestamp
-  ntpts.ntp_secs=rf->t1_s;
-  ntpts.ntp_fracs=rf->t1_f;
-  timestamps[0]=untimestamp(&ntpts);
-  //grab reflector stamps
-  ntpts.ntp_secs=rf->t2_s;
-  ntpts.ntp_fracs=rf->t2_f;
-  timestamps[1]=untimestamp(&ntpts);
-  ntpts.ntp_secs=rf->t3_s;
-  ntpts.ntp_fracs=rf->t3_f;
-  timestamps[2]=untimestamp(&ntpts);
-  //save the last one we saved earlier
-  timestamps[3]=last_ts;
-  //calculate samples
-  s.near=timestamps[1]-timestamps[0];
-  s.far=timestamps[3]-timestamps[2];
-  s.rt=timestamps[3]-timestamps[0];
-  //send it
-  bpf_ringbuf_output(&output, &s, sizeof(struct sample), 0);
+  }
+  uint8_t raddr[16];
+  if (load_raddr(skb, l2, FORME_INBOUND, raddr) != 0) return TCX_PASS;
+  struct follow_up_tlv fu;
+  load_follow_up(skb, stampoffset(skb, sizeof(struct reflectorpkt)), &fu);
+  struct location_info loc;
+  load_location(skb, stampoffset(skb, sizeof(struct reflectorpkt)), &loc);
+  struct ts_info_tlv ti;
+  load_ts_info(skb, stampoffset(skb, sizeof(struct reflectorpkt)), &ti);
+  handle_reply(rf, raddr, last_ts, src, &fu, &loc, &ti);
    
   //We're done with the packet:
   return TCX_DROP; 
 }
+
+// XDP MODE
+// LoaderConfig.AttachMode AttachXDP puts this one on the driver in front of sender_in, nothing else changes: probes still go out
+// through sender_out since XDP only ever sees what comes in, and whatever this passes still gets to sender_in
+// it has no skb, so no hardware stamps, no VLAN tags, no TLVs and no captures; the loader doesn't attach it when any of those are on
+// RETURN VALUE: FOR-ME ? XDP_DROP : XDP_PASS
+
+SEC("xdp")
+int sender_xdp_in(struct xdp_md *ctx){
+  //timestamp before the kernel even has an skb for it
+  uint64_t last_ts = bpf_ktime_get_tai_ns();
+  //userspace has to check the HMAC, sender_in notes these down
+  if (auth == AUTH_ON) return XDP_PASS;
+
+  void *data = (void *)(long)ctx->data;
+  void *data_end = (void *)(long)ctx->data_end;
+  struct ethhdr *eth = data;
+  if ((void *)(eth+1) > data_end) return XDP_PASS;
+  //same for-me check as for_me() inbound, only straight off the frame
+  uint8_t raddr[16];
+  struct udphdr *udph;
+  if (ip_family == IPFAM_V6) {
+    struct ipv6hdr *ip6h = (void *)(eth+1);
+    if (eth->h_proto != bpf_htons(ETH_P_IPV6) || (void *)(ip6h+1) > data_end) return XDP_PASS;
+    if (ip6h->nexthdr != IPPROTO_UDP || !payload_ok(bpf_ntohs(ip6h->payload_len), sizeof(struct udphdr)) || !is_laddr6(ip6h->daddr.s6_addr))
+      return XDP_PASS;
+    __builtin_memcpy(raddr, ip6h->saddr.s6_addr, 16);
+    udph = (void *)(ip6h+1);
+  } else {
+    struct iphdr *iph = (void *)(eth+1);
+    if (eth->h_proto != bpf_htons(ETH_P_IP) || (void *)(iph+1) > data_end) return XDP_PASS;
+    if (iph->protocol != IPPROTO_UDP || !payload_ok(bpf_ntohs(iph->tot_len), sizeof(struct iphdr)+sizeof(struct udphdr)) || iph->daddr != laddr)
+      return XDP_PASS;
+    //IPv4-mapped, see load_raddr()
+    __builtin_memset(raddr, 0, 10);
+    raddr[10]=0xff;
+    raddr[11]=0xff;
+    __builtin_memcpy(raddr+12, &iph->saddr, 4);
+    udph = (void *)(iph+1);
+  }
+  struct reflectorpkt *rf = (void *)(udph+1);
+  if ((void *)(rf+1) > data_end) return XDP_PASS;
+  if (udph->dest != bpf_htons(s_port)) return XDP_PASS;
+
+  //none of the TLVs are on or we wouldn't be attached
+  struct follow_up_tlv fu;
+  struct location_info loc;
+  struct ts_info_tlv ti;
+  __builtin_memset(&fu, 0, sizeof(fu));
+  __builtin_memset(&loc, 0, sizeof(loc));
+  __builtin_memset(&ti, 0, sizeof(ti));
+  handle_reply(rf, raddr, last_ts, TS_KERNEL, &fu, &loc, &ti);
+
+  //We're done with the packet:
+  return XDP_DROP;
+}
+
+// CGROUP MODE
+// cgroup skb programs only see traffic of sockets in that cgroup, which gets us per-container measurement
+// they come with strings attached though: the packet starts at the IP header, there's no direct packet access
+// and most importantly they can't modify the packet - so userspace has to write T1 itself
+// and we note down the actual egress time here to do the math with
+// RETURN VALUE: 1 lets the packet through, 0 drops it
+
+SEC("cgroup_skb/egress")
+int sender_cg_out(struct __sk_buff *skb){
+  //RETURN VALUE: FOR-ME && OVER THE LIMIT ? 0 : 1
+
+  //timestamp at the last possible moment
+  struct ntp_ts ts;
+  timestamp(&ts, ts_format);
+
+  //for-me check
+  if (!for_me_l3(skb, FORME_OUTBOUND)) return 1;
+  if (!probe_allowed()) return 0;
+  stat_inc(STAT_SENT);
+
+  //grab the T1 userspace put in there so we can check it against what the reflector echoes
+  struct ntp_ts wire;
+  uint8_t raddr[16];
+  uint32_t seq;
+  uint32_t offset=l3len(skb)+sizeof(struct udphdr);
+  //the authenticated packet has T1 further down, seq stays put
+  offset+=auth == AUTH_ON ? offsetof(struct senderpkt_auth, t1_s) : offsetof(struct senderpkt, t1_s);
+  if (load_raddr(skb, 0, FORME_OUTBOUND, raddr) == 0 &&
+      bpf_skb_load_bytes(skb, l3len(skb)+sizeof(struct udphdr)+offsetof(struct senderpkt, seq), &seq, sizeof(seq)) == 0 &&
+      bpf_skb_load_bytes(skb, offset, &wire, sizeof(wire)) == 0) {
+    remember_probe(raddr, seq, &wire, untimestamp(&ts, ts_format));
+    note_seq(seq);
+  }
+  return 1;
+}
+
+SEC("cgroup_skb/ingress")
+int sender_cg_in(struct __sk_buff *skb){
+  //RETURN VALUE: FOR-ME && !AUTH ? 0 : 1
+
+  //timestamp as soon as we get the packet
+  uint64_t last_ts;
+  uint8_t src = rx_timestamp(skb, &last_ts);
+
+  //for-me check
+  if (!for_me_l3(skb, FORME_INBOUND)) return 1;
+  if (auth == AUTH_ON) {
+    note_arrival(skb, 0, last_ts);
+    return 1;
+  }
+
+  //no direct packet access here so we copy it out
+  struct reflectorpkt rf;
+  uint8_t raddr[16];
+  if (load_raddr(skb, 0, FORME_INBOUND, raddr) != 0 ||
+      bpf_skb_load_bytes(skb, l3len(skb)+sizeof(struct udphdr), &rf, sizeof(rf)) != 0){
+    stat_inc(STAT_DROPPED);
+    return 1;
+  }
+  struct follow_up_tlv fu;
+  load_follow_up(skb, l3len(skb)+sizeof(struct udphdr)+sizeof(struct reflectorpkt), &fu);
+  struct location_info loc;
+  load_location(skb, l3len(skb)+sizeof(struct udphdr)+sizeof(struct reflectorpkt), &loc);
+  struct ts_info_tlv ti;
+  load_ts_info(skb, l3len(skb)+sizeof(struct udphdr)+sizeof(struct reflectorpkt), &ti);
+  handle_reply(&rf, raddr, last_ts, src, &fu, &loc, &ti);
+
+  //We're done with the packet:
+  return 0;
+}
@@ -7,6 +7,7 @@
 #include <bpf/bpf_helpers.h>
 #include <linux/udp.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 #include <linux/in.h>
 #include <bpf/bpf_core_read.h>
 #include <bpf/bpf_helpers.h>
@@ -14,8 +15,29 @@
 
 // global vars for for-me check
 volatile uint32_t laddr; // local IP
+volatile uint8_t laddr6[16]; // local IPv6, used instead of laddr when ip_family is IPFAM_V6(or the packet is, see dual_stack)
+volatile uint16_t ip_family; // which IP version the session runs over
+volatile uint16_t dual_stack; // reflector only: answer on both laddr and laddr6, the family goes by the packet instead of ip_family
 volatile uint16_t s_port; // source port 
+volatile uint16_t d_port; // sender only: reflector port our probes go to, 0 doesn't check
 volatile uint16_t tai; // flag for TAI correction
+volatile int32_t tai_offset; // seconds to add to TAI with --tai-offset(tai == TAI_OFFSET), can be negative if the kernel's offset is too big
+volatile uint16_t reply_sport; // reflector only: source port for replies, 0 means reply from s_port
+volatile uint16_t auth; // authenticated mode(RFC 8762 4.4), see the auth packets at the bottom
+volatile uint16_t tlv_len; // sender only: size of the TLVs(RFC 8972) behind the base packet, headers included
+volatile uint16_t follow_up; // Follow-Up Telemetry TLV(RFC 8972 4.7): the reflector fills it in, the sender reads it out
+volatile uint16_t tlv_any; // reflector only: take packets with any TLVs behind the base packet, they get echoed back as is
+volatile uint16_t allow_from; // reflector only: only answer senders in the allowed map
+volatile uint16_t location; // Location TLV(RFC 8972 4.2): the reflector fills it in, the sender reads it out
+volatile uint16_t hw_ts; // --hw-timestamps: take the receive time from the NIC when it put one on the packet, see rx_timestamp()
+volatile uint16_t err_est; // Error Estimate(RFC 8762 4.2.1) that goes with our timestamps, host order; userspace works it out from the clock sync state
+volatile uint16_t ts_info; // Timestamp Information TLV(RFC 8972 4.3): the reflector fills it in, the sender reads it out
+volatile uint8_t sync_src; // reflector only: what our clock is synced to for the Timestamp Information TLV, SYNC_* below; userspace keeps it up to date
+volatile uint16_t vlan_aware; // --vlan-aware: skip up to two 802.1Q/802.1ad tags in front of the IP header, see l2len()
+volatile uint16_t ts_format; // sender only: enum ts_fmt our probes go out with, the reflector answers in whatever the probe came in
+volatile uint16_t passive; // reflector only: --passive, count requests going to any address and let them through, nothing gets answered
+volatile uint16_t keep_ports; // reflector only: --keep-ports, replies go out with the request's ports as they were instead of swapped
+volatile uint16_t zero_csum; // reflector only: --zero-udp-csum, IPv4 replies go out with no UDP checksum instead of a fixed up one
 
 enum forme_dir {
   FORME_OUTBOUND,
@@ -25,23 +47,144 @@ enum forme_dir {
 enum tai_corr {
   TAI_CORRECT,
   TAI_LEAP,
+  TAI_OFFSET,
+};
+
+// timestamp format on the wire, the Z bit of the Error Estimate says which one a timestamp is in
+// KEEP IN SYNC with TimestampFormat in internal/userspace/stamp/errest.go
+enum ts_fmt {
+  TS_FMT_NTP, //seconds since 1900 and 2^-32 fractions
+  TS_FMT_PTP, //PTPv2 truncated: seconds since 1970 and nanoseconds
+};
+#define ERR_EST_Z 0x4000
+
+//the format the timestamps an Error Estimate goes with are in, err in network order like it sits in the packet
+static __always_inline uint8_t ts_fmt_of(uint16_t err){
+  return (bpf_ntohs(err) & ERR_EST_Z) != 0 ? TS_FMT_PTP : TS_FMT_NTP;
+}
+
+//our Error Estimate for timestamps in fmt, ready to go in the packet
+static __always_inline uint16_t err_est_for(uint8_t fmt){
+  uint16_t err = err_est & ~ERR_EST_Z;
+  if (fmt == TS_FMT_PTP) err |= ERR_EST_Z;
+  return bpf_htons(err);
+}
+
+enum ip_fam {
+  IPFAM_V4,
+  IPFAM_V6,
+};
+
+enum auth_mode {
+  AUTH_OFF,
+  AUTH_ON,
+};
+
+// where a timestamp came from
+// KEEP IN SYNC with TimestampSource in internal/userspace/loader/events.go
+enum ts_source {
+  TS_KERNEL, //bpf_ktime_get_tai_ns() when the program ran
+  TS_HW, //the NIC's PHC, skb->hwtstamp
 };
   
+// session counters, one per-CPU slot each
+// KEEP IN SYNC with the stat* keys in internal/userspace/loader/stats.go
+enum stat_key {
+  STAT_SENT, //sender: probes that went out
+  STAT_REFLECTED, //sender: replies that came back, reflector: requests turned around
+  STAT_DROPPED, //ours but too short to do anything with
+  STAT_SEQ_ERR, //sender: replies to a seq we never sent(or that got evicted from probes)
+  STAT_DENIED, //reflector: from a sender outside --allow-from
+  STAT_LOST, //sender: gaps in the reflector's seq, minus the ones that showed up late
+  STAT_REORDERED, //sender: replies that came in behind a later one
+  STAT_HEALTH_OUT, //health probes egress turned around
+  STAT_HEALTH_IN, //health probes that made it back to ingress
+  STAT_OBSERVED, //reflector: requests --passive counted and let through
+  STAT_RATE_LIMITED, //reflector: requests dropped over --max-reply-pps
+  STAT_MAX,
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, STAT_MAX);
+  __type(key, uint32_t);
+  __type(value, uint64_t);
+} stats SEC(".maps");
+
+// per-CPU so no atomics needed
+static __always_inline void stat_add(uint32_t key, uint64_t n){
+  uint64_t *val = bpf_map_lookup_elem(&stats, &key);
+  if (val) *val += n;
+}
+
+static __always_inline void stat_inc(uint32_t key){
+  stat_add(key, 1);
+}
+
+// --capture: the first capture frames every interface's programs see of ours go into the captures ring whole,
+// for looking at the actual bytes when the numbers look off; with it off it's a load and a branch
+// KEEP IN SYNC with captureLen in internal/userspace/loader/capture.go
+#define CAPTURE_LEN 256
+volatile uint32_t capture; // how many frames to capture, 0 is off
+volatile uint32_t captured; // how many we took so far
+
+struct capture_rec{
+  uint64_t ts; //bpf_ktime_get_tai_ns() when we took it
+  uint32_t len; //the whole frame's
+  uint32_t caplen; //how much of it is in data
+  uint8_t data[CAPTURE_LEN];
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 1 << 18); //userspace shrinks it to a page without --capture
+  __type(value, struct capture_rec);
+} captures SEC(".maps");
+
+static __always_inline void capture_frame(struct __sk_buff *skb){
+  if (capture == 0 || captured >= capture) return;
+  //two CPUs can both get past the check above, only one gets the last slot
+  if (__sync_fetch_and_add(&captured, 1) >= capture) return;
+  struct capture_rec *rec = bpf_ringbuf_reserve(&captures, sizeof(struct capture_rec), 0);
+  if (!rec) return;
+  uint32_t caplen = skb->len;
+  if (caplen > CAPTURE_LEN) caplen = CAPTURE_LEN;
+  rec->ts=bpf_ktime_get_tai_ns();
+  rec->len=skb->len;
+  rec->caplen=caplen;
+  if (caplen == 0 || bpf_skb_load_bytes(skb, 0, rec->data, caplen) != 0) {
+    bpf_ringbuf_discard(rec, 0);
+    return;
+  }
+  bpf_ringbuf_submit(rec, 0);
+}
+
 struct senderpkt; //proto
 
+//either format, see enum ts_fmt: PTP has nanoseconds where NTP has fractions
 struct ntp_ts{
   uint32_t ntp_secs;
   uint32_t ntp_fracs;
 };
 
 // NTP CONVERSION
-uint32_t timestamp(struct ntp_ts *arg) {
-  uint64_t utns = bpf_ktime_get_tai_ns(); //Unix nanoseconds
+// the TAI correction is about the kernel's offset, a hardware stamp comes straight from the PHC which ptp4l keeps on TAI
+static __always_inline uint32_t timestamp_at(uint64_t utns, uint8_t src, struct ntp_ts *arg, uint8_t fmt) {
   uint64_t ntps = utns / 1000000000 ; //this needs to be 64 bit to avoid over/underflows
-  if (tai==TAI_LEAP) { //we add leap seconds to TAI if userspace detects that it hasn't been done
+  if (src==TS_HW) {
+    //nothing to correct
+  } else if (tai==TAI_LEAP) { //we add leap seconds to TAI if userspace detects that it hasn't been done
     ntps=ntps+37;
+  } else if (tai==TAI_OFFSET) { //or whatever userspace worked out from the offset it was given
+    ntps=ntps+tai_offset;
   }
   uint64_t ntpf = utns % 1000000000 ;
+  //PTP goes from 1970 in nanoseconds, that's what we've got already
+  if (fmt == TS_FMT_PTP) {
+    arg->ntp_secs=bpf_htonl((uint32_t) ntps);
+    arg->ntp_fracs=bpf_htonl((uint32_t) ntpf);
+    return 0;
+  }
   ntps += 2208988800 ;
   ntpf = ( ntpf << 32 ) ; 
   ntpf /= 1000000000 ;
@@ -49,9 +192,25 @@ uint32_t timestamp(struct ntp_ts *arg) {
   arg->ntp_fracs=bpf_htonl((uint32_t) ntpf);
   return 0;
 }
-uint64_t untimestamp(struct ntp_ts *arg){
+uint32_t timestamp(struct ntp_ts *arg, uint8_t fmt) {
+  return timestamp_at(bpf_ktime_get_tai_ns(), TS_KERNEL, arg, fmt); //Unix nanoseconds
+}
+
+// receive time in TAI ns: the NIC's with --hw-timestamps if it stamped this packet, ours otherwise
+// transmit stamps are always ours, the NIC only stamps a packet on its way out after we're done writing T1/T3 into it
+static __always_inline uint8_t rx_timestamp(struct __sk_buff *skb, uint64_t *ns){
+  *ns = bpf_ktime_get_tai_ns();
+  if (hw_ts == 0) return TS_KERNEL;
+  uint64_t hw = skb->hwtstamp;
+  if (hw == 0) return TS_KERNEL;
+  *ns = hw;
+  return TS_HW;
+}
+
+uint64_t untimestamp(struct ntp_ts *arg, uint8_t fmt){
   uint64_t unix_s = (uint64_t) bpf_ntohl(arg->ntp_secs);
   uint64_t unix_ns = (uint64_t) bpf_ntohl(arg->ntp_fracs);
+  if (fmt == TS_FMT_PTP) return unix_s*1000000000 + unix_ns;
   //reverse conversion
   unix_s -= 2208988800 ;
   unix_ns *= 1000000000 ; 
@@ -77,50 +236,257 @@ uint64_t untimestamp(struct ntp_ts *arg){
 /*   return utns; */
 /* } */
 
+// port our outbound packets leave from - s_port unless the reflector was told to reply from a different one
+static __always_inline uint16_t out_port(){
+  if (reply_sport != 0) return reply_sport;
+  return s_port;
+}
+
+// is an outbound packet one of our replies as far as ports go: it leaves from out_port(), or with keep_ports it's still going to s_port
+static __always_inline uint32_t out_ports_ok(uint16_t source, uint16_t dest){
+  if (keep_ports != 0) return dest == bpf_htons(s_port);
+  return source == bpf_htons(out_port());
+}
+
+// VLAN TAGS
+// a tag the kernel took off(hardware offload, or the outer one on ingress) lives in skb->vlan_tci and isn't in the packet, so there's nothing to skip;
+// tags still inline push the IP header 4 bytes down each, we go through two at most(802.1ad QinQ: S-tag then C-tag)
+static __always_inline int vlan_tag(uint16_t proto){
+  return proto == bpf_htons(ETH_P_8021Q) || proto == bpf_htons(ETH_P_8021AD);
+}
+
+// ethernet header size, tags included - it's always one of 14, 18 or 22 so the verifier knows what it's getting
+// TCX only, cgroup programs start at the IP header
+static __always_inline uint32_t l2len(struct __sk_buff *skb){
+  if (vlan_aware == 0) return sizeof(struct ethhdr);
+  uint16_t proto;
+  if (bpf_skb_load_bytes(skb, offsetof(struct ethhdr, h_proto), &proto, sizeof(proto)) != 0 || !vlan_tag(proto)) return sizeof(struct ethhdr);
+  //the tag's TCI comes first, then the next ethertype
+  if (bpf_skb_load_bytes(skb, sizeof(struct ethhdr)+2, &proto, sizeof(proto)) != 0 || !vlan_tag(proto)) return sizeof(struct ethhdr)+4;
+  return sizeof(struct ethhdr)+8;
+}
+
+// the ethertype right in front of the IP header, network order
+static __always_inline uint16_t l3proto(struct __sk_buff *skb){
+  if (vlan_aware == 0) return skb->protocol;
+  uint16_t proto;
+  if (bpf_skb_load_bytes(skb, l2len(skb)-2, &proto, sizeof(proto)) != 0) return 0;
+  return proto;
+}
+
+// which IP version this packet is, a dual-stack reflector takes both and goes by what the packet says
+static __always_inline uint16_t pkt_family(struct __sk_buff *skb){
+  if (dual_stack == 0) return ip_family;
+  return l3proto(skb) == bpf_htons(ETH_P_IPV6) ? IPFAM_V6 : IPFAM_V4;
+}
+
+// IP header size, everything past it moves 20 bytes down for IPv6
+static __always_inline uint32_t l3len(struct __sk_buff *skb){
+  if (pkt_family(skb) == IPFAM_V6) return sizeof(struct ipv6hdr);
+  return sizeof(struct iphdr);
+}
+
+// STAMP payload size, authenticated packets are padded out to fit the HMAC
+static __always_inline uint32_t stamp_len(){
+  if (auth == AUTH_ON) return 112;
+  return 44 + tlv_len;
+}
+
+// len is the length field off the IP header, hdrs is whatever it counts on top of the STAMP payload
+static __always_inline int payload_ok(uint32_t len, uint32_t hdrs){
+  if (len < hdrs) return 0;
+  len -= hdrs;
+  if (tlv_any != 0) return len >= stamp_len();
+  return len == stamp_len();
+}
+
+// is it our IPv6? no memcmp in BPF so we go byte by byte
+static __always_inline int is_laddr6(const uint8_t *addr){
+#pragma unroll
+  for (int i = 0; i < 16; i++)
+    if (addr[i] != laddr6[i]) return 0;
+  return 1;
+}
+
+// IPv6 half of for_me, we don't do extension headers
+static __always_inline uint32_t for_me6(struct __sk_buff *skb, enum forme_dir dir){
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  uint32_t l2 = l2len(skb);
+  if ( data + l2+sizeof(struct ipv6hdr)+sizeof(struct udphdr) > data_end ) return TCX_PASS;
+  //is it an IPv6 packet?
+  if(l3proto(skb)!=bpf_htons(ETH_P_IPV6)) return TCX_PASS;
+  //IPv6 header, payload length doesn't include the header itself
+  struct ipv6hdr *ip6h = data+l2;
+  if (!payload_ok(bpf_ntohs(ip6h->payload_len), sizeof(struct udphdr))) return TCX_PASS;
+  //Is it UDP?
+  if (ip6h->nexthdr!=IPPROTO_UDP) return TCX_PASS;
+  //Is it for us?
+  if (dir == FORME_INBOUND && passive == 0 && !is_laddr6(ip6h->daddr.s6_addr)) return TCX_PASS;
+  if (dir == FORME_OUTBOUND && !is_laddr6(ip6h->saddr.s6_addr)) return TCX_PASS;
+  //UDP header
+  struct udphdr *udph = data + sizeof(struct ipv6hdr)+l2;
+  // Is it for our port?
+  if (dir == FORME_INBOUND && udph->dest!=bpf_ntohs(s_port)) return TCX_PASS;
+  if (dir == FORME_OUTBOUND && !out_ports_ok(udph->source, udph->dest)) return TCX_PASS;
+  if (dir == FORME_OUTBOUND && d_port != 0 && udph->dest!=bpf_ntohs(d_port)) return TCX_PASS;
+
+  return 1;
+}
+
 // for me check, DONE BEFORE ANY MODIFICATION OF THE PACKET, usage: if (!for_me(skb)) return TCX_PASS;
 uint32_t for_me(struct __sk_buff *skb, enum forme_dir dir){
   //TCX_PASS evaluates to 0 so we can use this as a simple true-false function
+  if (pkt_family(skb) == IPFAM_V6) return for_me6(skb, dir);
   //grab the actual packet
   void *data = (void *)(long)skb->data;
   void *data_end = (void *)(long)skb->data_end;
-  if ( data + sizeof(struct ethhdr)+sizeof(struct iphdr)+sizeof(struct udphdr) > data_end ) return TCX_PASS;
+  uint32_t l2 = l2len(skb);
+  if ( data + l2+sizeof(struct iphdr)+sizeof(struct udphdr) > data_end ) return TCX_PASS;
   //is it an IP packet?
-  //the +0 has to be there, don't ask
-  struct ethhdr *eh = data+0;
-  if(eh->h_proto!=bpf_htons(ETH_P_IP)) return TCX_PASS;
+  if(l3proto(skb)!=bpf_htons(ETH_P_IP)) return TCX_PASS;
   //IP header
-  struct iphdr *iph = data+sizeof(struct ethhdr);
-  if (bpf_ntohs(iph->tot_len) != sizeof(struct iphdr)+sizeof(struct udphdr) + 44) return TCX_PASS;
+  struct iphdr *iph = data+l2;
+  if (!payload_ok(bpf_ntohs(iph->tot_len), sizeof(struct iphdr)+sizeof(struct udphdr))) return TCX_PASS;
   //these kinds of checks are mandated by the eBPF verifier, without them the program won't get loaded
-  if (data + sizeof(struct iphdr) + sizeof(struct ethhdr) > data_end) return TCX_PASS;
+  if (data + sizeof(struct iphdr) + l2 > data_end) return TCX_PASS;
   //Is it UDP?
   if (iph->protocol!=IPPROTO_UDP) return TCX_PASS;
   //Is it for us? If it's inbound then we check dest IP, if outbound we check source IP
   // surprisingly, IPs are stored in LE
-  if (dir == FORME_INBOUND && iph->daddr!=laddr) return TCX_PASS;
+  //a passive reflector sits next to whoever they're for, it goes by the port alone
+  if (dir == FORME_INBOUND && passive == 0 && iph->daddr!=laddr) return TCX_PASS;
   if (dir == FORME_OUTBOUND && iph->saddr!=laddr) return TCX_PASS;
   //UDP header
-  struct udphdr *udph = data + sizeof(struct iphdr)+sizeof(struct ethhdr);
-  if (data + sizeof(struct iphdr) + sizeof(struct udphdr) + sizeof(struct ethhdr) > data_end) return TCX_PASS;
+  struct udphdr *udph = data + sizeof(struct iphdr)+l2;
+  if (data + sizeof(struct iphdr) + sizeof(struct udphdr) + l2 > data_end) return TCX_PASS;
   // Is it for our port?
   if (dir == FORME_INBOUND && udph->dest!=bpf_ntohs(s_port)) return TCX_PASS;
-  if (dir == FORME_OUTBOUND && udph->source!=bpf_ntohs(s_port)) return TCX_PASS;
+  if (dir == FORME_OUTBOUND && !out_ports_ok(udph->source, udph->dest)) return TCX_PASS;
+  if (dir == FORME_OUTBOUND && d_port != 0 && udph->dest!=bpf_ntohs(d_port)) return TCX_PASS;
   
   return 1;
 }
 
+// IPv6 half of for_me_l3
+static __always_inline uint32_t for_me_l3_6(struct __sk_buff *skb, enum forme_dir dir){
+  struct ipv6hdr ip6h;
+  struct udphdr udph;
+  if (bpf_skb_load_bytes(skb, 0, &ip6h, sizeof(ip6h)) != 0) return 0;
+  //is it an IPv6 packet of the right size?
+  if (ip6h.version != 6) return 0;
+  if (!payload_ok(bpf_ntohs(ip6h.payload_len), sizeof(struct udphdr))) return 0;
+  //Is it UDP?
+  if (ip6h.nexthdr!=IPPROTO_UDP) return 0;
+  //Is it for us?
+  if (dir == FORME_INBOUND && !is_laddr6(ip6h.daddr.s6_addr)) return 0;
+  if (dir == FORME_OUTBOUND && !is_laddr6(ip6h.saddr.s6_addr)) return 0;
+  //UDP header
+  if (bpf_skb_load_bytes(skb, sizeof(struct ipv6hdr), &udph, sizeof(udph)) != 0) return 0;
+  // Is it for our port?
+  if (dir == FORME_INBOUND && udph.dest!=bpf_ntohs(s_port)) return 0;
+  if (dir == FORME_OUTBOUND && !out_ports_ok(udph.source, udph.dest)) return 0;
+  if (dir == FORME_OUTBOUND && d_port != 0 && udph.dest!=bpf_ntohs(d_port)) return 0;
+
+  return 1;
+}
+
+// same as for_me but for cgroup skb programs: the packet starts at the IP header and there's no direct packet access
+// returns 1 if it's for us, 0 otherwise
+uint32_t for_me_l3(struct __sk_buff *skb, enum forme_dir dir){
+  if (pkt_family(skb) == IPFAM_V6) return for_me_l3_6(skb, dir);
+  struct iphdr iph;
+  struct udphdr udph;
+  if (bpf_skb_load_bytes(skb, 0, &iph, sizeof(iph)) != 0) return 0;
+  //is it an IPv4 packet of the right size?
+  if (iph.version != 4) return 0;
+  if (!payload_ok(bpf_ntohs(iph.tot_len), sizeof(struct iphdr)+sizeof(struct udphdr))) return 0;
+  //Is it UDP?
+  if (iph.protocol!=IPPROTO_UDP) return 0;
+  //Is it for us?
+  if (dir == FORME_INBOUND && iph.daddr!=laddr) return 0;
+  if (dir == FORME_OUTBOUND && iph.saddr!=laddr) return 0;
+  //UDP header
+  if (bpf_skb_load_bytes(skb, sizeof(struct iphdr), &udph, sizeof(udph)) != 0) return 0;
+  // Is it for our port?
+  if (dir == FORME_INBOUND && udph.dest!=bpf_ntohs(s_port)) return 0;
+  if (dir == FORME_OUTBOUND && !out_ports_ok(udph.source, udph.dest)) return 0;
+  if (dir == FORME_OUTBOUND && d_port != 0 && udph.dest!=bpf_ntohs(d_port)) return 0;
+
+  return 1;
+}
+
+//grab the remote IP - dest on the way out, source on the way in
+//it's always 16 bytes, IPv4 goes IPv4-mapped(::ffff:a.b.c.d) so neither the maps nor userspace care about the family
+//l2 is whatever sits in front of the IP header: ethernet for TCX, nothing for cgroup programs
+static __always_inline int load_raddr(struct __sk_buff *skb, uint32_t l2, enum forme_dir dir, uint8_t *raddr){
+  if (pkt_family(skb) == IPFAM_V6) {
+    uint32_t off = dir == FORME_OUTBOUND ? offsetof(struct ipv6hdr, daddr) : offsetof(struct ipv6hdr, saddr);
+    return bpf_skb_load_bytes(skb, l2+off, raddr, 16);
+  }
+  __builtin_memset(raddr, 0, 10);
+  raddr[10]=0xff;
+  raddr[11]=0xff;
+  uint32_t off = dir == FORME_OUTBOUND ? offsetof(struct iphdr, daddr) : offsetof(struct iphdr, saddr);
+  return bpf_skb_load_bytes(skb, l2+off, raddr+12, 4);
+}
+
+// HEALTH CHECK
+// userspace's HealthCheck() puts one of these on the interface through a packet socket: egress counts it and hands it to our own
+// ingress, ingress counts it and drops it, so if both counters move both programs are in the data path and nothing in front of them ate it
+// UDP from and to s_port with HEALTH_MAGIC right behind the UDP header, never anything past the interface
+// KEEP IN SYNC with internal/userspace/loader/health.go
+#define HEALTH_MAGIC 0x53544843 // "STHC"
+static __always_inline int health_probe(struct __sk_buff *skb){
+  uint16_t proto;
+  uint8_t l4proto;
+  uint32_t l3;
+  uint32_t l2 = l2len(skb);
+  proto = l3proto(skb);
+  //goes by the packet, a dual-stack reflector can get either
+  if (proto == bpf_htons(ETH_P_IP)) {
+    l3=sizeof(struct iphdr);
+    if (bpf_skb_load_bytes(skb, l2+offsetof(struct iphdr, protocol), &l4proto, sizeof(l4proto)) != 0) return 0;
+  } else if (proto == bpf_htons(ETH_P_IPV6)) {
+    l3=sizeof(struct ipv6hdr);
+    if (bpf_skb_load_bytes(skb, l2+offsetof(struct ipv6hdr, nexthdr), &l4proto, sizeof(l4proto)) != 0) return 0;
+  } else return 0;
+  if (l4proto != IPPROTO_UDP) return 0;
+  struct udphdr udph;
+  uint32_t magic;
+  if (bpf_skb_load_bytes(skb, l2+l3, &udph, sizeof(udph)) != 0 ||
+      bpf_skb_load_bytes(skb, l2+l3+sizeof(udph), &magic, sizeof(magic)) != 0) return 0;
+  return udph.source == bpf_htons(s_port) && udph.dest == bpf_htons(s_port) && magic == bpf_htonl(HEALTH_MAGIC);
+}
+
+// egress half of the health check, goes on to our own ingress as if it came in off the wire
+static __always_inline int health_turnaround(struct __sk_buff *skb){
+  stat_inc(STAT_HEALTH_OUT);
+  return bpf_redirect(skb->ifindex, BPF_F_INGRESS);
+}
+
 // reflector func to send packet back
 uint64_t pkt_turnaround(struct __sk_buff *skb){
   void* data = (void *)(long)skb->data;
   void* data_end = (void *)(long)skb->data_end;
-  struct iphdr *iph = data+sizeof(struct ethhdr);
-  if(data+sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) return TCX_PASS;
-
-  //Switch IP
-  uint32_t src_ip=iph->saddr;
-  uint32_t dest_ip=iph->daddr;
-  bpf_skb_store_bytes(skb,sizeof(struct ethhdr)+offsetof(struct iphdr, saddr), &dest_ip, sizeof(dest_ip),0);
-  bpf_skb_store_bytes(skb,sizeof(struct ethhdr)+offsetof(struct iphdr, daddr), &src_ip, sizeof(src_ip),0);
+  uint32_t l2 = l2len(skb);
+  uint32_t l3 = l3len(skb);
+
+  //Switch IP - neither swap touches a checksum, they're sums so the order doesn't matter
+  if (pkt_family(skb) == IPFAM_V6) {
+    uint8_t src_ip6[16], dest_ip6[16];
+    if (bpf_skb_load_bytes(skb,l2+offsetof(struct ipv6hdr, saddr), src_ip6, sizeof(src_ip6)) != 0) return TCX_PASS;
+    if (bpf_skb_load_bytes(skb,l2+offsetof(struct ipv6hdr, daddr), dest_ip6, sizeof(dest_ip6)) != 0) return TCX_PASS;
+    bpf_skb_store_bytes(skb,l2+offsetof(struct ipv6hdr, saddr), dest_ip6, sizeof(dest_ip6),0);
+    bpf_skb_store_bytes(skb,l2+offsetof(struct ipv6hdr, daddr), src_ip6, sizeof(src_ip6),0);
+  } else {
+    struct iphdr *iph = data+l2;
+    if(data+l2 + sizeof(struct iphdr) > data_end) return TCX_PASS;
+    uint32_t src_ip=iph->saddr;
+    uint32_t dest_ip=iph->daddr;
+    bpf_skb_store_bytes(skb,l2+offsetof(struct iphdr, saddr), &dest_ip, sizeof(dest_ip),0);
+    bpf_skb_store_bytes(skb,l2+offsetof(struct iphdr, daddr), &src_ip, sizeof(src_ip),0);
+  }
   
   //Switch MAC
   if(data+sizeof(struct ethhdr) > data_end) return TCX_PASS;
@@ -130,24 +496,57 @@ uint64_t pkt_turnaround(struct __sk_buff *skb){
   bpf_skb_store_bytes(skb,offsetof(struct ethhdr, h_source),dest_mac,6,0);
   bpf_skb_store_bytes(skb,offsetof(struct ethhdr, h_dest),src_mac,6,0);
 
-  //Switch ports
+  //Switch ports - unless we're told to keep them, then the reply goes back with the request's and there's no checksum to fix
+  if (keep_ports != 0) return bpf_redirect(skb->ifindex,0);
   data = (void *)(long)skb->data;
   data_end = (void *)(long)skb->data_end;
-  struct udphdr *udph=data+sizeof(struct ethhdr)+sizeof(struct iphdr);
-  if(data+sizeof(struct ethhdr) + sizeof(struct iphdr) + sizeof(struct udphdr) > data_end) return TCX_PASS;
-  if (udph->source != udph->dest) {
+  struct udphdr *udph=data+l2+l3;
+  if(data+l2 + l3 + sizeof(struct udphdr) > data_end) return TCX_PASS;
   uint16_t src_port=udph->source;
   uint16_t dest_port=udph->dest;
-  bpf_skb_store_bytes(skb,sizeof(struct ethhdr)+sizeof(struct iphdr)+offsetof(struct udphdr, source), &dest_port, sizeof(dest_port),0);
-  bpf_skb_store_bytes(skb,sizeof(struct ethhdr)+sizeof(struct iphdr)+offsetof(struct udphdr, dest), &src_port, sizeof(src_port),0);
+  //we reply from the port we were reached on unless told otherwise
+  uint16_t reply_port=bpf_htons(out_port());
+  if (src_port != reply_port || dest_port != src_port) {
+  bpf_skb_store_bytes(skb,l2+l3+offsetof(struct udphdr, source), &reply_port, sizeof(reply_port),0);
+  bpf_skb_store_bytes(skb,l2+l3+offsetof(struct udphdr, dest), &src_port, sizeof(src_port),0);
   }
+  //swapping ports doesn't change the checksum but replying from a different port does
+  //MANGLED_0 leaves a zero(disabled) checksum alone
+  if (reply_port != dest_port)
+    bpf_l4_csum_replace(skb, l2+l3+offsetof(struct udphdr, check), dest_port, reply_port, BPF_F_MARK_MANGLED_0 | sizeof(reply_port));
 
   return bpf_redirect(skb->ifindex,0);
 }
 
 //a simple function that adds the headers' sizeofs to a STAMP packet field's offsetof
-uint32_t stampoffset(uint32_t offset){
-  return sizeof(struct ethhdr)+sizeof(struct iphdr)+sizeof(struct udphdr)+offset;
+uint32_t stampoffset(struct __sk_buff *skb, uint32_t offset){
+  return l2len(skb)+l3len(skb)+sizeof(struct udphdr)+offset;
+}
+
+//everything behind the UDP header is in the UDP checksum, a reply that doesn't fix it up gets dropped by whoever checks
+//MANGLED_0 leaves a zero(disabled, IPv4 only) checksum alone, on CHECKSUM_PARTIAL packets the kernel leaves it to the NIC
+static __always_inline uint32_t csum_offset(struct __sk_buff *skb){
+  return l2len(skb)+l3len(skb)+offsetof(struct udphdr, check);
+}
+
+//bpf_skb_store_bytes() that keeps the UDP checksum right, len goes in multiples of 4 up to 20 bytes
+//everything we write starts an even number of bytes into the payload so it lines up with the checksum's 16-bit words
+static __always_inline int store_csum(struct __sk_buff *skb, uint32_t off, void *from, uint32_t len){
+  uint8_t old[20];
+  if (len > sizeof(old) || len % 4 != 0) return -1;
+  if (bpf_skb_load_bytes(skb, off, old, len) != 0) return -1;
+  int64_t diff = bpf_csum_diff((__be32 *)old, len, (__be32 *)from, len, 0);
+  if (diff < 0) return -1;
+  if (bpf_skb_store_bytes(skb, off, from, len, 0) != 0) return -1;
+  return bpf_l4_csum_replace(skb, csum_offset(skb), 0, diff, BPF_F_MARK_MANGLED_0);
+}
+
+//same for a 16-bit field, bpf_csum_diff() only takes whole words
+static __always_inline int store_csum16(struct __sk_buff *skb, uint32_t off, uint16_t to){
+  uint16_t from;
+  if (bpf_skb_load_bytes(skb, off, &from, sizeof(from)) != 0) return -1;
+  if (bpf_skb_store_bytes(skb, off, &to, sizeof(to), 0) != 0) return -1;
+  return bpf_l4_csum_replace(skb, csum_offset(skb), from, to, BPF_F_MARK_MANGLED_0 | sizeof(to));
 }
 
 // session-sender packet(RFC 8762)
@@ -155,7 +554,7 @@ struct senderpkt{
   uint32_t seq; //sequence number
   uint32_t t1_s;
   uint32_t t1_f;
-  uint16_t err; //error estimate(unused)
+  uint16_t err; //error estimate, see err_est
   uint8_t mbz[30]; //30 octets of MBZ
 }__attribute__((packed));
 // session-reflector packet(RFC 8762)
@@ -175,3 +574,104 @@ struct reflectorpkt {
   uint8_t ttl; //sender ttl
   uint8_t t_mbz[3]; 
 }__attribute__((packed));
+
+// Follow-Up Telemetry TLV(RFC 8972 4.7), the sender puts an empty one right behind the base packet and the reflector fills it in
+// KEEP IN SYNC with internal/userspace/stamp/packet.go
+#define TLV_FOLLOW_UP 7
+#define TS_SW_LOCAL 2 //timestamp method, same values as the Timestamp Information TLV
+struct follow_up_tlv{
+  uint8_t flags;
+  uint8_t type;
+  uint16_t len; //network order, everything past the header
+  uint32_t seq; //reflector seq of the previous reply in the same session
+  struct ntp_ts ts; //when that reply actually left
+  uint8_t mode; //how ts was taken
+  uint8_t mbz[3];
+}__attribute__((packed));
+
+// Location TLV(RFC 8972 4.2), the sender puts an empty one behind the base packet and the Follow-Up TLV(if it asked for one)
+// with a destination and a source address sub-TLV of its own family; the reflector fills in the ports and addresses
+// the request came in with, which is how the sender gets to see itself from the far side of any NAT
+// KEEP IN SYNC with internal/userspace/stamp/packet.go
+#define TLV_LOCATION 2
+#define SUBTLV_DST_IPV4 3
+#define SUBTLV_DST_IPV6 4
+#define SUBTLV_SRC_IPV4 5
+#define SUBTLV_SRC_IPV6 6
+#define TLV_FLAG_U 0x80 //unrecognized: a reflector that doesn't know the TLV says so and leaves it alone
+struct tlv_hdr{
+  uint8_t flags;
+  uint8_t type;
+  uint16_t len; //network order, everything past the header
+}__attribute__((packed));
+struct location_ports{
+  uint16_t dport; //network order
+  uint16_t sport;
+}__attribute__((packed));
+
+// Timestamp Information TLV(RFC 8972 4.3), the sender puts an empty one behind the Follow-Up and Location TLVs(if it asked for them)
+// and the reflector fills in what its clock is synced to and how it took T2 and T3
+// KEEP IN SYNC with internal/userspace/stamp/packet.go and SyncSource/TimestampMethod in internal/userspace/loader/clockinfo.go
+#define TLV_TS_INFO 3
+#define TS_HW_ASSIST 1
+#define SYNC_NTP 1 //unsynced goes as 0, the registry has nothing for a free-running clock
+#define SYNC_PTP 2
+struct ts_info_tlv{
+  uint8_t flags;
+  uint8_t type;
+  uint16_t len;
+  uint8_t sync_in; //what the clock that took T2 is synced to
+  uint8_t ts_in; //how T2 was taken
+  uint8_t sync_out; //same for T3
+  uint8_t ts_out;
+}__attribute__((packed));
+
+// where the TLV of that type is, going past the Follow-Up and Location TLVs that can be in front of it; -1 if it isn't there
+// off is where the TLVs start
+static __always_inline int64_t find_tlv(struct __sk_buff *skb, uint32_t off, uint8_t type){
+  struct tlv_hdr hdr;
+#pragma unroll
+  for (int i = 0; i < 3; i++) {
+    if (bpf_skb_load_bytes(skb, off, &hdr, sizeof(hdr)) != 0) return -1;
+    if (hdr.type == type) return off;
+    if (hdr.type != TLV_FOLLOW_UP && hdr.type != TLV_LOCATION) return -1;
+    off+=sizeof(hdr)+bpf_ntohs(hdr.len);
+  }
+  return -1;
+}
+
+// AUTHENTICATED MODE
+// there's no HMAC-SHA-256 in BPF(no helper, no kfunc) so userspace signs and checks every packet
+// and these go through the regular socket; all we do here is note down precise timestamps for userspace to pick up
+// KEEP IN SYNC with the offsets in internal/userspace/stamp/auth.go
+// session-sender packet, authenticated(RFC 8762 4.2.2)
+struct senderpkt_auth{
+  uint32_t seq;
+  uint8_t mbz[12];
+  uint32_t t1_s;
+  uint32_t t1_f;
+  uint16_t err;
+  uint8_t mbz2[70];
+  uint8_t hmac[16]; //covers everything above
+}__attribute__((packed));
+// session-reflector packet, authenticated(RFC 8762 4.3.2)
+struct reflectorpkt_auth{
+  uint32_t seq;
+  uint8_t mbz[12];
+  uint32_t t3_s;
+  uint32_t t3_f;
+  uint16_t err;
+  uint8_t mbz2[6];
+  uint32_t t2_s;
+  uint32_t t2_f;
+  uint8_t mbz3[8];
+  uint32_t s_seq;
+  uint8_t mbz4[12];
+  uint32_t t1_s;
+  uint32_t t1_f;
+  uint16_t s_err;
+  uint8_t mbz5[6];
+  uint8_t ttl;
+  uint8_t mbz6[15];
+  uint8_t hmac[16]; //covers everything above
+}__attribute__((packed));
@@ -1,9 +1,10 @@
 package anchor
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"net"
+	"log/slog"
+	"strings"
 	"sync"
 
 	"github.com/cilium/ebpf"
@@ -22,52 +23,156 @@ const (
 	Generic
 )
 
+func (p AnchorPosition) String() string {
+	switch p {
+	case BeforeCilium:
+		return "before Cilium"
+	case AfterCilium:
+		return "after Cilium"
+	case Generic:
+		return "generic"
+	}
+	return fmt.Sprintf("AnchorPosition(%d)", int(p))
+}
+
 // AnchorManager manages TCX anchors
 type AnchorManager struct {
 	mutex sync.RWMutex
+	// Debug logs the fallback to a generic anchor when there's no Cilium on the interface
+	Debug bool
+	// where fallbacks get logged, slog.Default() when nil
+	Logger *slog.Logger
+	// Strict fails CreateAnchor when looking for Cilium fails instead of falling back to a generic anchor
+	// no Cilium on the interface still gets the generic one, there's nothing to be out of order with
+	Strict bool
+	// program name prefixes BeforeCilium and AfterCilium go relative to instead of Cilium's, for other CNIs(e.g. Calico's "cali_")
+	// or Cilium versions that name theirs differently; the kernel cuts names down to 15 chars so longer prefixes never match
+	RelativeTo []string
+	// kernel calls, kernelTCX unless a test swaps it out
+	tcx tcxLinker
+	// what CreateAnchor came up with for every interface and direction, until ReleaseAnchor
+	anchors map[anchorKey]createdAnchor
+}
+
+type anchorKey struct {
+	iface     string
+	direction ebpf.AttachType
+}
+
+type createdAnchor struct {
+	anchor   link.Anchor
+	position AnchorPosition
+}
+
+// Cilium's TCX programs, the kernel truncates names to 15 chars but these prefixes survive that
+var ciliumPrefixes = []string{"cil_from_", "cil_to_"}
+
+// not having Cilium on the interface is perfectly normal, unlike failing to look for it
+var errNoCilium = errors.New("no Cilium programs attached")
+
+// anchors only make sense on the TCX hooks, anything else would get one that means nothing to it
+var errUnsupportedAttach = errors.New("unsupported attach type for a TCX anchor")
+
+func checkDirection(direction ebpf.AttachType) error {
+	if direction != ebpf.AttachTCXIngress && direction != ebpf.AttachTCXEgress {
+		return fmt.Errorf("%w: %v", errUnsupportedAttach, direction)
+	}
+	return nil
 }
 
 // NewAnchorManager creates a new anchor manager
 func NewAnchorManager() *AnchorManager {
-	return &AnchorManager{}
+	return &AnchorManager{tcx: kernelTCX{}}
+}
+
+func (am *AnchorManager) logger() *slog.Logger {
+	if am.Logger != nil {
+		return am.Logger
+	}
+	return slog.Default()
+}
+
+// a zero AnchorManager still works
+func (am *AnchorManager) linker() tcxLinker {
+	if am.tcx == nil {
+		return kernelTCX{}
+	}
+	return am.tcx
 }
 
-// CreateAnchor creates a new TCX anchor
-func (am *AnchorManager) CreateAnchor(iface string, direction ebpf.AttachType, position AnchorPosition) (link.Anchor, error) {
+// CreateAnchor creates a new TCX anchor and returns the position it actually went with,
+// Generic instead of the one asked for if it had to fall back.
+// Once there's one for the interface and direction every call gets that same one back whatever the position, until ReleaseAnchor
+func (am *AnchorManager) CreateAnchor(iface string, direction ebpf.AttachType, position AnchorPosition) (link.Anchor, AnchorPosition, error) {
 	am.mutex.Lock()
 	defer am.mutex.Unlock()
+	key := anchorKey{iface: iface, direction: direction}
+	if c, ok := am.anchors[key]; ok {
+		return c.anchor, c.position, nil
+	}
+	anchor, position, err := am.createAnchor(iface, direction, position)
+	if err != nil {
+		return nil, position, err
+	}
+	if am.anchors == nil {
+		am.anchors = map[anchorKey]createdAnchor{}
+	}
+	am.anchors[key] = createdAnchor{anchor: anchor, position: position}
+	return anchor, position, nil
+}
+
+// ReleaseAnchor forgets the anchor CreateAnchor made for the interface and direction, the next call looks at the chain again.
+// An anchor points at a program ID so it goes stale once that program is replaced, e.g. after the interface flapped
+func (am *AnchorManager) ReleaseAnchor(iface string, direction ebpf.AttachType) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	delete(am.anchors, anchorKey{iface: iface, direction: direction})
+}
 
+// caller holds the lock
+func (am *AnchorManager) createAnchor(iface string, direction ebpf.AttachType, position AnchorPosition) (link.Anchor, AnchorPosition, error) {
+	// before looking for Cilium, the fallback would turn it down anyway
+	if err := checkDirection(direction); err != nil {
+		return nil, position, err
+	}
 	// Try to create anchor relative to Cilium if requested
 	if position == BeforeCilium || position == AfterCilium {
 		anchor, err := am.createAnchorRelativeToCilium(iface, direction, position)
 		if err == nil {
-			return anchor, nil
+			return anchor, position, nil
+		}
+		if errors.Is(err, errNoCilium) == false && am.Strict == true {
+			return nil, position, fmt.Errorf("failed to create anchor relative to Cilium: %w", err)
+		}
+		if errors.Is(err, errNoCilium) == false {
+			am.logger().Warn("Failed to create anchor relative to Cilium, falling back to generic anchor", "iface", iface, "direction", direction, "prefixes", am.relativeTo(), "err", err)
+		} else if am.Debug == true {
+			am.logger().Info("No Cilium programs, falling back to generic anchor", "iface", iface, "direction", direction, "prefixes", am.relativeTo())
 		}
-		log.Printf("Failed to create anchor relative to Cilium: %v, falling back to generic anchor", err)
 	}
 
 	// Create generic anchor
 	anchor, err := am.createGenericAnchor(iface, direction)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create generic anchor: %w", err)
+		return nil, Generic, fmt.Errorf("failed to create generic anchor: %w", err)
 	}
 
-	return anchor, nil
+	return anchor, Generic, nil
 }
 
 // AttachToAnchor attaches a program to an anchor
 func (am *AnchorManager) AttachToAnchor(anchor link.Anchor, prog *ebpf.Program, iface string, direction ebpf.AttachType) (link.Link, error) {
 	// Get interface index
-	ifaceObj, err := net.InterfaceByName(iface)
+	ifindex, err := am.linker().interfaceIndex(iface)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get interface %s: %w", iface, err)
 	}
 
 	// Attach program to anchor using TCX
-	link, err := link.AttachTCX(link.TCXOptions{
+	link, err := am.linker().attach(link.TCXOptions{
 		Program:   prog,
 		Attach:    direction,
-		Interface: ifaceObj.Index,
+		Interface: ifindex,
 		Anchor:    anchor,
 	})
 	if err != nil {
@@ -77,27 +182,127 @@ func (am *AnchorManager) AttachToAnchor(anchor link.Anchor, prog *ebpf.Program,
 	return link, nil
 }
 
-// createAnchorRelativeToCilium creates an anchor relative to Cilium programs
+// CiliumProgInfo is a Cilium program found on an interface
+type CiliumProgInfo struct {
+	Name string
+	ID   ebpf.ProgramID
+	// 0 if the program wasn't attached through a link(or the kernel can't tell us)
+	LinkID link.ID
+}
+
+// DetectCilium reports whether there are Cilium programs attached to the interface in the given direction,
+// they're returned in the order they run. It goes by Cilium's names whatever RelativeTo says
+func (am *AnchorManager) DetectCilium(iface string, direction ebpf.AttachType) (bool, []CiliumProgInfo, error) {
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	progs, err := am.detectPrefixed(iface, direction, ciliumPrefixes)
+	if err != nil {
+		return false, nil, err
+	}
+	return len(progs) > 0, progs, nil
+}
+
+// programs with a name starting with one of prefixes, caller holds the lock
+func (am *AnchorManager) detectPrefixed(iface string, direction ebpf.AttachType, prefixes []string) ([]CiliumProgInfo, error) {
+	progs, err := am.programs(iface, direction)
+	if err != nil {
+		return nil, err
+	}
+	var cilium []CiliumProgInfo
+	for _, p := range progs {
+		if hasPrefix(p.Name, prefixes) == true {
+			cilium = append(cilium, CiliumProgInfo{Name: p.Name, ID: p.ID, LinkID: p.LinkID})
+		}
+	}
+	return cilium, nil
+}
+
+// what's attached to the interface in the order it runs
+func (am *AnchorManager) programs(iface string, direction ebpf.AttachType) ([]attachedProgram, error) {
+	ifindex, err := am.linker().interfaceIndex(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %s: %w", iface, err)
+	}
+	progs, err := am.linker().programs(ifindex, direction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query programs on %s: %w", iface, err)
+	}
+	return progs, nil
+}
+
+// the kernel only keeps this much of a program's name
+const progNameLen = 15
+
+// CreateAnchorByName creates an anchor right before or after the program with this name on the interface.
+// If several programs share the name, before goes in front of the first one and after behind the last one
+func (am *AnchorManager) CreateAnchorByName(iface string, direction ebpf.AttachType, name string, before bool) (link.Anchor, error) {
+	// a TC or XDP hook has no TCX chain to look the name up in
+	if err := checkDirection(direction); err != nil {
+		return nil, err
+	}
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if len(name) > progNameLen {
+		name = name[:progNameLen]
+	}
+	progs, err := am.programs(iface, direction)
+	if err != nil {
+		return nil, err
+	}
+	var found []ebpf.ProgramID
+	for _, p := range progs {
+		if p.Name == name {
+			found = append(found, p.ID)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no program named %s attached to %s", name, iface)
+	}
+	if before == true {
+		return link.BeforeProgramByID(found[0]), nil
+	}
+	return link.AfterProgramByID(found[len(found)-1]), nil
+}
+
+// createAnchorRelativeToCilium creates an anchor relative to Cilium programs(or the RelativeTo ones)
+// before goes in front of the first Cilium program in the chain, after goes behind the last one
 func (am *AnchorManager) createAnchorRelativeToCilium(iface string, direction ebpf.AttachType, position AnchorPosition) (link.Anchor, error) {
-	// This is a simplified implementation
-	// In a full implementation, this would:
-	// 1. Detect Cilium programs on the interface
-	// 2. Create an anchor relative to those programs
-	// 3. Return the anchor information
+	cilium, err := am.detectPrefixed(iface, direction, am.relativeTo())
+	if err != nil {
+		return nil, err
+	}
+	if len(cilium) == 0 {
+		return nil, errNoCilium
+	}
+	if position == BeforeCilium {
+		return link.BeforeProgramByID(cilium[0].ID), nil
+	}
+	return link.AfterProgramByID(cilium[len(cilium)-1].ID), nil
+}
 
-	// For now, we'll return an error to trigger the fallback to generic anchor
-	return nil, fmt.Errorf("Cilium integration not fully implemented")
+// Cilium's unless told otherwise
+func (am *AnchorManager) relativeTo() []string {
+	if len(am.RelativeTo) > 0 {
+		return am.RelativeTo
+	}
+	return ciliumPrefixes
+}
+
+// checks the program's name against what the CNI calls its programs
+func hasPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 // createGenericAnchor creates a generic anchor not relative to any specific program
 func (am *AnchorManager) createGenericAnchor(iface string, direction ebpf.AttachType) (link.Anchor, error) {
-	// For a generic anchor, we'll use the Head() or Tail() anchor depending on the direction
-	// This is a simplified implementation
-	if direction == ebpf.AttachTCXIngress || direction == ebpf.AttachTCXEgress {
-		// For ingress/egress, we'll use Head() to place our program at the beginning
-		return link.Head(), nil
+	if err := checkDirection(direction); err != nil {
+		return nil, err
 	}
-
-	// Default to Head() anchor
+	// For ingress/egress, we'll use Head() to place our program at the beginning
 	return link.Head(), nil
 }
@@ -0,0 +1,207 @@
+package anchor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// stands in for the kernel: one interface with whatever programs the test puts on it
+type fakeTCX struct {
+	progs     []attachedProgram
+	queryErr  error
+	attachErr error
+	queried   int
+	attached  []link.TCXOptions
+}
+
+const fakeIface, fakeIndex = "eth0", 2
+
+var errFake = errors.New("fake kernel error")
+
+func (f *fakeTCX) interfaceIndex(iface string) (int, error) {
+	if iface != fakeIface {
+		return 0, errFake
+	}
+	return fakeIndex, nil
+}
+
+func (f *fakeTCX) programs(ifindex int, direction ebpf.AttachType) ([]attachedProgram, error) {
+	f.queried++
+	if f.queryErr != nil {
+		return nil, f.queryErr
+	}
+	return f.progs, nil
+}
+
+func (f *fakeTCX) attach(opts link.TCXOptions) (link.Link, error) {
+	if f.attachErr != nil {
+		return nil, f.attachErr
+	}
+	f.attached = append(f.attached, opts)
+	return nil, nil
+}
+
+func TestCreateAnchor(t *testing.T) {
+	cilium := []attachedProgram{
+		{ID: 10, Name: "other_prog"},
+		{ID: 11, Name: "cil_from_netdev"},
+		{ID: 12, Name: "cil_to_netdev"},
+		{ID: 13, Name: "other_prog"},
+	}
+	calico := []attachedProgram{
+		{ID: 20, Name: "other_prog"},
+		{ID: 21, Name: "cali_tc_preambl"},
+		{ID: 22, Name: "cil_from_netdev"},
+	}
+	tests := []struct {
+		name      string
+		progs     []attachedProgram
+		queryErr  error
+		iface     string
+		position  AnchorPosition
+		strict    bool
+		prefixes  []string
+		want      link.Anchor
+		wantPos   AnchorPosition
+		wantQuery bool
+		wantErr   bool
+	}{
+		{name: "cilium present, before", progs: cilium, position: BeforeCilium, want: link.BeforeProgramByID(11), wantPos: BeforeCilium, wantQuery: true},
+		{name: "cilium present, after", progs: cilium, position: AfterCilium, want: link.AfterProgramByID(12), wantPos: AfterCilium, wantQuery: true},
+		{name: "cilium absent, before", progs: []attachedProgram{{ID: 10, Name: "other_prog"}}, position: BeforeCilium, want: link.Head(), wantPos: Generic, wantQuery: true},
+		{name: "nothing attached, before", position: BeforeCilium, want: link.Head(), wantPos: Generic, wantQuery: true},
+		{name: "cilium absent, strict", position: BeforeCilium, strict: true, want: link.Head(), wantPos: Generic, wantQuery: true},
+		{name: "other CNI, before", progs: calico, position: BeforeCilium, prefixes: []string{"cali_"}, want: link.BeforeProgramByID(21), wantPos: BeforeCilium, wantQuery: true},
+		{name: "other CNI, after", progs: calico, position: AfterCilium, prefixes: []string{"cali_", "cil_"}, want: link.AfterProgramByID(22), wantPos: AfterCilium, wantQuery: true},
+		// Cilium's names are only the default
+		{name: "other CNI, cilium's ignored", progs: cilium, position: BeforeCilium, prefixes: []string{"cali_"}, want: link.Head(), wantPos: Generic, wantQuery: true},
+		{name: "generic", progs: cilium, position: Generic, want: link.Head(), wantPos: Generic},
+		{name: "query fails", queryErr: errFake, position: BeforeCilium, want: link.Head(), wantPos: Generic, wantQuery: true},
+		{name: "query fails, strict", queryErr: errFake, position: BeforeCilium, strict: true, wantQuery: true, wantErr: true},
+		{name: "no such interface, strict", iface: "eth1", position: AfterCilium, strict: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeTCX{progs: tt.progs, queryErr: tt.queryErr}
+			am := &AnchorManager{Strict: tt.strict, RelativeTo: tt.prefixes, tcx: fake}
+			iface := fakeIface
+			if tt.iface != "" {
+				iface = tt.iface
+			}
+			got, pos, err := am.CreateAnchor(iface, ebpf.AttachTCXIngress, tt.position)
+			if (fake.queried > 0) != tt.wantQuery {
+				t.Errorf("queried programs %d times, want query: %v", fake.queried, tt.wantQuery)
+			}
+			if tt.wantErr == true {
+				if err == nil {
+					t.Errorf("CreateAnchor() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateAnchor() returned error: %v", err)
+			}
+			if reflect.DeepEqual(got, tt.want) == false {
+				t.Errorf("CreateAnchor() = %#v, want %#v", got, tt.want)
+			}
+			if pos != tt.wantPos {
+				t.Errorf("CreateAnchor() went %v, want %v", pos, tt.wantPos)
+			}
+		})
+	}
+}
+
+func TestAttachToAnchor(t *testing.T) {
+	tests := []struct {
+		name      string
+		iface     string
+		attachErr error
+		wantErr   error
+	}{
+		{name: "attached", iface: fakeIface},
+		{name: "attach fails", iface: fakeIface, attachErr: errFake, wantErr: errFake},
+		{name: "no such interface", iface: "eth1", wantErr: errFake},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeTCX{attachErr: tt.attachErr}
+			am := &AnchorManager{tcx: fake}
+			anchor := link.BeforeProgramByID(11)
+			_, err := am.AttachToAnchor(anchor, nil, tt.iface, ebpf.AttachTCXEgress)
+			if tt.wantErr != nil {
+				if errors.Is(err, tt.wantErr) == false {
+					t.Errorf("AttachToAnchor() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AttachToAnchor() returned error: %v", err)
+			}
+			if len(fake.attached) != 1 {
+				t.Fatalf("attached %d times, want once", len(fake.attached))
+			}
+			opts := fake.attached[0]
+			if opts.Interface != fakeIndex || opts.Attach != ebpf.AttachTCXEgress || reflect.DeepEqual(opts.Anchor, anchor) == false {
+				t.Errorf("attached with %+v, want interface %d, egress and the anchor it was given", opts, fakeIndex)
+			}
+		})
+	}
+}
+
+func TestCreateAnchorReuse(t *testing.T) {
+	fake := &fakeTCX{progs: []attachedProgram{{ID: 11, Name: "cil_from_netdev"}}}
+	am := &AnchorManager{tcx: fake}
+	first, _, err := am.CreateAnchor(fakeIface, ebpf.AttachTCXIngress, BeforeCilium)
+	if err != nil {
+		t.Fatalf("CreateAnchor() returned error: %v", err)
+	}
+	// Cilium got replaced, we shouldn't notice until the anchor's released
+	fake.progs = []attachedProgram{{ID: 21, Name: "cil_from_netdev"}}
+	again, pos, err := am.CreateAnchor(fakeIface, ebpf.AttachTCXIngress, AfterCilium)
+	if err != nil {
+		t.Fatalf("CreateAnchor() returned error: %v", err)
+	}
+	if fake.queried != 1 || reflect.DeepEqual(again, first) == false || pos != BeforeCilium {
+		t.Errorf("second CreateAnchor() = %#v %v after %d queries, want %#v %v from the first one", again, pos, fake.queried, first, BeforeCilium)
+	}
+	// the other direction has its own
+	if _, _, err := am.CreateAnchor(fakeIface, ebpf.AttachTCXEgress, BeforeCilium); err != nil || fake.queried != 2 {
+		t.Errorf("CreateAnchor() for egress queried %d times(err %v), want it to look for itself", fake.queried, err)
+	}
+	am.ReleaseAnchor(fakeIface, ebpf.AttachTCXIngress)
+	got, _, err := am.CreateAnchor(fakeIface, ebpf.AttachTCXIngress, BeforeCilium)
+	if err != nil {
+		t.Fatalf("CreateAnchor() returned error: %v", err)
+	}
+	if want := link.BeforeProgramByID(21); reflect.DeepEqual(got, want) == false {
+		t.Errorf("CreateAnchor() after ReleaseAnchor() = %#v, want %#v", got, want)
+	}
+}
+
+func TestCreateAnchorUnsupportedAttach(t *testing.T) {
+	for _, position := range []AnchorPosition{Generic, BeforeCilium, AfterCilium} {
+		fake := &fakeTCX{progs: []attachedProgram{{ID: 11, Name: "cil_from_netdev"}}}
+		am := &AnchorManager{tcx: fake}
+		got, _, err := am.CreateAnchor(fakeIface, ebpf.AttachCGroupInetIngress, position)
+		if errors.Is(err, errUnsupportedAttach) == false {
+			t.Errorf("CreateAnchor() with %v = %#v, %v; want %v", position, got, err, errUnsupportedAttach)
+		}
+		if fake.queried != 0 {
+			t.Errorf("CreateAnchor() with %v queried programs %d times, want none", position, fake.queried)
+		}
+	}
+	if _, err := (&AnchorManager{}).createGenericAnchor(fakeIface, ebpf.AttachNetkitPrimary); errors.Is(err, errUnsupportedAttach) == false {
+		t.Errorf("createGenericAnchor() error = %v, want %v", err, errUnsupportedAttach)
+	}
+	fake := &fakeTCX{progs: []attachedProgram{{ID: 11, Name: "cil_from_netdev"}}}
+	if got, err := (&AnchorManager{tcx: fake}).CreateAnchorByName(fakeIface, ebpf.AttachXDP, "cil_from_netdev", true); errors.Is(err, errUnsupportedAttach) == false {
+		t.Errorf("CreateAnchorByName() with %v = %#v, %v; want %v", ebpf.AttachXDP, got, err, errUnsupportedAttach)
+	}
+	if fake.queried != 0 {
+		t.Errorf("CreateAnchorByName() queried programs %d times, want none", fake.queried)
+	}
+}
@@ -0,0 +1,69 @@
+package anchor
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// attachedProgram is a program attached to an interface, in the order they run
+type attachedProgram struct {
+	ID     ebpf.ProgramID
+	Name   string
+	LinkID link.ID // 0 if it wasn't attached through a link
+}
+
+// tcxLinker is everything the manager needs from the kernel, swapped out for a fake in tests
+type tcxLinker interface {
+	interfaceIndex(iface string) (int, error)
+	programs(ifindex int, direction ebpf.AttachType) ([]attachedProgram, error)
+	attach(opts link.TCXOptions) (link.Link, error)
+}
+
+// the real thing
+type kernelTCX struct{}
+
+func (kernelTCX) interfaceIndex(iface string) (int, error) {
+	ifaceObj, err := net.InterfaceByName(iface)
+	if err != nil {
+		return 0, err
+	}
+	return ifaceObj.Index, nil
+}
+
+func (kernelTCX) programs(ifindex int, direction ebpf.AttachType) ([]attachedProgram, error) {
+	// TCX query returns programs in the order they run
+	res, err := link.QueryPrograms(link.QueryOptions{Target: ifindex, Attach: direction})
+	if err != nil {
+		return nil, err
+	}
+	var progs []attachedProgram
+	for _, p := range res.Programs {
+		name, err := programName(p.ID)
+		if err != nil {
+			return nil, err
+		}
+		linkID, _ := p.LinkID()
+		progs = append(progs, attachedProgram{ID: p.ID, Name: name, LinkID: linkID})
+	}
+	return progs, nil
+}
+
+func (kernelTCX) attach(opts link.TCXOptions) (link.Link, error) {
+	return link.AttachTCX(opts)
+}
+
+func programName(id ebpf.ProgramID) (string, error) {
+	prog, err := ebpf.NewProgramFromID(id)
+	if err != nil {
+		return "", fmt.Errorf("failed to open program %d: %w", id, err)
+	}
+	defer prog.Close()
+	info, err := prog.Info()
+	if err != nil {
+		return "", fmt.Errorf("failed to get info of program %d: %w", id, err)
+	}
+	return info.Name, nil
+}
@@ -1,11 +1,15 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
+	"slices"
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/loader"
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
 )
 
@@ -18,20 +22,57 @@ func (senderArgs) Epilogue() string {
 }
 
 type senderArgs struct {
-	Device   string   `arg:"positional,required" help:"network device to attach BPF programs to, e.g. eth0"`
-	IP       string   `arg:"positional,required" help:"Session-Reflector's IP to send packets to"`
-	Src      uint16   `arg:"-s" default:"862" help:"source port"`
-	Dest     uint16   `arg:"-d" default:"862" help:"destination port"`
-	Count    uint32   `arg:"-c,--" default:"0" help:"number of packets to send; infinite by default"`
-	Interval float64  `arg:"-i,--" default:"1" help:"interval between packets sent, in seconds; takes sub-1 arguments"`
-	Debug    bool     `help:"get BPF verifier output log and other debug info"`
-	Timeout  uint32   `arg:"-w,--" default:"1" help:"timeout before a packet is considered lost, in seconds"`
-	Hist     []uint32 `help:"print out a histogram, args: number of bins, value floor, value ceiling"`
-	Histpath string   `default:"./hist" help:"output path for the histogram"`
-	Sync     bool     `arg:"--enforce-sync" help:"abort if no clock syncing detected"`
-	PTP      bool     `arg:"--enforce-ptp" help:"abort if no PTP syncing detected (assumes systemd, possibly unstable)"`
+	Device    string   `arg:"positional,required" help:"network device to attach BPF programs to, e.g. eth0"`
+	IPs       []string `arg:"positional,required" help:"Session-Reflector IPs or hostnames to send packets to, each one is a separate session"`
+	Local     string   `arg:"--local-addr" help:"local IP to run the session from, IPv4 or IPv6; the interface's first address by default"`
+	Rewrite   bool     `arg:"--rewrite-source" help:"let routing pick the source address and rewrite it to --local-addr on the way out, for when routing would pick another one of the interface's addresses"`
+	Src       uint16   `arg:"-s" default:"862" help:"source port"`
+	Dest      uint16   `arg:"-d,--dest-port" default:"862" help:"destination port, only probes going to it are timestamped"`
+	Count     uint32   `arg:"-c,--" default:"0" help:"number of packets to send; infinite by default"`
+	Duration  string   `arg:"--duration" help:"stop sending after this long, e.g. 30s or 5m; with --count whichever comes first"`
+	Interval  float64  `arg:"-i,--" default:"1" help:"interval between packets sent, in seconds; takes sub-1 arguments"`
+	Debug     bool     `help:"get BPF verifier output log and other debug info"`
+	VerifLog  *uint32  `arg:"--verifier-log-level" help:"verifier log verbosity: 0 off, 1 branches, 2 every instruction; 1 with --debug, 0 otherwise. Anything above 0 needs --debug"`
+	Timeout   uint32   `arg:"-w,--" default:"1" help:"timeout before a packet is considered lost, in seconds"`
+	Hist      []uint32 `help:"print out a histogram, args: number of bins, value floor, value ceiling"`
+	Histpath  string   `default:"./hist" help:"output path for the histogram"`
+	Sync      bool     `arg:"--enforce-sync" help:"abort if no clock syncing detected"`
+	PTP       bool     `arg:"--enforce-ptp" help:"abort if no PTP syncing detected (assumes systemd, possibly unstable)"`
+	Recent    uint32   `default:"0" help:"keep last N raw measurements in a BPF map, dumped on SIGUSR1; costs ~40 bytes of kernel memory per entry"`
+	DumpMaps  bool     `arg:"--dump-maps" help:"dump the last N raw measurements once the session is over, requires --recent"`
+	Unhealthy uint32   `arg:"--unhealthy-after" default:"10" help:"exclude a reflector from the aggregate after this many packets lost in a row, 0 to disable"`
+	Healthy   uint32   `arg:"--healthy-after" default:"3" help:"include an excluded reflector back into the aggregate after this many responses in a row"`
+	Seed      *uint64  `help:"seed for the randomized probe spacing of --poisson so a run can be reproduced; time-based by default, printed with --debug"`
+	Poisson   bool     `arg:"--poisson" help:"send probes at exponentially distributed intervals averaging --interval instead of a fixed one(RFC 2330 Poisson sampling), so they don't lock into step with anything periodic on the path"`
+	Cgroup    string   `help:"attach to this cgroup(v2 path) instead of the network device, which is then only used for the local IP"`
+	IfDrops   bool     `arg:"--if-drops" help:"print the interface's rx/tx/qdisc drop counters alongside the metrics to tell local loss from network loss"`
+	Metrics   string   `arg:"--metrics-addr" help:"serve Prometheus metrics with pre-computed percentiles and windowed loss on this address, e.g. :9862"`
+	Windows   []string `arg:"--loss-windows" help:"windows to publish loss ratio over, up to 1h [default: 1m 5m 15m]"`
+	FailFast  bool     `arg:"--fail-fast" help:"abort if any reflector can't be resolved (default)"`
+	KeepGoing bool     `arg:"--keep-going" help:"run the session with the reflectors that could be resolved, report the rest and exit with code 3 at the end"`
+	AuthKey   string   `arg:"--auth-key,env:STAMP_AUTH_KEY" help:"run in authenticated mode with this shared key, the reflector has to have the same one"`
+	Output    string   `arg:"--output" default:"text" help:"text for the live report, json to print the results to stdout once the session's over(or stopped) with everything else going to stderr, csv for a row per reply on stdout with the live report on stderr"`
+	TAIOffset int      `arg:"--tai-offset" help:"TAI-UTC offset in seconds(37 as of 2025) to stamp with, overrides detecting whether the kernel's TAI clock has it; the reflector has to agree"`
+	DSCP      uint8    `arg:"--dscp" default:"0" help:"mark probes with this DSCP(0-63) to measure a given traffic class, the reflector's replies keep it"`
+	Padding   uint16   `arg:"--padding-bytes" default:"0" help:"pad every probe out with an Extra Padding TLV carrying this many bytes, the reflector echoes it back; has to fit the interface MTU"`
+	Size      uint16   `arg:"--packet-size" help:"pad every probe out to an IP packet of exactly this many bytes and set DF on it, e.g. 9000 to check a jumbo frame path; has to fit the interface MTU"`
+	HWTstamps bool     `arg:"--hw-timestamps" help:"turn on the NIC's hardware receive timestamps and take T4 from them when a reply has one, the kernel's otherwise; the NIC clock has to be PTP-synced to TAI"`
+	FollowUp  bool     `arg:"--follow-up" help:"ask the reflector for a Follow-Up Telemetry TLV with the sequence number and actual send time of its previous reply in the per-packet events; the reflector needs --follow-up too"`
+	Location  bool     `arg:"--location-tlv" help:"ask the reflector for a Location TLV with the addresses and ports it saw the probe come in with in the per-packet events, shows any NAT on the way; the reflector needs --location-tlv too"`
+	TSInfo    bool     `arg:"--timestamp-info" help:"ask the reflector for a Timestamp Information TLV with what its clock is synced to and how it took T2 and T3 in the per-packet events; the reflector needs --timestamp-info too"`
+	TSFormat  string   `arg:"--timestamp-format" default:"ntp" help:"ntp or ptp(PTPv2 truncated, seconds and nanoseconds since 1970) timestamps on the wire, the reflector answers in the same format"`
+	StatsPin  string   `arg:"--stats-pin" help:"pin the stats map under this bpffs directory(e.g. /sys/fs/bpf/stamp-stats) for another process to read, removed on exit"`
+	VLAN      bool     `arg:"--vlan-aware" help:"skip 802.1Q/802.1ad tags(up to two) still in the frame to find the IP header, for attaching to the parent of a VLAN with tag offload off"`
+	Sampling  uint32   `arg:"--sample-rate" help:"with --output csv only write a row for every Nth reply, for high packet rates; the live report and stats still count every one"`
+	Replace   bool     `arg:"--replace" help:"take another run's sender programs off the interface instead of refusing to attach next to them"`
+	SeqStart  uint32   `arg:"--seq-start" default:"1" help:"sequence number of the first probe, e.g. to match what a reflector implementation expects; it wraps around to 0 past 4294967295"`
+	Capture   uint32   `arg:"--capture" help:"write the first N frames of the session(probes as they leave, replies as they come in, cut off at 256 bytes) to --capture-path as a pcap, for when the numbers look off"`
+	CapPath   string   `arg:"--capture-path" default:"./capture.pcap" help:"where --capture writes to"`
 }
 
+// exit code for a session that ran but not with every target it was asked for
+const ExitPartial = 3
+
 func ParseSenderArgs() stamp.Args {
 	var args senderArgs
 	var res stamp.Args
@@ -50,21 +91,37 @@ func ParseSenderArgs() stamp.Args {
 		res.Dev = iface
 	}
 
-	// grab local IP
-	addrs, err := res.Dev.Addrs()
-	res.Localaddr, _, err = net.ParseCIDR(addrs[0].String())
-	if res.Localaddr == nil || err != nil {
-		parser.Fail(fmt.Sprintf("Failed to fetch local IP: %v", err))
+	// grab local IP, the loader makes sure it's actually on the interface
+	if ip, err := localAddr(res.Dev, args.Local); err != nil {
+		parser.Fail(err.Error())
+	} else {
+		res.Localaddr = ip
 	}
 
-	// parse IP
-	if parsedIP := net.ParseIP(args.IP); parsedIP == nil {
-		parser.Fail(fmt.Sprintf("Can't parse IP: %s", args.IP))
-	} else {
-		res.IP = parsedIP
+	// resolve targets, by default a single bad one aborts everything
+	if args.FailFast == true && args.KeepGoing == true {
+		parser.Fail(fmt.Sprintf("--fail-fast and --keep-going are mutually exclusive"))
+	}
+	res.KeepGoing = args.KeepGoing
+	for _, target := range args.IPs {
+		ip, err := resolveTarget(target, res.Localaddr.To4() == nil)
+		if err != nil && args.KeepGoing == false {
+			parser.Fail(err.Error())
+		} else if err != nil {
+			res.Failed = append(res.Failed, err)
+		} else {
+			res.IPs = append(res.IPs, ip)
+		}
+	}
+	if len(res.IPs) == 0 {
+		parser.Fail(fmt.Sprintf("None of the reflectors could be resolved"))
 	}
 
 	// cool hack - by making port numbers uint16, we limit them to 0-65536 without any explicit checks
+	// except for 0 which would bind us to a random port the BPF side knows nothing about
+	if args.Src == 0 || args.Dest == 0 {
+		parser.Fail(fmt.Sprintf("Ports can't be 0"))
+	}
 	res.S_port = int(args.Src)
 	res.D_port = int(args.Dest)
 
@@ -81,10 +138,145 @@ func ParseSenderArgs() stamp.Args {
 	}
 
 	res.Count = args.Count
+	if args.Duration != "" {
+		d, err := time.ParseDuration(args.Duration)
+		if err != nil || d <= 0 {
+			parser.Fail(fmt.Sprintf("Invalid duration %s: has to be a positive duration", args.Duration))
+		}
+		res.Duration = d
+	}
 	res.Debug = args.Debug
+	if l, err := verifierLogLevel(args.VerifLog, args.Debug); err != nil {
+		parser.Fail(err.Error())
+	} else {
+		res.VerifierLogLevel = l
+	}
 	res.Sync = args.Sync
 	res.PTP = args.PTP
 
+	if args.DumpMaps == true && args.Recent == 0 {
+		parser.Fail(fmt.Sprintf("--dump-maps requires --recent"))
+	}
+	if args.Healthy == 0 {
+		parser.Fail(fmt.Sprintf("--healthy-after has to be positive"))
+	}
+	res.UnhealthyAfter = args.Unhealthy
+	res.HealthyAfter = args.Healthy
+	res.Seed = parseSeed(args.Seed)
+	res.Poisson = args.Poisson
+
+	if args.Cgroup != "" {
+		if fi, err := os.Stat(args.Cgroup); err != nil || fi.IsDir() == false {
+			parser.Fail(fmt.Sprintf("Can't use cgroup %s: not a directory", args.Cgroup))
+		}
+		res.Cgroup = args.Cgroup
+	}
+	// cgroup programs can't write to the packet
+	if args.Cgroup != "" && args.Rewrite == true {
+		parser.Fail(fmt.Sprintf("--rewrite-source doesn't work with --cgroup"))
+	}
+	res.RewriteSource = args.Rewrite
+	// cgroup programs never see the ethernet header
+	if args.Cgroup != "" && args.VLAN == true {
+		parser.Fail(fmt.Sprintf("--vlan-aware doesn't work with --cgroup"))
+	}
+	res.VLANAware = args.VLAN
+	res.IfDrops = args.IfDrops
+	res.Recent = args.Recent
+	// the recent ring is filled by BPF and in authenticated mode BPF doesn't handle the replies
+	if args.AuthKey != "" && args.Recent > 0 {
+		parser.Fail(fmt.Sprintf("--recent doesn't work with --auth-key"))
+	}
+	res.AuthKey = []byte(args.AuthKey)
+	// authenticated packets have their own fixed size
+	if args.AuthKey != "" && args.Padding > 0 {
+		parser.Fail(fmt.Sprintf("--padding-bytes doesn't work with --auth-key"))
+	}
+	res.PaddingBytes = int(args.Padding)
+	if args.AuthKey != "" && args.FollowUp == true {
+		parser.Fail(fmt.Sprintf("--follow-up doesn't work with --auth-key"))
+	}
+	res.FollowUp = args.FollowUp
+	if args.AuthKey != "" && args.Location == true {
+		parser.Fail(fmt.Sprintf("--location-tlv doesn't work with --auth-key"))
+	}
+	res.LocationTLV = args.Location
+	if args.AuthKey != "" && args.TSInfo == true {
+		parser.Fail(fmt.Sprintf("--timestamp-info doesn't work with --auth-key"))
+	}
+	res.TimestampInfo = args.TSInfo
+	switch args.TSFormat {
+	case "ntp":
+	case "ptp":
+		res.TimestampFormat = stamp.FormatPTP
+	default:
+		parser.Fail(fmt.Sprintf("--timestamp-format has to be ntp or ptp"))
+	}
+	// padding worked out for us, so it's one or the other
+	if args.Size > 0 {
+		if args.Padding > 0 {
+			parser.Fail(fmt.Sprintf("--packet-size and --padding-bytes are mutually exclusive"))
+		}
+		if args.AuthKey != "" {
+			parser.Fail(fmt.Sprintf("--packet-size doesn't work with --auth-key"))
+		}
+		padding, err := stamp.PaddingForSize(res, int(args.Size))
+		if err != nil {
+			parser.Fail(err.Error())
+		}
+		res.PaddingBytes = padding
+		res.PacketSize = int(args.Size)
+	}
+	if args.DSCP > 63 {
+		parser.Fail(fmt.Sprintf("Invalid DSCP %d: has to be between 0 and 63", args.DSCP))
+	}
+	res.DSCP = int(args.DSCP)
+	res.StatsPinPath = args.StatsPin
+	res.HWTimestamps = args.HWTstamps
+	if args.TAIOffset < 0 {
+		parser.Fail(fmt.Sprintf("Invalid TAI offset %d: can't be negative", args.TAIOffset))
+	}
+	res.TAIOffset = args.TAIOffset
+	switch args.Output {
+	case "text":
+	case "json":
+		res.JSON = true
+	case "csv":
+		// the rows come from the per-packet events, which authenticated mode doesn't have
+		if args.AuthKey != "" {
+			parser.Fail(fmt.Sprintf("--output csv doesn't work with --auth-key"))
+		}
+		res.CSV = true
+	default:
+		parser.Fail(fmt.Sprintf("Invalid output %s: has to be text, json or csv", args.Output))
+	}
+	// the per-packet events are the only thing it thins out
+	if args.Sampling > 1 && res.CSV == false {
+		parser.Fail(fmt.Sprintf("--sample-rate requires --output csv"))
+	}
+	res.SampleRate = args.Sampling
+	res.SeqStart = args.SeqStart
+	res.ReplaceAttached = args.Replace
+	// the cgroup programs only ever see the IP packet
+	if args.Capture > 0 && args.Cgroup != "" {
+		parser.Fail(fmt.Sprintf("--capture doesn't work with --cgroup"))
+	}
+	res.Capture = args.Capture
+	res.CapturePath = args.CapPath
+
+	res.MetricsAddr = args.Metrics
+	if len(args.Windows) == 0 {
+		args.Windows = []string{"1m", "5m", "15m"}
+	}
+	for _, w := range args.Windows {
+		d, err := time.ParseDuration(w)
+		if err != nil || d < time.Second || d > time.Hour {
+			parser.Fail(fmt.Sprintf("Invalid loss window %s: has to be a duration between 1s and 1h", w))
+		}
+		res.LossWindows = append(res.LossWindows, d)
+	}
+	res.DumpMaps = args.DumpMaps
+
 	if len(args.Hist) == 3 {
 		res.Hist = true
 		if args.Hist[0] < 3 {
@@ -112,14 +304,41 @@ func (reflectorArgs) Epilogue() string {
 }
 
 type reflectorArgs struct {
-	Device   string   `arg:"positional,required" help:"network device to attach BPF programs to, e.g. eth0"`
-	Port     uint16   `arg:"-p" default:"862" help:"port to listen on"`
-	Debug    bool     `help:"get BPF verifier output log and other debug info"`
-	Output   bool     `help:"print output - CAN'T PROPERLY HANDLE SIMULTANEOUS SESSIONS, HIST ARGS WITHOUT THIS FLAG WILL BE IGNORED"`
-	Hist     []uint32 `help:"print out a histogram, args: number of bins, value floor, value ceiling"`
-	Histpath string   `default:"./hist" help:"output path for the histogram"`
-	Sync     bool     `arg:"--enforce-sync" help:"abort if no clock syncing detected"`
-	PTP      bool     `arg:"--enforce-ptp" help:"abort if no PTP syncing detected (assumes systemd, possibly unstable)"`
+	Devices   []string `arg:"positional" help:"network devices to attach BPF programs to, e.g. eth0; each one reflects on its own first address, except the first one which goes by --local-addr"`
+	Wildcard  string   `arg:"--interface-wildcard" help:"also attach to every interface whose name matches this glob, e.g. 'eth*'; they go behind the devices given, if any"`
+	WatchNew  bool     `arg:"--watch-interfaces" help:"keep watching for interfaces matching --interface-wildcard as they come up and attach to them too; flapping ones get reattached"`
+	Port      uint16   `arg:"-p" default:"862" help:"port to listen on"`
+	Local     string   `arg:"--local-addr" help:"local IP to reflect on, IPv4 or IPv6; the interface's first address by default"`
+	Debug     bool     `help:"get BPF verifier output log and other debug info"`
+	VerifLog  *uint32  `arg:"--verifier-log-level" help:"verifier log verbosity: 0 off, 1 branches, 2 every instruction; 1 with --debug, 0 otherwise. Anything above 0 needs --debug"`
+	Output    bool     `help:"print output - CAN'T PROPERLY HANDLE SIMULTANEOUS SESSIONS, HIST ARGS WITHOUT THIS FLAG WILL BE IGNORED"`
+	Hist      []uint32 `help:"print out a histogram, args: number of bins, value floor, value ceiling"`
+	Histpath  string   `default:"./hist" help:"output path for the histogram"`
+	Sync      bool     `arg:"--enforce-sync" help:"abort if no clock syncing detected"`
+	PTP       bool     `arg:"--enforce-ptp" help:"abort if no PTP syncing detected (assumes systemd, possibly unstable)"`
+	Sport     *uint16  `arg:"--reflect-sport" help:"always reply from this source port regardless of which port the request came to"`
+	IfDrops   bool     `arg:"--if-drops" help:"print the interface's rx/tx/qdisc drop counters alongside the metrics, requires --output"`
+	FailFast  bool     `arg:"--fail-fast" help:"abort if any of the devices can't be attached to (default)"`
+	KeepGoing bool     `arg:"--keep-going" help:"run on the devices that could be attached to, report the rest and exit with code 3 once stopped"`
+	AuthKey   string   `arg:"--auth-key,env:STAMP_AUTH_KEY" help:"only reflect authenticated packets signed with this shared key"`
+	Mode      string   `arg:"--reflector-mode" default:"stateless" help:"stateless echoes the sender's sequence number, stateful keeps one per session-sender(source IP and port)"`
+	TAIOffset int      `arg:"--tai-offset" help:"TAI-UTC offset in seconds(37 as of 2025) to stamp with, overrides detecting whether the kernel's TAI clock has it; the sender has to agree"`
+	DualStack bool     `arg:"--dual-stack" help:"answer IPv4 and IPv6 senders alike, on the local address plus every device's first address of the other IP version"`
+	AllowFrom []string `arg:"--allow-from" help:"only answer senders in these CIDR prefixes, IPv4 or IPv6, e.g. 10.0.0.0/8; everyone else is dropped and counted"`
+	HWTstamps bool     `arg:"--hw-timestamps" help:"turn on the NIC's hardware receive timestamps and take T2 from them when a request has one, the kernel's otherwise; the NIC clock has to be PTP-synced to TAI"`
+	FollowUp  bool     `arg:"--follow-up" help:"fill in the Follow-Up Telemetry TLV with the sequence number and send time of the previous reply to the same session-sender"`
+	Location  bool     `arg:"--location-tlv" help:"fill in the Location TLV with the addresses and ports requests came in with"`
+	TSInfo    bool     `arg:"--timestamp-info" help:"fill in the Timestamp Information TLV with what our clock is synced to(NTP or PTP, as detected at startup) and how T2 and T3 were taken"`
+	Queues    int      `arg:"--queues" help:"how many RX queues the NIC spreads requests over; more than 1 gives every CPU its own LRU lists in the per-session maps and a bigger ringbuf"`
+	StatsPin  string   `arg:"--stats-pin" help:"pin the stats and sessions maps under this bpffs directory(e.g. /sys/fs/bpf/stamp-stats) for another process to read, removed on exit"`
+	VLAN      bool     `arg:"--vlan-aware" help:"skip 802.1Q/802.1ad tags(up to two) still in the frame to find the IP header, for attaching to the parent of a VLAN with tag offload off"`
+	MaxPPS    uint32   `arg:"--max-reply-pps" help:"send at most this many replies a second, drop and count the requests over it; split over --queues, 0 for no limit"`
+	Passive   bool     `arg:"--passive" help:"don't answer anything, count the requests going to any address on --port(into the stats and, stateful, the sessions map) and let them through; for a tap or SPAN port"`
+	KeepPorts bool     `arg:"--keep-ports" help:"send replies back with the request's source and destination ports as they came in instead of swapping them(RFC 8762 says swap); for finding out what a NAT or firewall does with them"`
+	ZeroCsum  bool     `arg:"--zero-udp-csum" help:"send IPv4 replies with no UDP checksum(zero) instead of fixing the request's up, for middleboxes that get the fixed up one wrong; IPv6 has to have one"`
+	Replace   bool     `arg:"--replace" help:"take another run's reflector programs off the interface instead of refusing to attach next to them"`
+	Capture   uint32   `arg:"--capture" help:"write the first N frames of the session(requests as they come in, replies as they leave, cut off at 256 bytes) to --capture-path as a pcap, for when the numbers look off"`
+	CapPath   string   `arg:"--capture-path" default:"./capture.pcap" help:"where --capture writes to"`
 }
 
 func ParseReflectorArgs() stamp.Args {
@@ -132,23 +351,138 @@ func ParseReflectorArgs() stamp.Args {
 		parser.Fail(fmt.Sprint(err))
 	}
 
-	// grab interface
-	if iface, err := net.InterfaceByName(args.Device); err != nil {
-		parser.Fail(fmt.Sprintf("Could not get interface %s: %v", args.Device, err))
-	} else {
-		res.Dev = iface
+	// grab interfaces, the first one is where the local IP comes from so that one always has to be there
+	if args.FailFast == true && args.KeepGoing == true {
+		parser.Fail(fmt.Sprintf("--fail-fast and --keep-going are mutually exclusive"))
+	}
+	res.KeepGoing = args.KeepGoing
+	if len(args.Devices) == 0 && args.Wildcard == "" {
+		parser.Fail(fmt.Sprintf("Need a device or --interface-wildcard"))
+	}
+	for i, dev := range args.Devices {
+		iface, err := net.InterfaceByName(dev)
+		if err != nil && (i == 0 || args.KeepGoing == false) {
+			parser.Fail(fmt.Sprintf("Could not get interface %s: %v", dev, err))
+		} else if err != nil {
+			res.Failed = append(res.Failed, fmt.Errorf("Could not get interface %s: %w", dev, err))
+		} else {
+			res.Devs = append(res.Devs, iface)
+		}
+	}
+	if args.Wildcard != "" {
+		matched, err := loader.MatchInterfaces(args.Wildcard)
+		if err != nil {
+			parser.Fail(err.Error())
+		}
+		for _, iface := range matched {
+			if slices.ContainsFunc(res.Devs, func(d *net.Interface) bool { return d.Index == iface.Index }) == false {
+				res.Devs = append(res.Devs, iface)
+			}
+		}
+		res.DevPattern = args.Wildcard
+	}
+	if args.WatchNew == true && args.Wildcard == "" {
+		parser.Fail(fmt.Sprintf("--watch-interfaces requires --interface-wildcard"))
 	}
+	res.WatchInterfaces = args.WatchNew
+	res.Dev = res.Devs[0]
 
-	// grab local IP
-	addrs, err := res.Dev.Addrs()
-	res.Localaddr, _, err = net.ParseCIDR(addrs[0].String())
-	if res.Localaddr == nil || err != nil {
-		parser.Fail(fmt.Sprintf("Failed to fetch local IP: %v", err))
+	// grab local IP, the loader makes sure it's actually on the interface
+	if ip, err := localAddr(res.Dev, args.Local); err != nil {
+		parser.Fail(err.Error())
+	} else {
+		res.Localaddr = ip
 	}
 
+	if args.Port == 0 {
+		parser.Fail(fmt.Sprintf("Port can't be 0"))
+	}
 	res.S_port = int(args.Port)
 	res.Debug = args.Debug
+	if l, err := verifierLogLevel(args.VerifLog, args.Debug); err != nil {
+		parser.Fail(err.Error())
+	} else {
+		res.VerifierLogLevel = l
+	}
 	res.Output = args.Output
+
+	if args.IfDrops == true && args.Output == false {
+		parser.Fail(fmt.Sprintf("--if-drops requires --output"))
+	}
+	res.IfDrops = args.IfDrops
+
+	if args.Sport != nil {
+		if *args.Sport == 0 {
+			parser.Fail(fmt.Sprintf("--reflect-sport can't be 0"))
+		}
+		res.ReflectSport = int(*args.Sport)
+	}
+	res.AuthKey = []byte(args.AuthKey)
+	switch args.Mode {
+	case "stateless":
+	case "stateful":
+		res.Stateful = true
+	default:
+		parser.Fail(fmt.Sprintf("--reflector-mode has to be stateless or stateful"))
+	}
+	// KEEP IN SYNC with max_entries of the allowed map in reflector.bpf.c
+	if len(args.AllowFrom) > 1024 {
+		parser.Fail(fmt.Sprintf("--allow-from takes up to 1024 prefixes"))
+	}
+	for _, cidr := range args.AllowFrom {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			parser.Fail(fmt.Sprintf("Invalid --allow-from prefix %s: %v", cidr, err))
+		}
+		res.AllowFrom = append(res.AllowFrom, n)
+	}
+	// authenticated replies are built in userspace, there's no TLV in them to fill in
+	if args.AuthKey != "" && args.FollowUp == true {
+		parser.Fail(fmt.Sprintf("--follow-up doesn't work with --auth-key"))
+	}
+	res.FollowUp = args.FollowUp
+	if args.AuthKey != "" && args.Location == true {
+		parser.Fail(fmt.Sprintf("--location-tlv doesn't work with --auth-key"))
+	}
+	res.LocationTLV = args.Location
+	if args.AuthKey != "" && args.TSInfo == true {
+		parser.Fail(fmt.Sprintf("--timestamp-info doesn't work with --auth-key"))
+	}
+	res.TimestampInfo = args.TSInfo
+	// userspace would answer them regardless
+	if args.AuthKey != "" && args.Passive == true {
+		parser.Fail(fmt.Sprintf("--passive doesn't work with --auth-key"))
+	}
+	res.Passive = args.Passive
+	// both say which port the reply leaves from, userspace replies from its socket
+	if args.KeepPorts == true && args.Sport != nil {
+		parser.Fail(fmt.Sprintf("--keep-ports doesn't work with --reflect-sport"))
+	}
+	if args.KeepPorts == true && args.AuthKey != "" {
+		parser.Fail(fmt.Sprintf("--keep-ports doesn't work with --auth-key"))
+	}
+	res.KeepPorts = args.KeepPorts
+	// a zero checksum means none only for IPv4(RFC 768), IPv6 receivers drop it(RFC 8200 8.1)
+	if args.ZeroCsum == true && (args.DualStack == true || res.Localaddr.To4() == nil) {
+		parser.Fail(fmt.Sprintf("--zero-udp-csum is IPv4 only, it doesn't work with IPv6 or --dual-stack"))
+	}
+	res.ZeroUDPCsum = args.ZeroCsum
+	res.ReplaceAttached = args.Replace
+	res.Capture = args.Capture
+	res.CapturePath = args.CapPath
+	if args.Queues < 0 {
+		parser.Fail(fmt.Sprintf("Invalid --queues %d: can't be negative", args.Queues))
+	}
+	res.Queues = args.Queues
+	res.MaxReplyPPS = args.MaxPPS
+	if args.TAIOffset < 0 {
+		parser.Fail(fmt.Sprintf("Invalid TAI offset %d: can't be negative", args.TAIOffset))
+	}
+	res.TAIOffset = args.TAIOffset
+	res.DualStack = args.DualStack
+	res.StatsPinPath = args.StatsPin
+	res.HWTimestamps = args.HWTstamps
+	res.VLANAware = args.VLAN
 	res.Sync = args.Sync
 	res.PTP = args.PTP
 
@@ -169,3 +503,81 @@ func ParseReflectorArgs() stamp.Args {
 
 	return res
 }
+
+// takes an IP or a hostname, it has to be the same IP version as the session
+// a hostname resolves to its first address of that version
+func resolveTarget(target string, v6 bool) (net.IP, error) {
+	family, network := "IPv4", "ip4"
+	if v6 == true {
+		family, network = "IPv6", "ip6"
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		if (ip.To4() == nil) != v6 {
+			return nil, fmt.Errorf("Can't use %s: the session is %s(pick the local address with --local-addr)", target, family)
+		}
+		if v6 == true {
+			return ip.To16(), nil
+		}
+		return ip.To4(), nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), network, target)
+	if err != nil {
+		return nil, fmt.Errorf("Can't resolve %s to %s: %w", target, family, err)
+	}
+	if v6 == true {
+		return ips[0].To16(), nil
+	}
+	return ips[0].To4(), nil
+}
+
+// the address given with --local-addr, or the interface's first one
+func localAddr(iface *net.Interface, local string) (net.IP, error) {
+	if local != "" {
+		ip := net.ParseIP(local)
+		if ip == nil {
+			return nil, fmt.Errorf("Can't parse local address: %s", local)
+		}
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		return ip, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil || len(addrs) == 0 {
+		return nil, fmt.Errorf("Failed to fetch local IP: %v", err)
+	}
+	ip, _, err := net.ParseCIDR(addrs[0].String())
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Failed to fetch local IP: %v", err)
+	}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	return ip, nil
+}
+
+// there's no point paying for a verifier log nobody's going to see
+func verifierLogLevel(level *uint32, debug bool) (uint32, error) {
+	if level == nil {
+		if debug == true {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if *level > 2 {
+		return 0, fmt.Errorf("--verifier-log-level has to be 0, 1 or 2")
+	}
+	// the logs only get printed at debug level
+	if *level > 0 && debug == false {
+		return 0, fmt.Errorf("--verifier-log-level needs --debug, that's where the logs get printed")
+	}
+	return *level, nil
+}
+
+// falls back to a time-based seed when none was given
+func parseSeed(seed *uint64) uint64 {
+	if seed != nil {
+		return *seed
+	}
+	return uint64(time.Now().UnixNano())
+}
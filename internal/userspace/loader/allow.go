@@ -0,0 +1,31 @@
+package loader
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+)
+
+// LPM trie keys go the same way load_raddr() in stamp.bpf.h has addresses: IPv4 is mapped into IPv6 so its prefix is 96 bits longer
+func allowKey(n *net.IPNet) reflector.ReflectorAllowKey {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	var key reflector.ReflectorAllowKey
+	key.Prefixlen = uint32(ones)
+	copy(key.Addr[:], n.IP.To16())
+	return key
+}
+
+func fillAllowed(m *ebpf.Map, nets []*net.IPNet) error {
+	for _, n := range nets {
+		key := allowKey(n)
+		if err := m.Put(&key, uint8(1)); err != nil {
+			return fmt.Errorf("Error adding %s to the allowed senders: %w", n, err)
+		}
+	}
+	return nil
+}
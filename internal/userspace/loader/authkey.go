@@ -0,0 +1,25 @@
+package loader
+
+import (
+	"fmt"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// RotateAuthKey switches the running session to a new authenticated mode key, the old one is still accepted for stamp.AuthKeyGrace.
+// The key lives in userspace only, BPF just knows the packets are authenticated, so nothing gets reloaded
+func (s senderFD) RotateAuthKey(newKey []byte) error {
+	return rotateAuthKey(s.args, newKey)
+}
+
+// RotateAuthKey switches the running session to a new key, see senderFD.RotateAuthKey; rotate the reflector before its senders
+func (s reflectorFD) RotateAuthKey(newKey []byte) error {
+	return rotateAuthKey(s.args, newKey)
+}
+
+func rotateAuthKey(args stamp.Args, newKey []byte) error {
+	if len(args.AuthKey) == 0 {
+		return fmt.Errorf("Can't rotate the auth key: not loaded in authenticated mode")
+	}
+	return stamp.RotateAuthKey(newKey)
+}
@@ -0,0 +1,155 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// how much of a frame the programs copy out with stamp.Args.Capture, the pcap's snaplen
+// KEEP IN SYNC with CAPTURE_LEN in stamp.bpf.h
+const captureLen = 256
+
+// DumpPackets writes the frames stamp.Args.Capture had the programs copy out to w as a pcap file: probes as they leave and
+// replies as they come in, every interface's in the order they got to the ring. It stops at n of them or once ctx is done,
+// whatever's in the ring by then still goes in, and returns how many it wrote. Frames are cut off at 256 bytes
+func (s senderFD) DumpPackets(ctx context.Context, n int, w io.Writer) (int, error) {
+	return dumpPackets(ctx, s.Objs.Captures, n, w)
+}
+
+// DumpPackets is the same as the sender's, only it's requests as they come in and replies as they leave(T3 and all)
+func (s reflectorFD) DumpPackets(ctx context.Context, n int, w io.Writer) (int, error) {
+	return dumpPackets(ctx, s.Objs.Captures, n, w)
+}
+
+// a ringbuf can't be empty, without --capture it only costs a page
+func shrinkCaptures(spec *ebpf.CollectionSpec, args stamp.Args) {
+	if args.Capture == 0 {
+		spec.Maps["captures"].MaxEntries = uint32(os.Getpagesize())
+	}
+}
+
+// PacketDumper is either handle's DumpPackets
+type PacketDumper interface {
+	DumpPackets(ctx context.Context, n int, w io.Writer) (int, error)
+}
+
+// DumpPacketsFile is DumpPackets into a new file at path
+func DumpPacketsFile(ctx context.Context, d PacketDumper, n int, path string) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("Error creating capture file: %w", err)
+	}
+	bw := bufio.NewWriter(f)
+	written, err := d.DumpPackets(ctx, n, bw)
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return written, err
+}
+
+func dumpPackets(ctx context.Context, m *ebpf.Map, n int, w io.Writer) (int, error) {
+	rd, err := ringbuf.NewReader(m)
+	if err != nil {
+		return 0, fmt.Errorf("Error opening captures ringbuf: %w", err)
+	}
+	defer rd.Close()
+	if err := writePcapHeader(w); err != nil {
+		return 0, err
+	}
+	// the frames are stamped on the TAI clock, pcap goes by UTC
+	offset := taiOffset()
+	// Read only gives up on a flush once it's handed out what's already there
+	stop := context.AfterFunc(ctx, func() { rd.Flush() })
+	defer stop()
+	written := 0
+	for written < n {
+		record, err := rd.Read()
+		if errors.Is(err, ringbuf.ErrFlushed) == true {
+			return written, nil
+		} else if err != nil {
+			return written, fmt.Errorf("Error reading captures ringbuf: %w", err)
+		}
+		rec, err := decodeCapture(record.RawSample)
+		if err != nil {
+			return written, err
+		}
+		if err := writePcapRecord(w, rec, offset); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// struct capture_rec is the same for both roles
+func decodeCapture(sample []byte) (sender.SenderCaptureRec, error) {
+	var rec sender.SenderCaptureRec
+	if size := binary.Size(rec); len(sample) != size {
+		return rec, fmt.Errorf("Capture is %d bytes, want %d", len(sample), size)
+	}
+	if err := binary.Read(bytes.NewReader(sample), binary.LittleEndian, &rec); err != nil {
+		return rec, err
+	}
+	if rec.Caplen > captureLen || rec.Caplen > rec.Len {
+		return rec, fmt.Errorf("Capture says it has %d bytes of a %d byte frame, it can only have up to %d", rec.Caplen, rec.Len, captureLen)
+	}
+	return rec, nil
+}
+
+// what CLOCK_TAI is ahead of CLOCK_REALTIME, 0 when the kernel doesn't know(see checkTAI)
+func taiOffset() time.Duration {
+	var tai, utc unix.Timespec
+	unix.ClockGettime(unix.CLOCK_TAI, &tai)
+	unix.ClockGettime(unix.CLOCK_REALTIME, &utc)
+	return time.Duration(tai.Sec-utc.Sec) * time.Second
+}
+
+// classic pcap with nanosecond timestamps, everything we attach to has the ethernet header in front
+const (
+	pcapMagicNanos   = 0xa1b23c4d
+	pcapLinkEthernet = 1
+)
+
+func writePcapHeader(w io.Writer) error {
+	hdr := struct {
+		Magic         uint32
+		Major, Minor  uint16
+		Zone, SigFigs int32
+		SnapLen, Link uint32
+	}{pcapMagicNanos, 2, 4, 0, 0, captureLen, pcapLinkEthernet}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return fmt.Errorf("Error writing pcap header: %w", err)
+	}
+	return nil
+}
+
+func writePcapRecord(w io.Writer, rec sender.SenderCaptureRec, offset time.Duration) error {
+	ts := time.Duration(rec.Ts) - offset
+	hdr := struct {
+		Sec, Nanos       uint32
+		InclLen, OrigLen uint32
+	}{uint32(ts / time.Second), uint32(ts % time.Second), rec.Caplen, rec.Len}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return fmt.Errorf("Error writing pcap record: %w", err)
+	}
+	if _, err := w.Write(rec.Data[:rec.Caplen]); err != nil {
+		return fmt.Errorf("Error writing pcap record: %w", err)
+	}
+	return nil
+}
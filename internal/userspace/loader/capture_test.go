@@ -0,0 +1,85 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+)
+
+// what tcpdump -r expects: the header once, then a record header in front of every frame
+func TestPcapFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePcapHeader(&buf); err != nil {
+		t.Fatalf("writePcapHeader() returned error: %v", err)
+	}
+	rec := sender.SenderCaptureRec{Ts: uint64(3*time.Second + 5), Len: 300, Caplen: 4}
+	copy(rec.Data[:], "abcd")
+	if err := writePcapRecord(&buf, rec, time.Second); err != nil {
+		t.Fatalf("writePcapRecord() returned error: %v", err)
+	}
+	b := buf.Bytes()
+	if len(b) != 24+16+4 {
+		t.Fatalf("got %d bytes, want %d", len(b), 24+16+4)
+	}
+	le := binary.LittleEndian
+	if le.Uint32(b) != pcapMagicNanos || le.Uint32(b[16:]) != captureLen || le.Uint32(b[20:]) != pcapLinkEthernet {
+		t.Errorf("header is %x, want nanosecond pcap of ethernet with snaplen %d", b[:24], captureLen)
+	}
+	// TAI goes back to UTC
+	if sec, ns := le.Uint32(b[24:]), le.Uint32(b[28:]); sec != 2 || ns != 5 {
+		t.Errorf("record is at %d.%09d, want 2.000000005", sec, ns)
+	}
+	if incl, orig := le.Uint32(b[32:]), le.Uint32(b[36:]); incl != 4 || orig != 300 {
+		t.Errorf("record has %d of %d bytes, want 4 of 300", incl, orig)
+	}
+	if string(b[40:]) != "abcd" {
+		t.Errorf("record has %q, want %q", b[40:], "abcd")
+	}
+	// anything that isn't exactly a capture_rec is an error
+	if _, err := decodeCapture(make([]byte, 3)); err == nil {
+		t.Errorf("decodeCapture() = nil error for a short sample")
+	}
+}
+
+// only the first Capture requests go in the ring
+func TestDumpPackets(t *testing.T) {
+	objs := newTestReflector(t)
+	laddr, snd := testAddrs()
+	objs.Capture.Set(uint32(2))
+
+	var reqs [][]byte
+	for seq := range uint32(3) {
+		req := stampRequest(snd, laddr, 40000, 862)
+		binary.BigEndian.PutUint32(req[42:], seq)
+		reqs = append(reqs, req)
+		out := make([]byte, len(req))
+		if _, err := objs.ReflectorIn.Run(&ebpf.RunOptions{Data: req, DataOut: out}); err != nil {
+			t.Fatalf("Error running reflector_in: %v", err)
+		}
+	}
+	// nothing else is coming, it only takes what's there
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	n, err := reflectorFD{Objs: *objs}.DumpPackets(ctx, 5, &buf)
+	if err != nil {
+		t.Fatalf("DumpPackets() returned error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("DumpPackets() wrote %d frames, want 2", n)
+	}
+	// the requests as they came in
+	b := buf.Bytes()[24:]
+	for i := range 2 {
+		size := int(binary.LittleEndian.Uint32(b[8:]))
+		if frame := b[16 : 16+size]; bytes.Equal(frame, reqs[i]) == false {
+			t.Errorf("frame %d is %x, want %x", i, frame, reqs[i])
+		}
+		b = b[16+size:]
+	}
+}
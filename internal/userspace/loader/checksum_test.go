@@ -0,0 +1,103 @@
+package loader
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// ones' complement sum of the pseudo-header and the UDP header and payload, 0xffff means the checksum in there is right
+func udpChecksumSum(pkt []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	var udp []byte
+	if binary.BigEndian.Uint16(pkt[12:]) == 0x0800 {
+		add(pkt[26:34])
+		udp = pkt[34:]
+	} else {
+		add(pkt[22:54])
+		udp = pkt[54:]
+	}
+	sum += 17 + uint32(len(udp))
+	add(udp)
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+// requests come in with a good checksum and replies have to go out with one
+func TestReplyChecksum(t *testing.T) {
+	objs := newTestReflector(t)
+	laddr, peer := testAddrs()
+	laddr6, peer6 := testAddrs6()
+	setDualStack(objs.Laddr, objs.Laddr6, objs.IpFamily, objs.DualStack, laddr, laddr6)
+
+	tests := []struct {
+		name      string
+		src, dst  net.IP
+		sport     uint16
+		mode      uint16 // 1 is stateful
+		zero      uint16
+		wantCheck bool
+	}{
+		{name: "IPv4", src: peer, dst: laddr, wantCheck: true},
+		{name: "IPv6", src: peer6, dst: laddr6, wantCheck: true},
+		{name: "IPv4 stateful from another port", src: peer, dst: laddr, sport: 40001, mode: 1, wantCheck: true},
+		{name: "IPv6 stateful from another port", src: peer6, dst: laddr6, sport: 40001, mode: 1, wantCheck: true},
+		{name: "IPv4 zeroed", src: peer, dst: laddr, zero: 1},
+		// IPv6 has to have one regardless
+		{name: "IPv6 zeroed", src: peer6, dst: laddr6, zero: 1, wantCheck: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs.ReplySport.Set(tt.sport)
+			objs.ReflMode.Set(tt.mode)
+			objs.ZeroCsum.Set(tt.zero)
+			req := stampRequest(tt.src, tt.dst, 40000, 862)
+			udp := 34
+			if tt.src.To4() == nil {
+				udp = 54
+			}
+			// T1 and the sender's seq, so there's something for the reflector to move around
+			binary.BigEndian.PutUint32(req[udp+8:], 12345)
+			binary.BigEndian.PutUint64(req[udp+12:], 0x0123456789abcdef)
+			binary.BigEndian.PutUint16(req[udp+6:], ^udpChecksumSum(req))
+			if got := udpChecksumSum(req); got != 0xffff {
+				t.Fatalf("request checksum sums to %#04x, the test's broken", got)
+			}
+
+			out := make([]byte, len(req))
+			ret, err := objs.ReflectorIn.Run(&ebpf.RunOptions{Data: req, DataOut: out})
+			if err != nil {
+				t.Fatalf("Error running reflector_in: %v", err)
+			}
+			if ret != tcxRedirect {
+				t.Fatalf("reflector_in returned %d, want %d(reflected)", ret, tcxRedirect)
+			}
+			reply := make([]byte, len(out))
+			if _, err := objs.ReflectorOut.Run(&ebpf.RunOptions{Data: out, DataOut: reply}); err != nil {
+				t.Fatalf("Error running reflector_out: %v", err)
+			}
+			check := binary.BigEndian.Uint16(reply[udp+6:])
+			if tt.wantCheck == false {
+				if check != 0 {
+					t.Errorf("reply checksum is %#04x, want 0", check)
+				}
+				return
+			}
+			if got := udpChecksumSum(reply); check == 0 || got != 0xffff {
+				t.Errorf("reply checksum %#04x sums to %#04x, want 0xffff", check, got)
+			}
+		})
+	}
+}
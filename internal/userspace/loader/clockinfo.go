@@ -0,0 +1,108 @@
+package loader
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SyncSource is what a clock is synced to, as the Timestamp Information TLV(RFC 8972 4.3) has it
+// KEEP IN SYNC with SYNC_* in stamp.bpf.h
+type SyncSource uint8
+
+const (
+	// not synced, or left out; the registry has nothing for a free-running clock so that's what goes on the wire for one
+	SyncNone SyncSource = iota
+	// NTP, chrony and ntpd alike
+	SyncNTP
+	// PTP, ptp4l and phc2sys
+	SyncPTP
+)
+
+func (s SyncSource) String() string {
+	switch s {
+	case SyncNone:
+		return "none"
+	case SyncNTP:
+		return "NTP"
+	case SyncPTP:
+		return "PTP"
+	}
+	return fmt.Sprintf("SyncSource(%d)", uint8(s))
+}
+
+// TimestampMethod is how a timestamp was taken, same registry
+// KEEP IN SYNC with TS_HW_ASSIST and TS_SW_LOCAL in stamp.bpf.h
+type TimestampMethod uint8
+
+const (
+	// left out
+	MethodNone TimestampMethod = iota
+	// the NIC's
+	MethodHardware
+	// the kernel's, which is how we take ours
+	MethodSoftware
+	// by the control plane
+	MethodControlPlane
+)
+
+func (m TimestampMethod) String() string {
+	switch m {
+	case MethodNone:
+		return "none"
+	case MethodHardware:
+		return "hardware"
+	case MethodSoftware:
+		return "software"
+	case MethodControlPlane:
+		return "control plane"
+	}
+	return fmt.Sprintf("TimestampMethod(%d)", uint8(m))
+}
+
+// TimestampInfo is the reflector's Timestamp Information TLV(--timestamp-info): its clock and how it took T2(In) and T3(Out)
+type TimestampInfo struct {
+	SyncIn, SyncOut           SyncSource
+	TimestampIn, TimestampOut TimestampMethod
+}
+
+// Valid is false when we didn't ask for it or the reflector doesn't support it
+func (t TimestampInfo) Valid() bool {
+	return t.TimestampIn != MethodNone || t.TimestampOut != MethodNone
+}
+
+// ClockInfo is what the loader found out about the local clock
+type ClockInfo struct {
+	Source SyncSource
+	// what the sync daemon(chrony, ntpd, phc2sys) last told the kernel: the offset it's still slewing away...
+	Offset time.Duration
+	// ...and the most the clock can be off, root dispersion plus half the root delay for NTP; grows while nobody syncs it
+	MaxError time.Duration
+	// the TAI-UTC offset came from the kernel or --tai-offset; false means the kernel has none and we're assuming the current one,
+	// our timestamps go out without the Synced() bit then since one-way delays off them can't be trusted
+	TAIKnown bool
+}
+
+func (c clocks) info() ClockInfo {
+	info := ClockInfo{Offset: c.offset, MaxError: c.maxErr, TAIKnown: c.taiKnown}
+	if c.ptp == true {
+		info.Source = SyncPTP
+	} else if c.synced == true {
+		info.Source = SyncNTP
+	}
+	return info
+}
+
+// offset and max error straight off adjtimex(), whatever the SyncChecker is - the kernel's the only one who'd know
+func readAdjtimex() (offset, maxErr time.Duration, err error) {
+	var t unix.Timex
+	if _, err := unix.Adjtimex(&t); err != nil {
+		return 0, 0, fmt.Errorf("Error getting adjtimex(): %w", err)
+	}
+	offset = time.Duration(t.Offset)
+	if t.Status&staNano == 0 {
+		offset *= time.Microsecond
+	}
+	return offset, time.Duration(t.Maxerror) * time.Microsecond, nil
+}
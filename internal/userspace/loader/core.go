@@ -0,0 +1,58 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// bpf2go embeds an object for every target in internal/bpf/gen.go behind build tags, so the one for runtime.GOARCH is the one
+// that gets compiled in - a Go binary is single-arch anyway, a mixed cluster takes one build per arch(make binaries ARCH=arm64)
+// the objects carry BTF for their maps and globals but have no CO-RE relocations, so the kernel's own BTF only comes into it
+// when something in the load needs it; when that fails on a kernel without it the library error doesn't tell you much so we spell it out
+func loadError(err error) error {
+	if perr := privilegeError(err); perr != err {
+		return fmt.Errorf("Error loading programs: %w", perr)
+	}
+	if btfError(err) == true {
+		if _, kerr := btf.LoadKernelSpec(); kerr != nil {
+			return fmt.Errorf("Error loading programs: the embedded %s object needs the kernel's BTF(CONFIG_DEBUG_INFO_BTF) which isn't there(%v): %w", runtime.GOARCH, kerr, err)
+		}
+	}
+	// *ebpf.VerifierError stays in the chain so the caller can get the full log out of it
+	return fmt.Errorf("Error loading programs: %w", err)
+}
+
+// the library saying BTF isn't supported, or the verifier complaining about it
+func btfError(err error) bool {
+	if errors.Is(err, btf.ErrNotSupported) == true {
+		return true
+	}
+	var verr *ebpf.VerifierError
+	if errors.As(err, &verr) == false {
+		return false
+	}
+	for _, line := range verr.Log {
+		if strings.Contains(line, "BTF") == true {
+			return true
+		}
+	}
+	return false
+}
+
+// kernels before 5.11 charge maps to RLIMIT_MEMLOCK, which is usually too low for ours; newer ones account them to the memory cgroup
+// and rlimit leaves the limit alone there. Once per process is enough, the limit's process-wide
+var memlockOnce = sync.OnceValue(rlimit.RemoveMemlock)
+
+func removeMemlock() error {
+	if err := memlockOnce(); err != nil {
+		return fmt.Errorf("%w, raising the locked memory limit this kernel charges BPF maps to needs CAP_SYS_RESOURCE(or ulimit -l unlimited beforehand): %w", ErrInsufficientPrivileges, err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+func TestBTFError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "not supported", err: fmt.Errorf("load: %w", btf.ErrNotSupported), want: true},
+		{name: "verifier on BTF", err: fmt.Errorf("load: %w", &ebpf.VerifierError{Cause: errors.New("permission denied"), Log: []string{"0: R1=ctx()", "invalid BTF type"}}), want: true},
+		{name: "verifier on something else", err: &ebpf.VerifierError{Cause: errors.New("permission denied"), Log: []string{"R0 !read_ok"}}},
+		{name: "anything else", err: errors.New("map create: invalid argument")},
+	}
+	for _, tt := range tests {
+		if got := btfError(tt.err); got != tt.want {
+			t.Errorf("%s: btfError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
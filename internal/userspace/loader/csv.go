@@ -0,0 +1,59 @@
+package loader
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+var csvHeader = []string{"seq", "t1", "t2", "t3", "t4", "rtt_ns", "oneway_fwd_ns", "oneway_rev_ns", "src", "dst", "ipdv_ns"}
+
+// WriteCSV writes a header and then a row for every event until the channel is closed, e.g. the one Events() returns.
+// Timestamps are unix ns. The one-way cells are left empty unless both clocks said they were synced(the S bit of
+// ReflectorError and of SenderError as the reflector echoed it back), a reflector that leaves the Error Estimate out never gets them.
+// ipdv_ns is the RTT's RFC 3393 IPDV against the session's previous seq, empty on the first reply, after a lost one and for a reply
+// that came after a later seq(IPDV is undefined across a reorder); it's signed, an RTT going down comes out negative.
+// Every row is flushed as it's written so the file can be followed
+func WriteCSV(w io.Writer, events <-chan StampEvent) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	cw.Flush()
+	ipdv := make(ipdvTracker)
+	for ev := range events {
+		cw.Write(append(csvRow(ev), ipdv.next(ev)))
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	return cw.Error()
+}
+
+func csvRow(ev StampEvent) []string {
+	// the clocks can be off by more than the latency so these can come out negative
+	ns := func(a, b uint64) string { return strconv.FormatInt(int64(a-b), 10) }
+	ts := func(t uint64) string { return strconv.FormatUint(t, 10) }
+	var fwd, rev string
+	if ev.SenderError.Synced() == true && ev.ReflectorError.Synced() == true {
+		fwd, rev = ns(ev.T2, ev.T1), ns(ev.T4, ev.T3)
+	}
+	return []string{strconv.FormatUint(uint64(ev.Seq), 10), ts(ev.T1), ts(ev.T2), ts(ev.T3), ts(ev.T4), ns(ev.T4, ev.T1), fwd, rev, ev.Src.String(), ev.Dst.String()}
+}
+
+// the highest seq of every session so far and its RTT
+type ipdvTracker map[SessionKey]sessionSample
+
+func (t ipdvTracker) next(ev StampEvent) string {
+	key := SessionKey{Addr: ev.Dst, Port: ev.DstPort}
+	rtt := time.Duration(int64(ev.T4 - ev.T1))
+	prev, ok := t[key]
+	if ok == true && int32(ev.Seq-prev.seq) <= 0 {
+		return ""
+	}
+	t[key] = sessionSample{seq: ev.Seq, rtt: rtt}
+	if ok == false || ev.Seq != prev.seq+1 {
+		return ""
+	}
+	return strconv.FormatInt(int64(rtt-prev.rtt), 10)
+}
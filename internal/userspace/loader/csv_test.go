@@ -0,0 +1,77 @@
+package loader
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+func TestWriteCSV(t *testing.T) {
+	synced, unsynced := stamp.NewErrorEstimate(time.Microsecond, true), stamp.NewErrorEstimate(time.Microsecond, false)
+	src, dst := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::2")
+	base := StampEvent{Seq: 7, T1: 1000, T2: 1400, T3: 1500, T4: 2100, Src: src, Dst: dst}
+	tests := []struct {
+		name              string
+		sender, reflector stamp.ErrorEstimate
+		want              string
+	}{
+		{name: "both synced", sender: synced, reflector: synced, want: "7,1000,1400,1500,2100,1100,400,600,192.0.2.1,2001:db8::2,\n"},
+		{name: "reflector unsynced", sender: synced, reflector: unsynced, want: "7,1000,1400,1500,2100,1100,,,192.0.2.1,2001:db8::2,\n"},
+		{name: "no error estimate", want: "7,1000,1400,1500,2100,1100,,,192.0.2.1,2001:db8::2,\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := base
+			ev.SenderError, ev.ReflectorError = tt.sender, tt.reflector
+			ch := make(chan StampEvent, 1)
+			ch <- ev
+			close(ch)
+			var buf bytes.Buffer
+			if err := WriteCSV(&buf, ch); err != nil {
+				t.Fatalf("WriteCSV() returned error: %v", err)
+			}
+			want := "seq,t1,t2,t3,t4,rtt_ns,oneway_fwd_ns,oneway_rev_ns,src,dst,ipdv_ns\n" + tt.want
+			if buf.String() != want {
+				t.Errorf("WriteCSV() wrote\n%s\nwant\n%s", buf.String(), want)
+			}
+		})
+	}
+}
+
+// the clocks being off shouldn't wrap around to a huge number
+func TestCSVRowNegative(t *testing.T) {
+	synced := stamp.NewErrorEstimate(time.Microsecond, true)
+	row := csvRow(StampEvent{T1: 1000, T2: 900, T3: 950, T4: 1200, SenderError: synced, ReflectorError: synced})
+	if row[6] != "-100" || row[7] != "250" {
+		t.Errorf("csvRow() one-way = %s, %s; want -100, 250", row[6], row[7])
+	}
+}
+
+// seq 2 comes after 3 and 5 after a lost 4, neither has an IPDV; other sessions keep their own
+func TestCSVIPDV(t *testing.T) {
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	tests := []struct {
+		dst  netip.Addr
+		seq  uint32
+		rtt  uint64
+		want string
+	}{
+		{dst: a, seq: 0, rtt: 1000, want: ""},
+		{dst: a, seq: 1, rtt: 1500, want: "500"},
+		{dst: b, seq: 2, rtt: 9000, want: ""},
+		{dst: a, seq: 3, rtt: 1200, want: ""},
+		{dst: a, seq: 2, rtt: 1100, want: ""},
+		{dst: a, seq: 5, rtt: 1300, want: ""},
+		{dst: a, seq: 6, rtt: 1000, want: "-300"},
+		{dst: b, seq: 3, rtt: 9100, want: "100"},
+	}
+	ipdv := make(ipdvTracker)
+	for _, tt := range tests {
+		if got := ipdv.next(StampEvent{Seq: tt.seq, T1: 1000, T4: 1000 + tt.rtt, Dst: tt.dst, DstPort: 862}); got != tt.want {
+			t.Errorf("IPDV of %v seq %d = %q, want %q", tt.dst, tt.seq, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// how often Drain looks at the counters, and how long it waits for the next reply when the session has nothing to go by
+const (
+	drainPoll         = 10 * time.Millisecond
+	drainDefaultQuiet = 100 * time.Millisecond
+)
+
+// Drain stops any more probes from going out(whatever userspace still sends gets dropped by BPF), waits up to timeout for
+// the replies to the ones already out to come in and then detaches like Detach(error or not), so they don't get counted as lost. It's done
+// early once every probe that was out is accounted for: its reply came in, or nothing came in for the session's timeout(or interval,
+// whichever's longer) and it's lost anyway. Returns how many replies came in meanwhile, they show up in Stats() and Events()
+// like any other. Authenticated replies go to userspace and aren't counted here; a handle reopened from pins can't be stopped,
+// it only gets detached
+func (s senderFD) Drain(timeout time.Duration) (uint64, error) {
+	defer s.Detach()
+	before, err := s.stop()
+	if err != nil {
+		return 0, err
+	}
+	return s.waitLate(before, timeout, drainQuiet(s.args.Interval, s.args.Timeout))
+}
+
+// a reply later than the session's timeout doesn't count, and one can't come in sooner than an interval after the last
+func drainQuiet(interval, timeout time.Duration) time.Duration {
+	quiet := max(interval, timeout)
+	if quiet == 0 {
+		return drainDefaultQuiet
+	}
+	return quiet
+}
+
+// stop sets Stopped everywhere and returns the counters as of then
+func (s senderFD) stop() (Stats, error) {
+	// globals can't be reopened from pins, there's no stopping those
+	if s.Objs.Stopped == nil {
+		return Stats{}, errors.New("Can't drain a handle reopened from pins")
+	}
+	for _, o := range s.allObjs() {
+		if err := o.Stopped.Set(uint16(1)); err != nil {
+			return Stats{}, fmt.Errorf("Error stopping probes: %w", err)
+		}
+	}
+	return s.Stats()
+}
+
+// waitLate counts the replies that came in since before until there's none outstanding, nothing came in for quiet
+// or timeout is up
+func (s senderFD) waitLate(before Stats, timeout, quiet time.Duration) (uint64, error) {
+	var outstanding uint64
+	if answered := before.PacketsReflected + before.PacketsDropped; before.PacketsSent > answered {
+		outstanding = before.PacketsSent - answered
+	}
+	last, lastAt := before.PacketsReflected, time.Now()
+	deadline := lastAt.Add(timeout)
+	for last-before.PacketsReflected < outstanding && time.Now().Before(deadline) && time.Since(lastAt) < quiet {
+		time.Sleep(drainPoll)
+		st, err := s.Stats()
+		if err != nil {
+			return last - before.PacketsReflected, err
+		}
+		if st.PacketsReflected != last {
+			last, lastAt = st.PacketsReflected, time.Now()
+		}
+	}
+	return last - before.PacketsReflected, nil
+}
@@ -0,0 +1,89 @@
+package loader
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestDrainFromPins(t *testing.T) {
+	if _, err := (senderFD{}).Drain(time.Second); err == nil {
+		t.Errorf("Drain() = nil error on a handle without globals")
+	}
+}
+
+func TestDrainQuiet(t *testing.T) {
+	tests := []struct {
+		interval, timeout, want time.Duration
+	}{
+		{interval: time.Second, timeout: 2 * time.Second, want: 2 * time.Second},
+		{interval: 3 * time.Second, timeout: 2 * time.Second, want: 3 * time.Second},
+		{want: drainDefaultQuiet},
+	}
+	for _, tt := range tests {
+		if got := drainQuiet(tt.interval, tt.timeout); got != tt.want {
+			t.Errorf("drainQuiet(%v, %v) = %v, want %v", tt.interval, tt.timeout, got, tt.want)
+		}
+	}
+}
+
+// a reply that comes in while draining and a probe that doesn't go out
+func TestDrain(t *testing.T) {
+	snd := newTestSender(t)
+	// the reflector's the remote end
+	us, them := testAddrs()
+	refl := newTestReflector(t)
+	setLocalAddr(refl.Laddr, refl.Laddr6, refl.IpFamily, them)
+	run := func(prog *ebpf.Program, pkt []byte) ([]byte, uint32) {
+		out := make([]byte, len(pkt))
+		ret, err := prog.Run(&ebpf.RunOptions{Data: pkt, DataOut: out})
+		if err != nil {
+			t.Fatalf("Error running %v: %v", prog, err)
+		}
+		return out, ret
+	}
+	// two out before the drain, one back during it
+	var replies [][]byte
+	for seq := range uint32(2) {
+		probe := stampRequest(us, them, 862, 862)
+		binary.BigEndian.PutUint32(probe[42:], seq)
+		out, _ := run(snd.SenderOut, probe)
+		reply, _ := run(refl.ReflectorIn, out)
+		reply, _ = run(refl.ReflectorOut, reply)
+		replies = append(replies, reply)
+	}
+
+	fd := senderFD{Objs: *snd}
+	before, err := fd.stop()
+	if err != nil {
+		t.Fatalf("stop() returned error: %v", err)
+	}
+	if _, ret := run(snd.SenderOut, stampRequest(us, them, 862, 862)); ret != tcxDrop {
+		t.Errorf("sender_out returned %d while draining, want %d(dropped)", ret, tcxDrop)
+	}
+	run(snd.SenderIn, replies[0])
+	// the other one's still out, nothing to go by but quiet
+	const quiet = 50 * time.Millisecond
+	start := time.Now()
+	late, err := fd.waitLate(before, 5*time.Second, quiet)
+	if err != nil {
+		t.Fatalf("waitLate() returned error: %v", err)
+	}
+	if late != 1 {
+		t.Errorf("waitLate() = %d late replies, want 1", late)
+	}
+	if took := time.Since(start); took < quiet {
+		t.Errorf("waitLate() gave up after %v with a probe still out, want at least %v", took, quiet)
+	}
+	// once it's in there's nothing to wait for
+	run(snd.SenderIn, replies[1])
+	start = time.Now()
+	if late, err := fd.waitLate(before, 5*time.Second, time.Hour); err != nil || late != 2 {
+		t.Errorf("waitLate() = %d, %v with every reply in, want 2", late, err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("waitLate() took %v with every reply in, want it done right away", took)
+	}
+}
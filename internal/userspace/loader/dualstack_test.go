@@ -0,0 +1,44 @@
+package loader
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// one load answers both families
+func TestDualStackReflects(t *testing.T) {
+	objs := newTestReflector(t)
+	laddr, peer := testAddrs()
+	laddr6, peer6 := testAddrs6()
+	setDualStack(objs.Laddr, objs.Laddr6, objs.IpFamily, objs.DualStack, laddr, laddr6)
+
+	tests := []struct {
+		name     string
+		src, dst net.IP
+		// where the addresses sit in the reply
+		srcOff, dstOff, ipLen int
+	}{
+		{name: "IPv4", src: peer, dst: laddr, srcOff: 26, dstOff: 30, ipLen: 4},
+		{name: "IPv6", src: peer6, dst: laddr6, srcOff: 22, dstOff: 38, ipLen: 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := stampRequest(tt.src, tt.dst, 40000, 862)
+			out := make([]byte, len(pkt))
+			opts := ebpf.RunOptions{Data: pkt, DataOut: out}
+			ret, err := objs.ReflectorIn.Run(&opts)
+			if err != nil {
+				t.Fatalf("Error running reflector_in: %v", err)
+			}
+			if ret != tcxRedirect {
+				t.Fatalf("reflector_in returned %d, want %d(reflected)", ret, tcxRedirect)
+			}
+			if bytes.Equal(out[tt.srcOff:tt.srcOff+tt.ipLen], tt.dst) == false || bytes.Equal(out[tt.dstOff:tt.dstOff+tt.ipLen], tt.src) == false {
+				t.Errorf("reply goes %v -> %v, want %v -> %v", net.IP(out[tt.srcOff:tt.srcOff+tt.ipLen]), net.IP(out[tt.dstOff:tt.dstOff+tt.ipLen]), tt.dst, tt.src)
+			}
+		})
+	}
+}
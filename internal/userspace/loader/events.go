@@ -0,0 +1,183 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// StampEvent is a single reply the sender got back, timestamps are unix ns
+type StampEvent struct {
+	Seq            uint32
+	T1, T2, T3, T4 uint64
+	// T3-T2, how long the reflector held on to the probe: T2 is taken as it came in and T3 just before the reply left.
+	// Can come out negative with --hw-timestamps on the reflector if its NIC clock is off from the system's
+	ReflectorDelay time.Duration
+	Src, Dst       netip.Addr // us and the reflector
+	// the reflector's port, every reflector gets probed on the same one(stamp.Args.D_port); 0 on handles reopened from pins
+	DstPort uint16
+	// Follow-Up Telemetry(--follow-up): the reflector's previous reply and when it actually left, zero without it
+	FollowUpSeq uint32
+	FollowUpT3  uint64
+	// Location TLV(--location-tlv): us and the reflector the way the reflector saw the probe, invalid without it
+	// or if the reflector doesn't support it; anything NATing in between shows up as a difference from Src/Dst
+	LocationSrc, LocationDst netip.AddrPort
+	// where T4 came from, T1 is always the kernel's and T2/T3 are up to the reflector
+	T4Source TimestampSource
+	// Error Estimate(RFC 8762 4.2.1) of the reflector's timestamps and of ours as it echoed them back, not Valid() if it leaves them out
+	ReflectorError, SenderError stamp.ErrorEstimate
+	// Timestamp Information TLV(--timestamp-info): what the reflector's clock is synced to and how it took T2/T3, not Valid() without it
+	ReflectorClock TimestampInfo
+	// which reply this is out of every one the interface's programs matched since Events() was first called, from 0; with
+	// stamp.Args.SampleRate only every Nth of them is an event and the step between two says what N is. Every interface counts its own
+	EventSeq uint64
+}
+
+// TimestampSource is the clock a timestamp was taken off of
+// KEEP IN SYNC with enum ts_source in stamp.bpf.h
+type TimestampSource uint8
+
+const (
+	// bpf_ktime_get_tai_ns() as the program ran
+	TimestampKernel TimestampSource = iota
+	// the NIC's, with --hw-timestamps and only if it stamped the packet
+	TimestampHardware
+)
+
+func (t TimestampSource) String() string {
+	switch t {
+	case TimestampKernel:
+		return "kernel"
+	case TimestampHardware:
+		return "hardware"
+	}
+	return fmt.Sprintf("TimestampSource(%d)", uint8(t))
+}
+
+// how far the consumer can fall behind before the reader blocks, the ringbuf itself drops events when full
+const eventsBacklog = 1024
+
+// one per senderFD no matter how many times Events() is called
+type eventStream struct {
+	start, stop sync.Once
+	ch          chan StampEvent
+	rd          *ringbuf.Reader
+	quit, done  chan struct{}
+	logger      *slog.Logger
+	// the replies only say who sent them, this is what they were sent to
+	dport uint16
+}
+
+func newEventStream(logger *slog.Logger, dport int) *eventStream {
+	return &eventStream{ch: make(chan StampEvent, eventsBacklog), quit: make(chan struct{}), done: make(chan struct{}), logger: logger, dport: uint16(dport)}
+}
+
+// Events streams T1-T4 of every reply the sender programs see(every stamp.Args.SampleRate-th with that set, Stats still count them all),
+// the BPF side only starts pushing them on the first call. The channel is closed once the handle is closed.
+// Authenticated mode doesn't produce any since userspace handles the replies there
+func (s senderFD) Events() <-chan StampEvent {
+	s.events.start.Do(func() {
+		// reopened from pins, there's no flag to turn them on with
+		if s.Objs.EventsOn == nil {
+			s.events.logger.Warn("Events aren't available on a handle reopened from pins")
+			close(s.events.ch)
+			close(s.events.done)
+			return
+		}
+		rd, err := ringbuf.NewReader(s.Objs.Events)
+		if err != nil {
+			s.events.logger.Error("Error opening events ringbuf", "err", err)
+			close(s.events.ch)
+			close(s.events.done)
+			return
+		}
+		s.events.rd = rd
+		go s.events.read()
+		// every interface has its own copy of the flag
+		s.Objs.EventsOn.Set(uint16(1))
+		for _, o := range s.others {
+			o.EventsOn.Set(uint16(1))
+		}
+	})
+	return s.events.ch
+}
+
+func (e *eventStream) read() {
+	defer close(e.done)
+	defer close(e.ch)
+	for {
+		record, err := e.rd.Read()
+		if err != nil {
+			// ringbuf.ErrClosed once we're shut down
+			return
+		}
+		ev, err := decodeEvent(record.RawSample, e.dport)
+		if err != nil {
+			e.logger.Warn("Error parsing event", "err", err)
+			continue
+		}
+		select {
+		case e.ch <- ev:
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+// a struct event off the ringbuf, anything that isn't exactly one is an error rather than half an event
+func decodeEvent(sample []byte, dport uint16) (StampEvent, error) {
+	var raw sender.SenderEvent
+	if size := binary.Size(raw); len(sample) != size {
+		return StampEvent{}, fmt.Errorf("Event is %d bytes, want %d", len(sample), size)
+	}
+	if err := binary.Read(bytes.NewReader(sample), binary.LittleEndian, &raw); err != nil {
+		return StampEvent{}, err
+	}
+	ev := StampEvent{
+		Seq: raw.Seq,
+		T1:  raw.T1, T2: raw.T2, T3: raw.T3, T4: raw.T4,
+		ReflectorDelay: time.Duration(int64(raw.T3 - raw.T2)),
+		Src:            netip.AddrFrom16(raw.Saddr).Unmap(),
+		Dst:            netip.AddrFrom16(raw.Daddr).Unmap(),
+		DstPort:        dport,
+		FollowUpSeq:    raw.FuSeq,
+		FollowUpT3:     raw.FuT3,
+		T4Source:       TimestampSource(raw.T4Src),
+		ReflectorError: stamp.ErrorEstimate(raw.T3Err),
+		SenderError:    stamp.ErrorEstimate(raw.T1Err),
+		ReflectorClock: TimestampInfo{
+			SyncIn: SyncSource(raw.TsSyncIn), TimestampIn: TimestampMethod(raw.TsIn),
+			SyncOut: SyncSource(raw.TsSyncOut), TimestampOut: TimestampMethod(raw.TsOut),
+		},
+		EventSeq: raw.EventSeq,
+	}
+	if raw.LocDport != 0 {
+		ev.LocationSrc = netip.AddrPortFrom(netip.AddrFrom16(raw.LocSaddr).Unmap(), raw.LocSport)
+		ev.LocationDst = netip.AddrPortFrom(netip.AddrFrom16(raw.LocDaddr).Unmap(), raw.LocDport)
+	}
+	return ev, nil
+}
+
+// stops the reader and waits for it, has to happen before the ringbuf map goes away; safe on a zero senderFD and to call twice
+func (e *eventStream) close() {
+	if e == nil {
+		return
+	}
+	e.stop.Do(func() {
+		close(e.quit)
+		// never started, nothing to wait for
+		e.start.Do(func() { close(e.ch); close(e.done) })
+		if e.rd != nil {
+			e.rd.Close()
+		}
+		<-e.done
+	})
+}
@@ -0,0 +1,184 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"golang.org/x/sys/unix"
+)
+
+// the checks for_me and reflector_in do before they touch a request, in the same order and with the same sizes: IPv4 without options,
+// IPv6 without extension headers, an IP length that leaves exactly the base packet behind the UDP header. laddr is one family only,
+// like a reflector without --dual-stack. Gives where the STAMP packet starts
+func refParseRequest(frame []byte, laddr net.IP, port uint16, vlanAware bool) (int, bool) {
+	if len(frame) < 14 {
+		return 0, false
+	}
+	l2, proto := 14, binary.BigEndian.Uint16(frame[12:])
+	// same as l2len(): the ethertype of whatever comes after each tag, two tags at most
+	if vlanAware == true {
+		for _, off := range []int{12, 16} {
+			if len(frame) < off+2 || vlanTag(binary.BigEndian.Uint16(frame[off:])) == false {
+				break
+			}
+			l2 = off + 6
+		}
+		if len(frame) < l2 {
+			return 0, false
+		}
+		proto = binary.BigEndian.Uint16(frame[l2-2:])
+	}
+	v4 := laddr.To4()
+	var l3 int
+	var dst []byte
+	if v4 != nil {
+		l3 = 20
+		if len(frame) < l2+l3+8 || proto != unix.ETH_P_IP {
+			return 0, false
+		}
+		ip := frame[l2:]
+		if int(binary.BigEndian.Uint16(ip[2:])) != l3+8+44 || ip[9] != unix.IPPROTO_UDP {
+			return 0, false
+		}
+		dst = ip[16:20]
+	} else {
+		l3 = 40
+		if len(frame) < l2+l3+8 || proto != unix.ETH_P_IPV6 {
+			return 0, false
+		}
+		ip := frame[l2:]
+		if int(binary.BigEndian.Uint16(ip[4:])) != 8+44 || ip[6] != unix.IPPROTO_UDP {
+			return 0, false
+		}
+		dst = ip[24:40]
+		v4 = laddr.To16()
+	}
+	if bytes.Equal(dst, v4) == false || binary.BigEndian.Uint16(frame[l2+l3+2:]) != port {
+		return 0, false
+	}
+	// the IP header only says how long the packet is, reflector_in checks it's really there
+	off := l2 + l3 + 8
+	if len(frame) < off+44 {
+		return 0, false
+	}
+	return off, true
+}
+
+func vlanTag(proto uint16) bool {
+	return proto == unix.ETH_P_8021Q || proto == unix.ETH_P_8021AD
+}
+
+// the reference parser never reads out of bounds, and with the reflector programs loaded nothing it turns down gets reflected;
+// BPF only ever sees a frame if it's at least an ethernet header, the kernel won't test-run anything shorter
+func FuzzReflectorParse(f *testing.F) {
+	laddr, laddr6, peer := net.ParseIP("192.0.2.1").To4(), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.2").To4()
+	req := stampRequest(peer, laddr, 40000, 862)
+	f.Add(req, false, false)
+	f.Add(req[:len(req)-1], false, false)
+	f.Add(append(append([]byte{}, req...), 0), false, false)
+	f.Add(stampRequest(net.ParseIP("2001:db8::2"), laddr6, 40000, 862), true, false)
+	f.Add(tagged(req, [2]uint16{unix.ETH_P_8021Q, 100}), false, true)
+	f.Add(tagged(req, [2]uint16{unix.ETH_P_8021AD, 200}, [2]uint16{unix.ETH_P_8021Q, 300}), false, true)
+	f.Add(tagged(req, [2]uint16{unix.ETH_P_8021Q, 100})[:17], false, true)
+	f.Add([]byte{}, false, false)
+
+	// one set per family, the address is a global
+	var objs [2]*reflector.ReflectorObjects
+	for i, addr := range []net.IP{laddr, laddr6} {
+		var o reflector.ReflectorObjects
+		if err := reflector.LoadReflectorObjects(&o, nil); err != nil {
+			break
+		}
+		f.Cleanup(func() { o.Close() })
+		setLocalAddr(o.Laddr, o.Laddr6, o.IpFamily, addr)
+		o.S_port.Set(uint16(862))
+		objs[i] = &o
+	}
+
+	f.Fuzz(func(t *testing.T, frame []byte, v6, vlanAware bool) {
+		addr, o := laddr, objs[0]
+		if v6 == true {
+			addr, o = laddr6, objs[1]
+		}
+		off, ok := refParseRequest(frame, addr, 862, vlanAware)
+		if ok == true && off+44 > len(frame) {
+			t.Fatalf("refParseRequest() says the packet starts at %d in a %d byte frame", off, len(frame))
+		}
+		if o == nil || len(frame) < 14 {
+			return
+		}
+		if vlanAware == true {
+			o.VlanAware.Set(uint16(1))
+		} else {
+			o.VlanAware.Set(uint16(0))
+		}
+		// leaves the frame alone, the program writes into the copy
+		in := append([]byte{}, frame...)
+		ret, err := o.ReflectorIn.Run(&ebpf.RunOptions{Data: in, DataOut: make([]byte, len(in))})
+		if err != nil {
+			return
+		}
+		if ret == tcxRedirect && ok == false {
+			t.Errorf("reflector_in reflected %x, the reference parser turns it down", frame)
+		}
+	})
+}
+
+// whatever the ringbuf hands us, it's an event or an error
+func FuzzDecodeEvent(f *testing.F) {
+	size := binary.Size(sender.SenderEvent{})
+	f.Add(make([]byte, size))
+	f.Add(make([]byte, size-1))
+	f.Add(make([]byte, size+1))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, sample []byte) {
+		ev, err := decodeEvent(sample, 862)
+		if len(sample) != size {
+			if err == nil {
+				t.Errorf("decodeEvent() took a %d byte event, want %d", len(sample), size)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("decodeEvent() returned error: %v", err)
+		}
+		if ev.DstPort != 862 || ev.Seq != binary.LittleEndian.Uint32(sample) {
+			t.Errorf("decodeEvent() = %+v, want seq %d and port 862", ev, binary.LittleEndian.Uint32(sample))
+		}
+		if ev.EventSeq != binary.LittleEndian.Uint64(sample[size-8:]) {
+			t.Errorf("decodeEvent() has event seq %d, want the last 8 bytes' %d", ev.EventSeq, binary.LittleEndian.Uint64(sample[size-8:]))
+		}
+		if ev.ReflectorDelay != time.Duration(int64(ev.T3-ev.T2)) {
+			t.Errorf("decodeEvent() has a reflector delay of %v with T2 %d and T3 %d", ev.ReflectorDelay, ev.T2, ev.T3)
+		}
+	})
+}
+
+// the probe is always a well-formed frame for us, whatever the interface's MAC and address look like
+func FuzzHealthFrame(f *testing.F) {
+	f.Add([]byte{0x02, 0, 0, 0, 0, 1}, []byte(net.ParseIP("192.0.2.1").To4()), 862)
+	f.Add([]byte{}, []byte(net.ParseIP("2001:db8::1")), 862)
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{1, 2, 3}, -1)
+	f.Fuzz(func(t *testing.T, mac, addr []byte, port int) {
+		frame, ethertype := healthFrame(mac, net.IP(addr), port)
+		ipLen := 40
+		if net.IP(addr).To4() != nil {
+			ipLen = 20
+		}
+		if len(frame) != 14+ipLen+12 {
+			t.Fatalf("healthFrame() is %d bytes, want %d", len(frame), 14+ipLen+12)
+		}
+		if got := binary.BigEndian.Uint16(frame[12:]); got != ethertype {
+			t.Errorf("healthFrame() has ethertype %#x at the end of the ethernet header, want %#x", got, ethertype)
+		}
+		if got := binary.BigEndian.Uint32(frame[len(frame)-4:]); got != healthMagic {
+			t.Errorf("healthFrame() ends with %#x, want the magic %#x", got, healthMagic)
+		}
+	})
+}
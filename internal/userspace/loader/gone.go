@@ -0,0 +1,72 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// ErrInterfaceGone is what Stats, StatsPerCPU and LinkInfo fail with once every interface a handle was on has been deleted(a container's
+// netns torn down and such), the programs are still loaded but nothing reaches them anymore. The error itself says which interfaces
+var ErrInterfaceGone = errors.New("Interface is gone")
+
+// Err is nil while the handle is on at least one interface that's still there; once all of them are gone it's ErrInterfaceGone and stays
+// that way, unless WatchAndReattach puts the programs back on one that got recreated. Always nil for handles reopened from pins and in cgroup mode
+func (s senderFD) Err() error {
+	return s.loader.detachedErr(s.args)
+}
+
+// Err is the handle's terminal error, see senderFD.Err
+func (s reflectorFD) Err() error {
+	return s.loader.detachedErr(s.args)
+}
+
+// by index: a recreated interface has a new one and our links are still on the old one
+func (l *Loader) detachedErr(args stamp.Args) error {
+	if l == nil || args.Cgroup != "" {
+		return nil
+	}
+	l.goneMu.Lock()
+	defer l.goneMu.Unlock()
+	if l.gone != nil || len(l.devs) == 0 {
+		return l.gone
+	}
+	var names []string
+	// the interfaces are in LoaderConfig.NetnsPath if it's set; can't tell isn't the same as gone
+	gone := false
+	l.inNetns(func() error {
+		conn, err := netlink.Dial()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		for _, dev := range l.devs {
+			if ok, err := conn.LinkExists(dev.Index); err != nil || ok == true {
+				return nil
+			}
+			// a self-test has the same one twice
+			if slices.Contains(names, dev.Name) == false {
+				names = append(names, dev.Name)
+			}
+		}
+		gone = true
+		return nil
+	})
+	if gone == false {
+		return nil
+	}
+	l.gone = fmt.Errorf("%w: %s deleted, nothing's attached anymore", ErrInterfaceGone, strings.Join(names, ", "))
+	l.logger().Error("Every interface we were on is gone, handle detached", "ifaces", names)
+	return l.gone
+}
+
+// the watcher got the programs back on a recreated interface
+func (l *Loader) clearGone() {
+	l.goneMu.Lock()
+	l.gone = nil
+	l.goneMu.Unlock()
+}
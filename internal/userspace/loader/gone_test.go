@@ -0,0 +1,55 @@
+package loader
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// the loader only needs to think it's on the veth, nothing gets attached; needs root
+func TestDetachedErr(t *testing.T) {
+	conn, err := netlink.Dial()
+	if err != nil {
+		t.Skipf("Can't talk to netlink: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.CreateVeth("stampgone0", "stampgone1"); err != nil {
+		t.Skipf("Can't create a veth pair: %v", err)
+	}
+	dev, err := net.InterfaceByName("stampgone0")
+	if err != nil {
+		t.Fatalf("Error getting the veth: %v", err)
+	}
+	t.Cleanup(func() { conn.DeleteLink(dev.Index) })
+	l := NewLoader(LoaderConfig{})
+	l.devs = []*net.Interface{dev}
+	if err := l.detachedErr(stamp.Args{}); err != nil {
+		t.Fatalf("detachedErr() = %v with the interface still there", err)
+	}
+	if err := conn.DeleteLink(dev.Index); err != nil {
+		t.Fatalf("Error deleting the veth: %v", err)
+	}
+	if err := l.detachedErr(stamp.Args{Cgroup: "/sys/fs/cgroup"}); err != nil {
+		t.Errorf("detachedErr() in cgroup mode = %v, want nil", err)
+	}
+	err = l.detachedErr(stamp.Args{})
+	if errors.Is(err, ErrInterfaceGone) == false {
+		t.Fatalf("detachedErr() = %v after deleting it, want %v", err, ErrInterfaceGone)
+	}
+	// terminal, even with devs pointing somewhere that's there
+	lo, _ := net.InterfaceByName("lo")
+	l.devs = []*net.Interface{lo}
+	if again := l.detachedErr(stamp.Args{}); again != err {
+		t.Errorf("detachedErr() = %v the second time, want %v", again, err)
+	}
+	l.clearGone()
+	if err := l.detachedErr(stamp.Args{}); err != nil {
+		t.Errorf("detachedErr() = %v after clearGone(), want nil", err)
+	}
+	if err := (*Loader)(nil).detachedErr(stamp.Args{}); err != nil {
+		t.Errorf("detachedErr() on a reopened handle = %v, want nil", err)
+	}
+}
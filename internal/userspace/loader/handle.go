@@ -0,0 +1,67 @@
+package loader
+
+import (
+	"context"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// Handle is the part of a loaded reflector that code running sessions needs, so it can be tested against loadertest.Fake
+// instead of the kernel
+type Handle interface {
+	Stats() (Stats, error)
+	Err() error
+	Detach()
+	Close()
+}
+
+// SenderHandle is a Handle with the sender's per-reply events on top
+type SenderHandle interface {
+	Handle
+	Events() <-chan StampEvent
+}
+
+// Attacher loads and attaches a session's programs. Loader is already the name of the thing that does the work,
+// Kernel is the Attacher around it and loadertest.Fake the one that never touches BPF
+type Attacher interface {
+	AttachSender(ctx context.Context, args stamp.Args) (SenderHandle, error)
+	AttachReflector(ctx context.Context, args stamp.Args) (Handle, error)
+}
+
+var (
+	_ SenderHandle = senderFD{}
+	_ Handle       = reflectorFD{}
+	_ Attacher     = Kernel{}
+	_ PacketDumper = senderFD{}
+	_ PacketDumper = reflectorFD{}
+)
+
+// Kernel is the real Attacher, LoadSenderContext and LoadReflectorContext with Config; nil means the config LoadSender uses
+type Kernel struct {
+	Config *LoaderConfig
+}
+
+func (k Kernel) config(args stamp.Args) LoaderConfig {
+	if k.Config == nil {
+		return defaultConfig(args)
+	}
+	return *k.Config
+}
+
+// AttachSender loads the sender, the handle behind the interface is a senderFD with everything else on it
+func (k Kernel) AttachSender(ctx context.Context, args stamp.Args) (SenderHandle, error) {
+	fd, err := LoadSenderContext(ctx, args, k.config(args))
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// AttachReflector loads the reflector, the handle behind the interface is a reflectorFD
+func (k Kernel) AttachReflector(ctx context.Context, args stamp.Args) (Handle, error) {
+	fd, err := LoadReflectorContext(ctx, args, k.config(args))
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
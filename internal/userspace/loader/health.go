@@ -0,0 +1,201 @@
+package loader
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// KEEP IN SYNC with the health check in stamp.bpf.h
+const healthMagic = 0x53544843 // "STHC"
+
+// the counters after the ones in Stats
+// KEEP IN SYNC with enum stat_key in stamp.bpf.h
+const (
+	statHealthOut = statReordered + 1 + iota
+	statHealthIn
+)
+
+// nobody has it so a probe that does make it onto the wire(egress not in the data path) goes nowhere,
+// and the stack drops one it gets back on ingress instead of handing it to our socket
+var healthMAC = net.HardwareAddr{0x02, 'S', 'T', 'A', 'M', 'P'}
+
+const (
+	// how long HealthCheck waits when ctx has no deadline of its own
+	healthTimeout = 2 * time.Second
+	// the probe goes out again this often until it's seen, one can get lost like anything else
+	healthResend = 50 * time.Millisecond
+)
+
+// HealthCheck proves the programs are actually in the data path, not just attached: on every interface it puts a probe on egress
+// through a packet socket, the egress program turns it around to our own ingress and the ingress program drops it, and it waits
+// for both to count it. If something in front of either one(an anchor gone wrong, another program dropping it) eats the probe
+// it fails and says which direction. Without a deadline on ctx it gives up after 2s.
+// Cgroup mode, dry runs, handles reopened from pins and ingress-only configs can't be checked
+func (s senderFD) HealthCheck(ctx context.Context) error {
+	return s.loader.healthCheck(ctx, s.args, s.Objs.Stats)
+}
+
+// HealthCheck proves the programs are in the data path, see senderFD.HealthCheck
+func (s reflectorFD) HealthCheck(ctx context.Context) error {
+	return s.loader.healthCheck(ctx, s.args, s.Objs.Stats)
+}
+
+// pairs are the interfaces(their index in devs) to check, none means all of them
+func (l *Loader) healthCheck(ctx context.Context, args stamp.Args, stats *ebpf.Map, pairs ...int) error {
+	if l == nil {
+		return fmt.Errorf("Can't health check a handle reopened from pins, its settings can't be reopened")
+	}
+	if args.Cgroup != "" {
+		return fmt.Errorf("Can't health check in cgroup mode, cgroup programs only see their own sockets' traffic")
+	}
+	doEgress, doIngress := l.directions()
+	if doEgress == false {
+		return fmt.Errorf("Can't health check without the egress program, it's what gets the probe over to ingress")
+	}
+	if len(l.devs) == 0 {
+		return fmt.Errorf("Nothing attached to check")
+	}
+	if _, ok := ctx.Deadline(); ok == false {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+	}
+	// the probe goes out of a packet socket on the interface, it has to be opened where the interface is
+	return l.inNetns(func() error {
+		for i, dev := range l.devs {
+			if len(pairs) > 0 && slices.Contains(pairs, i) == false {
+				continue
+			}
+			if l.Links[2*i] == nil {
+				return fmt.Errorf("Health check on %s failed: not attached", dev.Name)
+			}
+			if err := healthProbe(ctx, stats, dev, args.Localaddr, args.S_port, doIngress); err != nil {
+				return fmt.Errorf("Health check on %s failed: %w", dev.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// the counters are shared by every interface so they go one at a time
+func healthProbe(ctx context.Context, stats *ebpf.Map, dev *net.Interface, laddr net.IP, port int, ingress bool) error {
+	outBefore, err := readCounter(stats, statHealthOut)
+	if err != nil {
+		return err
+	}
+	inBefore, err := readCounter(stats, statHealthIn)
+	if err != nil {
+		return err
+	}
+	frame, ethertype := healthFrame(dev.HardwareAddr, laddr, port)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return fmt.Errorf("Error opening packet socket: %w", err)
+	}
+	defer unix.Close(fd)
+	to := &unix.SockaddrLinklayer{Ifindex: dev.Index, Protocol: htons(ethertype), Halen: 6}
+	copy(to.Addr[:], healthMAC)
+	ticker := time.NewTicker(healthResend)
+	defer ticker.Stop()
+	var out, in uint64
+	for {
+		if err := unix.Sendto(fd, frame, 0, to); err != nil {
+			return fmt.Errorf("Error sending probe: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			if out == outBefore {
+				return fmt.Errorf("Egress program never saw the probe, something in front of it dropped it: %w", ctx.Err())
+			}
+			return fmt.Errorf("Egress turned the probe around but the ingress program never saw it, something in front of it dropped it: %w", ctx.Err())
+		case <-ticker.C:
+		}
+		if out, err = readCounter(stats, statHealthOut); err != nil {
+			return err
+		}
+		if in, err = readCounter(stats, statHealthIn); err != nil {
+			return err
+		}
+		if out > outBefore && (ingress == false || in > inBefore) {
+			return nil
+		}
+	}
+}
+
+// Ethernet, IP and UDP from and to port with the magic behind it; the addresses don't matter to BPF, only the family does
+func healthFrame(mac net.HardwareAddr, laddr net.IP, port int) ([]byte, uint16) {
+	udp := make([]byte, 12)
+	binary.BigEndian.PutUint16(udp[0:], uint16(port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	binary.BigEndian.PutUint32(udp[8:], healthMagic)
+	var ethertype uint16
+	var ip []byte
+	if v4 := laddr.To4(); v4 != nil {
+		ethertype = unix.ETH_P_IP
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(udp)))
+		ip[8] = 64
+		ip[9] = unix.IPPROTO_UDP
+		copy(ip[12:], v4)
+		copy(ip[16:], v4)
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+	} else {
+		ethertype = unix.ETH_P_IPV6
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = unix.IPPROTO_UDP
+		ip[7] = 64
+		copy(ip[8:], laddr.To16())
+		copy(ip[24:], laddr.To16())
+	}
+	// anything without an ethernet MAC(tun, wireguard...) would throw the whole frame off
+	src := make([]byte, 6)
+	copy(src, mac)
+	frame := make([]byte, 0, 14+len(ip)+len(udp))
+	frame = append(frame, healthMAC...)
+	frame = append(frame, src...)
+	frame = binary.BigEndian.AppendUint16(frame, ethertype)
+	frame = append(frame, ip...)
+	return append(frame, udp...), ethertype
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// one counter summed over every CPU
+func readCounter(m *ebpf.Map, key uint32) (uint64, error) {
+	statsMut.RLock()
+	defer statsMut.RUnlock()
+	var percpu []uint64
+	if err := m.Lookup(key, &percpu); err != nil {
+		return 0, fmt.Errorf("Error reading stats counter %d: %w", key, err)
+	}
+	var sum uint64
+	for _, v := range percpu {
+		sum += v
+	}
+	return sum, nil
+}
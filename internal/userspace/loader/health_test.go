@@ -0,0 +1,47 @@
+package loader
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// what health_probe() in stamp.bpf.h looks at has to be where it looks
+func TestHealthFrame(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	tests := []struct {
+		name      string
+		laddr     net.IP
+		ethertype uint16
+		l3        int
+		proto     int
+	}{
+		{name: "IPv4", laddr: net.ParseIP("192.0.2.1"), ethertype: 0x0800, l3: 20, proto: 14 + 9},
+		{name: "IPv6", laddr: net.ParseIP("2001:db8::1"), ethertype: 0x86dd, l3: 40, proto: 14 + 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, ethertype := healthFrame(mac, tt.laddr, 862)
+			if ethertype != tt.ethertype || binary.BigEndian.Uint16(frame[12:]) != tt.ethertype {
+				t.Fatalf("healthFrame() ethertype %#x(%#x in the frame), want %#x", ethertype, binary.BigEndian.Uint16(frame[12:]), tt.ethertype)
+			}
+			if len(frame) != 14+tt.l3+12 {
+				t.Fatalf("healthFrame() is %d bytes, want %d", len(frame), 14+tt.l3+12)
+			}
+			if frame[tt.proto] != 17 {
+				t.Errorf("healthFrame() L4 protocol %d, want UDP", frame[tt.proto])
+			}
+			udp := frame[14+tt.l3:]
+			if binary.BigEndian.Uint16(udp) != 862 || binary.BigEndian.Uint16(udp[2:]) != 862 {
+				t.Errorf("healthFrame() ports %d->%d, want 862->862", binary.BigEndian.Uint16(udp), binary.BigEndian.Uint16(udp[2:]))
+			}
+			if binary.BigEndian.Uint32(udp[8:]) != healthMagic {
+				t.Errorf("healthFrame() magic %#x, want %#x", binary.BigEndian.Uint32(udp[8:]), healthMagic)
+			}
+			// a valid header sums up to all ones
+			if tt.l3 == 20 && ipChecksum(frame[14:34]) != 0 {
+				t.Errorf("healthFrame() IPv4 header checksum doesn't check out")
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+)
+
+// TC_ACT_REDIRECT, what bpf_redirect() hands back once the reply is turned around
+const tcxRedirect = 7
+
+// TC_ACT_SHOT
+const tcxDrop = 2
+
+// the documentation addresses the BPF tests go by: local is the laddr newTestReflector and newTestSender set, remote is
+// whoever's on the other end of it
+func testAddrs() (local, remote net.IP) {
+	return net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()
+}
+
+// the same for IPv6, the programs only get these with setDualStack or setLocalAddr
+func testAddrs6() (local, remote net.IP) {
+	return net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+}
+
+// newTestReflector and newTestSender load the real objects for a test to run its packets through. That needs root and a
+// kernel that can test-run TC(and XDP) programs, without them the test is skipped rather than failed.
+// They come with testAddrs' local as laddr and on port 862, and are closed once the test's done
+func newTestReflector(t *testing.T) *reflector.ReflectorObjects {
+	t.Helper()
+	var objs reflector.ReflectorObjects
+	if err := reflector.LoadReflectorObjects(&objs, nil); err != nil {
+		t.Skipf("Can't load the reflector programs: %v", err)
+	}
+	t.Cleanup(func() { objs.Close() })
+	local, _ := testAddrs()
+	setLocalAddr(objs.Laddr, objs.Laddr6, objs.IpFamily, local)
+	objs.S_port.Set(uint16(862))
+	return &objs
+}
+
+// probes go to port 862 as well
+func newTestSender(t *testing.T) *sender.SenderObjects {
+	t.Helper()
+	var objs sender.SenderObjects
+	if err := sender.LoadSenderObjects(&objs, nil); err != nil {
+		t.Skipf("Can't load the sender programs: %v", err)
+	}
+	t.Cleanup(func() { objs.Close() })
+	local, _ := testAddrs()
+	setLocalAddr(objs.Laddr, objs.Laddr6, objs.IpFamily, local)
+	objs.S_port.Set(uint16(862))
+	objs.D_port.Set(uint16(862))
+	return &objs
+}
+
+// ethernet, IP and UDP headers in front of a 44-byte STAMP request; no checksums since nothing on the way checks them
+func stampRequest(src, dst net.IP, sport, dport uint16) []byte {
+	var pkt bytes.Buffer
+	udpLen := uint16(8 + 44)
+	pkt.Write(make([]byte, 12)) // MACs
+	if src.To4() != nil {
+		binary.Write(&pkt, binary.BigEndian, uint16(0x0800))
+		pkt.Write([]byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, 17, 0, 0})
+		binary.BigEndian.PutUint16(pkt.Bytes()[16:], 20+udpLen)
+		pkt.Write(src.To4())
+		pkt.Write(dst.To4())
+	} else {
+		binary.Write(&pkt, binary.BigEndian, uint16(0x86dd))
+		pkt.Write([]byte{0x60, 0, 0, 0})
+		binary.Write(&pkt, binary.BigEndian, udpLen)
+		pkt.Write([]byte{17, 64})
+		pkt.Write(src.To16())
+		pkt.Write(dst.To16())
+	}
+	binary.Write(&pkt, binary.BigEndian, []uint16{sport, dport, udpLen, 0})
+	req := make([]byte, 44)
+	binary.BigEndian.PutUint32(req, 1)
+	pkt.Write(req)
+	return pkt.Bytes()
+}
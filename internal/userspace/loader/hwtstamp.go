@@ -0,0 +1,52 @@
+package loader
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// --hw-timestamps: BPF takes the receive time from skb->hwtstamp whenever the NIC put one there, so all we have to do is
+// ask the driver to stamp everything it receives; whatever it doesn't stamp goes by the kernel clock same as without the flag
+func (l *Loader) setHWTimestamps(hw *ebpf.Variable, args stamp.Args, dev *net.Interface) {
+	if args.HWTimestamps == false {
+		hw.Set(uint16(0))
+		return
+	}
+	hw.Set(uint16(1))
+	if l.Config.DryRun == true || dev == nil {
+		return
+	}
+	if err := enableRXTimestamps(dev.Name); err != nil {
+		l.logger().Warn("Can't turn on hardware timestamping, going by kernel timestamps", "iface", dev.Name, "err", err)
+	}
+}
+
+// it's a setting of the whole interface and we leave it on once we're done, ptp4l and the like might depend on it
+// the TX side stays the way it was, we can't use it anyway
+func enableRXTimestamps(iface string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("Error opening socket: %w", err)
+	}
+	defer unix.Close(fd)
+	cfg, err := unix.IoctlGetHwTstamp(fd, iface)
+	if err != nil {
+		return fmt.Errorf("Error getting the timestamping config: %w", err)
+	}
+	if cfg.Rx_filter == unix.HWTSTAMP_FILTER_ALL {
+		return nil
+	}
+	cfg.Rx_filter = unix.HWTSTAMP_FILTER_ALL
+	if err := unix.IoctlSetHwTstamp(fd, iface, cfg); err != nil {
+		return fmt.Errorf("Error setting the timestamping config: %w", err)
+	}
+	// the driver writes back what it actually went with, some only do PTP packets
+	if cfg.Rx_filter != unix.HWTSTAMP_FILTER_ALL && cfg.Rx_filter != unix.HWTSTAMP_FILTER_SOME {
+		return fmt.Errorf("The driver only stamps some packets(filter %d), STAMP ones aren't among them", cfg.Rx_filter)
+	}
+	return nil
+}
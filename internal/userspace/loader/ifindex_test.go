@@ -0,0 +1,54 @@
+package loader
+
+import (
+	"net"
+	"testing"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+)
+
+// a veth recreated under the same name gets a new index, needs root
+func TestRefreshIndex(t *testing.T) {
+	conn, err := netlink.Dial()
+	if err != nil {
+		t.Skipf("Can't talk to netlink: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.CreateVeth("stampidx0", "stampidx1"); err != nil {
+		t.Skipf("Can't create a veth pair: %v", err)
+	}
+	stale, err := net.InterfaceByName("stampidx0")
+	if err != nil {
+		t.Fatalf("Error getting the veth: %v", err)
+	}
+	if err := conn.DeleteLink(stale.Index); err != nil {
+		t.Fatalf("Error deleting the veth: %v", err)
+	}
+	l := NewLoader(LoaderConfig{})
+	if err := l.refreshIndex(stale); err == nil {
+		t.Fatalf("refreshIndex() = nil with the interface gone")
+	}
+	if err := conn.CreateVeth("stampidx0", "stampidx1"); err != nil {
+		t.Fatalf("Error recreating the veth pair: %v", err)
+	}
+	cur, err := net.InterfaceByName("stampidx0")
+	if err != nil {
+		t.Fatalf("Error getting the recreated veth: %v", err)
+	}
+	t.Cleanup(func() {
+		if conn, err := netlink.Dial(); err == nil {
+			conn.DeleteLink(cur.Index)
+			conn.Close()
+		}
+	})
+	if cur.Index == stale.Index {
+		t.Skipf("The kernel handed out index %d again", cur.Index)
+	}
+	dev := *stale
+	if err := l.refreshIndex(&dev); err != nil {
+		t.Fatalf("refreshIndex() returned error: %v", err)
+	}
+	if dev.Index != cur.Index {
+		t.Errorf("refreshIndex() left index %d, want %d", dev.Index, cur.Index)
+	}
+}
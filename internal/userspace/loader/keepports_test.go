@@ -0,0 +1,51 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// the reply's ports with and without --keep-ports
+func TestKeepPorts(t *testing.T) {
+	objs := newTestReflector(t)
+	laddr, sender := testAddrs()
+
+	tests := []struct {
+		name         string
+		keep         uint16
+		sport, dport uint16
+	}{
+		{name: "swapped", keep: 0, sport: 862, dport: 40000},
+		{name: "kept", keep: 1, sport: 40000, dport: 862},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs.KeepPorts.Set(tt.keep)
+			req := stampRequest(sender, laddr, 40000, 862)
+			out := make([]byte, len(req))
+			ret, err := objs.ReflectorIn.Run(&ebpf.RunOptions{Data: req, DataOut: out})
+			if err != nil {
+				t.Fatalf("Error running reflector_in: %v", err)
+			}
+			if ret != tcxRedirect {
+				t.Fatalf("reflector_in returned %d, want %d(reflected)", ret, tcxRedirect)
+			}
+			// ethernet and IPv4 in front of the UDP header
+			sport, dport := binary.BigEndian.Uint16(out[34:]), binary.BigEndian.Uint16(out[36:])
+			if sport != tt.sport || dport != tt.dport {
+				t.Errorf("reply goes from port %d to %d, want %d to %d", sport, dport, tt.sport, tt.dport)
+			}
+			// egress has to know it for ours either way, or T3 never gets stamped
+			stamped := make([]byte, len(out))
+			if _, err := objs.ReflectorOut.Run(&ebpf.RunOptions{Data: out, DataOut: stamped}); err != nil {
+				t.Fatalf("Error running reflector_out: %v", err)
+			}
+			if bytes.Equal(stamped, out) == true {
+				t.Errorf("reflector_out left the reply alone, want T3 stamped")
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package loader
+
+import (
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// --count and --duration: userspace stops sending on its own, BPF drops whatever gets past that
+// every reflector gets its own copy of each probe so the count goes for all of them
+// the session starts a bit after we load so the deadline gets an interval of slack, userspace is always the first to stop
+func setLimits(objs *sender.SenderObjects, args stamp.Args) {
+	if args.Count > 0 {
+		objs.ProbeLimit.Set(uint16(1))
+		objs.ProbesLeft.Set(int64(args.Count) * int64(len(args.IPs)))
+	} else {
+		objs.ProbeLimit.Set(uint16(0))
+	}
+	if args.Duration > 0 {
+		// same clock as bpf_ktime_get_ns()
+		var mono unix.Timespec
+		unix.ClockGettime(unix.CLOCK_MONOTONIC, &mono)
+		objs.Deadline.Set(uint64(mono.Nano() + int64(args.Duration+args.Interval)))
+	} else {
+		objs.Deadline.Set(uint64(0))
+	}
+}
@@ -0,0 +1,97 @@
+package loader
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/anchor"
+)
+
+// LinkInfo is what the kernel says about one of the links a handle holds
+type LinkInfo struct {
+	ID      link.ID
+	Program ebpf.ProgramID
+	Attach  ebpf.AttachType
+	// TCX links and TC filters only, a link whose interface went away stays around with an index of 0
+	Ifindex int
+	Ifname  string
+	// cgroup links only
+	CgroupID uint64
+	// went in right before or after another program rather than at the head of the chain
+	// loaders don't pin this or the two below so they're always zero on handles reopened with Load*FromPin
+	Anchored bool
+	// with UseAnchors and LoaderConfig.Position: the position it actually went with, nil otherwise
+	Position *anchor.AnchorPosition
+	// didn't go where it was asked to, e.g. BeforeCilium without Cilium on the interface ends up Generic
+	// or a stale anchor that fell back to the head
+	Fallback bool
+	// a TC filter(LoaderConfig.AttachMode) rather than a link, it has no ID
+	TC bool
+	// the kernel couldn't tell us about the link, the rest is zero; detached links end up here, and every link once the
+	// handle's Err() is set(ErrInterfaceGone)
+	Err error
+}
+
+// LinkInfo describes every link the handle holds, egress and ingress for every interface in the order they were attached
+func (s senderFD) LinkInfo() []LinkInfo {
+	return linkInfo(s.Links, s.placements, s.Err())
+}
+
+// LinkInfo describes every link the handle holds, egress and ingress for every interface in the order they were attached
+func (s reflectorFD) LinkInfo() []LinkInfo {
+	return linkInfo(s.allLinks(), s.placements, s.Err())
+}
+
+// gone is the handle's Err(), once it's set there's nothing left to ask the kernel about
+func linkInfo(links []link.Link, placements map[link.Link]placement, gone error) []LinkInfo {
+	var res []LinkInfo
+	for _, l := range links {
+		if gone != nil {
+			res = append(res, LinkInfo{Err: gone})
+			continue
+		}
+		if l == nil {
+			res = append(res, LinkInfo{Err: fmt.Errorf("Link not attached: already detached, or its direction was skipped in LoaderConfig")})
+			continue
+		}
+		if f, ok := l.(*tcFilter); ok {
+			res = append(res, filterInfo(f))
+			continue
+		}
+		info, err := l.Info()
+		if err != nil {
+			res = append(res, LinkInfo{Err: fmt.Errorf("Error getting link info: %w", err)})
+			continue
+		}
+		p := placements[l]
+		li := LinkInfo{ID: info.ID, Program: info.Program, Anchored: p.anchored, Position: p.position, Fallback: p.fallback}
+		if tcx := info.TCX(); tcx != nil {
+			li.Attach = ebpf.AttachType(tcx.AttachType)
+			li.Ifindex = int(tcx.Ifindex)
+			if dev, err := net.InterfaceByIndex(li.Ifindex); err == nil {
+				li.Ifname = dev.Name
+			}
+		} else if cg := info.Cgroup(); cg != nil {
+			li.Attach = ebpf.AttachType(cg.AttachType)
+			li.CgroupID = cg.CgroupId
+		}
+		res = append(res, li)
+	}
+	return res
+}
+
+// there's no link to ask, it's all stuff we noted down when adding the filter
+func filterInfo(f *tcFilter) LinkInfo {
+	li := LinkInfo{Attach: f.attach, Ifindex: f.filter.Ifindex, TC: true}
+	if info, err := f.prog.Info(); err == nil {
+		li.Program, _ = info.ID()
+	} else {
+		li.Err = fmt.Errorf("Error getting program info: %w", err)
+	}
+	if dev, err := net.InterfaceByIndex(li.Ifindex); err == nil {
+		li.Ifname = dev.Name
+	}
+	return li
+}
@@ -0,0 +1,115 @@
+package loader
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// LIVE SETTINGS
+// most globals are set once at load and stay that way: the addresses, ports and IP family, auth, the TLVs the reflector gets asked for
+// (--follow-up, --location-tlv, --timestamp-info), hardware timestamps, --vlan-aware, dual stack and the maps' sizes all take a new load.
+// Whatever can change under running programs has a setter here; the clock globals are WatchSync's
+
+// SetDSCP changes the DSCP probes are marked with from the next one on, 0 stops marking them
+func (s senderFD) SetDSCP(dscp uint8) error {
+	if s.loader == nil {
+		return fmt.Errorf("Can't change the DSCP of a handle reopened from pins, its globals can't be reopened")
+	}
+	if dscp > 63 {
+		return fmt.Errorf("Invalid DSCP %d: has to be between 0 and 63", dscp)
+	}
+	// the socket marks them there and it's set up once when the session starts
+	if s.args.Cgroup != "" {
+		return fmt.Errorf("Can't change the DSCP in cgroup mode, BPF doesn't mark the probes")
+	}
+	for _, o := range s.allObjs() {
+		if err := o.Dscp.Set(uint16(dscp)); err != nil {
+			return fmt.Errorf("Error setting DSCP: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetPadding changes the Extra Padding TLV of the probes from the next one on, 0 drops it; the probes have to fit every interface's MTU.
+// Replies to probes that are already out come back the old size, both sizes are taken until those have timed out
+func (s senderFD) SetPadding(bytes uint16) error {
+	if s.loader == nil {
+		return fmt.Errorf("Can't change the padding of a handle reopened from pins, its globals can't be reopened")
+	}
+	if s.args.PacketSize > 0 {
+		return fmt.Errorf("Can't change the padding of a session with a fixed packet size")
+	}
+	args := s.args
+	args.PaddingBytes = int(bytes)
+	tlvs, err := checkTLVs(args, nil)
+	if err != nil {
+		return err
+	}
+	for _, dev := range s.loader.devs {
+		if _, err := checkTLVs(args, dev); err != nil {
+			return err
+		}
+	}
+	objs := s.allObjs()
+	var old uint16
+	if err := objs[0].TlvLen.Get(&old); err != nil {
+		return fmt.Errorf("Error reading the TLV length: %w", err)
+	}
+
+	l := s.loader
+	l.padMu.Lock()
+	defer l.padMu.Unlock()
+	l.padGen++
+	gen := l.padGen
+	// the for-me check goes by size, the smaller one with anything behind it lets both through
+	for _, o := range objs {
+		o.TlvLen.Set(min(old, tlvs))
+		o.TlvAny.Set(uint16(1))
+	}
+	stamp.SetPadding(int(bytes))
+	time.AfterFunc(s.args.Timeout, func() {
+		l.padMu.Lock()
+		defer l.padMu.Unlock()
+		// a later change took over
+		if l.padGen != gen {
+			return
+		}
+		for _, o := range objs {
+			o.TlvLen.Set(tlvs)
+			o.TlvAny.Set(uint16(0))
+		}
+	})
+	return nil
+}
+
+// the first interface's objects and everyone else's, every one of them has its own globals
+func (s senderFD) allObjs() []sender.SenderObjects {
+	return append([]sender.SenderObjects{s.Objs}, s.others...)
+}
+
+// SetMaxReplyPPS changes how many replies a second we send at most, every interface together; 0 lifts the limit.
+// Requests over it are dropped and counted in RateLimited, in authenticated mode too
+func (s reflectorFD) SetMaxReplyPPS(pps uint32) error {
+	if s.loader == nil {
+		return fmt.Errorf("Can't change the reply rate of a handle reopened from pins, its globals can't be reopened")
+	}
+	budget := replyBudget(pps, s.args.Queues)
+	for _, o := range s.allObjs() {
+		if err := o.MaxReplyPps.Set(budget); err != nil {
+			return fmt.Errorf("Error setting the reply rate: %w", err)
+		}
+	}
+	return nil
+}
+
+// every CPU has its own bucket, with --queues RSS spreads the requests over that many so each one gets its share(rounded up so it's never 0);
+// without it they're taken to all land on one
+func replyBudget(pps uint32, queues int) uint32 {
+	if queues <= 1 || pps == 0 {
+		return pps
+	}
+	return uint32((uint64(pps) + uint64(queues) - 1) / uint64(queues))
+}
@@ -1,15 +1,20 @@
 package loader
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
 	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/anchor"
 	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
 )
 
@@ -17,212 +22,970 @@ import (
 type LoaderConfig struct {
 	UseAnchors bool
 	Anchor     link.Anchor
+	// with UseAnchors and no Anchor the anchor manager picks one at this position
+	Position anchor.AnchorPosition
+	// 0 doesn't even ask for a log buffer, 1 logs branches, 2 every instruction
+	VerifierLogLevel uint32
+	// nil for DefaultSyncChecker
+	SyncChecker SyncChecker
+	// with UseAnchors: go right before or after the program with this name on the interface, at most one of them
+	// these take priority over Anchor and Position, and since you asked for a spot we don't fall back to the head if it's not there
+	AnchorBeforeProgram string
+	AnchorAfterProgram  string
+	// a failed anchor is an error instead of falling back to the head(or a generic anchor), a program in the wrong spot of the chain measures the wrong thing
+	StrictAnchoring bool
+	// program name prefixes anchor.BeforeCilium and AfterCilium go relative to, for a CNI other than Cilium(or a Cilium that
+	// names its programs differently); empty for Cilium's cil_from_ and cil_to_
+	AnchorRelativeTo []string
+	// load, verify and populate globals but don't attach anything, for checking the programs against a kernel in CI
+	// args.Dev can be nil and doesn't have to have Localaddr, the handle's Close() only unloads the objects
+	DryRun bool
+	// pin everything under this bpffs directory(e.g. /sys/fs/bpf/stamp) so it can be reopened with Load*FromPin, see pin.go
+	PinPath string
+	// where the loader, the anchor manager and the handles log to; slog.Default() when nil, slog.DiscardHandler silences it
+	Logger *slog.Logger
+	// TCX or TC(clsact) for interfaces, AttachAuto picks TC only when the kernel has no TCX; TC has no anchors and can't be pinned.
+	// AttachXDP has the sender take replies in XDP where the driver can, see senderFD.AttachModes for where it did
+	AttachMode AttachMode
+	// which of the two programs go on, e.g. egress only for a one-way sender; both are loaded either way so the maps are all there.
+	// Leaving both false attaches both, same as Load* without a config does
+	AttachIngress bool
+	AttachEgress  bool
+	// what to do when the kernel says EBUSY/EAGAIN to an attach, the zero value doesn't retry
+	AttachRetry RetryPolicy
+	// pin just the stats(and the reflector's sessions) under this bpffs directory for a sidecar to read with OpenPinnedStats,
+	// independent of PinPath; unpinned once the handle's closed, see statspin.go
+	StatsPinPath string
+	// merged into what the programs are loaded with, e.g. KernelTypes with an external BTF for a kernel without /sys/kernel/btf/vmlinux,
+	// or MapReplacements with maps of your own. Programs.LogLevel only counts if VerifierLogLevel is 0; every interface after the
+	// first still shares the first one's maps, whatever MapReplacements says about them
+	CollectionOptions ebpf.CollectionOptions
+	// load this .o(e.g. a freshly built sender.bpf.o) instead of the object embedded at build time, for iterating on the C side
+	// without rebuilding; it has to have every program, map and variable this build expects. Empty for the embedded one
+	ObjectPath string
+	// a netns(e.g. /var/run/netns/foo or /proc/<pid>/ns/net) to look the interfaces up and attach in, for a supervisor outside of it;
+	// args.Dev and args.Devs only go by Name there. Empty for our own, see netns.go
+	NetnsPath string
+	// take a program of the same name another run left on an interface's TCX hook off instead of failing with ErrAlreadyAttached
+	ReplaceAttached bool
 }
 
+// anything Run can tear down: senderFD, reflectorFD, *Loader
 type fd interface {
-	Close() error
+	Close()
 }
 
+// handles cover every interface the programs went on, Objs is the first one's and its maps are shared by all of them
 type senderFD struct {
 	Objs  sender.SenderObjects
 	Links []link.Link
+	// under --keep-going: interfaces we couldn't attach to
+	Failed     []error
+	others     []sender.SenderObjects
+	events     *eventStream
+	pinDir     string
+	statsPin   string
+	placements map[link.Link]placement
+	// AttachXDP: interface name -> the XDP link in front of its ingress
+	xdp map[string]link.Link
+	// whatever loaded us, for WatchAndReattach; nil when reopened from pins
+	loader *Loader
+	args   stamp.Args
+	// what BPF puts in our timestamps, userspace-built packets need it too(stamp.Args.ErrorEstimate); zero when reopened from pins
+	ErrorEstimate stamp.ErrorEstimate
+	// the local clock as of the load, the far side needs the reflector's to make sense of one-way delays(see StampEvent.ReflectorClock)
+	Clock ClockInfo
 }
 
 func (s senderFD) Close() {
+	s.Detach()
+	s.CloseObjects()
+}
+
+// Detach takes the programs off the interface(or cgroup) but leaves the maps open for reading
+func (s senderFD) Detach() {
+	detach(s.Links)
+	detachXDP(s.xdp)
+}
+
+// CloseObjects unloads programs and maps, call it once you're done reading maps after Detach()
+func (s senderFD) CloseObjects() {
+	s.closeFDs()
+	unpin(s.pinDir)
+	unpin(s.statsPin)
+}
+
+// Release lets go of the programs without taking them down: pinned ones stay attached for LoadSenderFromPin, unpinned ones come off
+func (s senderFD) Release() {
 	for _, l := range s.Links {
 		if l != nil {
 			l.Close()
 		}
 	}
+	detachXDP(s.xdp)
+	s.closeFDs()
+}
+
+func (s senderFD) closeFDs() {
+	s.events.close()
 	s.Objs.Close()
+	for _, o := range s.others {
+		o.Close()
+	}
 }
 
 type reflectorFD struct {
 	Objs  reflector.ReflectorObjects
 	Links []link.Link
+	// under --keep-going: interfaces we couldn't attach to
+	Failed     []error
+	others     []reflector.ReflectorObjects
+	pinDir     string
+	statsPin   string
+	placements map[link.Link]placement
+	// whatever loaded us, for WatchAndReattach; nil when reopened from pins
+	loader *Loader
+	args   stamp.Args
+	// what BPF puts in our timestamps, userspace-built packets need it too(stamp.Args.ErrorEstimate); zero when reopened from pins
+	ErrorEstimate stamp.ErrorEstimate
+	// the local clock as of the load, what the Timestamp Information TLV tells senders about; zero when reopened from pins
+	Clock ClockInfo
 }
 
 func (s reflectorFD) Close() {
-	for _, l := range s.Links {
+	s.Detach()
+	s.CloseObjects()
+}
+
+// Detach takes the programs off the interface but leaves the maps open for reading
+func (s reflectorFD) Detach() {
+	detach(s.Links)
+	added, _ := s.added()
+	detach(added)
+}
+
+// CloseObjects unloads programs and maps, call it once you're done reading maps after Detach()
+func (s reflectorFD) CloseObjects() {
+	s.closeFDs()
+	unpin(s.pinDir)
+	unpin(s.statsPin)
+}
+
+// Release lets go of the programs without taking them down: pinned ones stay attached for LoadReflectorFromPin, unpinned ones come off
+func (s reflectorFD) Release() {
+	for _, l := range s.allLinks() {
 		if l != nil {
 			l.Close()
 		}
 	}
-	s.Objs.Close()
+	s.closeFDs()
 }
 
-func LoadSender(args stamp.Args) senderFD {
-	// Default config - use Head anchor
-	config := LoaderConfig{
-		UseAnchors: true,
-		Anchor:     link.Head(),
+func (s reflectorFD) closeFDs() {
+	for _, o := range s.allObjs() {
+		o.Close()
 	}
-
-	return loadSenderWithConfig(args, config)
 }
 
-func loadSenderWithConfig(args stamp.Args, config LoaderConfig) senderFD {
-	// Load TCX programs
-	var objs sender.SenderObjects
-	var opts = ebpf.CollectionOptions{Programs: ebpf.ProgramOptions{LogLevel: 1}}
-	err := sender.LoadSenderObjects(&objs, &opts)
-	if err != nil {
-		var verr *ebpf.VerifierError
-		if errors.As(err, &verr) {
-			log.Fatalf("Verifier error: %+v\n", verr)
-		}
-		log.Fatalf("Error loading programs: %v", err)
-	} else {
-		fmt.Println("All programs successfully loaded and verified")
-		if args.Debug == true {
-			log.Print(objs.SenderOut.VerifierLog)
-			log.Print(objs.SenderIn.VerifierLog)
+// a pinned link outlives its fd so it has to be unpinned to actually come off
+func detach(links []link.Link) {
+	for i, l := range links {
+		if l != nil {
+			l.Unpin()
+			l.Close()
+			links[i] = nil
 		}
 	}
+}
 
-	// populate globals
-	ip := binary.LittleEndian.Uint32(args.Localaddr.To4())
-	objs.Laddr.Set(ip)
-	objs.S_port.Set(uint16(args.S_port))
+// Loader loads the STAMP programs and keeps track of everything it attached
+type Loader struct {
+	Config  LoaderConfig
+	Anchors *anchor.AnchorManager
+	Links   []link.Link
+	// one set of objects per interface, in the order they were attached
+	// only the first one's maps are real, everyone else writes into them
+	Senders    []sender.SenderObjects
+	Reflectors []reflector.ReflectorObjects
+	// under --keep-going: interfaces we skipped
+	Failed []error
+	pinDir string
+	// links that went in relative to another program, for LinkInfo
+	placements map[link.Link]placement
+	// the interface of every pair in Links, Links[2*i] and Links[2*i+1] are devs[i]'s egress and ingress
+	devs []*net.Interface
+	// AttachAuto: whether the kernel has TCX, nil until we've asked
+	haveTCX *bool
+	// AttachXDP: the interfaces sender_xdp_in went on, by name
+	xdp map[string]link.Link
+	// TC mode: interfaces we added the clsact qdisc to
+	clsacts map[int]bool
+	// what checkClocks came up with, for the handle and WatchSync
+	clocks clocks
+	// LoadSelfTest: the sender's links while the reflector goes on next to them
+	around []link.Link
+	// where pinStats put them, LoaderConfig.StatsPinPath/<role>
+	statsPinDir string
+	// SetPadding: bumped on every change so an older one's cleanup knows it's been overtaken
+	padMu  sync.Mutex
+	padGen uint64
+	// once every interface is gone, see Err
+	goneMu sync.Mutex
+	gone   error
+	// interfaces matching DevPattern the watcher attached to after loading, the last ones in devs, Links and Reflectors
+	added int
+}
 
-	// Check if we need to adjust TAI
-	if checkTAI() == true {
-		objs.Tai.Set(uint16(1))
-	} else {
-		objs.Tai.Set(uint16(0))
+// NewLoader creates a loader with its own anchor manager
+func NewLoader(config LoaderConfig) *Loader {
+	anchors := anchor.NewAnchorManager()
+	anchors.Strict = config.StrictAnchoring
+	anchors.RelativeTo = config.AnchorRelativeTo
+	anchors.Logger = config.Logger
+	return &Loader{Config: config, Anchors: anchors, placements: map[link.Link]placement{}, clsacts: map[int]bool{}, xdp: map[string]link.Link{}}
+}
+
+func (l *Loader) logger() *slog.Logger {
+	if l.Config.Logger != nil {
+		return l.Config.Logger
+	}
+	return slog.Default()
+}
+
+// Default config - use Head anchor, log to stderr and with --debug that includes the verifier logs
+func defaultConfig(args stamp.Args) LoaderConfig {
+	level := slog.LevelInfo
+	if args.Debug == true {
+		level = slog.LevelDebug
+	}
+	return LoaderConfig{
+		UseAnchors:       true,
+		Anchor:           link.Head(),
+		AttachIngress:    true,
+		AttachEgress:     true,
+		AttachRetry:      RetryPolicy{Count: 3, Backoff: 50 * time.Millisecond},
+		StatsPinPath:     args.StatsPinPath,
+		VerifierLogLevel: args.VerifierLogLevel,
+		ReplaceAttached:  args.ReplaceAttached,
+		Logger:           slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	}
+}
+
+// LoadSender loads the sender programs and attaches them to the head of the interface's TCX chain.
+// On error whatever was loaded is cleaned up and the returned senderFD is zero, so it's still safe to Close()
+func LoadSender(args stamp.Args) (senderFD, error) {
+	return LoadSenderWithAnchors(args, defaultConfig(args))
+}
+
+// LoadSenderWithAnchors is LoadSender with the TCX anchor and verifier log level taken from config
+func LoadSenderWithAnchors(args stamp.Args, config LoaderConfig) (senderFD, error) {
+	return LoadSenderContext(context.Background(), args, config)
+}
+
+// LoadSenderContext is LoadSenderWithAnchors that gives up once ctx is done, see AttachSenderContext
+func LoadSenderContext(ctx context.Context, args stamp.Args, config LoaderConfig) (senderFD, error) {
+	l := NewLoader(config)
+	if err := l.AttachSenderContext(ctx, args); err != nil {
+		return senderFD{}, err
 	}
+	return senderFD{Objs: l.Senders[0], Links: l.Links, Failed: l.Failed, others: l.Senders[1:], events: newEventStream(l.logger(), args.D_port), pinDir: l.pinDir, statsPin: l.statsPinDir, placements: l.placements, xdp: l.xdp, loader: l, args: args, ErrorEstimate: l.clocks.errEst, Clock: l.clocks.info()}, nil
+}
+
+// LoadReflector loads the reflector programs and attaches them to the head of the interface's TCX chain.
+// On error whatever was loaded is cleaned up and the returned reflectorFD is zero, so it's still safe to Close()
+func LoadReflector(args stamp.Args) (reflectorFD, error) {
+	return LoadReflectorWithAnchors(args, defaultConfig(args))
+}
+
+// LoadReflectorWithAnchors is LoadReflector with the TCX anchor and verifier log level taken from config
+func LoadReflectorWithAnchors(args stamp.Args, config LoaderConfig) (reflectorFD, error) {
+	return LoadReflectorContext(context.Background(), args, config)
+}
+
+// LoadReflectorContext is LoadReflectorWithAnchors that gives up once ctx is done, see AttachReflectorContext
+func LoadReflectorContext(ctx context.Context, args stamp.Args, config LoaderConfig) (reflectorFD, error) {
+	l := NewLoader(config)
+	if err := l.AttachReflectorContext(ctx, args); err != nil {
+		return reflectorFD{}, err
+	}
+	return reflectorFD{Objs: l.Reflectors[0], Links: l.Links, Failed: l.Failed, others: l.Reflectors[1:], pinDir: l.pinDir, statsPin: l.statsPinDir, placements: l.placements, loader: l, args: args, ErrorEstimate: l.clocks.errEst, Clock: l.clocks.info()}, nil
+}
+
+// every interface we attach to, args.Dev is the one we take the local IP from and always goes first
+func devices(args stamp.Args) []*net.Interface {
+	if len(args.Devs) == 0 {
+		return []*net.Interface{args.Dev}
+	}
+	return args.Devs
+}
 
-	// Check if we have clock syncing
-	if checkSync() == false {
-		if args.Sync == true || args.PTP == true {
-			log.Fatalf("No clock syncing detected with --enforce-sync flag set, aborting")
+// runs attach for every interface
+// fail-fast tears down everything attached so far on the first failure, keep-going notes it down and moves on
+// a done ctx tears everything down either way, nobody's waiting for the result anymore
+func (l *Loader) attachAll(ctx context.Context, args stamp.Args, attach func(dev *net.Interface) error) error {
+	for _, dev := range devices(args) {
+		if ctx.Err() != nil {
+			l.Close()
+			return fmt.Errorf("Attach cancelled before %s: %w", dev.Name, ctx.Err())
 		}
-	} else {
-		if checkPTP() == false && args.PTP == true {
-			log.Fatalf("No PTP syncing detected with --enforce-ptp flag set, aborting")
+		err := attach(dev)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("Error attaching to %s: %w", dev.Name, err)
+		if args.KeepGoing == false || ctx.Err() != nil {
+			l.Close()
+			return err
 		}
+		l.Failed = append(l.Failed, err)
+	}
+	if len(l.Links) == 0 {
+		l.Close()
+		return fmt.Errorf("Couldn't attach to any interface: %w", errors.Join(l.Failed...))
 	}
+	return nil
+}
 
-	// Attach TCX programs
-	var links []link.Link
+// AttachSender loads the sender programs and attaches them to every interface, or the cgroup in cgroup mode.
+// On error whatever was loaded is cleaned up
+func (l *Loader) AttachSender(args stamp.Args) error {
+	return l.AttachSenderContext(context.Background(), args)
+}
 
-	// No anchor manager needed - using direct attachment with anchor from config
+// AttachSenderContext is AttachSender that gives up once ctx is done. Syscalls can't be interrupted so it's checked in between steps,
+// once it's done whatever got attached comes back off(an egress link whose ingress didn't make it yet included) and ctx.Err() is in the chain
+func (l *Loader) AttachSenderContext(ctx context.Context, args stamp.Args) error {
+	return l.inNetns(func() error { return l.attachSenderContext(ctx, args) })
+}
 
-	// Attach egress program
-	var egressLink link.Link
-	// Direct attachment with anchor from config
-	egressLink, err = link.AttachTCX(link.TCXOptions{
-		Program:   objs.SenderOut,
-		Attach:    ebpf.AttachTCXEgress,
-		Interface: args.Dev.Index,
-		Anchor:    config.Anchor,
-	})
+func (l *Loader) attachSenderContext(ctx context.Context, args stamp.Args) error {
+	if err := l.netnsDevices(args); err != nil {
+		return err
+	}
+	if err := l.checkLocalAddr(args); err != nil {
+		return err
+	}
+	port, err := sourcePort(args.S_port)
 	if err != nil {
-		log.Fatalf("Error attaching egress program: %v", err)
-	}
-	links = append(links, egressLink)
-
-	// Attach ingress program
-	var ingressLink link.Link
-	// Direct attachment with anchor from config
-	ingressLink, err = link.AttachTCX(link.TCXOptions{
-		Program:   objs.SenderIn,
-		Attach:    ebpf.AttachTCXIngress,
-		Interface: args.Dev.Index,
-		Anchor:    config.Anchor,
-	})
+		return err
+	}
+	args.S_port = int(port)
+	// same rules as the source port, 0 goes to 862 too
+	if port, err = sourcePort(args.D_port); err != nil {
+		return err
+	}
+	args.D_port = int(port)
+	// it's only 6 bits in the header, anything bigger would spill over into ECN
+	if args.DSCP < 0 || args.DSCP > 63 {
+		return fmt.Errorf("Invalid DSCP %d: has to be between 0 and 63", args.DSCP)
+	}
+	// cgroup programs can't write to the packet
+	if args.RewriteSource == true && args.Cgroup != "" {
+		return fmt.Errorf("Source address rewriting doesn't work in cgroup mode")
+	}
+	if l.Config.AttachMode == AttachXDP && args.Cgroup != "" {
+		return fmt.Errorf("AttachXDP needs an interface, it doesn't work in cgroup mode")
+	}
+	// a reopened handle would have to find its links again and XDP ones don't get pinned
+	if l.Config.AttachMode == AttachXDP && l.Config.PinPath != "" {
+		return fmt.Errorf("AttachXDP can't be pinned")
+	}
+	// Check if we need to adjust TAI and if clock syncing is what we were asked to enforce
+	clk, err := checkClocks(args, l.syncChecker(), l.logger())
 	if err != nil {
-		log.Fatalf("Error attaching ingress program: %v", err)
+		return err
 	}
-	links = append(links, ingressLink)
-
-	fmt.Println()
-	return senderFD{Objs: objs, Links: links}
+	l.clocks = clk
+	// cgroup mode replaces the interface attachment altogether, the device is only there for the local IP
+	if args.Cgroup != "" {
+		args.Devs = nil
+	}
+	// nothing gets attached so one set of objects is enough, and the pins of a live run are none of our business
+	if l.Config.DryRun == true {
+		return l.attachSender(ctx, args, args.Dev, clk)
+	}
+	if err := l.clearStalePins("sender"); err != nil {
+		return err
+	}
+	if err := l.attachAll(ctx, args, func(dev *net.Interface) error { return l.attachSender(ctx, args, dev, clk) }); err != nil {
+		return err
+	}
+	if err := l.pinStats("sender", map[string]*ebpf.Map{pinStats: l.Senders[0].Stats}); err != nil {
+		l.Close()
+		return err
+	}
+	return nil
 }
 
-func LoadReflector(args stamp.Args) reflectorFD {
-	// Default config - use Head anchor
-	config := LoaderConfig{
-		UseAnchors: true,
-		Anchor:     link.Head(),
+func (l *Loader) attachSender(ctx context.Context, args stamp.Args, dev *net.Interface, clk clocks) error {
+	tlvs, err := checkTLVs(args, dev)
+	if err != nil {
+		return err
+	}
+	var objs sender.SenderObjects
+	// every interface after the first one shares its maps so they all feed the same session
+	// recent_idx isn't shared so the ring can lose a few entries early, the dump sorts by T4 anyway
+	var shared map[string]*ebpf.Map
+	if len(l.Senders) > 0 {
+		shared = map[string]*ebpf.Map{
+			"output":   l.Senders[0].Output,
+			"probes":   l.Senders[0].Probes,
+			"recent":   l.Senders[0].Recent,
+			"stats":    l.Senders[0].Stats,
+			"arrivals": l.Senders[0].Arrivals,
+			"events":   l.Senders[0].Events,
+			"seqtrack": l.Senders[0].Seqtrack,
+			"captures": l.Senders[0].Captures,
+		}
+	}
+	opts := l.collectionOptions(shared)
+	if err := removeMemlock(); err != nil {
+		return err
+	}
+	spec, err := l.loadSpec("sender", sender.LoadSender, &sender.SenderSpecs{})
+	if err != nil {
+		return fmt.Errorf("Error loading program spec: %w", err)
+	}
+	// size the recent measurements ring, array maps can't have 0 entries so it stays at 1 when disabled
+	if args.Recent > 0 {
+		spec.Maps["recent"].MaxEntries = args.Recent
+	}
+	shrinkCaptures(spec, args)
+	err = spec.LoadAndAssign(&objs, &opts)
+	if err != nil {
+		return loadError(err)
+	} else {
+		l.logger().Info("All programs successfully loaded and verified", "role", "sender", "iface", devName(dev))
+		logVerifier(l.logger(), senderProgs(&objs.SenderPrograms))
+	}
+
+	// populate globals - we only ever send from the one socket so the local IP is the same everywhere
+	setLocalAddr(objs.Laddr, objs.Laddr6, objs.IpFamily, args.Localaddr)
+	objs.S_port.Set(uint16(args.S_port))
+	objs.D_port.Set(uint16(args.D_port))
+	objs.RecentLen.Set(args.Recent)
+	objs.SampleRate.Set(args.SampleRate)
+	objs.NextSeq.Set(args.SeqStart)
+	objs.Capture.Set(args.Capture)
+	setTAI(objs.Tai, objs.TaiOffset, clk.leap, args.TAIOffset)
+	objs.ErrEst.Set(uint16(clk.errEst))
+	setAuth(objs.Auth, args.AuthKey)
+	objs.TlvLen.Set(tlvs)
+	if args.FollowUp == true {
+		objs.FollowUp.Set(uint16(1))
+	} else {
+		objs.FollowUp.Set(uint16(0))
+	}
+	if args.LocationTLV == true {
+		objs.Location.Set(uint16(1))
+	} else {
+		objs.Location.Set(uint16(0))
+	}
+	if args.TimestampInfo == true {
+		objs.TsInfo.Set(uint16(1))
+	} else {
+		objs.TsInfo.Set(uint16(0))
+	}
+	// the Z bit goes on with it, the reflector takes its cue from that
+	objs.TsFormat.Set(uint16(args.TimestampFormat))
+	objs.Dscp.Set(uint16(args.DSCP))
+	if args.RewriteSource == true {
+		objs.RewriteSrc.Set(uint16(1))
+	} else {
+		objs.RewriteSrc.Set(uint16(0))
+	}
+	// cgroup programs start at the IP header, there's no tag to skip
+	if args.VLANAware == true && args.Cgroup == "" {
+		objs.VlanAware.Set(uint16(1))
+	} else {
+		objs.VlanAware.Set(uint16(0))
+	}
+	setLimits(&objs, args)
+	l.setHWTimestamps(objs.HwTs, args, dev)
+	if l.Config.DryRun == true {
+		l.logger().Info("Dry run, not attaching", "iface", devName(dev))
+		l.Senders = append(l.Senders, objs)
+		return nil
+	}
+
+	if args.Cgroup != "" {
+		err = l.attachPair(ctx, args, dev, objs.SenderCgOut, objs.SenderCgIn, ebpf.AttachCGroupInetEgress, ebpf.AttachCGroupInetIngress)
+	} else {
+		err = l.attachPair(ctx, args, dev, objs.SenderOut, objs.SenderIn, ebpf.AttachTCXEgress, ebpf.AttachTCXIngress)
+	}
+	if err != nil {
+		objs.Close()
+		return err
+	}
+	var maps map[string]**ebpf.Map
+	if len(l.Senders) == 0 {
+		maps = senderMaps(&objs.SenderMaps)
 	}
+	if err := l.pinInterface(pinName(args, dev), senderProgs(&objs.SenderPrograms), maps); err != nil {
+		l.dropLastPair()
+		objs.Close()
+		return err
+	}
+	l.Senders = append(l.Senders, objs)
+	l.attachXDP(args, dev, objs.SenderXdpIn)
+	return nil
+}
 
-	return loadReflectorWithConfig(args, config)
+// AttachReflector loads the reflector programs and attaches them to every interface.
+// On error whatever was loaded is cleaned up
+func (l *Loader) AttachReflector(args stamp.Args) error {
+	return l.AttachReflectorContext(context.Background(), args)
 }
 
-func loadReflectorWithConfig(args stamp.Args, config LoaderConfig) reflectorFD {
+// AttachReflectorContext is AttachReflector that gives up once ctx is done, see AttachSenderContext
+func (l *Loader) AttachReflectorContext(ctx context.Context, args stamp.Args) error {
+	return l.inNetns(func() error { return l.attachReflectorContext(ctx, args) })
+}
+
+func (l *Loader) attachReflectorContext(ctx context.Context, args stamp.Args) error {
+	if err := l.netnsDevices(args); err != nil {
+		return err
+	}
+	if err := l.checkLocalAddr(args); err != nil {
+		return err
+	}
+	port, err := sourcePort(args.S_port)
+	if err != nil {
+		return err
+	}
+	args.S_port = int(port)
+	// it's there for the replies coming back, the reflector's requests need turning around on TC
+	if l.Config.AttachMode == AttachXDP {
+		return fmt.Errorf("AttachXDP is sender only")
+	}
+	// Check if we need to adjust TAI and if clock syncing is what we were asked to enforce
+	clk, err := checkClocks(args, l.syncChecker(), l.logger())
+	if err != nil {
+		return err
+	}
+	l.clocks = clk
+	if l.Config.DryRun == true {
+		return l.attachReflector(ctx, args, args.Dev, clk)
+	}
+	if err := l.clearStalePins("reflector"); err != nil {
+		return err
+	}
+	if err := l.attachAll(ctx, args, func(dev *net.Interface) error { return l.attachReflector(ctx, args, dev, clk) }); err != nil {
+		return err
+	}
+	if err := l.pinStats("reflector", map[string]*ebpf.Map{pinStats: l.Reflectors[0].Stats, pinSessions: l.Reflectors[0].Sessions}); err != nil {
+		l.Close()
+		return err
+	}
+	return nil
+}
+
+func (l *Loader) attachReflector(ctx context.Context, args stamp.Args, dev *net.Interface, clk clocks) error {
+	// every interface has its own address that requests come to
+	laddr := args.Localaddr
+	if dev != nil && dev.Index != args.Dev.Index {
+		var err error
+		if laddr, err = interfaceAddr(dev, args.Localaddr); err != nil {
+			return err
+		}
+	}
+	// a dry run might not have an interface to take it from, it never sees a packet anyway
+	var other net.IP
+	if args.DualStack == true && dev != nil {
+		var err error
+		if other, err = otherFamilyAddr(dev, laddr); err != nil {
+			return fmt.Errorf("Can't run dual-stack: %w", err)
+		}
+	} else if args.DualStack == true {
+		other = net.IPv6zero
+		if laddr.To4() == nil {
+			other = net.IPv4zero
+		}
+	}
 	var objs reflector.ReflectorObjects
-	var opts = ebpf.CollectionOptions{Programs: ebpf.ProgramOptions{LogLevel: 1}}
-	err := reflector.LoadReflectorObjects(&objs, &opts)
+	// every interface after the first one reports through its ringbuf and counts into its stats
+	var shared map[string]*ebpf.Map
+	if len(l.Reflectors) > 0 {
+		shared = map[string]*ebpf.Map{
+			"output":    l.Reflectors[0].Output,
+			"stats":     l.Reflectors[0].Stats,
+			"arrivals":  l.Reflectors[0].Arrivals,
+			"sessions":  l.Reflectors[0].Sessions,
+			"followups": l.Reflectors[0].Followups,
+			"allowed":   l.Reflectors[0].Allowed,
+			"rate":      l.Reflectors[0].Rate,
+			"captures":  l.Reflectors[0].Captures,
+		}
+	}
+	opts := l.collectionOptions(shared)
+	if err := removeMemlock(); err != nil {
+		return err
+	}
+	spec, err := l.loadSpec("reflector", reflector.LoadReflector, &reflector.ReflectorSpecs{})
 	if err != nil {
-		var verr *ebpf.VerifierError
-		if errors.As(err, &verr) {
-			log.Fatalf("Verifier error: %+v\n", verr)
+		return fmt.Errorf("Error loading program spec: %w", err)
+	}
+	shrinkCaptures(spec, args)
+	// the shared maps get created with the first interface, the rest reuse them as they are
+	if args.Queues > 1 && len(l.Reflectors) == 0 {
+		if err := spreadQueues(spec, args.Queues); err != nil {
+			return err
 		}
-		log.Fatalf("Error loading programs: %v", err)
+	}
+	err = spec.LoadAndAssign(&objs, &opts)
+	if err != nil {
+		return loadError(err)
 	} else {
-		fmt.Println("All programs successfully loaded and verified")
-		if args.Debug == true {
-			log.Print(objs.ReflectorIn.VerifierLog)
-			log.Print(objs.ReflectorOut.VerifierLog)
-		}
+		l.logger().Info("All programs successfully loaded and verified", "role", "reflector", "iface", devName(dev))
+		logVerifier(l.logger(), reflectorProgs(&objs.ReflectorPrograms))
 	}
 
 	// populate globals
-	ip := binary.LittleEndian.Uint32(args.Localaddr.To4())
-	objs.Laddr.Set(ip)
+	if args.DualStack == true {
+		setDualStack(objs.Laddr, objs.Laddr6, objs.IpFamily, objs.DualStack, laddr, other)
+	} else {
+		setLocalAddr(objs.Laddr, objs.Laddr6, objs.IpFamily, laddr)
+	}
 	objs.S_port.Set(uint16(args.S_port))
-
-	// Check if we need to adjust TAI
-	if checkTAI() == true {
-		objs.Tai.Set(uint16(1))
+	objs.ReplySport.Set(uint16(args.ReflectSport))
+	objs.Capture.Set(args.Capture)
+	setTAI(objs.Tai, objs.TaiOffset, clk.leap, args.TAIOffset)
+	objs.ErrEst.Set(uint16(clk.errEst))
+	setAuth(objs.Auth, args.AuthKey)
+	if args.Stateful == true {
+		objs.ReflMode.Set(uint16(1))
+	} else {
+		objs.ReflMode.Set(uint16(0))
+	}
+	objs.MaxReplyPps.Set(replyBudget(args.MaxReplyPPS, args.Queues))
+	// whatever TLVs the sender put behind the base packet come back to it untouched, authenticated packets are handled in userspace
+	if len(args.AuthKey) > 0 {
+		objs.TlvAny.Set(uint16(0))
 	} else {
-		objs.Tai.Set(uint16(0))
+		objs.TlvAny.Set(uint16(1))
 	}
-	// Check if we have clock syncing
-	if checkSync() == false {
-		if args.Sync == true || args.PTP == true {
-			log.Fatalf("No clock syncing detected with --enforce-sync flag set, aborting")
+	// the map is shared, it only has to be filled in once
+	if len(l.Reflectors) == 0 {
+		if err := fillAllowed(objs.Allowed, args.AllowFrom); err != nil {
+			objs.Close()
+			return err
 		}
+	}
+	if len(args.AllowFrom) > 0 {
+		objs.AllowFrom.Set(uint16(1))
+	} else {
+		objs.AllowFrom.Set(uint16(0))
+	}
+	// the sender makes room for the Follow-Up TLV, we only fill it in if it's there
+	if args.FollowUp == true && len(args.AuthKey) == 0 {
+		objs.FollowUp.Set(uint16(1))
+	} else {
+		objs.FollowUp.Set(uint16(0))
+	}
+	// same for the Location TLV
+	if args.LocationTLV == true && len(args.AuthKey) == 0 {
+		objs.Location.Set(uint16(1))
+	} else {
+		objs.Location.Set(uint16(0))
+	}
+	// and the Timestamp Information TLV, which tells the sender what our clock is synced to
+	if args.TimestampInfo == true && len(args.AuthKey) == 0 {
+		objs.TsInfo.Set(uint16(1))
+	} else {
+		objs.TsInfo.Set(uint16(0))
+	}
+	objs.SyncSrc.Set(uint8(clk.info().Source))
+	if args.VLANAware == true {
+		objs.VlanAware.Set(uint16(1))
+	} else {
+		objs.VlanAware.Set(uint16(0))
+	}
+	if args.Passive == true {
+		objs.Passive.Set(uint16(1))
+	} else {
+		objs.Passive.Set(uint16(0))
+	}
+	if args.KeepPorts == true {
+		objs.KeepPorts.Set(uint16(1))
 	} else {
-		if checkPTP() == false && args.PTP == true {
-			log.Fatalf("No PTP syncing detected with --enforce-ptp flag set, aborting")
+		objs.KeepPorts.Set(uint16(0))
+	}
+	if args.ZeroUDPCsum == true {
+		objs.ZeroCsum.Set(uint16(1))
+	} else {
+		objs.ZeroCsum.Set(uint16(0))
+	}
+	l.setHWTimestamps(objs.HwTs, args, dev)
+	if l.Config.DryRun == true {
+		l.logger().Info("Dry run, not attaching", "iface", devName(dev))
+		l.Reflectors = append(l.Reflectors, objs)
+		return nil
+	}
+
+	if err := l.attachPair(ctx, args, dev, objs.ReflectorOut, objs.ReflectorIn, ebpf.AttachTCXEgress, ebpf.AttachTCXIngress); err != nil {
+		objs.Close()
+		return err
+	}
+	var maps map[string]**ebpf.Map
+	if len(l.Reflectors) == 0 {
+		maps = reflectorMaps(&objs.ReflectorMaps)
+	}
+	if err := l.pinInterface(pinName(args, dev), reflectorProgs(&objs.ReflectorPrograms), maps); err != nil {
+		l.dropLastPair()
+		objs.Close()
+		return err
+	}
+	l.Reflectors = append(l.Reflectors, objs)
+	return nil
+}
+
+// Detach takes everything the loader attached off the interfaces, the objects stay loaded
+func (l *Loader) Detach() {
+	detach(l.Links)
+	detachXDP(l.xdp)
+	for _, dev := range l.devs {
+		l.releaseAnchors(dev.Name)
+	}
+	l.Links, l.devs = nil, nil
+}
+
+func (l *Loader) releaseAnchors(iface string) {
+	l.Anchors.ReleaseAnchor(iface, ebpf.AttachTCXEgress)
+	l.Anchors.ReleaseAnchor(iface, ebpf.AttachTCXIngress)
+}
+
+// Close detaches and unloads everything
+func (l *Loader) Close() {
+	l.Detach()
+	for _, o := range l.Senders {
+		o.Close()
+	}
+	for _, o := range l.Reflectors {
+		o.Close()
+	}
+	l.Senders, l.Reflectors = nil, nil
+	unpin(l.pinDir)
+	unpin(l.statsPinDir)
+}
+
+// LoaderConfig.CollectionOptions with our log level and the maps every interface shares on top.
+// A failed load still gets a log since the library retries with logging on, 0 only skips it for the successful ones
+func (l *Loader) collectionOptions(shared map[string]*ebpf.Map) ebpf.CollectionOptions {
+	opts := l.Config.CollectionOptions
+	if l.Config.VerifierLogLevel != 0 {
+		opts.Programs.LogLevel = ebpf.LogLevel(l.Config.VerifierLogLevel)
+	}
+	// a copy, the caller's map stays the way they made it
+	replacements := make(map[string]*ebpf.Map, len(opts.MapReplacements)+len(shared))
+	for name, m := range opts.MapReplacements {
+		replacements[name] = m
+	}
+	for name, m := range shared {
+		replacements[name] = m
+	}
+	opts.MapReplacements = replacements
+	return opts
+}
+
+// an explicit --tai-offset wins over whatever detection came up with
+func setTAI(tai, offset *ebpf.Variable, leap bool, taiOffset int) {
+	if taiOffset != 0 {
+		tai.Set(uint16(2))
+		offset.Set(int32(stamp.TAICorrection(taiOffset)))
+	} else if leap == true {
+		tai.Set(uint16(1))
+	} else {
+		tai.Set(uint16(0))
+	}
+}
+
+// the key itself never makes it into the kernel, BPF can't do HMAC - it only has to know the packets are bigger
+func setAuth(auth *ebpf.Variable, key []byte) {
+	if len(key) > 0 {
+		auth.Set(uint16(1))
+	} else {
+		auth.Set(uint16(0))
+	}
+}
+
+// the one place programs get attached: egress first, then ingress
+// if ingress fails egress comes back off so we never leave half a session attached
+func (l *Loader) attachPair(ctx context.Context, args stamp.Args, dev *net.Interface, egress, ingress *ebpf.Program, egressType, ingressType ebpf.AttachType) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("Attach cancelled: %w", ctx.Err())
+	}
+	// a direction we skip still gets its spot in Links, nil like a detached one
+	doEgress, doIngress := l.directions()
+	var egressLink, ingressLink link.Link
+	var err error
+	if doEgress == true {
+		if egressLink, err = l.attach(args, dev, egress, egressType); err != nil {
+			return fmt.Errorf("Error attaching egress program: %w", err)
+		}
+	}
+	if ctx.Err() != nil {
+		detachOne(l.placements, egressLink)
+		return fmt.Errorf("Attach cancelled after egress: %w", ctx.Err())
+	}
+	if doIngress == true {
+		if ingressLink, err = l.attach(args, dev, ingress, ingressType); err != nil {
+			detachOne(l.placements, egressLink)
+			return fmt.Errorf("Error attaching ingress program: %w", err)
 		}
 	}
+	l.Links = append(l.Links, egressLink, ingressLink)
+	l.devs = append(l.devs, dev)
+	return nil
+}
 
-	// Attach TCX programs
-	var links []link.Link
+// LoaderConfig.AttachEgress/AttachIngress, neither means both
+func (l *Loader) directions() (egress, ingress bool) {
+	if l.Config.AttachEgress == false && l.Config.AttachIngress == false {
+		return true, true
+	}
+	return l.Config.AttachEgress, l.Config.AttachIngress
+}
 
-	// No anchor manager needed - using direct attachment with anchor from config
+// takes a link that never made it into Links back off, nil is fine
+func detachOne(placements map[link.Link]placement, lnk link.Link) {
+	if lnk == nil {
+		return
+	}
+	delete(placements, lnk)
+	lnk.Close()
+}
 
-	// Attach egress program
-	var egressLink link.Link
-	// Direct attachment with anchor from config
-	egressLink, err = link.AttachTCX(link.TCXOptions{
-		Program:   objs.ReflectorOut,
-		Attach:    ebpf.AttachTCXEgress,
-		Interface: args.Dev.Index,
-		Anchor:    config.Anchor,
-	})
+// undoes the last attachPair
+func (l *Loader) dropLastPair() {
+	for _, lnk := range l.Links[len(l.Links)-2:] {
+		delete(l.placements, lnk)
+	}
+	detach(l.Links[len(l.Links)-2:])
+	l.Links = l.Links[:len(l.Links)-2]
+	l.devs = l.devs[:len(l.devs)-1]
+}
+
+func (l *Loader) attach(args stamp.Args, dev *net.Interface, prog *ebpf.Program, typ ebpf.AttachType) (link.Link, error) {
+	// unlike TCX there are no anchors, cgroup programs are run in attach order
+	if typ == ebpf.AttachCGroupInetEgress || typ == ebpf.AttachCGroupInetIngress {
+		lnk, err := l.withRetry(args.Cgroup, typ, func() (link.Link, error) {
+			return link.AttachCgroup(link.CgroupOptions{Path: args.Cgroup, Attach: typ, Program: prog})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cgroup %s: %w", args.Cgroup, err)
+		}
+		return lnk, nil
+	}
+	if l.tcMode() == true {
+		return l.withRetry(dev.Name, typ, func() (link.Link, error) {
+			if err := l.refreshIndex(dev); err != nil {
+				return nil, err
+			}
+			return l.attachTC(dev, prog, typ)
+		})
+	}
+	if err := l.refreshIndex(dev); err != nil {
+		return nil, err
+	}
+	if err := l.checkAttached(dev, prog, typ); err != nil {
+		return nil, err
+	}
+	anc, pos, err := l.anchorFor(dev, typ)
 	if err != nil {
-		log.Fatalf("Error attaching egress program: %v", err)
-	}
-	links = append(links, egressLink)
-
-	// Attach ingress program
-	var ingressLink link.Link
-	// Direct attachment with anchor from config
-	ingressLink, err = link.AttachTCX(link.TCXOptions{
-		Program:   objs.ReflectorIn,
-		Attach:    ebpf.AttachTCXIngress,
-		Interface: args.Dev.Index,
-		Anchor:    config.Anchor,
+		return nil, err
+	}
+	lnk, err := l.withRetry(dev.Name, typ, func() (link.Link, error) {
+		if err := l.refreshIndex(dev); err != nil {
+			return nil, err
+		}
+		return link.AttachTCX(link.TCXOptions{
+			Program:   prog,
+			Attach:    typ,
+			Interface: dev.Index,
+			Anchor:    anc,
+		})
 	})
+	// a relative anchor can go stale(e.g. the program we anchored to got replaced), the head is always there
+	if err != nil && anc != nil && anc != link.Head() && l.strict() == false {
+		l.logger().Warn("Failed to attach relative to the configured anchor, falling back to head", "iface", dev.Name, "direction", typ, "err", err)
+		lnk, err = l.withRetry(dev.Name, typ, func() (link.Link, error) {
+			if err := l.refreshIndex(dev); err != nil {
+				return nil, err
+			}
+			return link.AttachTCX(link.TCXOptions{
+				Program:   prog,
+				Attach:    typ,
+				Interface: dev.Index,
+				Anchor:    link.Head(),
+			})
+		})
+		if err == nil {
+			p := placement{fallback: true}
+			if pos != nil {
+				generic := anchor.Generic
+				p.position = &generic
+			}
+			l.placements[lnk] = p
+		}
+		return lnk, err
+	}
+	if err == nil {
+		p := placement{anchored: anc != nil && anc != link.Head() && anc != link.Tail(), position: pos}
+		p.fallback = pos != nil && *pos != l.Config.Position
+		l.placements[lnk] = p
+	}
+	return lnk, err
+}
+
+// where a link ended up in the chain, see LinkInfo
+type placement struct {
+	anchored bool
+	position *anchor.AnchorPosition
+	fallback bool
+}
+
+// without anchors we just get appended to the chain
+// the position is where the anchor manager actually put us, only when it went by LoaderConfig.Position
+// the index we got at startup is only good until the interface is recreated, the name is what the user gave us;
+// dev is updated in place so everything holding it(args, devs, the health check) follows
+func (l *Loader) refreshIndex(dev *net.Interface) error {
+	cur, err := net.InterfaceByName(dev.Name)
 	if err != nil {
-		log.Fatalf("Error attaching ingress program: %v", err)
+		return fmt.Errorf("Interface %s no longer exists: %w", dev.Name, err)
+	}
+	if cur.Index != dev.Index {
+		l.logger().Warn("Interface index changed since startup, attaching to the new one", "iface", dev.Name, "was", dev.Index, "now", cur.Index)
+		*dev = *cur
+	}
+	return nil
+}
+
+func (l *Loader) anchorFor(dev *net.Interface, typ ebpf.AttachType) (link.Anchor, *anchor.AnchorPosition, error) {
+	if anc := l.aroundSender(typ); anc != nil {
+		return anc, nil, nil
 	}
-	links = append(links, ingressLink)
+	if l.Config.UseAnchors == false {
+		return nil, nil, nil
+	}
+	if l.Config.AnchorBeforeProgram != "" && l.Config.AnchorAfterProgram != "" {
+		return nil, nil, fmt.Errorf("Can't anchor both before %s and after %s", l.Config.AnchorBeforeProgram, l.Config.AnchorAfterProgram)
+	}
+	if l.Config.AnchorBeforeProgram != "" {
+		anc, err := l.Anchors.CreateAnchorByName(dev.Name, typ, l.Config.AnchorBeforeProgram, true)
+		return anc, nil, err
+	}
+	if l.Config.AnchorAfterProgram != "" {
+		anc, err := l.Anchors.CreateAnchorByName(dev.Name, typ, l.Config.AnchorAfterProgram, false)
+		return anc, nil, err
+	}
+	if l.Config.Anchor != nil {
+		return l.Config.Anchor, nil, nil
+	}
+	anc, pos, err := l.Anchors.CreateAnchor(dev.Name, typ, l.Config.Position)
+	return anc, &pos, err
+}
 
-	fmt.Println()
-	return reflectorFD{Objs: objs, Links: links}
+// whether a failed anchor is an error rather than a reason to take the head, being told which program to go next to counts too
+func (l *Loader) strict() bool {
+	return l.Config.StrictAnchoring == true || l.Config.AnchorBeforeProgram != "" || l.Config.AnchorAfterProgram != ""
 }
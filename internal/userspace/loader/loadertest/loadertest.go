@@ -0,0 +1,151 @@
+// Package loadertest has an in-memory loader.Attacher for unit testing code that runs STAMP sessions without root or a kernel
+package loadertest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/loader"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// Fake hands out handles with canned stats and events, set the fields before the first attach
+type Fake struct {
+	// what every handle's Stats() starts out returning, see Handle.SetStats
+	Stats loader.Stats
+	// queued up on every sender handle's Events() channel
+	Events []loader.StampEvent
+	// returned by the attach calls instead of a handle, e.g. to test what happens when the interface isn't there
+	AttachErr error
+
+	mut     sync.Mutex
+	handles []*Handle
+}
+
+var _ loader.Attacher = (*Fake)(nil)
+
+// AttachSender gives a sender handle, AttachErr if it's set. Like the real one it fails with ctx.Err() once ctx is done
+func (f *Fake) AttachSender(ctx context.Context, args stamp.Args) (loader.SenderHandle, error) {
+	h, err := f.attach(ctx, args, true)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// AttachReflector gives a reflector handle, no events on it
+func (f *Fake) AttachReflector(ctx context.Context, args stamp.Args) (loader.Handle, error) {
+	h, err := f.attach(ctx, args, false)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (f *Fake) attach(ctx context.Context, args stamp.Args, sender bool) (*Handle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Gave up loading: %w", err)
+	}
+	if f.AttachErr != nil {
+		return nil, f.AttachErr
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	h := &Handle{Args: args, Sender: sender, stats: f.Stats}
+	if sender == true {
+		h.events = make(chan loader.StampEvent, len(f.Events))
+		for _, ev := range f.Events {
+			h.events <- ev
+		}
+	}
+	f.handles = append(f.handles, h)
+	return h, nil
+}
+
+// Handles is every handle handed out so far, in order
+func (f *Fake) Handles() []*Handle {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return append([]*Handle{}, f.handles...)
+}
+
+// Handle is a fake loaded sender or reflector, it remembers what was done to it
+type Handle struct {
+	// what it was attached with
+	Args   stamp.Args
+	Sender bool
+
+	mut              sync.Mutex
+	stats            loader.Stats
+	err              error
+	events           chan loader.StampEvent
+	detached, closed bool
+}
+
+// Stats returns the canned stats, or whatever SetErr set
+func (h *Handle) Stats() (loader.Stats, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.err != nil {
+		return loader.Stats{}, h.err
+	}
+	return h.stats, nil
+}
+
+// SetStats changes what Stats() returns from now on, e.g. to move the counters along between polls
+func (h *Handle) SetStats(st loader.Stats) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.stats = st
+}
+
+// SetErr makes Err() and Stats() fail with err, the way a real handle does with loader.ErrInterfaceGone; nil clears it
+func (h *Handle) SetErr(err error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.err = err
+}
+
+func (h *Handle) Err() error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.err
+}
+
+// Events hands back Fake.Events and, like the real one, the channel is closed once the handle is closed; nil on a reflector
+func (h *Handle) Events() <-chan loader.StampEvent {
+	return h.events
+}
+
+func (h *Handle) Detach() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.detached = true
+}
+
+func (h *Handle) Close() {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.closed == true {
+		return
+	}
+	h.detached, h.closed = true, true
+	if h.events != nil {
+		close(h.events)
+	}
+}
+
+// Detached says whether Detach() or Close() was called
+func (h *Handle) Detached() bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.detached
+}
+
+// Closed says whether Close() was called
+func (h *Handle) Closed() bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.closed
+}
@@ -0,0 +1,51 @@
+package loadertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/loader"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// what a consumer's session code looks like: attach, read, close; none of it needs root
+func TestFake(t *testing.T) {
+	fake := &Fake{Stats: loader.Stats{PacketsSent: 3}, Events: []loader.StampEvent{{Seq: 0}, {Seq: 1}}}
+	var attacher loader.Attacher = fake
+	h, err := attacher.AttachSender(context.Background(), stamp.Args{D_port: 862})
+	if err != nil {
+		t.Fatalf("AttachSender() returned error: %v", err)
+	}
+	if st, err := h.Stats(); err != nil || st.PacketsSent != 3 {
+		t.Errorf("Stats() = %+v, %v, want 3 sent", st, err)
+	}
+	fake.Handles()[0].SetErr(loader.ErrInterfaceGone)
+	if _, err := h.Stats(); errors.Is(err, loader.ErrInterfaceGone) == false {
+		t.Errorf("Stats() error = %v, want %v", err, loader.ErrInterfaceGone)
+	}
+	h.Close()
+	var seqs []uint32
+	for ev := range h.Events() {
+		seqs = append(seqs, ev.Seq)
+	}
+	if len(seqs) != 2 || seqs[0] != 0 || seqs[1] != 1 {
+		t.Errorf("Events() gave seqs %v, want [0 1]", seqs)
+	}
+	got := fake.Handles()
+	if len(got) != 1 || got[0].Closed() == false || got[0].Args.D_port != 862 {
+		t.Errorf("Handles() = %+v, want the one closed sender", got)
+	}
+	// twice is fine
+	h.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := attacher.AttachReflector(ctx, stamp.Args{}); errors.Is(err, context.Canceled) == false {
+		t.Errorf("AttachReflector() with a done ctx = %v, want %v", err, context.Canceled)
+	}
+	fake.AttachErr = errors.New("no such interface")
+	if _, err := attacher.AttachReflector(context.Background(), stamp.Args{}); err != fake.AttachErr {
+		t.Errorf("AttachReflector() = %v, want %v", err, fake.AttachErr)
+	}
+}
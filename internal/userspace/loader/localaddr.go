@@ -0,0 +1,125 @@
+package loader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// mirrors enum ip_fam in stamp.bpf.h
+const (
+	ipFamilyV4 uint16 = iota
+	ipFamilyV6
+)
+
+// dry runs can go without a device
+func devName(dev *net.Interface) string {
+	if dev == nil {
+		return ""
+	}
+	return dev.Name
+}
+
+func familyName(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// the BPF programs only look for packets to/from the local IP, so it has to actually be on the interface
+// a dry run never sees a packet so it doesn't care
+func (l *Loader) checkLocalAddr(args stamp.Args) error {
+	if l.Config.DryRun == true {
+		return nil
+	}
+	if args.Localaddr == nil {
+		return fmt.Errorf("No local address to run the session from")
+	}
+	addrs, err := args.Dev.Addrs()
+	if err != nil {
+		return fmt.Errorf("Error getting addresses of %s: %w", args.Dev.Name, err)
+	}
+	var sameFamily bool
+	for _, a := range addrs {
+		ip, _, err := net.ParseCIDR(a.String())
+		if err != nil {
+			continue
+		}
+		if ip.Equal(args.Localaddr) {
+			return nil
+		}
+		if (ip.To4() != nil) == (args.Localaddr.To4() != nil) {
+			sameFamily = true
+		}
+	}
+	if sameFamily == false {
+		return fmt.Errorf("Local address %s is %s but %s has no %s addresses", args.Localaddr, familyName(args.Localaddr), args.Dev.Name, familyName(args.Localaddr))
+	}
+	return fmt.Errorf("Local address %s is not assigned to %s", args.Localaddr, args.Dev.Name)
+}
+
+// populates the local address globals and tells the BPF side which IP version it's dealing with
+func setLocalAddr(laddr, laddr6, family *ebpf.Variable, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		// surprisingly, IPs are stored in LE
+		laddr.Set(binary.LittleEndian.Uint32(ip4))
+		family.Set(ipFamilyV4)
+		return
+	}
+	var ip6 [16]byte
+	copy(ip6[:], ip.To16())
+	laddr6.Set(ip6)
+	family.Set(ipFamilyV6)
+}
+
+// dual-stack reflector: both addresses go in and the packet says which one it's for, ip_family is just what we'd go by without it
+func setDualStack(laddr, laddr6, family, dual *ebpf.Variable, ip, other net.IP) {
+	setLocalAddr(laddr, laddr6, family, other)
+	// this one sets the family last
+	setLocalAddr(laddr, laddr6, family, ip)
+	dual.Set(uint16(1))
+}
+
+// first address on dev of the other IP version, for the other half of a dual-stack reflector
+func otherFamilyAddr(dev *net.Interface, ip net.IP) (net.IP, error) {
+	if ip.To4() != nil {
+		return interfaceAddr(dev, net.IPv6loopback)
+	}
+	return interfaceAddr(dev, net.IPv4zero)
+}
+
+// first address on dev of the same IP version as like, for the interfaces past the first one
+func interfaceAddr(dev *net.Interface, like net.IP) (net.IP, error) {
+	addrs, err := dev.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting addresses of %s: %w", dev.Name, err)
+	}
+	if ip := pickAddr(addrs, like); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("%s has no %s addresses", dev.Name, familyName(like))
+}
+
+// every IPv6 interface has a link-local fe80:: address and it's usually listed first, but it can't talk past the link;
+// it's only taken when there's nothing else
+func pickAddr(addrs []net.Addr, like net.IP) net.IP {
+	var linkLocal net.IP
+	for _, a := range addrs {
+		ip, _, err := net.ParseCIDR(a.String())
+		if err != nil || (ip.To4() != nil) != (like.To4() != nil) {
+			continue
+		}
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() == true {
+			if linkLocal == nil {
+				linkLocal = ip
+			}
+			continue
+		}
+		return ip
+	}
+	return linkLocal
+}
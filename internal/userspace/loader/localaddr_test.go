@@ -0,0 +1,121 @@
+package loader
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// a dummy interface with a primary and a secondary IPv4 address, needs root
+func dummyWithTwoAddrs(t *testing.T) *net.Interface {
+	conn, err := netlink.Dial()
+	if err != nil {
+		t.Skipf("Can't talk to netlink: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.CreateDummy("stampdummy0"); err != nil {
+		t.Skipf("Can't create a dummy interface: %v", err)
+	}
+	dev, err := net.InterfaceByName("stampdummy0")
+	if err != nil {
+		t.Fatalf("Error getting the dummy interface: %v", err)
+	}
+	t.Cleanup(func() {
+		if conn, err := netlink.Dial(); err == nil {
+			conn.DeleteLink(dev.Index)
+			conn.Close()
+		}
+	})
+	for _, cidr := range []string{"192.0.2.1/24", "192.0.2.2/24"} {
+		ip, n, _ := net.ParseCIDR(cidr)
+		n.IP = ip
+		if err := conn.AddAddr(dev.Index, n); err != nil {
+			t.Fatalf("Error adding %s: %v", cidr, err)
+		}
+	}
+	return dev
+}
+
+func TestCheckLocalAddr(t *testing.T) {
+	dev := dummyWithTwoAddrs(t)
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr bool
+	}{
+		{name: "primary", addr: "192.0.2.1"},
+		{name: "secondary", addr: "192.0.2.2"},
+		{name: "not assigned", addr: "192.0.2.3", wantErr: true},
+		{name: "other family", addr: "2001:db8::1", wantErr: true},
+	}
+	l := NewLoader(LoaderConfig{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := l.checkLocalAddr(stamp.Args{Dev: dev, Localaddr: net.ParseIP(tt.addr)})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkLocalAddr(%s) = %v, want error: %v", tt.addr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPickAddr(t *testing.T) {
+	cidrs := func(cs ...string) []net.Addr {
+		var res []net.Addr
+		for _, c := range cs {
+			ip, n, _ := net.ParseCIDR(c)
+			n.IP = ip
+			res = append(res, n)
+		}
+		return res
+	}
+	tests := []struct {
+		name  string
+		addrs []net.Addr
+		like  net.IP
+		want  string
+	}{
+		{name: "IPv4", addrs: cidrs("fe80::1/64", "192.0.2.1/24", "192.0.2.2/24"), like: net.IPv4zero, want: "192.0.2.1"},
+		{name: "global over link-local", addrs: cidrs("fe80::1/64", "2001:db8::1/64"), like: net.IPv6loopback, want: "2001:db8::1"},
+		{name: "link-local only", addrs: cidrs("192.0.2.1/24", "fe80::1/64", "fe80::2/64"), like: net.IPv6loopback, want: "fe80::1"},
+		{name: "none", addrs: cidrs("192.0.2.1/24"), like: net.IPv6loopback},
+	}
+	for _, tt := range tests {
+		got := pickAddr(tt.addrs, tt.like)
+		if (tt.want == "" && got != nil) || (tt.want != "" && got.Equal(net.ParseIP(tt.want)) == false) {
+			t.Errorf("%s: pickAddr() = %v, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// a probe routing sent from another address goes out from the one we asked for
+func TestRewriteSource(t *testing.T) {
+	objs := newTestSender(t)
+	laddr, routed := testAddrs()
+	objs.RewriteSrc.Set(uint16(1))
+
+	pkt := stampRequest(routed, net.ParseIP("192.0.2.100").To4(), 862, 862)
+	out := make([]byte, len(pkt))
+	opts := ebpf.RunOptions{Data: pkt, DataOut: out}
+	if _, err := objs.SenderOut.Run(&opts); err != nil {
+		t.Fatalf("Error running sender_out: %v", err)
+	}
+	if src := out[26:30]; bytes.Equal(src, laddr) == false {
+		t.Errorf("probe went out from %v, want %v", net.IP(src), laddr)
+	}
+	// the header checksum still has to add up
+	var sum uint32
+	for i := 14; i < 34; i += 2 {
+		sum += uint32(out[i])<<8 | uint32(out[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	if sum != 0xffff {
+		t.Errorf("IP header checksum is off by %#x", 0xffff-sum)
+	}
+}
@@ -0,0 +1,70 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// LoaderConfig.NetnsPath: setns(2) only moves the calling thread, so whatever looks interfaces up or talks netlink and TCX(ifindexes are per netns)
+// runs in fn on a locked thread that's in the target netns for the time being. BPF objects don't belong to a netns, everything else stays put
+func (l *Loader) inNetns(fn func() error) error {
+	return inNetns(l.Config.NetnsPath, fn)
+}
+
+func inNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	runtime.LockOSThread()
+	orig, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Error opening our own netns: %w", err)
+	}
+	defer unix.Close(orig)
+	target, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Error opening netns %s: %w", path, err)
+	}
+	defer unix.Close(target)
+	if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Error entering netns %s: %w", path, privilegeError(err))
+	}
+	ferr := fn()
+	if err := unix.Setns(orig, unix.CLONE_NEWNET); err != nil {
+		// the thread's stuck in there, it stays locked so the runtime throws it away instead of handing it to someone else
+		return errors.Join(ferr, fmt.Errorf("Error going back to our own netns: %w", err))
+	}
+	runtime.UnlockOSThread()
+	return ferr
+}
+
+// whoever filled in args looked the interfaces up in their own netns, in ours they might have other indexes or not be there at all
+func (l *Loader) netnsDevices(args stamp.Args) error {
+	if l.Config.NetnsPath == "" {
+		return nil
+	}
+	devs := devices(args)
+	if args.Dev != nil && (len(devs) == 0 || devs[0] != args.Dev) {
+		devs = append(devs, args.Dev)
+	}
+	for _, dev := range devs {
+		// a dry run can go without one
+		if dev == nil {
+			continue
+		}
+		cur, err := net.InterfaceByName(dev.Name)
+		if err != nil {
+			return fmt.Errorf("Error looking up %s in netns %s: %w", dev.Name, l.Config.NetnsPath, err)
+		}
+		*dev = *cur
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// wherever we end up, it's the netns we started from
+func netnsIno(t *testing.T) uint64 {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var st unix.Stat_t
+	if err := unix.Stat("/proc/thread-self/ns/net", &st); err != nil {
+		t.Fatalf("Error looking at our netns: %v", err)
+	}
+	return st.Ino
+}
+
+// needs CAP_SYS_ADMIN for the new netns
+func TestInNetns(t *testing.T) {
+	if err := inNetns("/nonexistent", func() error { t.Errorf("inNetns() ran fn without a netns"); return nil }); err == nil {
+		t.Errorf("inNetns() = nil error with a netns that isn't there")
+	}
+	// a thread of its own in a new netns, its ns file is good for as long as the thread's around; it's never unlocked
+	// so it goes away with the goroutine
+	ready, done := make(chan string), make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			ready <- ""
+			return
+		}
+		ready <- fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		<-done
+	}()
+	path := <-ready
+	defer close(done)
+	if path == "" {
+		t.Skipf("Can't make a netns")
+	}
+	home := netnsIno(t)
+	var ifaces []net.Interface
+	if err := inNetns(path, func() (err error) { ifaces, err = net.Interfaces(); return err }); err != nil {
+		t.Fatalf("inNetns() returned error: %v", err)
+	}
+	// a fresh netns has nothing but loopback
+	if len(ifaces) != 1 || ifaces[0].Name != "lo" {
+		t.Errorf("inNetns() saw %v, want just lo", ifaces)
+	}
+	failed := errors.New("attach failed")
+	if err := inNetns(path, func() error { return failed }); err != failed {
+		t.Errorf("inNetns() = %v, want fn's %v", err, failed)
+	}
+	// the caller's interfaces go by name in there
+	l := NewLoader(LoaderConfig{NetnsPath: path})
+	dev := &net.Interface{Name: "lo", Index: 99}
+	if err := l.inNetns(func() error { return l.netnsDevices(stamp.Args{Dev: dev}) }); err != nil || dev.Index != ifaces[0].Index {
+		t.Errorf("netnsDevices() = %v with lo at %d, want %d", err, dev.Index, ifaces[0].Index)
+	}
+	if err := l.inNetns(func() error { return l.netnsDevices(stamp.Args{Dev: &net.Interface{Name: "stampns-nothing"}}) }); err == nil {
+		t.Errorf("netnsDevices() = nil error for an interface that's not in there")
+	}
+	if netnsIno(t) != home {
+		t.Errorf("inNetns() left us in another netns")
+	}
+}
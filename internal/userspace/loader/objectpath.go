@@ -0,0 +1,24 @@
+package loader
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// LoaderConfig.ObjectPath instead of the object bpf2go embedded. It gets checked against the generated layout(every program, map
+// and variable in the Specs struct, by the names in its tags) so a stale or wrong .o fails here, not halfway through setting globals
+func (l *Loader) loadSpec(role string, embedded func() (*ebpf.CollectionSpec, error), layout any) (*ebpf.CollectionSpec, error) {
+	if l.Config.ObjectPath == "" {
+		return embedded()
+	}
+	spec, err := ebpf.LoadCollectionSpec(l.Config.ObjectPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %w", l.Config.ObjectPath, err)
+	}
+	if err := spec.Assign(layout); err != nil {
+		return nil, fmt.Errorf("%s isn't a %s object this build knows: %w", l.Config.ObjectPath, role, err)
+	}
+	l.logger().Info("Loading programs from disk instead of the embedded ones", "role", role, "path", l.Config.ObjectPath)
+	return spec, nil
+}
@@ -0,0 +1,25 @@
+package loader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+)
+
+// a real object needs clang, these are the ways it goes wrong before that
+func TestLoadSpecRejects(t *testing.T) {
+	junk := filepath.Join(t.TempDir(), "sender.bpf.o")
+	if err := os.WriteFile(junk, []byte("not an ELF"), 0o644); err != nil {
+		t.Fatalf("Error writing %s: %v", junk, err)
+	}
+	for _, path := range []string{junk, filepath.Join(t.TempDir(), "missing.o")} {
+		l := NewLoader(LoaderConfig{ObjectPath: path})
+		_, err := l.loadSpec("sender", sender.LoadSender, &sender.SenderSpecs{})
+		if err == nil || strings.Contains(err.Error(), path) == false {
+			t.Errorf("loadSpec() with %s = %v, want an error naming it", path, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestCollectionOptions(t *testing.T) {
+	mine, theirs, first := new(ebpf.Map), new(ebpf.Map), new(ebpf.Map)
+	config := LoaderConfig{CollectionOptions: ebpf.CollectionOptions{
+		Programs:        ebpf.ProgramOptions{LogLevel: ebpf.LogLevelStats},
+		MapReplacements: map[string]*ebpf.Map{"allowed": mine, "stats": theirs},
+	}}
+	l := NewLoader(config)
+	opts := l.collectionOptions(nil)
+	if opts.Programs.LogLevel != ebpf.LogLevelStats {
+		t.Errorf("LogLevel = %v, want the caller's %v with VerifierLogLevel 0", opts.Programs.LogLevel, ebpf.LogLevelStats)
+	}
+	if opts.MapReplacements["allowed"] != mine || opts.MapReplacements["stats"] != theirs {
+		t.Errorf("MapReplacements = %v, want the caller's", opts.MapReplacements)
+	}
+	// the next interface shares the first one's, which beat the caller's
+	opts = l.collectionOptions(map[string]*ebpf.Map{"stats": first})
+	if opts.MapReplacements["stats"] != first || opts.MapReplacements["allowed"] != mine {
+		t.Errorf("MapReplacements = %v, want the shared stats and the caller's allowed", opts.MapReplacements)
+	}
+	if config.CollectionOptions.MapReplacements["stats"] != theirs {
+		t.Errorf("collectionOptions() changed the caller's MapReplacements")
+	}
+	l.Config.VerifierLogLevel = 2
+	if opts := l.collectionOptions(nil); opts.Programs.LogLevel != 2 {
+		t.Errorf("LogLevel = %v, want VerifierLogLevel's 2", opts.Programs.LogLevel)
+	}
+}
@@ -0,0 +1,37 @@
+package loader
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// the IP packet a probe with TLVs makes has to fit the interface, a fragmented one never passes the for-me check
+// the reflector sends the same size back so its MTU matters too, we can only check ours
+func checkTLVs(args stamp.Args, dev *net.Interface) (uint16, error) {
+	if args.PaddingBytes == 0 && args.FollowUp == false && args.LocationTLV == false && args.TimestampInfo == false {
+		return 0, nil
+	}
+	if len(args.AuthKey) > 0 {
+		return 0, fmt.Errorf("TLVs don't work in authenticated mode")
+	}
+	l3 := 20
+	if args.Localaddr.To4() == nil {
+		l3 = 40
+	}
+	// the BPF global holds every TLV, headers included
+	tlvs := stamp.TLVLen(args)
+	if args.PaddingBytes < 0 || tlvs > 65535 {
+		return 0, fmt.Errorf("Invalid padding %d: TLVs have to fit in 65535 bytes", args.PaddingBytes)
+	}
+	total := l3 + 8 + 44 + tlvs
+	// dry runs can go without an interface
+	if dev != nil && total > dev.MTU && args.PacketSize > 0 {
+		return 0, fmt.Errorf("Packet size %d is over %s's MTU of %d, we'd have to fragment it", total, dev.Name, dev.MTU)
+	}
+	if dev != nil && total > dev.MTU {
+		return 0, fmt.Errorf("TLVs of %d bytes make %d-byte packets, over %s's MTU of %d", tlvs, total, dev.Name, dev.MTU)
+	}
+	return uint16(tlvs), nil
+}
@@ -0,0 +1,54 @@
+package loader
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// --passive counts requests to anyone and hands every one of them on untouched
+func TestPassiveDoesntReply(t *testing.T) {
+	objs := newTestReflector(t)
+	laddr, sender := testAddrs()
+	objs.Passive.Set(uint16(1))
+
+	tests := []struct {
+		name string
+		pkt  []byte
+	}{
+		{name: "to us", pkt: stampRequest(sender, laddr, 40000, 862)},
+		{name: "to someone else", pkt: stampRequest(sender, net.ParseIP("192.0.2.3").To4(), 40000, 862)},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make([]byte, len(tt.pkt))
+			ret, err := objs.ReflectorIn.Run(&ebpf.RunOptions{Data: tt.pkt, DataOut: out})
+			if err != nil {
+				t.Fatalf("Error running reflector_in: %v", err)
+			}
+			if ret == tcxRedirect {
+				t.Fatalf("reflector_in reflected the request in passive mode")
+			}
+			if bytes.Equal(out, tt.pkt) == false {
+				t.Errorf("reflector_in changed the request to %x, want %x", out, tt.pkt)
+			}
+			if got, err := readCounter(objs.Stats, statObserved); err != nil {
+				t.Fatalf("Error reading the observed counter: %v", err)
+			} else if got != uint64(i+1) {
+				t.Errorf("observed counter is %d, want %d", got, i+1)
+			}
+		})
+	}
+
+	// a reply from us would look like this on the way out, egress leaves it alone
+	reply := stampRequest(laddr, sender, 862, 40000)
+	out := make([]byte, len(reply))
+	if _, err := objs.ReflectorOut.Run(&ebpf.RunOptions{Data: reply, DataOut: out}); err != nil {
+		t.Fatalf("Error running reflector_out: %v", err)
+	}
+	if bytes.Equal(out, reply) == false {
+		t.Errorf("reflector_out stamped %x in passive mode, want it untouched", out)
+	}
+}
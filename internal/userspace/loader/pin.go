@@ -0,0 +1,273 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// pinned layout under LoaderConfig.PinPath, role is sender or reflector:
+//
+//	<role>/maps/<map>              maps, shared by every interface
+//	<role>/<dev>/<program>         each interface's programs...
+//	<role>/<dev>/link_egress       ...and the links that keep them attached
+//	<role>/<dev>/link_ingress
+//
+// cgroup mode goes by "cgroup" instead of the device
+const (
+	pinMaps    = "maps"
+	pinCgroup  = "cgroup"
+	pinEgress  = "link_egress"
+	pinIngress = "link_ingress"
+)
+
+// name -> field tables, used both to pin and to reopen so the two can't drift apart
+func senderMaps(m *sender.SenderMaps) map[string]**ebpf.Map {
+	return map[string]**ebpf.Map{
+		"output":   &m.Output,
+		"probes":   &m.Probes,
+		"recent":   &m.Recent,
+		"stats":    &m.Stats,
+		"arrivals": &m.Arrivals,
+		"events":   &m.Events,
+		"seqtrack": &m.Seqtrack,
+		"captures": &m.Captures,
+	}
+}
+
+func senderProgs(p *sender.SenderPrograms) map[string]**ebpf.Program {
+	return map[string]**ebpf.Program{
+		"sender_out":    &p.SenderOut,
+		"sender_in":     &p.SenderIn,
+		"sender_cg_out": &p.SenderCgOut,
+		"sender_cg_in":  &p.SenderCgIn,
+	}
+}
+
+func reflectorMaps(m *reflector.ReflectorMaps) map[string]**ebpf.Map {
+	return map[string]**ebpf.Map{
+		"output":    &m.Output,
+		"stats":     &m.Stats,
+		"arrivals":  &m.Arrivals,
+		"sessions":  &m.Sessions,
+		"followups": &m.Followups,
+		"allowed":   &m.Allowed,
+		"rate":      &m.Rate,
+		"captures":  &m.Captures,
+	}
+}
+
+func reflectorProgs(p *reflector.ReflectorPrograms) map[string]**ebpf.Program {
+	return map[string]**ebpf.Program{
+		"reflector_in":  &p.ReflectorIn,
+		"reflector_out": &p.ReflectorOut,
+	}
+}
+
+func pinName(args stamp.Args, dev *net.Interface) string {
+	if args.Cgroup != "" {
+		return pinCgroup
+	}
+	return dev.Name
+}
+
+// a crashed run never got to unpin, removing the pins drops the last reference to its links which takes its programs off
+func (l *Loader) clearStalePins(role string) error {
+	if l.Config.PinPath == "" {
+		return nil
+	}
+	l.pinDir = filepath.Join(l.Config.PinPath, role)
+	if _, err := os.Stat(l.pinDir); err == nil {
+		l.logger().Info("Removing stale pins from a previous run", "dir", l.pinDir)
+		if err := os.RemoveAll(l.pinDir); err != nil {
+			return fmt.Errorf("Error removing stale pins: %w", err)
+		}
+	}
+	return nil
+}
+
+// pins the interface's programs and the pair of links attachPair just made, maps only come with the first interface
+// on error whatever got pinned for this interface is taken back off
+func (l *Loader) pinInterface(name string, progs map[string]**ebpf.Program, maps map[string]**ebpf.Map) error {
+	if l.pinDir == "" {
+		return nil
+	}
+	dir := filepath.Join(l.pinDir, name)
+	err := pinAll(dir, progs, maps, l.Links[len(l.Links)-2], l.Links[len(l.Links)-1])
+	if err == nil {
+		return nil
+	}
+	os.RemoveAll(dir)
+	if maps != nil {
+		os.RemoveAll(filepath.Join(l.pinDir, pinMaps))
+	}
+	return fmt.Errorf("Error pinning to %s: %w", dir, err)
+}
+
+func pinAll(dir string, progs map[string]**ebpf.Program, maps map[string]**ebpf.Map, egress, ingress link.Link) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, p := range progs {
+		// only the programs that were actually loaded, TCX and cgroup ones are mutually exclusive
+		if *p == nil {
+			continue
+		}
+		if err := (*p).Pin(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	if maps != nil {
+		mapDir := filepath.Join(filepath.Dir(dir), pinMaps)
+		if err := os.MkdirAll(mapDir, 0700); err != nil {
+			return err
+		}
+		for name, m := range maps {
+			if err := (*m).Pin(filepath.Join(mapDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return pinLinks(dir, egress, ingress)
+}
+
+// either can be nil if LoaderConfig skipped its direction, then there's no pin for it
+func pinLinks(dir string, egress, ingress link.Link) error {
+	if egress != nil {
+		if err := egress.Pin(filepath.Join(dir, pinEgress)); err != nil {
+			return err
+		}
+	}
+	if ingress != nil {
+		return ingress.Pin(filepath.Join(dir, pinIngress))
+	}
+	return nil
+}
+
+// removing the pins is enough to unpin everything under them
+func unpin(dir string) {
+	if dir != "" {
+		os.RemoveAll(dir)
+	}
+}
+
+// LoadSenderFromPin reopens sender programs pinned under path(LoaderConfig.PinPath) by an earlier run, they stay attached the whole time.
+// Global variables can't be reopened so they keep whatever the loading run set and Events() isn't available
+func LoadSenderFromPin(path string) (senderFD, error) {
+	var fd senderFD
+	fd.pinDir = filepath.Join(path, "sender")
+	fd.events = newEventStream(slog.Default(), 0)
+	devs, err := reopen(fd.pinDir, senderMaps(&fd.Objs.SenderMaps))
+	if err != nil {
+		fd.Objs.Close()
+		return senderFD{}, err
+	}
+	for i, dev := range devs {
+		var objs sender.SenderObjects
+		links, err := reopenInterface(filepath.Join(fd.pinDir, dev), senderProgs(&objs.SenderPrograms))
+		if err != nil {
+			objs.Close()
+			fd.Release()
+			return senderFD{}, err
+		}
+		fd.Links = append(fd.Links, links...)
+		// every interface shares the first one's maps, see attachSender
+		if i == 0 {
+			fd.Objs.SenderPrograms = objs.SenderPrograms
+		} else {
+			fd.others = append(fd.others, objs)
+		}
+	}
+	return fd, nil
+}
+
+// LoadReflectorFromPin reopens reflector programs pinned under path(LoaderConfig.PinPath) by an earlier run, they stay attached the whole time.
+// Global variables can't be reopened so they keep whatever the loading run set
+func LoadReflectorFromPin(path string) (reflectorFD, error) {
+	var fd reflectorFD
+	fd.pinDir = filepath.Join(path, "reflector")
+	devs, err := reopen(fd.pinDir, reflectorMaps(&fd.Objs.ReflectorMaps))
+	if err != nil {
+		fd.Objs.Close()
+		return reflectorFD{}, err
+	}
+	for i, dev := range devs {
+		var objs reflector.ReflectorObjects
+		links, err := reopenInterface(filepath.Join(fd.pinDir, dev), reflectorProgs(&objs.ReflectorPrograms))
+		if err != nil {
+			objs.Close()
+			fd.Release()
+			return reflectorFD{}, err
+		}
+		fd.Links = append(fd.Links, links...)
+		if i == 0 {
+			fd.Objs.ReflectorPrograms = objs.ReflectorPrograms
+		} else {
+			fd.others = append(fd.others, objs)
+		}
+	}
+	return fd, nil
+}
+
+// opens the maps and returns the interfaces that have programs pinned
+func reopen(dir string, maps map[string]**ebpf.Map) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading pins: %w", err)
+	}
+	for name, m := range maps {
+		if *m, err = ebpf.LoadPinnedMap(filepath.Join(dir, pinMaps, name), nil); err != nil {
+			return nil, fmt.Errorf("Error reopening map %s: %w", name, err)
+		}
+	}
+	var devs []string
+	for _, e := range entries {
+		if e.IsDir() == true && e.Name() != pinMaps {
+			devs = append(devs, e.Name())
+		}
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("No pinned programs in %s", dir)
+	}
+	return devs, nil
+}
+
+func reopenInterface(dir string, progs map[string]**ebpf.Program) ([]link.Link, error) {
+	var err error
+	for name, p := range progs {
+		*p, err = ebpf.LoadPinnedProgram(filepath.Join(dir, name), nil)
+		// TCX and cgroup programs never get pinned together
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reopening program %s: %w", name, err)
+		}
+	}
+	var links []link.Link
+	for _, name := range []string{pinEgress, pinIngress} {
+		lnk, err := link.LoadPinnedLink(filepath.Join(dir, name), nil)
+		// the loading run skipped that direction, it stays nil same as it was there
+		if errors.Is(err, os.ErrNotExist) {
+			links = append(links, nil)
+			continue
+		}
+		if err != nil {
+			for _, l := range links {
+				l.Close()
+			}
+			return nil, fmt.Errorf("Error reopening link %s: %w", filepath.Join(dir, name), err)
+		}
+		links = append(links, lnk)
+	}
+	return links, nil
+}
@@ -0,0 +1,36 @@
+package loader
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+)
+
+// a map missing from the pins comes back nil in Load*FromPin, every one bpf2go generated has to be in there under its own name
+func checkPinnedMaps(t *testing.T, maps any, table map[string]**ebpf.Map) {
+	v := reflect.ValueOf(maps).Elem()
+	if v.NumField() != len(table) {
+		t.Errorf("%s has %d maps, the pin table %d", v.Type().Name(), v.NumField(), len(table))
+	}
+	for i := range v.NumField() {
+		name := v.Type().Field(i).Tag.Get("ebpf")
+		m, ok := table[name]
+		if ok == false {
+			t.Errorf("map %s isn't pinned", name)
+			continue
+		}
+		if m != v.Field(i).Addr().Interface().(**ebpf.Map) {
+			t.Errorf("map %s is pinned from the wrong field", name)
+		}
+	}
+}
+
+func TestPinnedMaps(t *testing.T) {
+	var snd sender.SenderMaps
+	checkPinnedMaps(t, &snd, senderMaps(&snd))
+	var refl reflector.ReflectorMaps
+	checkPinnedMaps(t, &refl, reflectorMaps(&refl))
+}
@@ -0,0 +1,18 @@
+package loader
+
+import "fmt"
+
+// STAMP's well-known port(RFC 8762 4.1)
+const defaultPort = 862
+
+// the BPF global is 16 bits so anything bigger would quietly wrap around into some other port
+// 0 is what an unset Args has, it goes to the default
+func sourcePort(port int) (uint16, error) {
+	if port == 0 {
+		return defaultPort, nil
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("Invalid port %d: has to be between 1 and 65535", port)
+	}
+	return uint16(port), nil
+}
@@ -0,0 +1,34 @@
+package loader
+
+import "testing"
+
+func TestSourcePort(t *testing.T) {
+	tests := []struct {
+		port    int
+		want    uint16
+		wantErr bool
+	}{
+		{port: 0, want: defaultPort},
+		{port: 1, want: 1},
+		{port: 862, want: 862},
+		{port: 65535, want: 65535},
+		// these would wrap around to 0 and 1 as uint16
+		{port: 65536, wantErr: true},
+		{port: 65537, wantErr: true},
+		{port: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := sourcePort(tt.port)
+		if tt.wantErr == true {
+			if err == nil {
+				t.Errorf("sourcePort(%d) = %d, want an error", tt.port, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sourcePort(%d) returned error: %v", tt.port, err)
+		} else if got != tt.want {
+			t.Errorf("sourcePort(%d) = %d, want %d", tt.port, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// ErrInsufficientPrivileges is what loading or attaching fails with when the kernel turned us down for lack of privileges, check with errors.Is;
+// the kernel's error stays in the chain behind it
+var ErrInsufficientPrivileges = errors.New("Insufficient privileges")
+
+// loading takes CAP_BPF, attaching CAP_NET_ADMIN(root has both); kernels before 5.11 charge BPF memory to RLIMIT_MEMLOCK
+// and say EPERM when it's too low, same as for a missing capability
+// the verifier rejects programs with EACCES too, that one's a bad program and not us
+func privilegeError(err error) error {
+	var verr *ebpf.VerifierError
+	if errors.Is(err, unix.EPERM) == false && (errors.Is(err, unix.EACCES) == false || errors.As(err, &verr) == true) {
+		return err
+	}
+	return fmt.Errorf("%w, needs CAP_BPF and CAP_NET_ADMIN(or root), on kernels before 5.11 also a big enough locked memory limit(ulimit -l): %w", ErrInsufficientPrivileges, err)
+}
@@ -0,0 +1,44 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+func TestPrivilegeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "EPERM", err: fmt.Errorf("attach: %w", unix.EPERM), want: true},
+		{name: "EACCES", err: fmt.Errorf("attach: %w", unix.EACCES), want: true},
+		{name: "verifier", err: &ebpf.VerifierError{Cause: unix.EACCES, Log: []string{"invalid access to packet"}}},
+		{name: "other errno", err: fmt.Errorf("attach: %w", unix.ENODEV)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := privilegeError(tt.err)
+			if errors.Is(got, ErrInsufficientPrivileges) != tt.want {
+				t.Errorf("privilegeError(%v) = %v, want ErrInsufficientPrivileges: %v", tt.err, got, tt.want)
+			}
+			// the kernel's error has to stay reachable
+			if errors.Is(got, tt.err) == false {
+				t.Errorf("privilegeError(%v) = %v, lost the original error", tt.err, got)
+			}
+		})
+	}
+}
+
+func TestWithRetryPrivileges(t *testing.T) {
+	l := NewLoader(LoaderConfig{AttachRetry: RetryPolicy{Count: 3}})
+	_, err := l.withRetry("eth0", ebpf.AttachTCXEgress, func() (link.Link, error) { return nil, unix.EPERM })
+	if errors.Is(err, ErrInsufficientPrivileges) == false || errors.Is(err, unix.EPERM) == false {
+		t.Errorf("withRetry() = %v, want ErrInsufficientPrivileges wrapping EPERM", err)
+	}
+}
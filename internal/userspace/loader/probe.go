@@ -0,0 +1,95 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+	"golang.org/x/sys/unix"
+)
+
+// Capabilities is what the running kernel(and its NICs) can do for us, see Probe
+type Capabilities struct {
+	// kernel version as in LINUX_VERSION_CODE, 0 if we couldn't tell
+	KernelVersion uint32
+	// TCX hooks(6.6+), without them AttachAuto goes through TC
+	TCXSupported bool
+	// TC programs at all, for AttachTC and the TC fallback
+	TCSupported bool
+	// cgroup skb programs, for Args.Cgroup
+	CgroupSupported bool
+	// BPF ring buffers(5.8+), both roles send their samples through one so nothing loads without it
+	RingbufSupported bool
+	// the kernel's own BTF(CONFIG_DEBUG_INFO_BTF), the embedded objects are CO-RE and need it unless
+	// LoaderConfig.CollectionOptions brings an external one
+	BTFAvailable bool
+	// per-CPU LRU hashes, what the per-session maps turn into with Args.Queues over 1
+	PerCPULRUSupported bool
+	// some interface's driver takes a timestamping config, for Args.HWTimestamps; HWTimestampInterfaces says which
+	HardwareTimestamping  bool
+	HWTimestampInterfaces []string
+	// probes that failed for some other reason than the kernel not having it(usually privileges, see ErrInsufficientPrivileges),
+	// their field is false but that doesn't mean much
+	Err error
+}
+
+// Probe asks the kernel what it supports so callers can pick a config(or fail with a proper message) before loading anything;
+// it needs the same privileges as loading, without them most of it comes back false with Err saying why
+func Probe() Capabilities {
+	var c Capabilities
+	var errs []error
+	// failing this is what the probes below will say too
+	removeMemlock()
+	probe := func(name string, err error) bool {
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, ebpf.ErrNotSupported) == false {
+			errs = append(errs, fmt.Errorf("Error probing %s: %w", name, privilegeError(err)))
+		}
+		return false
+	}
+	if v, err := features.LinuxVersionCode(); err == nil {
+		c.KernelVersion = v
+	} else {
+		errs = append(errs, fmt.Errorf("Error getting the kernel version: %w", err))
+	}
+	c.TCXSupported = tcxSupported()
+	c.TCSupported = probe("TC programs", features.HaveProgramType(ebpf.SchedCLS))
+	c.CgroupSupported = probe("cgroup programs", features.HaveProgramType(ebpf.CGroupSKB))
+	c.RingbufSupported = probe("ring buffers", features.HaveMapType(ebpf.RingBuf))
+	c.PerCPULRUSupported = probe("per-CPU LRU maps", features.HaveMapType(ebpf.LRUCPUHash))
+	if _, err := btf.LoadKernelSpec(); err == nil {
+		c.BTFAvailable = true
+	}
+	c.HWTimestampInterfaces = hwTimestampInterfaces()
+	c.HardwareTimestamping = len(c.HWTimestampInterfaces) > 0
+	c.Err = errors.Join(errs...)
+	return c
+}
+
+// a driver that can't timestamp says EOPNOTSUPP to reading the config, it doesn't take privileges
+func hwTimestampInterfaces() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil
+	}
+	defer unix.Close(fd)
+	var res []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if _, err := unix.IoctlGetHwTstamp(fd, iface.Name); err == nil {
+			res = append(res, iface.Name)
+		}
+	}
+	return res
+}
@@ -0,0 +1,28 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// whatever the kernel has, the answers have to agree with each other and with asking directly
+func TestProbe(t *testing.T) {
+	c := Probe()
+	if c.KernelVersion == 0 {
+		t.Errorf("Probe() got no kernel version: %v", c.Err)
+	}
+	_, err := btf.LoadKernelSpec()
+	if c.BTFAvailable != (err == nil) {
+		t.Errorf("BTFAvailable = %v, LoadKernelSpec() said %v", c.BTFAvailable, err)
+	}
+	if c.HardwareTimestamping != (len(c.HWTimestampInterfaces) > 0) {
+		t.Errorf("HardwareTimestamping = %v with interfaces %v", c.HardwareTimestamping, c.HWTimestampInterfaces)
+	}
+	for _, name := range c.HWTimestampInterfaces {
+		if name == "lo" {
+			t.Errorf("HWTimestampInterfaces has loopback in it")
+		}
+	}
+	t.Logf("%+v", c)
+}
@@ -0,0 +1,39 @@
+package loader
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/cilium/ebpf"
+)
+
+// BPF_F_NO_COMMON_LRU, x/sys/unix doesn't have it
+const bpfNoCommonLRU = 1 << 1
+
+// the reflector maps every CPU taking requests reads and writes
+var perSessionMaps = []string{"sessions", "followups", "arrivals"}
+
+// sizes the reflector's maps for requests coming in on several RX queues at once.
+// Stats are per-CPU already. A session's 5-tuple always hashes to the same queue, so its entry only ever gets touched from one CPU;
+// what the CPUs do fight over is the LRU lists every hash operation takes a lock on. Keying sessions per CPU and adding them up
+// would restart a session's sequence whenever RSS moves it(an IRQ getting rebalanced), so the maps stay as they are
+// and just stop sharing their LRU lists. Those get max_entries/CPUs each, so the maps grow to keep 4096 per CPU.
+// The ringbuf has one lock no matter what, it only grows with the queues so bursts from all of them fit
+func spreadQueues(spec *ebpf.CollectionSpec, queues int) error {
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return fmt.Errorf("Error getting CPU count: %w", err)
+	}
+	for _, name := range perSessionMaps {
+		m, ok := spec.Maps[name]
+		if ok == false {
+			return fmt.Errorf("Map %s missing from the program spec", name)
+		}
+		m.Flags |= bpfNoCommonLRU
+		m.MaxEntries *= uint32(cpus)
+	}
+	// ringbuf sizes have to be a power of 2
+	out := spec.Maps["output"]
+	out.MaxEntries <<= bits.Len(uint(queues - 1))
+	return nil
+}
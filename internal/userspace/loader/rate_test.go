@@ -0,0 +1,63 @@
+package loader
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+func TestReplyBudget(t *testing.T) {
+	tests := []struct {
+		pps    uint32
+		queues int
+		want   uint32
+	}{
+		{pps: 1000, queues: 0, want: 1000},
+		{pps: 1000, queues: 1, want: 1000},
+		{pps: 1000, queues: 4, want: 250},
+		{pps: 10, queues: 4, want: 3},
+		{pps: 1, queues: 16, want: 1},
+		{pps: 0, queues: 16, want: 0},
+		{pps: ^uint32(0), queues: 2, want: 1 << 31},
+	}
+	for _, tt := range tests {
+		if got := replyBudget(tt.pps, tt.queues); got != tt.want {
+			t.Errorf("replyBudget(%d, %d) = %d, want %d", tt.pps, tt.queues, got, tt.want)
+		}
+	}
+}
+
+// the bucket starts full, a second's worth
+func TestRateLimitDrops(t *testing.T) {
+	// every CPU has its own bucket, all the runs have to land in the same one
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var set unix.CPUSet
+	set.Set(0)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		t.Skipf("Can't pin the test to a CPU: %v", err)
+	}
+	objs := newTestReflector(t)
+	laddr, sender := testAddrs()
+	objs.MaxReplyPps.Set(uint32(2))
+
+	var rets []uint32
+	for range 3 {
+		req := stampRequest(sender, laddr, 40000, 862)
+		ret, err := objs.ReflectorIn.Run(&ebpf.RunOptions{Data: req, DataOut: make([]byte, len(req))})
+		if err != nil {
+			t.Fatalf("Error running reflector_in: %v", err)
+		}
+		rets = append(rets, ret)
+	}
+	if rets[0] != tcxRedirect || rets[1] != tcxRedirect || rets[2] != tcxDrop {
+		t.Errorf("reflector_in returned %v with a limit of 2, want two reflected and the third dropped", rets)
+	}
+	if got, err := readCounter(objs.Stats, statRateLimited); err != nil {
+		t.Fatalf("Error reading the rate limited counter: %v", err)
+	} else if got != 1 {
+		t.Errorf("rate limited counter is %d, want 1", got)
+	}
+}
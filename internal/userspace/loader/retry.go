@@ -0,0 +1,52 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// RetryPolicy is how attaching copes with another tool changing the TCX chain(or the qdisc, in TC mode) at the same moment,
+// the kernel turns one of us down with EBUSY or EAGAIN then. Anything else fails right away
+type RetryPolicy struct {
+	// tries on top of the first one, 0 doesn't retry
+	Count int
+	// wait before the first retry, doubled for every one after it; 10ms when 0
+	Backoff time.Duration
+}
+
+const defaultBackoff = 10 * time.Millisecond
+
+func retryable(err error) bool {
+	return errors.Is(err, unix.EBUSY) || errors.Is(err, unix.EAGAIN)
+}
+
+// runs try until it works, fails with something we shouldn't retry or we're out of retries
+func (l *Loader) withRetry(iface string, what fmt.Stringer, try func() (link.Link, error)) (link.Link, error) {
+	policy := l.Config.AttachRetry
+	backoff := policy.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		lnk, err := try()
+		if err == nil {
+			return lnk, nil
+		}
+		if retryable(err) == false {
+			return nil, privilegeError(err)
+		}
+		if attempt >= policy.Count {
+			if policy.Count > 0 {
+				return nil, fmt.Errorf("Giving up after %d retries: %w", policy.Count, err)
+			}
+			return nil, err
+		}
+		l.logger().Warn("Attach failed, retrying", "iface", iface, "direction", what, "err", err, "retry", attempt+1, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,53 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+func TestWithRetry(t *testing.T) {
+	// busy wraps the errno the way cilium/ebpf does
+	busy := fmt.Errorf("create link: %w", unix.EBUSY)
+	tests := []struct {
+		name      string
+		policy    RetryPolicy
+		errs      []error
+		wantTries int
+		wantErr   error
+	}{
+		{name: "works right away", policy: RetryPolicy{Count: 3}, errs: []error{nil}, wantTries: 1},
+		{name: "busy then works", policy: RetryPolicy{Count: 3}, errs: []error{busy, unix.EAGAIN, nil}, wantTries: 3},
+		{name: "out of retries", policy: RetryPolicy{Count: 2}, errs: []error{busy, busy, busy, nil}, wantTries: 3, wantErr: unix.EBUSY},
+		{name: "not retryable", policy: RetryPolicy{Count: 3}, errs: []error{unix.EPERM, nil}, wantTries: 1, wantErr: unix.EPERM},
+		{name: "no retries", errs: []error{busy, nil}, wantTries: 1, wantErr: unix.EBUSY},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.Backoff = time.Microsecond
+			l := NewLoader(LoaderConfig{AttachRetry: tt.policy, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+			var tries int
+			_, err := l.withRetry("eth0", ebpf.AttachTCXIngress, func() (link.Link, error) {
+				err := tt.errs[tries]
+				tries++
+				return nil, err
+			})
+			if tries != tt.wantTries {
+				t.Errorf("withRetry() tried %d times, want %d", tries, tt.wantTries)
+			}
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("withRetry() returned error: %v", err)
+			}
+			if tt.wantErr != nil && errors.Is(err, tt.wantErr) == false {
+				t.Errorf("withRetry() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
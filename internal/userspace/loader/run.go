@@ -0,0 +1,17 @@
+package loader
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Run blocks until ctx is done or we get SIGINT/SIGTERM, then tears the handle down
+// links are only ever held by us so closing them detaches the programs right away, by the time this returns they're off the interface
+func Run(ctx context.Context, handle fd) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	handle.Close()
+}
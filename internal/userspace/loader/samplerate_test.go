@@ -0,0 +1,63 @@
+package loader
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// probes go sender_out -> reflector_in -> reflector_out -> sender_in
+func TestSampleRate(t *testing.T) {
+	snd := newTestSender(t)
+	snd.EventsOn.Set(uint16(1))
+	snd.SampleRate.Set(uint32(3))
+	// the reflector's the remote end
+	us, them := testAddrs()
+	refl := newTestReflector(t)
+	setLocalAddr(refl.Laddr, refl.Laddr6, refl.IpFamily, them)
+	rd, err := ringbuf.NewReader(snd.Events)
+	if err != nil {
+		t.Fatalf("Error opening the events ring: %v", err)
+	}
+	defer rd.Close()
+
+	run := func(prog *ebpf.Program, pkt []byte) []byte {
+		out := make([]byte, len(pkt))
+		if _, err := prog.Run(&ebpf.RunOptions{Data: pkt, DataOut: out}); err != nil {
+			t.Fatalf("Error running %v: %v", prog, err)
+		}
+		return out
+	}
+	const replies = 7
+	for seq := range uint32(replies) {
+		probe := stampRequest(us, them, 862, 862)
+		binary.BigEndian.PutUint32(probe[42:], seq)
+		run(snd.SenderIn, run(refl.ReflectorOut, run(refl.ReflectorIn, run(snd.SenderOut, probe))))
+	}
+
+	// every one counts, every third one's an event
+	if got, err := readCounter(snd.Stats, statReflected); err != nil {
+		t.Fatalf("Error reading the reply counter: %v", err)
+	} else if got != replies {
+		t.Errorf("sender counted %d replies, want %d", got, replies)
+	}
+	var seqs, eseqs []uint64
+	rd.SetDeadline(time.Now().Add(time.Second))
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			break
+		}
+		ev, err := decodeEvent(record.RawSample, 862)
+		if err != nil {
+			t.Fatalf("Error decoding event: %v", err)
+		}
+		seqs, eseqs = append(seqs, uint64(ev.Seq)), append(eseqs, ev.EventSeq)
+	}
+	if len(eseqs) != 3 || eseqs[0] != 0 || eseqs[1] != 3 || eseqs[2] != 6 {
+		t.Errorf("got events %v(seqs %v), want event seqs [0 3 6]", eseqs, seqs)
+	}
+}
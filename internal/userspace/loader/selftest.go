@@ -0,0 +1,121 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// selfTestFD is a sender and a reflector on the same interface, see LoadSelfTest
+type selfTestFD struct {
+	// for everything but closing: stats, events, maps, LinkInfo; each one only holds its own two links
+	Sender    senderFD
+	Reflector reflectorFD
+	loader    *Loader
+}
+
+// Close detaches all four programs and unloads both sets of objects
+func (s selfTestFD) Close() {
+	s.Sender.events.close()
+	if s.loader != nil {
+		s.loader.Close()
+	}
+}
+
+// HealthCheck probes the sender's programs and then the reflector's, each with its own port and counters(see senderFD.HealthCheck).
+// Without a deadline on ctx the two share the one 2s
+func (s selfTestFD) HealthCheck(ctx context.Context) error {
+	if s.loader == nil {
+		return fmt.Errorf("Nothing attached to check")
+	}
+	if _, ok := ctx.Deadline(); ok == false {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+	}
+	// the sender's pair went on first, see LoadSelfTest
+	if err := s.loader.healthCheck(ctx, s.Sender.args, s.Sender.Objs.Stats, 0); err != nil {
+		return fmt.Errorf("Sender: %w", err)
+	}
+	if err := s.loader.healthCheck(ctx, s.Reflector.args, s.Reflector.Objs.Stats, 1); err != nil {
+		return fmt.Errorf("Reflector: %w", err)
+	}
+	return nil
+}
+
+// LoadSelfTest loads the sender and the reflector onto one interface(lo, or wherever the sender's probes to the reflector's address go)
+// for a loopback self-test, with one Loader holding all four links. The sender goes wherever config says and the reflector right
+// next to it, so with the default head anchor the chains come out as
+//
+//	egress:  sender_out, reflector_out, whatever was there before
+//	ingress: reflector_in, sender_in, whatever was there before
+//
+// Every program only touches its own packets so the order is about timestamps: the reflector's programs are the closest to the wire,
+// T2 and T3 are taken with nothing of ours in between and its turnaround(T3-T2) doesn't include the sender's for-me checks.
+// Both need the same single interface, TCX and their own ports, and it can't be pinned or WatchAndReattach'ed; senderArgs.D_port should be
+// reflectorArgs.S_port. Either half's HealthCheck only proves its own programs are in the data path, the handle's checks both
+func LoadSelfTest(ctx context.Context, senderArgs, reflectorArgs stamp.Args, config LoaderConfig) (selfTestFD, error) {
+	if len(devices(senderArgs)) != 1 || len(devices(reflectorArgs)) != 1 || devName(senderArgs.Dev) != devName(reflectorArgs.Dev) {
+		return selfTestFD{}, fmt.Errorf("A self-test needs the sender and reflector on the same single interface")
+	}
+	if senderArgs.Cgroup != "" {
+		return selfTestFD{}, fmt.Errorf("A self-test can't run in cgroup mode, both halves go on the interface")
+	}
+	// TC filters have no anchors to put the reflector next to the sender with
+	if config.AttachMode == AttachTC {
+		return selfTestFD{}, fmt.Errorf("A self-test needs TCX")
+	}
+	if config.PinPath != "" || config.StatsPinPath != "" {
+		return selfTestFD{}, fmt.Errorf("A self-test can't be pinned")
+	}
+	// there's only the one and the two halves are different objects
+	if config.ObjectPath != "" {
+		return selfTestFD{}, fmt.Errorf("A self-test can't load from ObjectPath")
+	}
+	// the reflector would take the replies for requests
+	if senderArgs.S_port == reflectorArgs.S_port {
+		return selfTestFD{}, fmt.Errorf("The sender and the reflector can't both use port %d", senderArgs.S_port)
+	}
+	config.AttachMode = AttachTCX
+	l := NewLoader(config)
+	if err := l.AttachSenderContext(ctx, senderArgs); err != nil {
+		l.Close()
+		return selfTestFD{}, fmt.Errorf("Error attaching sender: %w", err)
+	}
+	// a dry run has no links to go next to
+	if len(l.Links) == 2 {
+		l.around = l.Links[:2]
+	}
+	if err := l.AttachReflectorContext(ctx, reflectorArgs); err != nil {
+		l.Close()
+		return selfTestFD{}, fmt.Errorf("Error attaching reflector: %w", err)
+	}
+	l.around = nil
+	var senderLinks, reflectorLinks []link.Link
+	if len(l.Links) == 4 {
+		senderLinks, reflectorLinks = l.Links[:2:2], l.Links[2:4:4]
+	}
+	return selfTestFD{
+		Sender:    senderFD{Objs: l.Senders[0], Links: senderLinks, events: newEventStream(l.logger(), senderArgs.D_port), placements: l.placements, loader: l, args: senderArgs, ErrorEstimate: l.clocks.errEst, Clock: l.clocks.info()},
+		Reflector: reflectorFD{Objs: l.Reflectors[0], Links: reflectorLinks, placements: l.placements, loader: l, args: reflectorArgs, ErrorEstimate: l.clocks.errEst, Clock: l.clocks.info()},
+		loader:    l,
+	}, nil
+}
+
+// LoadSelfTest: the reflector only ever goes after the sender's egress and in front of its ingress;
+// nil means go by LoaderConfig, also when the sender skipped that direction
+func (l *Loader) aroundSender(typ ebpf.AttachType) link.Anchor {
+	if l.around == nil {
+		return nil
+	}
+	if typ == ebpf.AttachTCXEgress && l.around[0] != nil {
+		return link.AfterLink(l.around[0])
+	}
+	if typ == ebpf.AttachTCXIngress && l.around[1] != nil {
+		return link.BeforeLink(l.around[1])
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package loader
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// probes going out past 2^32-1 and one behind the rest
+func TestNextSeq(t *testing.T) {
+	objs := newTestSender(t)
+	us, them := testAddrs()
+	const start = 0xfffffffe
+	objs.NextSeq.Set(uint32(start))
+	fd := senderFD{Objs: *objs, args: stamp.Args{SeqStart: start}}
+	if next, err := fd.nextSeq(); err != nil || next != start {
+		t.Fatalf("nextSeq() = %d, %v before anything went out, want %d", next, err, uint32(start))
+	}
+
+	for _, seq := range []uint32{0xfffffffe, 0xffffffff, 0, 1, 0xffffffff} {
+		probe := stampRequest(us, them, 862, 862)
+		binary.BigEndian.PutUint32(probe[42:], seq)
+		out := make([]byte, len(probe))
+		if _, err := objs.SenderOut.Run(&ebpf.RunOptions{Data: probe, DataOut: out}); err != nil {
+			t.Fatalf("Error running sender_out: %v", err)
+		}
+	}
+	// it wrapped and the late one didn't set it back
+	if next, err := fd.nextSeq(); err != nil || next != 2 {
+		t.Errorf("nextSeq() = %d, %v, want 2", next, err)
+	}
+}
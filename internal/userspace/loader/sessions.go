@@ -0,0 +1,176 @@
+package loader
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// how many seqs a session's stats cover when NewSessionTracker isn't told
+const defaultSessionWindow = 128
+
+// SessionKey is one sender-reflector session, replies are told apart by where the probe went
+type SessionKey struct {
+	Addr netip.Addr
+	Port uint16
+}
+
+// SessionStats is what the last window seqs of a session came to, counting back from the highest one that came back
+type SessionStats struct {
+	// replies in the window and seqs in it that never got one(yet), they add up to the window once it's full
+	Received, Lost uint32
+	// Lost over Received+Lost
+	Loss float64
+	// roundtrip(T4-T1) of the replies in the window
+	MinRTT, MeanRTT, MaxRTT time.Duration
+	// mean difference between the RTTs of replies next to each other in seq order, zero with less than two
+	Jitter time.Duration
+	// RFC 3393 IPDV of the RTTs: mean and max of the absolute difference between seq n-1 and n, over the pairs in the window
+	// that both came back in that order; zero without any
+	MeanIPDV, MaxIPDV time.Duration
+	// pairs of seqs next to each other that came back the other way around, IPDV is undefined for them
+	IPDVReordered uint32
+	// RFC 5481 PDV: how far above MinRTT the mean and the worst reply were
+	MeanPDV, MaxPDV time.Duration
+	// the highest seq that came back
+	LastSeq uint32
+}
+
+// SessionTracker groups a sender's events by session and keeps rolling stats for each, for when one sender measures to a lot of reflectors.
+// Every seq comparison is serial(RFC 1982) so sessions survive their seqs wrapping around 2^32. A reply more than the window behind
+// the highest seq is taken for the sender starting over(seq back at 0) and the session's window starts over with it
+type SessionTracker struct {
+	window   uint32
+	mut      sync.Mutex
+	sessions map[SessionKey]*session
+}
+
+// one reply's worth of a session's window
+type sessionSample struct {
+	seq uint32
+	rtt time.Duration
+	// when it came back relative to the rest of the session, for telling reordered pairs apart
+	arrival uint64
+}
+
+type session struct {
+	// the highest seq so far and the first one since the window last started over, the window can't reach back past it
+	head, first uint32
+	// by seq, so a duplicate doesn't count twice; dropped as the head moves past them
+	samples  map[uint32]sessionSample
+	arrivals uint64
+}
+
+// NewSessionTracker makes a tracker whose stats cover the last window seqs of each session, 128 if it's 0 or less
+func NewSessionTracker(window int) *SessionTracker {
+	if window <= 0 {
+		window = defaultSessionWindow
+	}
+	return &SessionTracker{window: uint32(window), sessions: make(map[SessionKey]*session)}
+}
+
+// Run feeds every event to the tracker until the channel is closed, e.g. the one Events() returns. Sessions can be read the whole time
+func (t *SessionTracker) Run(events <-chan StampEvent) {
+	for ev := range events {
+		t.Add(ev)
+	}
+}
+
+// Add counts a single event, for when something else already owns the channel
+func (t *SessionTracker) Add(ev StampEvent) {
+	key := SessionKey{Addr: ev.Dst, Port: ev.DstPort}
+	rtt := time.Duration(int64(ev.T4 - ev.T1))
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	s := t.sessions[key]
+	if s == nil {
+		s = &session{}
+		t.sessions[key] = s
+		s.restart(ev.Seq)
+	}
+	switch d := int32(ev.Seq - s.head); {
+	case d > 0:
+		// whatever's now more than the window behind falls out, no further back than there's anything to drop
+		for i := uint32(0); i < min(uint32(d), t.window); i++ {
+			delete(s.samples, s.head-t.window+1+i)
+		}
+		s.head = ev.Seq
+	case uint32(-int64(d)) >= t.window:
+		s.restart(ev.Seq)
+	case int32(ev.Seq-s.first) < 0:
+		// late, from before the first one we got
+		s.first = ev.Seq
+	}
+	// a duplicate keeps the first one's arrival, or it'd turn the pairs it's in into reordered ones
+	s.arrivals++
+	arrival := s.arrivals
+	if prev, ok := s.samples[ev.Seq]; ok == true {
+		arrival = prev.arrival
+	}
+	s.samples[ev.Seq] = sessionSample{seq: ev.Seq, rtt: rtt, arrival: arrival}
+}
+
+func (s *session) restart(seq uint32) {
+	s.head, s.first = seq, seq
+	s.samples = make(map[uint32]sessionSample)
+}
+
+// Sessions is a snapshot of every session seen so far
+func (t *SessionTracker) Sessions() map[SessionKey]SessionStats {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	res := make(map[SessionKey]SessionStats, len(t.sessions))
+	for key, s := range t.sessions {
+		res[key] = s.stats(t.window)
+	}
+	return res
+}
+
+func (s *session) stats(window uint32) SessionStats {
+	samples := make([]sessionSample, 0, len(s.samples))
+	for _, sm := range s.samples {
+		samples = append(samples, sm)
+	}
+	// oldest first, by how far behind the head they are so it doesn't matter if seq wrapped in the middle
+	slices.SortFunc(samples, func(a, b sessionSample) int {
+		return int(int64(s.head-b.seq) - int64(s.head-a.seq))
+	})
+	span := min(s.head-s.first+1, window)
+	st := SessionStats{Received: uint32(len(samples)), Lost: span - uint32(len(samples)), LastSeq: s.head}
+	st.Loss = float64(st.Lost) / float64(span)
+	var sum, diffs, ipdvs time.Duration
+	var pairs uint32
+	for i, sm := range samples {
+		sum += sm.rtt
+		if i == 0 || sm.rtt < st.MinRTT {
+			st.MinRTT = sm.rtt
+		}
+		st.MaxRTT = max(st.MaxRTT, sm.rtt)
+		if i > 0 {
+			diffs += (sm.rtt - samples[i-1].rtt).Abs()
+		}
+		if i == 0 || sm.seq != samples[i-1].seq+1 {
+			continue
+		}
+		if sm.arrival < samples[i-1].arrival {
+			st.IPDVReordered++
+			continue
+		}
+		ipdv := (sm.rtt - samples[i-1].rtt).Abs()
+		ipdvs += ipdv
+		st.MaxIPDV = max(st.MaxIPDV, ipdv)
+		pairs++
+	}
+	if len(samples) > 0 {
+		st.MeanRTT = sum / time.Duration(len(samples))
+		st.MeanPDV, st.MaxPDV = st.MeanRTT-st.MinRTT, st.MaxRTT-st.MinRTT
+	}
+	if pairs > 0 {
+		st.MeanIPDV = ipdvs / time.Duration(pairs)
+	}
+	if len(samples) > 1 {
+		st.Jitter = diffs / time.Duration(len(samples)-1)
+	}
+	return st
+}
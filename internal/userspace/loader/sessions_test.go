@@ -0,0 +1,65 @@
+package loader
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSessionTracker(t *testing.T) {
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	reply := func(dst netip.Addr, seq uint32, rtt time.Duration) StampEvent {
+		return StampEvent{Seq: seq, T1: 1000, T4: 1000 + uint64(rtt), Dst: dst, DstPort: 862}
+	}
+	tests := []struct {
+		name   string
+		window int
+		seqs   []uint32
+		want   SessionStats
+	}{
+		{name: "in order", window: 4, seqs: []uint32{0, 1, 2}, want: SessionStats{Received: 3, LastSeq: 2}},
+		{name: "gap", window: 4, seqs: []uint32{0, 2, 3}, want: SessionStats{Received: 3, Lost: 1, Loss: 0.25, LastSeq: 3}},
+		{name: "reordered and duplicate", window: 4, seqs: []uint32{0, 2, 1, 2}, want: SessionStats{Received: 3, IPDVReordered: 1, LastSeq: 2}},
+		{name: "late before the first", window: 4, seqs: []uint32{5, 6, 4}, want: SessionStats{Received: 3, IPDVReordered: 1, LastSeq: 6}},
+		{name: "window slides", window: 2, seqs: []uint32{0, 3, 4}, want: SessionStats{Received: 2, LastSeq: 4}},
+		{name: "slides past everything", window: 2, seqs: []uint32{0, 1, 10}, want: SessionStats{Received: 1, Lost: 1, Loss: 0.5, LastSeq: 10}},
+		{name: "wraps", window: 4, seqs: []uint32{1<<32 - 2, 1<<32 - 1, 1}, want: SessionStats{Received: 3, Lost: 1, Loss: 0.25, LastSeq: 1}},
+		{name: "sender starts over", window: 4, seqs: []uint32{100, 101, 0}, want: SessionStats{Received: 1, LastSeq: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewSessionTracker(tt.window)
+			for _, seq := range tt.seqs {
+				tr.Add(reply(a, seq, time.Millisecond))
+			}
+			got := tr.Sessions()[SessionKey{a, 862}]
+			got.MinRTT, got.MeanRTT, got.MaxRTT, got.Jitter = 0, 0, 0, 0
+			got.MeanIPDV, got.MaxIPDV, got.MeanPDV, got.MaxPDV = 0, 0, 0, 0
+			if got != tt.want {
+				t.Errorf("Sessions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	// RTTs and jitter go in seq order, not arrival order; other sessions stay out of it. IPDV only has 0-1 to go by, 2 came before 1
+	ch := make(chan StampEvent, 4)
+	ch <- reply(a, 2, 3*time.Millisecond)
+	ch <- reply(a, 0, 1*time.Millisecond)
+	ch <- reply(b, 1, time.Second)
+	ch <- reply(a, 1, 4*time.Millisecond)
+	close(ch)
+	tr := NewSessionTracker(0)
+	tr.Run(ch)
+	sessions := tr.Sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("Sessions() has %d sessions, want 2", len(sessions))
+	}
+	got := sessions[SessionKey{a, 862}]
+	want := SessionStats{
+		Received: 3, MinRTT: time.Millisecond, MeanRTT: 8 * time.Millisecond / 3, MaxRTT: 4 * time.Millisecond, Jitter: 2 * time.Millisecond,
+		MeanIPDV: 3 * time.Millisecond, MaxIPDV: 3 * time.Millisecond, IPDVReordered: 1,
+		MeanPDV: 8*time.Millisecond/3 - time.Millisecond, MaxPDV: 3 * time.Millisecond, LastSeq: 2,
+	}
+	if got != want {
+		t.Errorf("Sessions() = %+v, want %+v", got, want)
+	}
+}
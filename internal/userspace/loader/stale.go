@@ -0,0 +1,153 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+	"golang.org/x/sys/unix"
+)
+
+// AttachedProg is one of our programs the kernel has on an interface's TCX hook
+type AttachedProg struct {
+	ID     ebpf.ProgramID
+	Name   string
+	Attach ebpf.AttachType
+	// 0 if it went on without a link
+	LinkID link.ID
+}
+
+// ours go by the program names, the same tables pinning uses
+func stampProgram(name string) bool {
+	if _, ok := senderProgs(&sender.SenderPrograms{})[name]; ok == true {
+		return true
+	}
+	_, ok := reflectorProgs(&reflector.ReflectorPrograms{})[name]
+	return ok
+}
+
+// ErrAlreadyAttached is what attaching fails with when a program of the same name is already on that TCX hook of the interface,
+// another run's most likely; both of them would stamp every packet. Check with errors.Is, LoaderConfig.ReplaceAttached takes it off instead
+var ErrAlreadyAttached = errors.New("Already attached")
+
+// ListAttached lists every stamp-bpf program on the interface's TCX ingress and egress, whoever attached them.
+// A crashed run's programs only stay on if something still holds their links, usually pins under a LoaderConfig.PinPath;
+// running sessions show up too
+func ListAttached(iface string) ([]AttachedProg, error) {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting interface %s: %w", iface, err)
+	}
+	return listAttached(dev)
+}
+
+func listAttached(dev *net.Interface) ([]AttachedProg, error) {
+	iface := dev.Name
+	var res []AttachedProg
+	for _, dir := range []ebpf.AttachType{ebpf.AttachTCXEgress, ebpf.AttachTCXIngress} {
+		q, err := link.QueryPrograms(link.QueryOptions{Target: dev.Index, Attach: dir})
+		if err != nil {
+			return nil, fmt.Errorf("Error querying %s programs on %s: %w", dir, iface, err)
+		}
+		for _, p := range q.Programs {
+			prog, err := ebpf.NewProgramFromID(p.ID)
+			if err != nil {
+				// detached in the meantime
+				continue
+			}
+			info, err := prog.Info()
+			prog.Close()
+			if err != nil || stampProgram(info.Name) == false {
+				continue
+			}
+			linkID, _ := p.LinkID()
+			res = append(res, AttachedProg{ID: p.ID, Name: info.Name, Attach: dir, LinkID: linkID})
+		}
+	}
+	return res, nil
+}
+
+// DetachStale takes every program ListAttached finds off the interface, running sessions' included, so only use it when there are none.
+// Pins stay behind with their links defunct, the next run with the same PinPath clears them out
+func DetachStale(iface string) error {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("Error getting interface %s: %w", iface, err)
+	}
+	progs, err := ListAttached(iface)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, p := range progs {
+		if err := detachProg(dev.Index, p); err != nil {
+			errs = append(errs, fmt.Errorf("Error detaching %s(%d) from %s: %w", p.Name, p.ID, iface, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func detachProg(ifindex int, p AttachedProg) error {
+	if p.LinkID == 0 {
+		prog, err := ebpf.NewProgramFromID(p.ID)
+		if err != nil {
+			return err
+		}
+		defer prog.Close()
+		return link.RawDetachProgram(link.RawDetachProgramOptions{Target: ifindex, Program: prog, Attach: p.Attach})
+	}
+	l, err := link.NewFromID(p.LinkID)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return linkDetach(l)
+}
+
+// BPF_LINK_DETACH, cilium/ebpf doesn't wrap it: the link stays but lets go of the program and the interface,
+// which is the only way to get at one someone else holds on to
+func linkDetach(l link.Link) error {
+	fdLink, ok := l.(interface{ FD() int })
+	if ok == false {
+		return fmt.Errorf("Link has no fd")
+	}
+	attr := struct{ fd uint32 }{uint32(fdLink.FD())}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, 34, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// before prog goes on: the same program of another run being there already is ErrAlreadyAttached, or with ReplaceAttached it comes off.
+// prog itself is fine, that's WatchAndReattach putting it back
+func (l *Loader) checkAttached(dev *net.Interface, prog *ebpf.Program, typ ebpf.AttachType) error {
+	info, err := prog.Info()
+	if err != nil {
+		// can't tell, the attach will go ahead like it used to
+		return nil
+	}
+	self, _ := info.ID()
+	progs, err := listAttached(dev)
+	if err != nil {
+		return err
+	}
+	for _, p := range progs {
+		if p.Attach != typ || p.Name != info.Name || p.ID == self {
+			continue
+		}
+		if l.Config.ReplaceAttached == false {
+			return fmt.Errorf("%w: %s(%d) is on %s %s already, another run's? ReplaceAttached(--replace) takes it off", ErrAlreadyAttached, p.Name, p.ID, dev.Name, typ)
+		}
+		l.logger().Warn("Taking another run's program off to replace it", "iface", dev.Name, "direction", typ, "prog", p.Name, "id", p.ID)
+		if err := detachProg(dev.Index, p); err != nil {
+			return fmt.Errorf("Error detaching %s(%d) from %s: %w", p.Name, p.ID, dev.Name, err)
+		}
+	}
+	return nil
+}
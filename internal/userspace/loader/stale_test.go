@@ -0,0 +1,66 @@
+package loader
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+)
+
+// another run's reflector_in on the same hook, needs root, TCX and the veths
+func TestCheckAttached(t *testing.T) {
+	var first, second reflector.ReflectorObjects
+	if err := reflector.LoadReflectorObjects(&first, nil); err != nil {
+		t.Skipf("Can't load the reflector programs: %v", err)
+	}
+	defer first.Close()
+	if err := reflector.LoadReflectorObjects(&second, nil); err != nil {
+		t.Fatalf("Error loading the reflector programs again: %v", err)
+	}
+	defer second.Close()
+	conn, err := netlink.Dial()
+	if err != nil {
+		t.Skipf("Can't talk to netlink: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.CreateVeth("stampdup0", "stampdup1"); err != nil {
+		t.Skipf("Can't create a veth pair: %v", err)
+	}
+	dev, err := net.InterfaceByName("stampdup0")
+	if err != nil {
+		t.Fatalf("Error looking up the veth: %v", err)
+	}
+	t.Cleanup(func() {
+		if conn, err := netlink.Dial(); err == nil {
+			conn.DeleteLink(dev.Index)
+			conn.Close()
+		}
+	})
+	lnk, err := link.AttachTCX(link.TCXOptions{Program: first.ReflectorIn, Attach: ebpf.AttachTCXIngress, Interface: dev.Index})
+	if err != nil {
+		t.Skipf("Can't attach with TCX: %v", err)
+	}
+	defer lnk.Close()
+
+	l := NewLoader(LoaderConfig{})
+	if err := l.checkAttached(dev, first.ReflectorIn, ebpf.AttachTCXIngress); err != nil {
+		t.Errorf("checkAttached() = %v for the program that's on, want nil", err)
+	}
+	if err := l.checkAttached(dev, second.ReflectorIn, ebpf.AttachTCXEgress); err != nil {
+		t.Errorf("checkAttached() = %v on the other hook, want nil", err)
+	}
+	if err := l.checkAttached(dev, second.ReflectorIn, ebpf.AttachTCXIngress); errors.Is(err, ErrAlreadyAttached) == false {
+		t.Errorf("checkAttached() = %v, want %v", err, ErrAlreadyAttached)
+	}
+	l.Config.ReplaceAttached = true
+	if err := l.checkAttached(dev, second.ReflectorIn, ebpf.AttachTCXIngress); err != nil {
+		t.Fatalf("checkAttached() with ReplaceAttached returned error: %v", err)
+	}
+	if progs, err := ListAttached(dev.Name); err != nil || len(progs) != 0 {
+		t.Errorf("ListAttached() = %v, %v after replacing, want nothing left", progs, err)
+	}
+}
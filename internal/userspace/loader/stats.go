@@ -0,0 +1,192 @@
+package loader
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// Stats are the session counters kept by the BPF programs, summed up over all CPUs
+type Stats struct {
+	PacketsSent      uint64 // sender only
+	PacketsReflected uint64 // replies received by the sender, requests turned around by the reflector
+	PacketsDropped   uint64 // ours but too short to process, or the reflector failed to turn it around
+	SeqErrors        uint64 // sender only: replies to a seq we never sent
+	PacketsDenied    uint64 // reflector only: requests from outside --allow-from
+	// sender only: gaps in the reflector's seq, round trip in stateless mode and return path only in stateful mode
+	Lost      uint64 // skipped over and never showed up(yet)
+	Reordered uint64 // showed up behind a later one
+	// reflector only: requests --passive counted and let through unanswered
+	PacketsObserved uint64
+	// reflector only: requests dropped over --max-reply-pps
+	RateLimited uint64
+	// sender only: the seq after the furthest probe that went out(so stamp.Args.SeqStart before the first one), 0 reopened from pins;
+	// not in StatsPerCPU
+	NextSeq uint32
+}
+
+// keys of the stats map
+// KEEP IN SYNC with enum stat_key in stamp.bpf.h
+const (
+	statSent uint32 = iota
+	statReflected
+	statDropped
+	statSeqErr
+	statDenied
+	statLost
+	statReordered
+)
+
+// these went in behind the health check's, see health.go
+const (
+	statObserved = statHealthIn + 1 + iota
+	statRateLimited
+)
+
+// Stats reads the session counters, with several interfaces they all count into the same map; ErrInterfaceGone once they're all gone
+func (s senderFD) Stats() (Stats, error) {
+	if err := s.Err(); err != nil {
+		return Stats{}, err
+	}
+	st, err := readStats(s.Objs.Stats)
+	if err != nil {
+		return Stats{}, err
+	}
+	st.NextSeq, err = s.nextSeq()
+	return st, err
+}
+
+// every interface keeps its own, probes go out whichever one the route says; the one furthest from the start(serial, so through
+// wrapping around) is where we're at
+func (s senderFD) nextSeq() (uint32, error) {
+	// globals can't be reopened from pins
+	if s.Objs.NextSeq == nil {
+		return 0, nil
+	}
+	var res uint32
+	for i, o := range s.allObjs() {
+		var next uint32
+		if err := o.NextSeq.Get(&next); err != nil {
+			return 0, fmt.Errorf("Error reading next seq: %w", err)
+		}
+		if i == 0 || int32(next-s.args.SeqStart) > int32(res-s.args.SeqStart) {
+			res = next
+		}
+	}
+	return res, nil
+}
+
+// Stats reads the session counters, with several interfaces they all count into the same map; ErrInterfaceGone once they're all gone
+func (s reflectorFD) Stats() (Stats, error) {
+	if err := s.Err(); err != nil {
+		return Stats{}, err
+	}
+	return readStats(s.Objs.Stats)
+}
+
+// ResetStats zeroes every counter on every CPU without detaching anything, for another run in the same process.
+// BPF keeps counting the whole time, whatever comes in while we're at it may or may not make it into the new run
+func (s senderFD) ResetStats() error {
+	return resetStats(s.Objs.Stats)
+}
+
+// ResetStats zeroes every counter on every CPU without detaching anything, see senderFD.ResetStats
+func (s reflectorFD) ResetStats() error {
+	return resetStats(s.Objs.Stats)
+}
+
+// StatsPerCPU is Stats() before it's summed up, one entry per possible CPU in CPU order; a hot CPU stands out here
+func (s senderFD) StatsPerCPU() ([]Stats, error) {
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return readStatsPerCPU(s.Objs.Stats)
+}
+
+// StatsPerCPU is Stats() before it's summed up, one entry per possible CPU in CPU order; a hot CPU stands out here
+func (s reflectorFD) StatsPerCPU() ([]Stats, error) {
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return readStatsPerCPU(s.Objs.Stats)
+}
+
+// a reset goes key by key, a read in the middle of it would see half a reset; handles get copied around so it's not theirs to hold
+var statsMut sync.RWMutex
+
+func resetStats(m *ebpf.Map) error {
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return fmt.Errorf("Error getting CPU count: %w", err)
+	}
+	zeroes := make([]uint64, cpus)
+	statsMut.Lock()
+	defer statsMut.Unlock()
+	// the health check's counters in between are its own business
+	for _, key := range []uint32{statSent, statReflected, statDropped, statSeqErr, statDenied, statLost, statReordered, statObserved, statRateLimited} {
+		if err := m.Put(key, zeroes); err != nil {
+			return fmt.Errorf("Error resetting stats counter %d: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// every program bumps the counters of the CPU it runs on so they never contend, it all adds up here
+func readStats(m *ebpf.Map) (Stats, error) {
+	percpu, err := readStatsPerCPU(m)
+	if err != nil {
+		return Stats{}, err
+	}
+	return sumStats(percpu), nil
+}
+
+func sumStats(percpu []Stats) Stats {
+	var res Stats
+	for _, s := range percpu {
+		res.PacketsSent += s.PacketsSent
+		res.PacketsReflected += s.PacketsReflected
+		res.PacketsDropped += s.PacketsDropped
+		res.SeqErrors += s.SeqErrors
+		res.PacketsDenied += s.PacketsDenied
+		res.Lost += s.Lost
+		res.Reordered += s.Reordered
+		res.PacketsObserved += s.PacketsObserved
+		res.RateLimited += s.RateLimited
+	}
+	return res
+}
+
+func readStatsPerCPU(m *ebpf.Map) ([]Stats, error) {
+	statsMut.RLock()
+	defer statsMut.RUnlock()
+	var res []Stats
+	counters := []struct {
+		key uint32
+		val func(*Stats) *uint64
+	}{
+		{statSent, func(s *Stats) *uint64 { return &s.PacketsSent }},
+		{statReflected, func(s *Stats) *uint64 { return &s.PacketsReflected }},
+		{statDropped, func(s *Stats) *uint64 { return &s.PacketsDropped }},
+		{statSeqErr, func(s *Stats) *uint64 { return &s.SeqErrors }},
+		{statDenied, func(s *Stats) *uint64 { return &s.PacketsDenied }},
+		{statLost, func(s *Stats) *uint64 { return &s.Lost }},
+		{statReordered, func(s *Stats) *uint64 { return &s.Reordered }},
+		{statObserved, func(s *Stats) *uint64 { return &s.PacketsObserved }},
+		{statRateLimited, func(s *Stats) *uint64 { return &s.RateLimited }},
+	}
+	for _, c := range counters {
+		// per-CPU maps come back as one value per possible CPU
+		var percpu []uint64
+		if err := m.Lookup(c.key, &percpu); err != nil {
+			return nil, fmt.Errorf("Error reading stats counter %d: %w", c.key, err)
+		}
+		if res == nil {
+			res = make([]Stats, len(percpu))
+		}
+		for cpu, v := range percpu {
+			*c.val(&res[cpu]) = v
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,66 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// same layout as the stats map in stamp.bpf.h, needs root
+func TestReadStats(t *testing.T) {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.PerCPUArray, KeySize: 4, ValueSize: 8, MaxEntries: statRateLimited + 1})
+	if err != nil {
+		t.Skipf("Can't create a per-CPU map: %v", err)
+	}
+	defer m.Close()
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		t.Fatalf("Error getting CPU count: %v", err)
+	}
+	// every CPU counts something different so a mixed up CPU or counter shows
+	for key := statSent; key <= statRateLimited; key++ {
+		vals := make([]uint64, cpus)
+		for cpu := range vals {
+			vals[cpu] = uint64(key+1) * uint64(cpu+1)
+		}
+		if err := m.Put(key, vals); err != nil {
+			t.Fatalf("Error setting counter %d: %v", key, err)
+		}
+	}
+	percpu, err := readStatsPerCPU(m)
+	if err != nil {
+		t.Fatalf("readStatsPerCPU() returned error: %v", err)
+	}
+	if len(percpu) != cpus {
+		t.Fatalf("readStatsPerCPU() returned %d CPUs, want %d", len(percpu), cpus)
+	}
+	for cpu, s := range percpu {
+		n := uint64(cpu + 1)
+		want := Stats{PacketsSent: n, PacketsReflected: 2 * n, PacketsDropped: 3 * n, SeqErrors: 4 * n, PacketsDenied: 5 * n, Lost: 6 * n, Reordered: 7 * n, PacketsObserved: 10 * n, RateLimited: 11 * n}
+		if s != want {
+			t.Errorf("CPU %d: got %+v, want %+v", cpu, s, want)
+		}
+	}
+	// 1+2+...+cpus times the counter's multiplier
+	sum := uint64(cpus * (cpus + 1) / 2)
+	want := Stats{PacketsSent: sum, PacketsReflected: 2 * sum, PacketsDropped: 3 * sum, SeqErrors: 4 * sum, PacketsDenied: 5 * sum, Lost: 6 * sum, Reordered: 7 * sum, PacketsObserved: 10 * sum, RateLimited: 11 * sum}
+	got, err := readStats(m)
+	if err != nil {
+		t.Fatalf("readStats() returned error: %v", err)
+	}
+	if got != want {
+		t.Errorf("readStats() = %+v, want %+v", got, want)
+	}
+	if err := resetStats(m); err != nil {
+		t.Fatalf("resetStats() returned error: %v", err)
+	}
+	percpu, err = readStatsPerCPU(m)
+	if err != nil {
+		t.Fatalf("readStatsPerCPU() returned error: %v", err)
+	}
+	for cpu, s := range percpu {
+		if s != (Stats{}) {
+			t.Errorf("CPU %d after resetStats(): %+v, want all zero", cpu, s)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+)
+
+// pinned layout under LoaderConfig.StatsPinPath, role is sender or reflector:
+//
+//	<role>/stats     the counters Stats() reads
+//	<role>/sessions  reflector only: the next seq of every session-sender in stateful mode
+const (
+	pinStats    = "stats"
+	pinSessions = "sessions"
+)
+
+// pins clones so a map pinned under PinPath stays there too, cilium/ebpf would move it otherwise
+// a crashed run's pins get replaced, a sidecar still holding on to those keeps reading a dead map until it reopens
+func (l *Loader) pinStats(role string, maps map[string]*ebpf.Map) error {
+	if l.Config.StatsPinPath == "" {
+		return nil
+	}
+	dir := filepath.Join(l.Config.StatsPinPath, role)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("Error removing stale stats pins: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Error creating %s: %w", dir, err)
+	}
+	for name, m := range maps {
+		clone, err := m.Clone()
+		if err == nil {
+			err = clone.Pin(filepath.Join(dir, name))
+			clone.Close()
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("Error pinning %s to %s: %w", name, dir, err)
+		}
+	}
+	l.statsPinDir = dir
+	return nil
+}
+
+// PinnedStats is a read-only view of the maps a running sender or reflector pinned under LoaderConfig.StatsPinPath, for another
+// process(e.g. an exporter sidecar) to poll. It doesn't care whether the programs are attached, the maps stay readable until it's closed.
+// Reading while BPF writes is safe: every CPU has its own 64-bit counters and a read never sees half of one,
+// but a ResetStats() in the other process can be seen half done
+type PinnedStats struct {
+	stats    *ebpf.Map
+	sessions *ebpf.Map
+}
+
+// OpenPinnedStats opens the pins of one role, e.g. /sys/fs/bpf/stamp-stats/reflector for StatsPinPath /sys/fs/bpf/stamp-stats
+func OpenPinnedStats(path string) (*PinnedStats, error) {
+	ro := &ebpf.LoadPinOptions{ReadOnly: true}
+	stats, err := ebpf.LoadPinnedMap(filepath.Join(path, pinStats), ro)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening pinned stats under %s: %w", path, err)
+	}
+	res := &PinnedStats{stats: stats}
+	res.sessions, err = ebpf.LoadPinnedMap(filepath.Join(path, pinSessions), ro)
+	if err != nil && errors.Is(err, os.ErrNotExist) == false {
+		stats.Close()
+		return nil, fmt.Errorf("Error opening pinned sessions under %s: %w", path, err)
+	}
+	return res, nil
+}
+
+// Stats reads the counters summed up over all CPUs, same as the handle's Stats()
+func (p *PinnedStats) Stats() (Stats, error) {
+	return readStats(p.stats)
+}
+
+// StatsPerCPU reads the counters of every CPU, same as the handle's StatsPerCPU()
+func (p *PinnedStats) StatsPerCPU() ([]Stats, error) {
+	return readStatsPerCPU(p.stats)
+}
+
+// Sessions is the next sequence number of every session-sender a stateful reflector knows about, by source IP and port.
+// The map keeps changing while it's read so a session that comes or goes right then may or may not be in there
+func (p *PinnedStats) Sessions() (map[netip.AddrPort]uint32, error) {
+	if p.sessions == nil {
+		return nil, fmt.Errorf("No sessions pinned, only reflectors have them")
+	}
+	res := make(map[netip.AddrPort]uint32)
+	var key reflector.ReflectorSessKey
+	var next uint32
+	iter := p.sessions.Iterate()
+	for iter.Next(&key, &next) {
+		res[netip.AddrPortFrom(netip.AddrFrom16(key.Raddr).Unmap(), key.Port)] = next
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading sessions: %w", err)
+	}
+	return res, nil
+}
+
+func (p *PinnedStats) Close() {
+	p.stats.Close()
+	if p.sessions != nil {
+		p.sessions.Close()
+	}
+}
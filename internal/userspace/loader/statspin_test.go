@@ -0,0 +1,76 @@
+package loader
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// pinning needs a real bpffs, the sandbox usually doesn't have one mounted
+func bpffs(t *testing.T) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/bpf", &st); err != nil || st.Type != unix.BPF_FS_MAGIC {
+		t.Skip("No bpffs at /sys/fs/bpf")
+	}
+	dir, err := os.MkdirTemp("/sys/fs/bpf", "stamp-test")
+	if err != nil {
+		t.Skipf("Can't create a directory on bpffs: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestOpenPinnedStats(t *testing.T) {
+	dir := bpffs(t)
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.PerCPUArray, KeySize: 4, ValueSize: 8, MaxEntries: statRateLimited + 1})
+	if err != nil {
+		t.Skipf("Can't create a per-CPU map: %v", err)
+	}
+	defer m.Close()
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		t.Fatalf("Error getting CPU count: %v", err)
+	}
+	vals := make([]uint64, cpus)
+	vals[0] = 5
+	if err := m.Put(statSent, vals); err != nil {
+		t.Fatalf("Error setting counter: %v", err)
+	}
+	l := NewLoader(LoaderConfig{StatsPinPath: dir})
+	if err := l.pinStats("sender", map[string]*ebpf.Map{pinStats: m}); err != nil {
+		t.Fatalf("pinStats() returned error: %v", err)
+	}
+	p, err := OpenPinnedStats(l.statsPinDir)
+	if err != nil {
+		t.Fatalf("OpenPinnedStats() returned error: %v", err)
+	}
+	defer p.Close()
+	// the writer going on while we read is the whole point
+	vals[0] = 7
+	if err := m.Put(statSent, vals); err != nil {
+		t.Fatalf("Error setting counter: %v", err)
+	}
+	s, err := p.Stats()
+	if err != nil {
+		t.Fatalf("Stats() returned error: %v", err)
+	}
+	if s.PacketsSent != 7 {
+		t.Errorf("Stats().PacketsSent = %d, want 7", s.PacketsSent)
+	}
+	if _, err := p.Sessions(); err == nil {
+		t.Errorf("Sessions() on a sender's pins returned no error")
+	}
+	if err := p.stats.Put(statSent, vals); err == nil {
+		t.Errorf("Writing through the pinned view worked, want it read-only")
+	}
+	// the handle lets go of the pins, the view keeps working
+	l.Close()
+	if _, err := os.Stat(l.statsPinDir); os.IsNotExist(err) == false {
+		t.Errorf("%s still there after Close(): %v", l.statsPinDir, err)
+	}
+	if _, err := p.Stats(); err != nil {
+		t.Errorf("Stats() after the pins are gone returned error: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// SyncState is what a round of clock checks found, see WatchSync
+type SyncState struct {
+	Synced bool
+	// only checked when Synced
+	PTP bool
+	// what our timestamps carry from now on
+	ErrorEstimate stamp.ErrorEstimate
+	// and what the Timestamp Information TLV says about the clock
+	Clock ClockInfo
+}
+
+// the clock globals of one set of objects
+type clockVars struct {
+	tai, taiOffset, errEst *ebpf.Variable
+	// reflector only, nil for the sender
+	syncSrc *ebpf.Variable
+}
+
+// WatchSync reruns the clock checks every interval and updates the TAI correction and Error Estimate in BPF(and stamp.SetErrorEstimate
+// for the packets userspace builds) as it goes. onChange, if not nil, gets the new state whenever the clock gets synced or loses it,
+// or PTP comes or goes; it runs on the watching goroutine so don't block in it. --enforce-sync and --enforce-ptp are only checked at load.
+// Replies sent while we were unsynced carry SenderError without Synced(), so consumers can tell those apart.
+// It blocks until ctx is done, stop it before closing the handle
+func (s senderFD) WatchSync(ctx context.Context, interval time.Duration, onChange func(SyncState)) error {
+	vars := []clockVars{{s.Objs.Tai, s.Objs.TaiOffset, s.Objs.ErrEst, nil}}
+	for _, o := range s.others {
+		vars = append(vars, clockVars{o.Tai, o.TaiOffset, o.ErrEst, nil})
+	}
+	return s.loader.watchSync(ctx, s.args, interval, onChange, vars)
+}
+
+// WatchSync reruns the clock checks and keeps the globals up to date, see senderFD.WatchSync.
+// Replies sent while we were unsynced carry ReflectorError without Synced()
+func (s reflectorFD) WatchSync(ctx context.Context, interval time.Duration, onChange func(SyncState)) error {
+	var vars []clockVars
+	for _, o := range s.allObjs() {
+		vars = append(vars, clockVars{o.Tai, o.TaiOffset, o.ErrEst, o.SyncSrc})
+	}
+	return s.loader.watchSync(ctx, s.args, interval, onChange, vars)
+}
+
+func (l *Loader) watchSync(ctx context.Context, args stamp.Args, interval time.Duration, onChange func(SyncState), vars []clockVars) error {
+	if l == nil {
+		return fmt.Errorf("Can't watch the clock for a handle reopened from pins, its globals can't be reopened")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("Invalid sync check interval %v", interval)
+	}
+	// the default checker logs everything it finds, every round of that is too much; we log the changes ourselves
+	checker := l.Config.SyncChecker
+	if checker == nil {
+		checker = DefaultSyncChecker{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	}
+	prev := l.clocks
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		cur, err := readClocks(args, checker, l.logger())
+		if err != nil {
+			// whatever we had keeps going, maybe it works next time
+			l.logger().Warn("Error rechecking clock sync", "err", err)
+			continue
+		}
+		for _, v := range vars {
+			setTAI(v.tai, v.taiOffset, cur.leap, args.TAIOffset)
+			v.errEst.Set(uint16(cur.errEst))
+			if v.syncSrc != nil {
+				v.syncSrc.Set(uint8(cur.info().Source))
+			}
+		}
+		stamp.SetErrorEstimate(cur.errEst)
+		if cur.leap != prev.leap {
+			l.logger().Warn("TAI-UTC offset changed, correction updated", "correction", cur.leap)
+		}
+		if cur.synced != prev.synced || cur.ptp != prev.ptp {
+			if cur.synced == false {
+				l.logger().Warn("System clock lost sync, measurements are unreliable until it's back", "estimate", cur.errEst)
+			} else {
+				l.logger().Info("System clock synced", "ptp", cur.ptp, "estimate", cur.errEst)
+			}
+			if onChange != nil {
+				onChange(SyncState{Synced: cur.synced, PTP: cur.ptp, ErrorEstimate: cur.errEst, Clock: cur.info()})
+			}
+		}
+		prev = cur
+	}
+}
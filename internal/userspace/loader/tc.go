@@ -0,0 +1,173 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// AttachMode is how the programs go on an interface, cgroup mode doesn't care
+type AttachMode int
+
+const (
+	// AttachAuto uses TCX and falls back to TC on kernels that don't have it(before 6.6)
+	AttachAuto AttachMode = iota
+	// AttachTCX attaches through TCX links, with anchors
+	AttachTCX
+	// AttachTC puts the programs on a clsact qdisc as cls_bpf filters in direct-action mode, always in front of whatever's already there
+	AttachTC
+	// AttachXDP is AttachAuto plus the sender's replies timestamped in XDP, on drivers with native XDP; sender only, see xdp.go
+	AttachXDP
+)
+
+func (m AttachMode) String() string {
+	switch m {
+	case AttachAuto:
+		return "auto"
+	case AttachTCX:
+		return "TCX"
+	case AttachTC:
+		return "TC"
+	case AttachXDP:
+		return "XDP"
+	}
+	return fmt.Sprintf("AttachMode(%d)", int(m))
+}
+
+// whether the programs go on as TC filters, AttachAuto asks the kernel once per loader
+func (l *Loader) tcMode() bool {
+	switch l.Config.AttachMode {
+	case AttachTC:
+		return true
+	case AttachTCX:
+		return false
+	}
+	if l.haveTCX == nil {
+		have := tcxSupported()
+		l.haveTCX = &have
+		if have == false {
+			l.logger().Info("No TCX on this kernel, attaching through TC(clsact) instead")
+		}
+	}
+	return *l.haveTCX == false
+}
+
+// asking what's on a TCX hook fails on kernels without TCX, loopback is there to ask about everywhere
+func tcxSupported() bool {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		// nothing to go by, TCX is what we'd use anyway
+		return true
+	}
+	_, err = link.QueryPrograms(link.QueryOptions{Target: lo.Index, Attach: ebpf.AttachTCXIngress})
+	return err == nil
+}
+
+// tcFilter is a program on a clsact qdisc. It's not a link but it goes everywhere links go so it passes for one:
+// link.Link can't be implemented outside cilium/ebpf, the embedded nil one is only there for that and never gets called
+type tcFilter struct {
+	link.Link
+	filter netlink.TCFilter
+	attach ebpf.AttachType
+	prog   *ebpf.Program
+	// we added the clsact qdisc, whoever takes the last filter off it deletes it
+	qdisc  bool
+	closed bool
+	// LoaderConfig.NetnsPath it went on in, netlink has to go back there to take it off
+	netns string
+}
+
+func (l *Loader) attachTC(dev *net.Interface, prog *ebpf.Program, typ ebpf.AttachType) (link.Link, error) {
+	conn, err := netlink.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	created, err := conn.AddClsact(dev.Index)
+	if err != nil {
+		return nil, err
+	}
+	// egress goes on first and creates it, ingress has to know it's ours too
+	if created == true {
+		l.clsacts[dev.Index] = true
+	}
+	f := &tcFilter{attach: typ, prog: prog, qdisc: l.clsacts[dev.Index], netns: l.Config.NetnsPath}
+	f.filter, err = conn.AddBPFFilter(dev.Index, typ == ebpf.AttachTCXIngress, prog.FD(), filterName(prog))
+	if err != nil {
+		if created == true {
+			conn.DeleteClsact(dev.Index)
+			delete(l.clsacts, dev.Index)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// tc shows this next to the filter
+func filterName(prog *ebpf.Program) string {
+	if info, err := prog.Info(); err == nil && info.Name != "" {
+		return info.Name
+	}
+	return "stamp"
+}
+
+// Close takes the filter off and the qdisc with it if we added it and nothing else is on it, safe to call twice
+func (f *tcFilter) Close() error {
+	if f.closed == true {
+		return nil
+	}
+	f.closed = true
+	return inNetns(f.netns, f.remove)
+}
+
+func (f *tcFilter) remove() error {
+	conn, err := netlink.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the interface(and everything on it) might be gone already
+	if err := conn.DeleteFilter(f.filter); err != nil && errors.Is(err, unix.ENOENT) == false && errors.Is(err, unix.ENODEV) == false && errors.Is(err, unix.EINVAL) == false {
+		return err
+	}
+	if f.qdisc == false {
+		return nil
+	}
+	if busy, err := conn.HasFilters(f.filter.Ifindex); err != nil || busy == true {
+		return nil
+	}
+	return conn.DeleteClsact(f.filter.Ifindex)
+}
+
+func (f *tcFilter) Update(prog *ebpf.Program) error {
+	return inNetns(f.netns, func() error {
+		conn, err := netlink.Dial()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.ReplaceBPFFilter(f.filter, prog.FD(), filterName(prog)); err != nil {
+			return err
+		}
+		f.prog = prog
+		return nil
+	})
+}
+
+// filters stay on the interface without anyone holding them, but the pins are what we reopen handles from
+func (f *tcFilter) Pin(string) error {
+	return fmt.Errorf("TC filters can't be pinned: %w", ebpf.ErrNotSupported)
+}
+
+func (f *tcFilter) Unpin() error {
+	return nil
+}
+
+func (f *tcFilter) Info() (*link.Info, error) {
+	return nil, fmt.Errorf("TC filters aren't links: %w", ebpf.ErrNotSupported)
+}
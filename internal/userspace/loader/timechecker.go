@@ -1,56 +1,211 @@
 package loader
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os/exec"
+	"time"
 
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
 	"golang.org/x/sys/unix"
 )
 
-// returns true if we need to add leap seconds to TAI clock
-func checkTAI() bool {
+// SyncChecker is how the loader finds out about the system clock before a session.
+// The default one probes adjtimex() and looks for ptp4l in the journal, plug your own into LoaderConfig if that doesn't fit your setup
+type SyncChecker interface {
+	// TAI returns whether CLOCK_TAI is missing the leap second offset and has to be corrected, not called with --tai-offset
+	TAI() (bool, error)
+	// Synced returns whether the system clock is synced at all
+	Synced() (bool, error)
+	// PTP returns whether it's synced over PTP
+	PTP() (bool, error)
+}
+
+// ErrorEstimator is an optional extension of SyncChecker for the Error Estimate(RFC 8762 4.2.1) that goes out with our timestamps,
+// a SyncChecker that doesn't implement it gets the kernel's estimate
+type ErrorEstimator interface {
+	// ErrorEstimate returns how far off the system clock might be
+	ErrorEstimate() (time.Duration, error)
+}
+
+// DefaultSyncChecker is the SyncChecker used when LoaderConfig doesn't set one, it logs what it finds to Logger(slog.Default() when nil)
+type DefaultSyncChecker struct {
+	Logger *slog.Logger
+}
+
+// TAI only needs correcting when the kernel doesn't know the offset, that's also when we're not sure about it
+func (c DefaultSyncChecker) TAI() (bool, error) {
+	_, known, err := checkTAI(c.logger())
+	return known == false, err
+}
+
+func (c DefaultSyncChecker) Synced() (bool, error) { return checkSync(c.logger()) }
+func (c DefaultSyncChecker) PTP() (bool, error)    { return checkPTP(c.logger()), nil }
+
+// ErrorEstimate goes by what the sync daemon told the kernel, see clockError
+func (c DefaultSyncChecker) ErrorEstimate() (time.Duration, error) { return clockError(c.logger()) }
+
+func (c DefaultSyncChecker) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+func (l *Loader) syncChecker() SyncChecker {
+	if l.Config.SyncChecker != nil {
+		return l.Config.SyncChecker
+	}
+	return DefaultSyncChecker{Logger: l.logger()}
+}
+
+// what the clock checks came up with
+type clocks struct {
+	// TAI needs correcting
+	leap bool
+	// the TAI-UTC offset isn't just assumed, see ClockInfo.TAIKnown
+	taiKnown bool
+	// synced at all, and over PTP; the latter is only checked if the former is true
+	synced, ptp bool
+	// goes into every timestamp we write
+	errEst stamp.ErrorEstimate
+	// for ClockInfo
+	offset, maxErr time.Duration
+}
+
+// runs all the clock checks, returns what they found or why we shouldn't go on
+func checkClocks(args stamp.Args, checker SyncChecker, logger *slog.Logger) (clocks, error) {
+	// an explicit offset is there precisely for when detection gets it wrong
+	if args.TAIOffset != 0 {
+		logger.Info("Going by the configured TAI-UTC offset", "offset", args.TAIOffset, "correction", stamp.TAICorrection(args.TAIOffset))
+	}
+	c, err := readClocks(args, checker, logger)
+	if err != nil {
+		return clocks{}, err
+	}
+	// Check if we have clock syncing
+	if c.synced == false && (args.Sync == true || args.PTP == true) {
+		return clocks{}, errors.New("No clock syncing detected with --enforce-sync flag set, aborting")
+	}
+	if c.synced == true && c.ptp == false && args.PTP == true {
+		return clocks{}, errors.New("No PTP syncing detected with --enforce-ptp flag set, aborting")
+	}
+	if c.taiKnown == false {
+		logger.Warn("TAI-UTC offset is assumed, not known: one-way delays can be off by whole seconds so timestamps go out marked unsynced, trust RTT only; set it with --tai-offset or have the sync daemon tell the kernel", "assumed", assumedTAIOffset)
+	}
+	logger.Info("Timestamp error estimate", "estimate", c.errEst)
+	return c, nil
+}
+
+// the checks themselves without passing judgement, WatchSync reruns them
+func readClocks(args stamp.Args, checker SyncChecker, logger *slog.Logger) (clocks, error) {
+	var c clocks
+	var err error
+	if args.TAIOffset == 0 {
+		if c.leap, err = checker.TAI(); err != nil {
+			return clocks{}, err
+		}
+	}
+	// a correction means the kernel doesn't know the offset and we're going by assumedTAIOffset
+	c.taiKnown = args.TAIOffset != 0 || c.leap == false
+	if c.synced, err = checker.Synced(); err != nil {
+		return clocks{}, err
+	}
+	if c.synced == true {
+		if c.ptp, err = checker.PTP(); err != nil {
+			return clocks{}, err
+		}
+	}
+	est, err := estimateError(checker, logger)
+	if err != nil {
+		return clocks{}, err
+	}
+	// a synced clock with an assumed TAI offset is still off by however wrong that is
+	c.errEst = stamp.NewErrorEstimate(est, c.synced == true && c.taiKnown == true)
+	if c.offset, c.maxErr, err = readAdjtimex(); err != nil {
+		return clocks{}, err
+	}
+	return c, nil
+}
+
+func estimateError(checker SyncChecker, logger *slog.Logger) (time.Duration, error) {
+	if e, ok := checker.(ErrorEstimator); ok == true {
+		return e.ErrorEstimate()
+	}
+	return clockError(logger)
+}
+
+// what TAI-UTC has been since 2017, and what BPF adds(TAI_LEAP) when the kernel doesn't know
+// KEEP IN SYNC with timestamp_at() in stamp.bpf.h
+const assumedTAIOffset = 37
+
+// returns the TAI-UTC offset in seconds and whether the kernel told us(confident) or we're assuming it(and need to add it to the TAI clock)
+func checkTAI(logger *slog.Logger) (int, bool, error) {
 	var tai, utc unix.Timespec
 	unix.ClockGettime(unix.CLOCK_TAI, &tai)
 	unix.ClockGettime(unix.CLOCK_REALTIME, &utc)
 	if tai.Sec == utc.Sec {
-		fmt.Println("TAI is equal to UTC - STAMP will account for that but you might wanna fix it on your system")
-		return true
+		logger.Warn("TAI is equal to UTC - STAMP will account for that but you might wanna fix it on your system")
+		return assumedTAIOffset, false, nil
 	} else if (tai.Sec-utc.Sec) > 36 && (tai.Sec-utc.Sec) < 38 {
-		fmt.Println("TAI seems to be correctly offset from UTC, no correction required")
-		return false
+		logger.Info("TAI seems to be correctly offset from UTC, no correction required")
+		return int(tai.Sec - utc.Sec), true, nil
 	} else {
-		log.Fatalf("System error: irregular (not 37) TAI-UTC offset")
-		return false
+		return 0, false, errors.New("System error: irregular (not 37) TAI-UTC offset")
 	}
 }
 
-func checkSync() bool {
+func checkSync(logger *slog.Logger) (bool, error) {
 	var t unix.Timex
 	t.Modes = unix.ADJ_OFFSET_SS_READ
 	s, err := unix.Adjtimex(&t)
 	if err != nil {
-		log.Fatalf("Error getting adjtimex():", err)
-		return false
+		return false, fmt.Errorf("Error getting adjtimex(): %w", err)
 	}
 	if s == unix.TIME_ERROR {
-		fmt.Println("System clock doesn't seem to be synced - you might wanna do that")
-		return false
+		logger.Warn("System clock doesn't seem to be synced - you might wanna do that")
+		return false, nil
 	} else {
-		fmt.Println("System clock sync detected")
-		return true
+		logger.Info("System clock sync detected")
+		return true, nil
 	}
 }
 
-func checkPTP() bool {
+func checkPTP(logger *slog.Logger) bool {
 	cmd := exec.Command("bash", "-c", "journalctl | tail -n100 | grep ptp4l")
 	err := cmd.Run()
 	if err == nil {
-		fmt.Println("Detected PTP syncing")
+		logger.Info("Detected PTP syncing")
 		return true
 		// } else if err.(*exec.ExitError).ExitCode()==1 { // this doesn't account for non-systemd systems
 	} else {
-		fmt.Println("No PTP syncing detected(or the method might have failed)")
+		logger.Info("No PTP syncing detected(or the method might have failed)")
 		return false
 	}
 }
+
+// STA_NANO, x/sys doesn't have it
+const staNano = 0x2000
+
+// adjtimex() has the error the sync daemon(chrony, ntpd, phc2sys) estimates plus the offset it's still slewing away,
+// an unsynced clock only has the max error which the kernel keeps growing until somebody syncs it
+func clockError(logger *slog.Logger) (time.Duration, error) {
+	var t unix.Timex
+	s, err := unix.Adjtimex(&t)
+	if err != nil {
+		return 0, fmt.Errorf("Error getting adjtimex(): %w", err)
+	}
+	if s == unix.TIME_ERROR {
+		return time.Duration(t.Maxerror) * time.Microsecond, nil
+	}
+	offset := time.Duration(t.Offset)
+	if t.Status&staNano == 0 {
+		offset *= time.Microsecond
+	}
+	if offset < 0 {
+		offset = -offset
+	}
+	logger.Debug("Clock error from adjtimex()", "esterror", time.Duration(t.Esterror)*time.Microsecond, "offset", offset)
+	return time.Duration(t.Esterror)*time.Microsecond + offset, nil
+}
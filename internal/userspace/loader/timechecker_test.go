@@ -0,0 +1,49 @@
+package loader
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// a synced clock that says whatever we tell it about TAI
+type fakeChecker struct {
+	leap bool
+}
+
+func (c fakeChecker) TAI() (bool, error)                    { return c.leap, nil }
+func (c fakeChecker) Synced() (bool, error)                 { return true, nil }
+func (c fakeChecker) PTP() (bool, error)                    { return false, nil }
+func (c fakeChecker) ErrorEstimate() (time.Duration, error) { return time.Millisecond, nil }
+
+// an assumed offset keeps RTT but marks our timestamps unsynced so nothing works out one-way delays with them
+func TestTAIKnown(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		name string
+		leap bool
+		args stamp.Args
+		want bool
+	}{
+		{name: "kernel knows", leap: false, want: true},
+		{name: "assumed", leap: true, want: false},
+		{name: "--tai-offset", leap: true, args: stamp.Args{TAIOffset: 37}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := checkClocks(tt.args, fakeChecker{leap: tt.leap}, logger)
+			if err != nil {
+				t.Skipf("Can't read adjtimex(): %v", err)
+			}
+			if c.info().TAIKnown != tt.want {
+				t.Errorf("TAIKnown = %v, want %v", c.info().TAIKnown, tt.want)
+			}
+			if c.errEst.Synced() != tt.want {
+				t.Errorf("Error Estimate synced = %v on a synced clock, want %v", c.errEst.Synced(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/cilium/ebpf"
+)
+
+// VerifierLog is the verifier's full log out of an error from one of the loads, for routing it to your own logger.
+// false if the load didn't fail in the verifier
+func VerifierLog(err error) (string, bool) {
+	var verr *ebpf.VerifierError
+	if errors.As(err, &verr) == false {
+		return "", false
+	}
+	// %+v is the only way to get every line, the error string is truncated
+	return fmt.Sprintf("%+v", verr), true
+}
+
+// VerifierLogs are the verifier logs of the programs that passed, by program name; the Debug flag doesn't matter.
+// The kernel only keeps one with LoaderConfig.VerifierLogLevel above 0, every interface gets the same so these are the first one's
+func (s senderFD) VerifierLogs() map[string]string {
+	return verifierLogs(senderProgs(&s.Objs.SenderPrograms))
+}
+
+// VerifierLogs are the verifier logs of the programs that passed, by program name; the Debug flag doesn't matter.
+// The kernel only keeps one with LoaderConfig.VerifierLogLevel above 0, every interface gets the same so these are the first one's
+func (s reflectorFD) VerifierLogs() map[string]string {
+	return verifierLogs(reflectorProgs(&s.Objs.ReflectorPrograms))
+}
+
+// every program's log at debug level, they're only there with a VerifierLogLevel
+func logVerifier(logger *slog.Logger, progs map[string]**ebpf.Program) {
+	for name, vlog := range verifierLogs(progs) {
+		logger.Debug("Verifier log", "program", name, "log", vlog)
+	}
+}
+
+// programs that weren't loaded(TCX vs cgroup) or came back from pins without a log are left out
+func verifierLogs(progs map[string]**ebpf.Program) map[string]string {
+	res := map[string]string{}
+	for name, p := range progs {
+		if *p != nil && (*p).VerifierLog != "" {
+			res[name] = (*p).VerifierLog
+		}
+	}
+	return res
+}
@@ -0,0 +1,107 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// a veth with an 802.1Q VLAN and a QinQ stack on top, needs root and the 8021q module
+// the tags in the test frames are what the veth carries for those VLANs with tag offload off
+func vethWithVLANs(t *testing.T) (dot1q, sTag, cTag uint16) {
+	conn, err := netlink.Dial()
+	if err != nil {
+		t.Skipf("Can't talk to netlink: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.CreateVeth("stampvlan0", "stampvlan1"); err != nil {
+		t.Skipf("Can't create a veth pair: %v", err)
+	}
+	dev, err := net.InterfaceByName("stampvlan0")
+	if err != nil {
+		t.Fatalf("Error getting the veth: %v", err)
+	}
+	t.Cleanup(func() {
+		if conn, err := netlink.Dial(); err == nil {
+			conn.DeleteLink(dev.Index)
+			conn.Close()
+		}
+	})
+	dot1q, sTag, cTag = 100, 200, 300
+	if err := conn.CreateVLAN("stampvlan0.100", dev.Index, dot1q, unix.ETH_P_8021Q); err != nil {
+		t.Skipf("Can't create a VLAN interface: %v", err)
+	}
+	if err := conn.CreateVLAN("stampvlan0.200", dev.Index, sTag, unix.ETH_P_8021AD); err != nil {
+		t.Skipf("Can't create an 802.1ad VLAN interface: %v", err)
+	}
+	outer, err := net.InterfaceByName("stampvlan0.200")
+	if err != nil {
+		t.Fatalf("Error getting the 802.1ad VLAN: %v", err)
+	}
+	if err := conn.CreateVLAN("stampqinq0", outer.Index, cTag, unix.ETH_P_8021Q); err != nil {
+		t.Skipf("Can't create a QinQ VLAN interface: %v", err)
+	}
+	return dot1q, sTag, cTag
+}
+
+// tags go in right behind the MACs, outermost first
+func tagged(pkt []byte, tags ...[2]uint16) []byte {
+	res := append([]byte{}, pkt[:12]...)
+	for _, tag := range tags {
+		res = binary.BigEndian.AppendUint16(res, tag[0])
+		res = binary.BigEndian.AppendUint16(res, tag[1])
+	}
+	return append(res, pkt[12:]...)
+}
+
+// the reply's addresses and the fields we stamp move down with every tag
+func TestVLANReflects(t *testing.T) {
+	dot1q, sTag, cTag := vethWithVLANs(t)
+	objs := newTestReflector(t)
+	laddr, sender := testAddrs()
+	objs.VlanAware.Set(uint16(1))
+
+	req := stampRequest(sender, laddr, 40000, 862)
+	tests := []struct {
+		name string
+		pkt  []byte
+		l2   int
+	}{
+		{name: "untagged", pkt: req, l2: 14},
+		{name: "802.1Q", pkt: tagged(req, [2]uint16{unix.ETH_P_8021Q, dot1q}), l2: 18},
+		{name: "QinQ", pkt: tagged(req, [2]uint16{unix.ETH_P_8021AD, sTag}, [2]uint16{unix.ETH_P_8021Q, cTag}), l2: 22},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make([]byte, len(tt.pkt))
+			opts := ebpf.RunOptions{Data: tt.pkt, DataOut: out}
+			ret, err := objs.ReflectorIn.Run(&opts)
+			if err != nil {
+				t.Fatalf("Error running reflector_in: %v", err)
+			}
+			if ret != tcxRedirect {
+				t.Fatalf("reflector_in returned %d, want %d(reflected)", ret, tcxRedirect)
+			}
+			if bytes.Equal(out[12:tt.l2], tt.pkt[12:tt.l2]) == false {
+				t.Errorf("tags changed to %x, want %x", out[12:tt.l2], tt.pkt[12:tt.l2])
+			}
+			ip := out[tt.l2:]
+			if bytes.Equal(ip[12:16], laddr) == false || bytes.Equal(ip[16:20], sender) == false {
+				t.Errorf("reply goes %v -> %v, want %v -> %v", net.IP(ip[12:16]), net.IP(ip[16:20]), laddr, sender)
+			}
+			// the sender's seq and TTL, where the reflector packet has them
+			stamp := ip[20+8:]
+			if seq := binary.BigEndian.Uint32(stamp[24:]); seq != 1 {
+				t.Errorf("sender seq in the reply is %d, want 1", seq)
+			}
+			if stamp[40] != 64 {
+				t.Errorf("sender TTL in the reply is %d, want 64", stamp[40])
+			}
+		})
+	}
+}
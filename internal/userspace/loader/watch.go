@@ -0,0 +1,172 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// how often the watcher looks up from netlink to see if it should stop
+const watchTimeout = time.Second
+
+// WatchAndReattach puts the programs back on an interface whenever it comes back up after going down(or getting deleted and recreated),
+// a flapping NIC can lose its TCX attachment and measurements would quietly stop. Anchors are recreated the way LoaderConfig says.
+// Getting an interface back clears the handle's Err(), see senderFD.Err.
+// It blocks until ctx is done, stop it before closing the handle
+func (s senderFD) WatchAndReattach(ctx context.Context) error {
+	return s.loader.watch(ctx, s.args, func(i int) (*ebpf.Program, *ebpf.Program) {
+		if i == 0 {
+			return s.Objs.SenderOut, s.Objs.SenderIn
+		}
+		return s.others[i-1].SenderOut, s.others[i-1].SenderIn
+	}, nil)
+}
+
+// WatchAndReattach puts the programs back on an interface whenever it comes back up, see senderFD.WatchAndReattach.
+// With stamp.Args.DevPattern it also attaches to interfaces matching it as they come up; the handle covers those
+// from then on, Close() included
+func (s reflectorFD) WatchAndReattach(ctx context.Context) error {
+	var pickUp func(name string) error
+	if _, err := filepath.Match(s.args.DevPattern, ""); err != nil {
+		return fmt.Errorf("Invalid interface pattern %s: %w", s.args.DevPattern, err)
+	}
+	if s.args.DevPattern != "" {
+		pickUp = func(name string) error { return s.loader.pickUp(ctx, s.args, name) }
+	}
+	return s.loader.watch(ctx, s.args, func(i int) (*ebpf.Program, *ebpf.Program) {
+		o := s.loader.Reflectors[i]
+		return o.ReflectorOut, o.ReflectorIn
+	}, pickUp)
+}
+
+// progs gives the egress and ingress program of the i-th interface we attached to,
+// pickUp, if not nil, attaches to a new interface matching args.DevPattern
+func (l *Loader) watch(ctx context.Context, args stamp.Args, progs func(i int) (*ebpf.Program, *ebpf.Program), pickUp func(name string) error) error {
+	if l == nil {
+		return fmt.Errorf("Can't reattach a handle reopened from pins, nothing here knows how it was attached")
+	}
+	if args.Cgroup != "" {
+		return fmt.Errorf("Nothing to watch in cgroup mode, the programs aren't on an interface")
+	}
+	// the link events socket would have to live in there and so would every lookup after it
+	if l.Config.NetnsPath != "" {
+		return fmt.Errorf("Can't watch interfaces in another netns(LoaderConfig.NetnsPath)")
+	}
+	// the interface shows up twice and the reflector's anchors point at the sender's old links
+	if len(l.Senders) > 0 && len(l.Reflectors) > 0 {
+		return fmt.Errorf("Can't reattach a self-test, reload it instead")
+	}
+	conn, err := netlink.DialLinkEvents(watchTimeout)
+	if err != nil {
+		return fmt.Errorf("Error watching interfaces: %w", err)
+	}
+	defer conn.Close()
+	// by name since a recreated interface comes back with a new index
+	down := make(map[string]bool)
+	for ctx.Err() == nil {
+		events, err := conn.ReadLinkEvents()
+		if errors.Is(err, unix.EAGAIN) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error watching interfaces: %w", err)
+		}
+		for _, ev := range events {
+			i := l.devIndex(ev.Name)
+			if i < 0 {
+				// an interface might show up before it has an address, it gets another go the next time it comes up
+				if pickUp != nil && ev.Up == true && ev.Deleted == false && matchesPattern(args.DevPattern, ev.Name) == true {
+					l.logger().Info("New interface matches, attaching", "iface", ev.Name, "pattern", args.DevPattern)
+					if err := pickUp(ev.Name); err != nil {
+						l.logger().Error("Error attaching to new interface", "iface", ev.Name, "err", err)
+					}
+				}
+				continue
+			}
+			if ev.Up == false || ev.Deleted == true {
+				down[ev.Name] = true
+				if ev.Deleted == true {
+					// logs it if that was the last one, Stats and co fail from here on unless it comes back
+					l.detachedErr(args)
+				}
+				continue
+			}
+			if down[ev.Name] == false {
+				continue
+			}
+			delete(down, ev.Name)
+			l.logger().Info("Interface is back up, reattaching", "iface", ev.Name)
+			egress, ingress := progs(i)
+			if err := l.reattach(args, i, egress, ingress); err != nil {
+				// it might flap again and give us another go
+				l.logger().Error("Error reattaching", "iface", ev.Name, "err", err)
+				continue
+			}
+			l.clearGone()
+		}
+	}
+	return nil
+}
+
+func (l *Loader) devIndex(name string) int {
+	for i, dev := range l.devs {
+		if dev.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// the old links come off first: if they survived the flap we'd run twice, if they didn't they'd just sit there holding the programs
+// handles share l.Links' backing array so they see the new links too
+func (l *Loader) reattach(args stamp.Args, i int, egress, ingress *ebpf.Program) error {
+	dev, err := net.InterfaceByName(l.devs[i].Name)
+	if err != nil {
+		return fmt.Errorf("Error looking up %s: %w", l.devs[i].Name, err)
+	}
+	pair := l.Links[2*i : 2*i+2]
+	for _, lnk := range pair {
+		delete(l.placements, lnk)
+	}
+	detach(pair)
+	// whatever we were anchored to might've been replaced while it was down
+	l.releaseAnchors(dev.Name)
+	doEgress, doIngress := l.directions()
+	var egressLink, ingressLink link.Link
+	if doEgress == true {
+		if egressLink, err = l.attach(args, dev, egress, ebpf.AttachTCXEgress); err != nil {
+			return fmt.Errorf("Error attaching egress program: %w", err)
+		}
+	}
+	if doIngress == true {
+		if ingressLink, err = l.attach(args, dev, ingress, ebpf.AttachTCXIngress); err != nil {
+			detachOne(l.placements, egressLink)
+			return fmt.Errorf("Error attaching ingress program: %w", err)
+		}
+	}
+	pair[0], pair[1] = egressLink, ingressLink
+	l.devs[i] = dev
+	// same goes for XDP, only the sender ever has it
+	if old := l.xdp[dev.Name]; old != nil {
+		old.Close()
+		delete(l.xdp, dev.Name)
+		l.attachXDP(args, dev, l.Senders[i].SenderXdpIn)
+	}
+	// detach took the old link pins with it
+	if l.pinDir != "" {
+		dir := filepath.Join(l.pinDir, dev.Name)
+		if err := pinLinks(dir, egressLink, ingressLink); err != nil {
+			return fmt.Errorf("Error pinning to %s: %w", dir, err)
+		}
+	}
+	return nil
+}
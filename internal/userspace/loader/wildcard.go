@@ -0,0 +1,74 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// MatchInterfaces lists every interface whose name matches a glob(filepath.Match syntax, e.g. eth* or ens[0-9]*) in index order,
+// for stamp.Args.DevPattern. Matching nothing is an error, there'd be nothing to attach to
+func MatchInterfaces(pattern string) ([]*net.Interface, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid interface pattern %s: %w", pattern, err)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing interfaces: %w", err)
+	}
+	var res []*net.Interface
+	for i := range ifaces {
+		if matchesPattern(pattern, ifaces[i].Name) == true {
+			res = append(res, &ifaces[i])
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("No interfaces match %s", pattern)
+	}
+	return res, nil
+}
+
+// a bad pattern just never matches, MatchInterfaces and WatchAndReattach are where it gets reported
+func matchesPattern(pattern, name string) bool {
+	ok, _ := filepath.Match(pattern, name)
+	return ok
+}
+
+// the watcher found an interface matching DevPattern that we're not on yet, it goes on like one of the ones we loaded with
+func (l *Loader) pickUp(ctx context.Context, args stamp.Args, name string) error {
+	dev, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("Error looking up %s: %w", name, err)
+	}
+	if err := l.attachReflector(ctx, args, dev, l.clocks); err != nil {
+		return err
+	}
+	l.added++
+	return nil
+}
+
+// whatever the watcher picked up after the handle was made, it's in the loader but not in Links and others
+func (s reflectorFD) added() ([]link.Link, []reflector.ReflectorObjects) {
+	if s.loader == nil || s.loader.added == 0 {
+		return nil, nil
+	}
+	l := s.loader
+	return l.Links[len(l.Links)-2*l.added:], l.Reflectors[len(l.Reflectors)-l.added:]
+}
+
+// every interface's objects, the ones the watcher picked up too; each of them has its own globals
+func (s reflectorFD) allObjs() []reflector.ReflectorObjects {
+	_, objs := s.added()
+	return append(append([]reflector.ReflectorObjects{s.Objs}, s.others...), objs...)
+}
+
+// every link, the ones the watcher picked up too
+func (s reflectorFD) allLinks() []link.Link {
+	links, _ := s.added()
+	return append(append([]link.Link{}, s.Links...), links...)
+}
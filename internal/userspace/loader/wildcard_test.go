@@ -0,0 +1,46 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+)
+
+// needs root to make the veths
+func TestMatchInterfaces(t *testing.T) {
+	if _, err := MatchInterfaces("eth[0"); err == nil {
+		t.Errorf("MatchInterfaces() took a bad pattern")
+	}
+	if _, err := MatchInterfaces("stampwc-nothing*"); err == nil {
+		t.Errorf("MatchInterfaces() = nil error with nothing matching")
+	}
+	conn, err := netlink.Dial()
+	if err != nil {
+		t.Skipf("Can't talk to netlink: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.CreateVeth("stampwc0", "stampwc1"); err != nil {
+		t.Skipf("Can't create a veth pair: %v", err)
+	}
+	t.Cleanup(func() {
+		if conn, err := netlink.Dial(); err == nil {
+			if devs, err := MatchInterfaces("stampwc0"); err == nil {
+				conn.DeleteLink(devs[0].Index)
+			}
+			conn.Close()
+		}
+	})
+	devs, err := MatchInterfaces("stampwc*")
+	if err != nil {
+		t.Fatalf("MatchInterfaces() returned error: %v", err)
+	}
+	if len(devs) != 2 {
+		t.Fatalf("MatchInterfaces() found %d interfaces, want both ends of the veth", len(devs))
+	}
+	if devs[0].Index > devs[1].Index {
+		t.Errorf("MatchInterfaces() gave %s before %s, want index order", devs[0].Name, devs[1].Name)
+	}
+	if matchesPattern("stampwc[0-9]", "stampwc1") == false || matchesPattern("stampwc[0-9]", "stampwc10") == true {
+		t.Errorf("matchesPattern() doesn't go by filepath.Match")
+	}
+}
@@ -0,0 +1,73 @@
+package loader
+
+import (
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// sender_xdp_in only does plain replies, anything that needs the skb stays with sender_in; "" when nothing's in the way
+func xdpBlocker(args stamp.Args) string {
+	switch {
+	case len(args.AuthKey) > 0:
+		return "authenticated mode"
+	case args.HWTimestamps == true:
+		return "hardware timestamps"
+	case args.VLANAware == true:
+		return "VLAN tags"
+	case args.FollowUp == true || args.LocationTLV == true || args.TimestampInfo == true:
+		return "TLVs"
+	case args.Capture > 0:
+		return "captures"
+	}
+	return ""
+}
+
+// AttachXDP: sender_xdp_in goes on the driver of an interface the pair's already on, TCX(or TC) ingress is what's left when it can't.
+// Not getting it on isn't an error, sender_in takes the replies like it does without it
+func (l *Loader) attachXDP(args stamp.Args, dev *net.Interface, prog *ebpf.Program) {
+	if _, doIngress := l.directions(); l.Config.AttachMode != AttachXDP || doIngress == false {
+		return
+	}
+	if reason := xdpBlocker(args); reason != "" {
+		l.logger().Info("XDP can't do "+reason+", timestamping replies on TCX ingress instead", "iface", dev.Name)
+		return
+	}
+	// generic XDP runs after the skb is built, that's no earlier than TCX
+	lnk, err := link.AttachXDP(link.XDPOptions{Program: prog, Interface: dev.Index, Flags: link.XDPDriverMode})
+	if err != nil {
+		l.logger().Info("No native XDP on this interface, timestamping replies on TCX ingress instead", "iface", dev.Name, "err", err)
+		return
+	}
+	l.logger().Info("Timestamping replies in XDP", "iface", dev.Name)
+	l.xdp[dev.Name] = lnk
+}
+
+// XDP links are never pinned, closing one takes it off
+func detachXDP(links map[string]link.Link) {
+	for name, lnk := range links {
+		lnk.Close()
+		delete(links, name)
+	}
+}
+
+// AttachModes says how the programs went on every interface: AttachXDP where sender_xdp_in takes the replies(see
+// LoaderConfig.AttachMode), AttachTC or AttachTCX otherwise; nil in cgroup mode, dry runs and for handles reopened from pins
+func (s senderFD) AttachModes() map[string]AttachMode {
+	if s.loader == nil || s.args.Cgroup != "" || s.loader.Config.DryRun == true {
+		return nil
+	}
+	modes := map[string]AttachMode{}
+	for _, dev := range s.loader.devs {
+		if s.xdp[dev.Name] != nil {
+			modes[dev.Name] = AttachXDP
+		} else if s.loader.tcMode() == true {
+			modes[dev.Name] = AttachTC
+		} else {
+			modes[dev.Name] = AttachTCX
+		}
+	}
+	return modes
+}
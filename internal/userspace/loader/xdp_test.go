@@ -0,0 +1,64 @@
+package loader
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// XDP_DROP and XDP_PASS
+const (
+	xdpDrop = 1
+	xdpPass = 2
+)
+
+func TestXDPBlocker(t *testing.T) {
+	tests := []struct {
+		name string
+		args stamp.Args
+		want bool
+	}{
+		{name: "plain", args: stamp.Args{}, want: false},
+		{name: "auth", args: stamp.Args{AuthKey: []byte("key")}, want: true},
+		{name: "hardware timestamps", args: stamp.Args{HWTimestamps: true}, want: true},
+		{name: "VLAN", args: stamp.Args{VLANAware: true}, want: true},
+		{name: "TLVs", args: stamp.Args{LocationTLV: true}, want: true},
+		{name: "capture", args: stamp.Args{Capture: 10}, want: true},
+	}
+	for _, tt := range tests {
+		if got := xdpBlocker(tt.args) != ""; got != tt.want {
+			t.Errorf("%s: xdpBlocker() = %q, want blocked %v", tt.name, xdpBlocker(tt.args), tt.want)
+		}
+	}
+}
+
+// replies get taken and counted straight off the frame, anything else goes on to sender_in
+func TestXDPReply(t *testing.T) {
+	objs := newTestSender(t)
+	us, them := testAddrs()
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want uint32
+	}{
+		{name: "reply", pkt: stampRequest(them, us, 862, 862), want: xdpDrop},
+		{name: "another port", pkt: stampRequest(them, us, 862, 863), want: xdpPass},
+		{name: "another address", pkt: stampRequest(them, net.ParseIP("192.0.2.3").To4(), 862, 862), want: xdpPass},
+		{name: "short", pkt: stampRequest(them, us, 862, 862)[:60], want: xdpPass},
+	}
+	for _, tt := range tests {
+		ret, err := objs.SenderXdpIn.Run(&ebpf.RunOptions{Data: tt.pkt})
+		if err != nil {
+			t.Fatalf("Error running sender_xdp_in: %v", err)
+		}
+		if ret != tt.want {
+			t.Errorf("%s: sender_xdp_in returned %d, want %d", tt.name, ret, tt.want)
+		}
+	}
+	if got, err := readCounter(objs.Stats, statReflected); err != nil || got != 1 {
+		t.Errorf("reflected counter = %d, %v, want 1", got, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Package loadtest finds out how many STAMP packets a second the reflector can turn around:
+// it attaches the reflector to a veth pair, blasts requests at it from the other end and reads what it made of them off the stats map
+package loadtest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/loader"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+	"golang.org/x/sys/unix"
+)
+
+// Config is what to blast and for how long, zero values get the defaults below
+type Config struct {
+	// requests per second, 0 for as fast as we can write them
+	Rate int
+	// stop after this many requests or this long, whichever comes first; at least one of them has to be set
+	Count    uint64
+	Duration time.Duration
+	// veth ends, stampbench0 and stampbench1 by default
+	Name, Peer string
+	// the reflector's address, 10.251.0.1/24 by default; IPv6 works too
+	Addr *net.IPNet
+	// reflector port, 862 by default
+	Port int
+	// where the loader logs to, nowhere by default
+	Logger *slog.Logger
+}
+
+// Result is what came out of a run, as counted by the reflector
+type Result struct {
+	Sent      uint64
+	Reflected uint64
+	// sent but never turned around, whether the reflector dropped it or it didn't get that far
+	Dropped uint64
+	Elapsed time.Duration
+}
+
+// PPS is requests turned around per second
+func (r Result) PPS() float64 {
+	if r.Elapsed == 0 {
+		return 0
+	}
+	return float64(r.Reflected) / r.Elapsed.Seconds()
+}
+
+// DropRate is the share of requests that never got turned around, 0 to 1
+func (r Result) DropRate() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Dropped) / float64(r.Sent)
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("Sent: %d Reflected: %d Dropped: %d in %s - %.0f pps, %.2f%% dropped", r.Sent, r.Reflected, r.Dropped, r.Elapsed.Round(time.Millisecond), r.PPS(), r.DropRate()*100)
+}
+
+// how long the last requests get to make it through before we read the counters
+const settle = 100 * time.Millisecond
+
+// Run sets up a veth pair, attaches the reflector to it, blasts requests and tears it all down again; needs root
+func Run(ctx context.Context, cfg Config) (Result, error) {
+	cfg = withDefaults(cfg)
+	if cfg.Count == 0 && cfg.Duration == 0 {
+		return Result{}, fmt.Errorf("Either Count or Duration has to be set")
+	}
+	veth, err := NewVeth(cfg.Name, cfg.Peer, cfg.Addr)
+	if err != nil {
+		return Result{}, fmt.Errorf("Error setting up veth: %w", err)
+	}
+	defer veth.Close()
+	args := stamp.Args{Dev: veth.Reflector, Localaddr: veth.Addr, S_port: cfg.Port}
+	refl, err := loader.LoadReflectorContext(ctx, args, loader.LoaderConfig{UseAnchors: true, Anchor: link.Head(), Logger: cfg.Logger})
+	if err != nil {
+		return Result{}, err
+	}
+	defer refl.Close()
+
+	start := time.Now()
+	sent, err := Blast(ctx, veth, cfg)
+	elapsed := time.Since(start)
+	if err != nil {
+		return Result{}, err
+	}
+	time.Sleep(settle)
+	stats, err := refl.Stats()
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Sent: sent, Reflected: stats.PacketsReflected, Elapsed: elapsed}
+	if res.Reflected < res.Sent {
+		res.Dropped = res.Sent - res.Reflected
+	}
+	return res, nil
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.Name == "" {
+		cfg.Name = "stampbench0"
+	}
+	if cfg.Peer == "" {
+		cfg.Peer = "stampbench1"
+	}
+	if cfg.Addr == nil {
+		cfg.Addr = &net.IPNet{IP: net.IPv4(10, 251, 0, 1).To4(), Mask: net.CIDRMask(24, 32)}
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 862
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return cfg
+}
+
+// Blast writes requests into the peer end of veth at cfg.Rate until cfg.Count or cfg.Duration runs out(or ctx is done), returns how many went out
+// they come from the address after veth.Addr, every one with the next seq
+func Blast(ctx context.Context, veth *Veth, cfg Config) (uint64, error) {
+	cfg = withDefaults(cfg)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return 0, fmt.Errorf("Error opening packet socket: %w", err)
+	}
+	defer unix.Close(fd)
+	to := &unix.SockaddrLinklayer{Ifindex: veth.Peer.Index, Protocol: htons(unix.ETH_P_ALL)}
+	pkt := Request(veth, cfg.Port)
+	seq := pkt[len(pkt)-stampLen:]
+
+	// a tick's worth of requests at a time, sleeping for every single one doesn't get anywhere near high rates
+	batch, every := 1, time.Duration(0)
+	if cfg.Rate > 0 {
+		every = time.Second / time.Duration(cfg.Rate)
+		if every < time.Millisecond {
+			batch, every = cfg.Rate/1000, time.Millisecond
+		}
+	}
+	var deadline time.Time
+	if cfg.Duration > 0 {
+		deadline = time.Now().Add(cfg.Duration)
+	}
+	var sent uint64
+	next := time.Now()
+	for {
+		for i := 0; i < batch; i++ {
+			if cfg.Count > 0 && sent >= cfg.Count {
+				return sent, nil
+			}
+			binary.BigEndian.PutUint32(seq, uint32(sent))
+			if err := unix.Sendto(fd, pkt, 0, to); err != nil {
+				// the peer's queue is full, that's the point
+				if err == unix.ENOBUFS || err == unix.EAGAIN {
+					continue
+				}
+				return sent, fmt.Errorf("Error sending request: %w", err)
+			}
+			sent++
+		}
+		if ctx.Err() != nil || (deadline.IsZero() == false && time.Now().After(deadline)) {
+			return sent, nil
+		}
+		if every > 0 {
+			next = next.Add(every)
+			time.Sleep(time.Until(next))
+		}
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,23 @@
+package loadtest
+
+import (
+	"context"
+	"flag"
+	"testing"
+)
+
+// go test -bench Reflector -loadtest.rate 100000 ./internal/userspace/loadtest/
+var rate = flag.Int("loadtest.rate", 0, "requests per second to blast the reflector with, 0 for as fast as we can")
+
+// b.N requests through the reflector on a veth pair, needs root and the BPF objects
+func BenchmarkReflector(b *testing.B) {
+	res, err := Run(context.Background(), Config{Rate: *rate, Count: uint64(b.N)})
+	if err != nil {
+		b.Skipf("Can't run the reflector on a veth pair: %v", err)
+	}
+	// setting up the veth and loading the programs isn't what we're measuring
+	b.ReportMetric(float64(res.Elapsed.Nanoseconds())/float64(res.Sent), "ns/op")
+	b.ReportMetric(res.PPS(), "pps")
+	b.ReportMetric(res.DropRate()*100, "%dropped")
+	b.Log(res)
+}
@@ -0,0 +1,55 @@
+package loadtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+// unauthenticated STAMP request(RFC 8762 4.2.1)
+const stampLen = 44
+
+// Request is a STAMP request to veth.Addr on port from the address right after it, framed to go into the peer end;
+// seq is the first 4 bytes of the last stampLen, T1 stays 0 since nothing here looks at the latency
+func Request(veth *Veth, port int) []byte {
+	dst := veth.Addr
+	src := make(net.IP, len(dst))
+	copy(src, dst)
+	src[len(src)-1]++
+	var pkt bytes.Buffer
+	udpLen := uint16(8 + stampLen)
+	pkt.Write(veth.Reflector.HardwareAddr)
+	pkt.Write(veth.Peer.HardwareAddr)
+	if dst.To4() != nil {
+		binary.Write(&pkt, binary.BigEndian, uint16(0x0800))
+		ip := make([]byte, 20)
+		copy(ip, []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, 17})
+		binary.BigEndian.PutUint16(ip[2:], 20+udpLen)
+		copy(ip[12:], src.To4())
+		copy(ip[16:], dst.To4())
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+		pkt.Write(ip)
+	} else {
+		binary.Write(&pkt, binary.BigEndian, uint16(0x86dd))
+		pkt.Write([]byte{0x60, 0, 0, 0})
+		binary.Write(&pkt, binary.BigEndian, udpLen)
+		pkt.Write([]byte{17, 64})
+		pkt.Write(src.To16())
+		pkt.Write(dst.To16())
+	}
+	// no UDP checksum, it's optional over IPv4 and the reflector doesn't check it over IPv6 either
+	binary.Write(&pkt, binary.BigEndian, []uint16{40000, uint16(port), udpLen, 0})
+	pkt.Write(make([]byte, stampLen))
+	return pkt.Bytes()
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,61 @@
+package loadtest
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+)
+
+// Veth is a veth pair to attach the reflector to: it goes on Reflector, packets get injected on Peer and come out of Reflector's ingress
+// Peer has no address so the replies coming back to it are dropped by the stack without anyone answering them
+type Veth struct {
+	Reflector, Peer *net.Interface
+	Addr            net.IP // on Reflector, what the packets are sent to
+}
+
+// NewVeth creates the pair, brings both ends up and puts addr on the reflector end; it has to be torn down with Close
+func NewVeth(name, peer string, addr *net.IPNet) (*Veth, error) {
+	conn, err := netlink.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.CreateVeth(name, peer); err != nil {
+		return nil, err
+	}
+	v := &Veth{Addr: addr.IP}
+	if v.Reflector, err = net.InterfaceByName(name); err != nil {
+		return nil, fmt.Errorf("Error looking up %s: %w", name, err)
+	}
+	fail := func(err error) (*Veth, error) {
+		v.Close()
+		return nil, err
+	}
+	if v.Peer, err = net.InterfaceByName(peer); err != nil {
+		return fail(fmt.Errorf("Error looking up %s: %w", peer, err))
+	}
+	if err := conn.AddAddr(v.Reflector.Index, addr); err != nil {
+		return fail(err)
+	}
+	for _, dev := range []*net.Interface{v.Reflector, v.Peer} {
+		if err := conn.SetLinkUp(dev.Index); err != nil {
+			return fail(err)
+		}
+	}
+	// pick up the new flags, the loader goes by them
+	if v.Reflector, err = net.InterfaceByName(name); err != nil {
+		return fail(fmt.Errorf("Error looking up %s: %w", name, err))
+	}
+	return v, nil
+}
+
+// Close deletes the pair, the programs on it come off with it
+func (v *Veth) Close() error {
+	conn, err := netlink.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.DeleteLink(v.Reflector.Index)
+}
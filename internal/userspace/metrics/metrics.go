@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/loader"
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/stamp"
+)
+
+// Prometheus collectors off a loader handle, plain text format same as the --metrics-addr endpoint so there's nothing to pull in
+// counters are read from the BPF maps when scraped, the RTT histogram is fed from the sender's per-packet events as they come
+
+// what loader.LoadSender and loader.LoadReflector return
+type statsSource interface {
+	Stats() (loader.Stats, error)
+}
+
+// only the sender has it
+type eventSource interface {
+	Events() <-chan loader.StampEvent
+}
+
+// upper bounds in seconds, from LAN to intercontinental
+var rttBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type rttHist struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *rttHist) observe(secs float64) {
+	h.count++
+	h.sum += secs
+	for i, le := range rttBuckets {
+		if secs <= le {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+type source struct {
+	role  string
+	stats statsSource
+	rtt   *rttHist // sender only
+}
+
+var mut sync.Mutex
+var sources []*source
+
+// Register adds a loader handle to what Handler serves, one sender and one reflector at most.
+// A sender's handle also gets its RTT histogram, which takes over its Events() channel
+func Register(handle statsSource) error {
+	src := &source{role: "reflector", stats: handle}
+	events, isSender := handle.(eventSource)
+	if isSender == true {
+		src.role = "sender"
+		src.rtt = &rttHist{counts: make([]uint64, len(rttBuckets))}
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	for _, s := range sources {
+		if s.role == src.role {
+			return fmt.Errorf("A %s is already registered", src.role)
+		}
+	}
+	sources = append(sources, src)
+	if isSender == true {
+		go feed(src.rtt, events.Events())
+	}
+	return nil
+}
+
+// runs until the handle is closed
+func feed(h *rttHist, events <-chan loader.StampEvent) {
+	for ev := range events {
+		mut.Lock()
+		h.observe(float64(ev.T4-ev.T1) / 1e9)
+		mut.Unlock()
+	}
+}
+
+// Handler serves everything registered in Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writeMetrics(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func writeMetrics(w io.Writer) error {
+	mut.Lock()
+	defer mut.Unlock()
+	// every handle's stats map gets read once per scrape, everything else comes out of that
+	stats := make([]loader.Stats, len(sources))
+	for i, s := range sources {
+		st, err := s.stats.Stats()
+		if err != nil {
+			return fmt.Errorf("Error reading %s stats: %w", s.role, err)
+		}
+		stats[i] = st
+	}
+	var res strings.Builder
+	counters := []struct {
+		name, help string
+		val        func(st loader.Stats) uint64
+	}{
+		{"stamp_packets_sent_total", "Probes sent by the sender", func(st loader.Stats) uint64 { return st.PacketsSent }},
+		{"stamp_packets_reflected_total", "Replies received by the sender, requests turned around by the reflector", func(st loader.Stats) uint64 { return st.PacketsReflected }},
+		{"stamp_packets_denied_total", "Requests the reflector dropped for coming from outside --allow-from", func(st loader.Stats) uint64 { return st.PacketsDenied }},
+		{"stamp_packets_observed_total", "Requests a --passive reflector counted and let through", func(st loader.Stats) uint64 { return st.PacketsObserved }},
+		{"stamp_packets_rate_limited_total", "Requests the reflector dropped for going over --max-reply-pps", func(st loader.Stats) uint64 { return st.RateLimited }},
+		{"stamp_seq_lost_total", "Gaps in the reflector's sequence numbers seen by the sender", func(st loader.Stats) uint64 { return st.Lost }},
+		{"stamp_seq_reordered_total", "Replies the sender got behind a later one", func(st loader.Stats) uint64 { return st.Reordered }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(&res, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for i, s := range sources {
+			fmt.Fprintf(&res, "%s{role=%q} %d\n", c.name, s.role, c.val(stats[i]))
+		}
+	}
+	fmt.Fprintf(&res, "# HELP stamp_rtt_seconds Roundtrip delay(T4-T1) of every reply\n# TYPE stamp_rtt_seconds histogram\n")
+	for _, s := range sources {
+		if s.rtt == nil {
+			continue
+		}
+		var cumulative uint64
+		for i, le := range rttBuckets {
+			cumulative += s.rtt.counts[i]
+			fmt.Fprintf(&res, "stamp_rtt_seconds_bucket{role=%q,le=\"%g\"} %d\n", s.role, le, cumulative)
+		}
+		fmt.Fprintf(&res, "stamp_rtt_seconds_bucket{role=%q,le=\"+Inf\"} %d\n", s.role, s.rtt.count)
+		fmt.Fprintf(&res, "stamp_rtt_seconds_sum{role=%q} %g\n", s.role, s.rtt.sum)
+		fmt.Fprintf(&res, "stamp_rtt_seconds_count{role=%q} %d\n", s.role, s.rtt.count)
+	}
+	// that one's counted in userspace, for the whole process
+	fmt.Fprintf(&res, "# HELP stamp_auth_failures_total Packets dropped for a bad or missing HMAC\n# TYPE stamp_auth_failures_total counter\n")
+	fmt.Fprintf(&res, "stamp_auth_failures_total %d\n", stamp.AuthFailures())
+	fmt.Fprintf(&res, "# HELP stamp_auth_previous_key_total Packets that checked out with the key from before the last rotation\n# TYPE stamp_auth_previous_key_total counter\n")
+	fmt.Fprintf(&res, "stamp_auth_previous_key_total %d\n", stamp.AuthPreviousKey())
+	_, err := io.WriteString(w, res.String())
+	return err
+}
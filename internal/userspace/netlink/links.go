@@ -0,0 +1,71 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinkEvent is a link notification, RTMGRP_LINK gets us one whenever an interface changes state or comes and goes
+type LinkEvent struct {
+	Index int
+	Name  string
+	// administratively up and has a carrier, i.e. traffic can actually flow
+	Up bool
+	// the interface is gone altogether, it may come back with the same name but a new index
+	Deleted bool
+}
+
+// DialLinkEvents opens a socket that gets link notifications, see DialGroups for the timeout
+func DialLinkEvents(timeout time.Duration) (*Conn, error) {
+	return DialGroups(unix.RTMGRP_LINK, timeout)
+}
+
+// ReadLinkEvents blocks until the next batch of notifications, or fails with unix.EAGAIN once the socket's timeout runs out
+func (c *Conn) ReadLinkEvents() ([]LinkEvent, error) {
+	buf := make([]byte, 1<<16)
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("receiving link events: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("parsing link events: %w", err)
+	}
+	var res []LinkEvent
+	for _, m := range msgs {
+		if (m.Header.Type != unix.RTM_NEWLINK && m.Header.Type != unix.RTM_DELLINK) || len(m.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		// struct ifinfomsg: family, pad, type, index, flags, change
+		flags := binary.NativeEndian.Uint32(m.Data[8:12])
+		ev := LinkEvent{
+			Index:   int(int32(binary.NativeEndian.Uint32(m.Data[4:8]))),
+			Up:      flags&unix.IFF_UP != 0 && flags&unix.IFF_RUNNING != 0,
+			Deleted: m.Header.Type == unix.RTM_DELLINK,
+		}
+		for _, a := range ParseAttrs(m.Data[unix.SizeofIfInfomsg:]) {
+			if a.Type == unix.IFLA_IFNAME {
+				ev.Name = unix.ByteSliceToString(a.Value)
+			}
+		}
+		res = append(res, ev)
+	}
+	return res, nil
+}
+
+// LinkExists reports whether there's still an interface with this index, a deleted one's index isn't reused until the counter wraps
+func (c *Conn) LinkExists(ifindex int) (bool, error) {
+	_, err := c.Request(unix.RTM_GETLINK, 0, ifinfomsg(ifindex, 0, 0))
+	if errors.Is(err, unix.ENODEV) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting link %d: %w", ifindex, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,172 @@
+// Package netlink is a bare-bones rtnetlink client, just enough for what stamp-bpf needs
+// and not enough to justify pulling in a whole netlink library
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tc bits x/sys doesn't have, from linux/rtnetlink.h, linux/pkt_sched.h and linux/gen_stats.h
+const (
+	sizeofTcmsg = 20
+
+	tcaKind   = 1
+	tcaStats  = 3
+	tcaStats2 = 7
+
+	tcaStatsQueue = 3
+
+	tcHRoot = 0xFFFFFFFF
+
+	// clsact and cls_bpf, from linux/pkt_sched.h and linux/pkt_cls.h
+	tcaOptions          = 2
+	tcHClsact           = 0xFFFFFFF1
+	tcHMinIngress       = 0xFFF2
+	tcHMinEgress        = 0xFFF3
+	tcaBPFFD            = 6
+	tcaBPFName          = 7
+	tcaBPFFlags         = 8
+	tcaBPFFlagActDirect = 1
+	clsactHandle        = 0xFFFF0000
+)
+
+var seq atomic.Uint32
+
+// Conn is a route netlink socket
+type Conn struct {
+	fd int
+}
+
+// Dial opens a route netlink socket, the caller has to Close it
+func Dial() (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding netlink socket: %w", err)
+	}
+	return &Conn{fd: fd}, nil
+}
+
+func (c *Conn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// Request sends a message and collects every reply up to NLMSG_DONE(for dumps) or the first reply/ack otherwise
+// kernel errors are returned as syscall.Errno so callers can errors.Is them
+func (c *Conn) Request(msgType, flags uint16, payload []byte) ([]syscall.NetlinkMessage, error) {
+	s := seq.Add(1)
+	msg := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.NLMSG_HDRLEN+len(payload)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|unix.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(msg[8:12], s)
+	msg = append(msg, payload...)
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("sending netlink request: %w", err)
+	}
+
+	var res []syscall.NetlinkMessage
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("receiving netlink reply: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("parsing netlink reply: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != s {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return res, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("truncated netlink error")
+				}
+				// zero errno is an ack
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return res, nil
+			}
+			res = append(res, m)
+			if flags&unix.NLM_F_DUMP == 0 {
+				return res, nil
+			}
+		}
+	}
+}
+
+// Attr is a single rtnetlink attribute
+type Attr struct {
+	Type  uint16
+	Value []byte
+}
+
+// ParseAttrs splits a buffer into attributes, nested attributes can be fed back into it
+func ParseAttrs(b []byte) []Attr {
+	var res []Attr
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		t := binary.NativeEndian.Uint16(b[2:4])
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		// NLA_F_NESTED and NLA_F_NET_BYTEORDER live in the top bits
+		res = append(res, Attr{Type: t & 0x3FFF, Value: b[unix.SizeofRtAttr:l]})
+		l = (l + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return res
+}
+
+// AppendAttr appends an attribute to a request payload
+func AppendAttr(b []byte, t uint16, value []byte) []byte {
+	l := unix.SizeofRtAttr + len(value)
+	hdr := make([]byte, unix.SizeofRtAttr)
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(hdr[2:4], t)
+	b = append(b, hdr...)
+	b = append(b, value...)
+	for l%unix.RTA_ALIGNTO != 0 {
+		b = append(b, 0)
+		l++
+	}
+	return b
+}
+
+// DialGroups opens a route netlink socket subscribed to the given RTMGRP_* multicast groups, the caller has to Close it
+// reads time out after timeout so a reader can check whether it should stop, they fail with unix.EAGAIN then
+func DialGroups(groups uint32, timeout time.Duration) (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding netlink socket: %w", err)
+	}
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("setting netlink socket timeout: %w", err)
+	}
+	return &Conn{fd: fd}, nil
+}
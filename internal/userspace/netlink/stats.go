@@ -0,0 +1,147 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Drops are the interface-level drop counters we care about when correlating with measured loss
+type Drops struct {
+	RxDropped, TxDropped uint64 // dropped by the kernel/driver
+	RxMissed             uint64 // NIC ran out of ring buffer
+	Qdisc                uint64 // dropped by the root egress qdisc
+}
+
+// Sub returns the drops that happened since the baseline, a counter that's gone below it(see Reset) counts as 0 rather than wrapping around
+func (d Drops) Sub(baseline Drops) Drops {
+	sub := func(cur, base uint64) uint64 {
+		if cur < base {
+			return 0
+		}
+		return cur - base
+	}
+	return Drops{
+		RxDropped: sub(d.RxDropped, baseline.RxDropped),
+		TxDropped: sub(d.TxDropped, baseline.TxDropped),
+		RxMissed:  sub(d.RxMissed, baseline.RxMissed),
+		Qdisc:     sub(d.Qdisc, baseline.Qdisc),
+	}
+}
+
+// Add sums up two sets of drops
+func (d Drops) Add(o Drops) Drops {
+	return Drops{
+		RxDropped: d.RxDropped + o.RxDropped,
+		TxDropped: d.TxDropped + o.TxDropped,
+		RxMissed:  d.RxMissed + o.RxMissed,
+		Qdisc:     d.Qdisc + o.Qdisc,
+	}
+}
+
+// Reset tells whether any counter went back since prev: the kernel starts them over when the root qdisc gets replaced
+// or the link is recreated, and the driver's can go back to 0 when the link bounces
+func (d Drops) Reset(prev Drops) bool {
+	return d.RxDropped < prev.RxDropped || d.TxDropped < prev.TxDropped || d.RxMissed < prev.RxMissed || d.Qdisc < prev.Qdisc
+}
+
+// Rebaseline is the baseline to count on from after a Reset: 0 for the counters that started over, prev for the rest
+func (d Drops) Rebaseline(prev Drops) Drops {
+	base := func(cur, prev uint64) uint64 {
+		if cur < prev {
+			return 0
+		}
+		return prev
+	}
+	return Drops{
+		RxDropped: base(d.RxDropped, prev.RxDropped),
+		TxDropped: base(d.TxDropped, prev.TxDropped),
+		RxMissed:  base(d.RxMissed, prev.RxMissed),
+		Qdisc:     base(d.Qdisc, prev.Qdisc),
+	}
+}
+
+// Total is everything that's been dropped locally
+func (d Drops) Total() uint64 {
+	return d.RxDropped + d.TxDropped + d.RxMissed + d.Qdisc
+}
+
+// InterfaceDrops reads the current drop counters for an interface
+func (c *Conn) InterfaceDrops(ifindex int) (Drops, error) {
+	var d Drops
+	if err := c.linkDrops(ifindex, &d); err != nil {
+		return d, err
+	}
+	q, err := c.qdiscDrops(ifindex)
+	if err != nil {
+		return d, err
+	}
+	d.Qdisc = q
+	return d, nil
+}
+
+func (c *Conn) linkDrops(ifindex int, d *Drops) error {
+	req := make([]byte, unix.SizeofIfInfomsg)
+	req[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(req[4:8], uint32(ifindex))
+	msgs, err := c.Request(unix.RTM_GETLINK, 0, req)
+	if err != nil {
+		return fmt.Errorf("getting link %d: %w", ifindex, err)
+	}
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWLINK || len(m.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		for _, a := range ParseAttrs(m.Data[unix.SizeofIfInfomsg:]) {
+			// struct rtnl_link_stats64 is just a bunch of u64s
+			if a.Type != unix.IFLA_STATS64 || len(a.Value) < 16*8 {
+				continue
+			}
+			stat := func(i int) uint64 { return binary.NativeEndian.Uint64(a.Value[i*8:]) }
+			d.RxDropped = stat(6)
+			d.TxDropped = stat(7)
+			d.RxMissed = stat(15)
+			return nil
+		}
+	}
+	return fmt.Errorf("no stats for link %d", ifindex)
+}
+
+// only the root qdisc counts - multiqueue roots(mq) already add up their children so summing everything would double count
+func (c *Conn) qdiscDrops(ifindex int) (uint64, error) {
+	req := make([]byte, sizeofTcmsg)
+	req[0] = unix.AF_UNSPEC
+	msgs, err := c.Request(unix.RTM_GETQDISC, unix.NLM_F_DUMP, req)
+	if err != nil {
+		return 0, fmt.Errorf("dumping qdiscs: %w", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWQDISC || len(m.Data) < sizeofTcmsg {
+			continue
+		}
+		if int(int32(binary.NativeEndian.Uint32(m.Data[4:8]))) != ifindex || binary.NativeEndian.Uint32(m.Data[12:16]) != tcHRoot {
+			continue
+		}
+		var legacy uint64
+		for _, a := range ParseAttrs(m.Data[sizeofTcmsg:]) {
+			switch a.Type {
+			case tcaStats2:
+				// struct gnet_stats_queue: qlen, backlog, drops, requeues, overlimits
+				for _, n := range ParseAttrs(a.Value) {
+					if n.Type == tcaStatsQueue && len(n.Value) >= 12 {
+						return uint64(binary.NativeEndian.Uint32(n.Value[8:12])), nil
+					}
+				}
+			case tcaStats:
+				// struct tc_stats: bytes(u64), packets, drops...
+				if len(a.Value) >= 16 {
+					legacy = uint64(binary.NativeEndian.Uint32(a.Value[12:16]))
+				}
+			}
+		}
+		return legacy, nil
+	}
+	// no root qdisc(e.g. noqueue on virtual interfaces) means nothing to drop
+	return 0, nil
+}
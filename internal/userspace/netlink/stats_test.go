@@ -0,0 +1,29 @@
+package netlink
+
+import "testing"
+
+// the root qdisc got replaced mid-session: its counter starts over, the link's keep going
+func TestDropsReset(t *testing.T) {
+	baseline := Drops{RxDropped: 10, Qdisc: 100}
+	prev := Drops{RxDropped: 12, Qdisc: 105}
+	cur := Drops{RxDropped: 13, Qdisc: 2}
+	if prev.Reset(baseline) == true {
+		t.Errorf("Reset() = true for counters that only went up")
+	}
+	if cur.Reset(prev) == false {
+		t.Fatalf("Reset() = false after the qdisc counter went back")
+	}
+	// no wrapping around to 1.8e19
+	if d := cur.Sub(baseline); d.Qdisc != 0 || d.RxDropped != 3 {
+		t.Errorf("Sub() = %+v, want 3 rx and 0 qdisc", d)
+	}
+	// what pollDrops does with it
+	carried := prev.Sub(baseline)
+	base := cur.Rebaseline(prev)
+	if want := (Drops{RxDropped: 12, Qdisc: 0}); base != want {
+		t.Errorf("Rebaseline() = %+v, want %+v", base, want)
+	}
+	if d := cur.Sub(base).Add(carried); d != (Drops{RxDropped: 3, Qdisc: 7}) {
+		t.Errorf("drops after the reset = %+v, want 3 rx and 7 qdisc", d)
+	}
+}
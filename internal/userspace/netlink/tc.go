@@ -0,0 +1,148 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCFilter is a cls_bpf filter on an interface's clsact qdisc, everything it takes to find it again
+type TCFilter struct {
+	Ifindex int
+	Ingress bool
+	Prio    uint16
+	Handle  uint32
+}
+
+// struct tcmsg: family, pad, ifindex, handle, parent, info
+func tcmsg(ifindex int, handle, parent, info uint32) []byte {
+	b := make([]byte, sizeofTcmsg)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:8], uint32(ifindex))
+	binary.NativeEndian.PutUint32(b[8:12], handle)
+	binary.NativeEndian.PutUint32(b[12:16], parent)
+	binary.NativeEndian.PutUint32(b[16:20], info)
+	return b
+}
+
+func filterParent(ingress bool) uint32 {
+	if ingress == true {
+		return tcHClsact&0xFFFF0000 | tcHMinIngress
+	}
+	return tcHClsact&0xFFFF0000 | tcHMinEgress
+}
+
+// filters match every protocol, info is the priority on top and the protocol in network order below
+func filterInfo(prio uint16) uint32 {
+	return uint32(prio)<<16 | uint32(htons(unix.ETH_P_ALL))
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// AddClsact adds a clsact qdisc to the interface, false if there already was one
+func (c *Conn) AddClsact(ifindex int) (bool, error) {
+	req := AppendAttr(tcmsg(ifindex, clsactHandle, tcHClsact, 0), tcaKind, nulTerminated("clsact"))
+	if _, err := c.Request(unix.RTM_NEWQDISC, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK, req); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			return false, nil
+		}
+		return false, fmt.Errorf("adding clsact to link %d: %w", ifindex, err)
+	}
+	return true, nil
+}
+
+// DeleteClsact deletes the interface's clsact qdisc and every filter on it
+func (c *Conn) DeleteClsact(ifindex int) error {
+	req := AppendAttr(tcmsg(ifindex, clsactHandle, tcHClsact, 0), tcaKind, nulTerminated("clsact"))
+	if _, err := c.Request(unix.RTM_DELQDISC, unix.NLM_F_ACK, req); err != nil {
+		return fmt.Errorf("deleting clsact from link %d: %w", ifindex, err)
+	}
+	return nil
+}
+
+// in direct-action mode the program's return value is the verdict, TCX_* and TC_ACT_* are the same numbers
+func bpfFilterOptions(progFD int, name string) []byte {
+	fd := make([]byte, 4)
+	binary.NativeEndian.PutUint32(fd, uint32(progFD))
+	flags := make([]byte, 4)
+	binary.NativeEndian.PutUint32(flags, tcaBPFFlagActDirect)
+	opts := AppendAttr(nil, tcaBPFFD, fd)
+	opts = AppendAttr(opts, tcaBPFName, nulTerminated(name))
+	return AppendAttr(opts, tcaBPFFlags, flags)
+}
+
+// AddBPFFilter puts a program on the interface's clsact qdisc, which has to be there already
+// it goes in front of whatever's already there so we run first same as at the head of a TCX chain, picking the priority like the kernel would
+func (c *Conn) AddBPFFilter(ifindex int, ingress bool, progFD int, name string) (TCFilter, error) {
+	prio, err := c.frontPrio(ifindex, ingress)
+	if err != nil {
+		return TCFilter{}, err
+	}
+	f := TCFilter{Ifindex: ifindex, Ingress: ingress, Prio: prio, Handle: 1}
+	req := AppendAttr(tcmsg(ifindex, f.Handle, filterParent(ingress), filterInfo(prio)), tcaKind, nulTerminated("bpf"))
+	req = AppendAttr(req, tcaOptions, bpfFilterOptions(progFD, name))
+	if _, err := c.Request(unix.RTM_NEWTFILTER, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK, req); err != nil {
+		return TCFilter{}, fmt.Errorf("adding filter to link %d: %w", ifindex, err)
+	}
+	return f, nil
+}
+
+// one below the lowest priority on the hook, 0xC000 on an empty one
+func (c *Conn) frontPrio(ifindex int, ingress bool) (uint16, error) {
+	msgs, err := c.Request(unix.RTM_GETTFILTER, unix.NLM_F_DUMP, tcmsg(ifindex, 0, filterParent(ingress), 0))
+	if err != nil {
+		return 0, fmt.Errorf("dumping filters on link %d: %w", ifindex, err)
+	}
+	var lowest uint16 = 0xC001
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWTFILTER || len(m.Data) < sizeofTcmsg {
+			continue
+		}
+		if prio := uint16(binary.NativeEndian.Uint32(m.Data[16:20]) >> 16); prio < lowest {
+			lowest = prio
+		}
+	}
+	if lowest <= 1 {
+		return 0, fmt.Errorf("no room in front of the filters on link %d, one of them has priority 1", ifindex)
+	}
+	return lowest - 1, nil
+}
+
+// ReplaceBPFFilter swaps the program a filter runs for another one
+func (c *Conn) ReplaceBPFFilter(f TCFilter, progFD int, name string) error {
+	req := AppendAttr(tcmsg(f.Ifindex, f.Handle, filterParent(f.Ingress), filterInfo(f.Prio)), tcaKind, nulTerminated("bpf"))
+	req = AppendAttr(req, tcaOptions, bpfFilterOptions(progFD, name))
+	if _, err := c.Request(unix.RTM_NEWTFILTER, unix.NLM_F_REPLACE|unix.NLM_F_ACK, req); err != nil {
+		return fmt.Errorf("replacing filter on link %d: %w", f.Ifindex, err)
+	}
+	return nil
+}
+
+// DeleteFilter takes a filter off its qdisc
+func (c *Conn) DeleteFilter(f TCFilter) error {
+	req := AppendAttr(tcmsg(f.Ifindex, f.Handle, filterParent(f.Ingress), filterInfo(f.Prio)), tcaKind, nulTerminated("bpf"))
+	if _, err := c.Request(unix.RTM_DELTFILTER, unix.NLM_F_ACK, req); err != nil {
+		return fmt.Errorf("deleting filter from link %d: %w", f.Ifindex, err)
+	}
+	return nil
+}
+
+// HasFilters reports whether there are any filters left on the interface's clsact qdisc, either direction
+func (c *Conn) HasFilters(ifindex int) (bool, error) {
+	for _, ingress := range []bool{true, false} {
+		msgs, err := c.Request(unix.RTM_GETTFILTER, unix.NLM_F_DUMP, tcmsg(ifindex, 0, filterParent(ingress), 0))
+		if err != nil {
+			return false, fmt.Errorf("dumping filters on link %d: %w", ifindex, err)
+		}
+		for _, m := range msgs {
+			if m.Header.Type == unix.RTM_NEWTFILTER {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,107 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// veth bits x/sys doesn't have, from linux/veth.h
+const vethInfoPeer = 1
+
+// struct ifinfomsg: family, pad, type, index, flags, change
+func ifinfomsg(index int, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+// CreateVeth creates a veth pair, both ends start out down
+func (c *Conn) CreateVeth(name, peer string) error {
+	peerInfo := AppendAttr(ifinfomsg(0, 0, 0), unix.IFLA_IFNAME, nulTerminated(peer))
+	data := AppendAttr(nil, vethInfoPeer, peerInfo)
+	info := AppendAttr(nil, unix.IFLA_INFO_KIND, []byte("veth"))
+	info = AppendAttr(info, unix.IFLA_INFO_DATA, data)
+	req := AppendAttr(ifinfomsg(0, 0, 0), unix.IFLA_IFNAME, nulTerminated(name))
+	req = AppendAttr(req, unix.IFLA_LINKINFO, info)
+	if _, err := c.Request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK, req); err != nil {
+		return fmt.Errorf("creating veth %s/%s: %w", name, peer, err)
+	}
+	return nil
+}
+
+// CreateDummy creates a dummy interface, it starts out down
+func (c *Conn) CreateDummy(name string) error {
+	info := AppendAttr(nil, unix.IFLA_INFO_KIND, []byte("dummy"))
+	req := AppendAttr(ifinfomsg(0, 0, 0), unix.IFLA_IFNAME, nulTerminated(name))
+	req = AppendAttr(req, unix.IFLA_LINKINFO, info)
+	if _, err := c.Request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK, req); err != nil {
+		return fmt.Errorf("creating dummy %s: %w", name, err)
+	}
+	return nil
+}
+
+// CreateVLAN creates a VLAN interface with the given ID on top of parent, proto is the tag's ethertype(ETH_P_8021Q or ETH_P_8021AD for a QinQ S-tag);
+// it starts out down
+func (c *Conn) CreateVLAN(name string, parent int, id, proto uint16) error {
+	data := AppendAttr(nil, unix.IFLA_VLAN_ID, binary.NativeEndian.AppendUint16(nil, id))
+	data = AppendAttr(data, unix.IFLA_VLAN_PROTOCOL, binary.BigEndian.AppendUint16(nil, proto))
+	info := AppendAttr(nil, unix.IFLA_INFO_KIND, []byte("vlan"))
+	info = AppendAttr(info, unix.IFLA_INFO_DATA, data)
+	req := AppendAttr(ifinfomsg(0, 0, 0), unix.IFLA_IFNAME, nulTerminated(name))
+	req = AppendAttr(req, unix.IFLA_LINK, binary.NativeEndian.AppendUint32(nil, uint32(parent)))
+	req = AppendAttr(req, unix.IFLA_LINKINFO, info)
+	if _, err := c.Request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK, req); err != nil {
+		return fmt.Errorf("creating vlan %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeleteLink deletes an interface, for a veth that takes the peer down with it
+func (c *Conn) DeleteLink(ifindex int) error {
+	if _, err := c.Request(unix.RTM_DELLINK, unix.NLM_F_ACK, ifinfomsg(ifindex, 0, 0)); err != nil {
+		return fmt.Errorf("deleting link %d: %w", ifindex, err)
+	}
+	return nil
+}
+
+// SetLinkUp brings an interface up administratively
+func (c *Conn) SetLinkUp(ifindex int) error {
+	if _, err := c.Request(unix.RTM_NEWLINK, unix.NLM_F_ACK, ifinfomsg(ifindex, unix.IFF_UP, unix.IFF_UP)); err != nil {
+		return fmt.Errorf("bringing up link %d: %w", ifindex, err)
+	}
+	return nil
+}
+
+// AddAddr assigns an address to an interface
+// IPv6 ones skip duplicate address detection so they're usable right away
+func (c *Conn) AddAddr(ifindex int, addr *net.IPNet) error {
+	ip, family := addr.IP.To4(), unix.AF_INET
+	if ip == nil {
+		ip, family = addr.IP.To16(), unix.AF_INET6
+	}
+	ones, _ := addr.Mask.Size()
+	// struct ifaddrmsg: family, prefixlen, flags, scope, index
+	req := make([]byte, unix.SizeofIfAddrmsg)
+	req[0] = byte(family)
+	req[1] = byte(ones)
+	if family == unix.AF_INET6 {
+		req[2] = unix.IFA_F_NODAD
+	}
+	binary.NativeEndian.PutUint32(req[4:8], uint32(ifindex))
+	req = AppendAttr(req, unix.IFA_LOCAL, ip)
+	req = AppendAttr(req, unix.IFA_ADDRESS, ip)
+	if _, err := c.Request(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK, req); err != nil {
+		return fmt.Errorf("adding %s to link %d: %w", addr, ifindex, err)
+	}
+	return nil
+}
+
+func nulTerminated(s string) []byte {
+	return append([]byte(s), 0)
+}
@@ -0,0 +1,307 @@
+package stamp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+)
+
+// authenticated mode(RFC 8762 4.4): both packets grow to 112 bytes and end with an HMAC-SHA-256 truncated to 16 bytes
+// BPF has no way to compute an HMAC so here userspace builds, signs and checks every packet and they go through the regular sockets;
+// BPF only notes down the precise timestamps in the arrivals/probes maps for us to pick up
+// KEEP IN SYNC with senderpkt_auth/reflectorpkt_auth in stamp.bpf.h
+const (
+	authLen = 112
+	hmacOff = 96 // the HMAC covers everything in front of it
+	hmacLen = 16
+	// both packets
+	authSeq = 0
+	authErr = 24 // right behind T1/T3
+	// sender packet
+	authT1 = 16
+	// reflector packet
+	authT3    = 16
+	authT2    = 32
+	authSSeq  = 48
+	authST1   = 64
+	authTTL   = 80
+	authTSLen = 10 // timestamp plus error estimate, copied over as is
+)
+
+// AuthKeyGrace is how long RotateAuthKey keeps accepting the old key, long enough for whatever's in flight at the time to make it
+const AuthKeyGrace = 10 * time.Second
+
+// auth failures are counted on both sides and shown alongside the metrics
+var authStats struct {
+	enabled  bool
+	failures uint64
+	// verified under the key we had before the last rotation
+	previous uint64
+}
+
+// what userspace signs and checks with, set from Args.AuthKey once a session starts and swapped by RotateAuthKey after that
+// BPF never sees the key so there's nothing to update in the kernel
+var authKeys struct {
+	sync.RWMutex
+	active   []byte
+	previous []byte
+	// previous is accepted until then
+	graceUntil time.Time
+}
+
+func setAuthKey(key []byte) {
+	authKeys.Lock()
+	authKeys.active, authKeys.previous = key, nil
+	authKeys.Unlock()
+}
+
+// RotateAuthKey swaps the authenticated mode key mid-session: everything we send from now on is signed with newKey,
+// packets signed with the old one are still accepted for AuthKeyGrace and counted in AuthPreviousKey.
+// The reflector answers with whichever key the request checked out with, so rotate it first and the sender after
+func RotateAuthKey(newKey []byte) error {
+	if len(newKey) == 0 {
+		return fmt.Errorf("Empty auth key")
+	}
+	authKeys.Lock()
+	defer authKeys.Unlock()
+	if len(authKeys.active) == 0 {
+		return fmt.Errorf("Not in authenticated mode")
+	}
+	if hmac.Equal(authKeys.active, newKey) == true {
+		return nil
+	}
+	authKeys.previous, authKeys.active = authKeys.active, append([]byte(nil), newKey...)
+	authKeys.graceUntil = time.Now().Add(AuthKeyGrace)
+	return nil
+}
+
+func currentAuthKey() []byte {
+	authKeys.RLock()
+	defer authKeys.RUnlock()
+	return authKeys.active
+}
+
+// checks pkt against the current key and, during the grace window, the previous one; returns the one that worked, nil if neither did
+func verifyKeys(pkt []byte) []byte {
+	authKeys.RLock()
+	active, previous, graceUntil := authKeys.active, authKeys.previous, authKeys.graceUntil
+	authKeys.RUnlock()
+	if verify(active, pkt) == true {
+		return active
+	}
+	if previous != nil && time.Now().Before(graceUntil) && verify(previous, pkt) == true {
+		mut.Lock()
+		authStats.previous++
+		mut.Unlock()
+		return previous
+	}
+	return nil
+}
+
+// samples from the authenticated path, picked up by the output loops next to the ringbuf
+// they're as big as the ringbufs and just as lossy when full
+var senderAuthSamples = make(chan sender.SenderSample, 4096)
+var refAuthSamples = make(chan refSample, 4096)
+
+func enableAuthStats() {
+	mut.Lock()
+	authStats.enabled = true
+	mut.Unlock()
+}
+
+func authFailed() {
+	mut.Lock()
+	authStats.failures++
+	mut.Unlock()
+}
+
+// AuthFailures is how many packets failed authentication so far, sender and reflector alike
+func AuthFailures() uint64 {
+	mut.RLock()
+	defer mut.RUnlock()
+	return authStats.failures
+}
+
+// AuthPreviousKey is how many packets checked out with the key from before the last RotateAuthKey, sender and reflector alike
+func AuthPreviousKey() uint64 {
+	mut.RLock()
+	defer mut.RUnlock()
+	return authStats.previous
+}
+
+// caller holds the lock
+func authString() string {
+	if authStats.previous > 0 {
+		return fmt.Sprintf("Auth failures: %-4d Old key: %-4d", authStats.failures, authStats.previous)
+	}
+	return fmt.Sprintf("Auth failures: %-4d", authStats.failures)
+}
+
+func sign(key, pkt []byte) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pkt[:hmacOff])
+	copy(pkt[hmacOff:], mac.Sum(nil)[:hmacLen])
+}
+
+// anything that isn't a full authenticated packet fails too, unauthenticated ones included
+func verify(key, pkt []byte) bool {
+	if len(pkt) != authLen {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pkt[:hmacOff])
+	return hmac.Equal(pkt[hmacOff:], mac.Sum(nil)[:hmacLen])
+}
+
+// T1 goes in here since it's under the HMAC, BPF notes the precise egress time same as in cgroup mode
+func senderPacketAuth(seq uint32) []byte {
+	pkt := make([]byte, authLen)
+	binary.BigEndian.PutUint32(pkt[authSeq:], seq)
+	secs, fracs := timestampNow(tsFormat)
+	binary.BigEndian.PutUint32(pkt[authT1:], secs)
+	binary.BigEndian.PutUint32(pkt[authT1+4:], fracs)
+	binary.BigEndian.PutUint16(pkt[authErr:], uint16(currentErrorEstimate().WithFormat(tsFormat)))
+	sign(currentAuthKey(), pkt)
+	return pkt
+}
+
+// sender side: replies land on our socket, once the HMAC checks out we do the math handle_reply() in sender.bpf.c would have
+// runs until the socket is closed
+func authReceive(conn *net.UDPConn, args Args) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkt := buf[:n]
+		if verifyKeys(pkt) == nil {
+			authFailed()
+			continue
+		}
+		// map keys hold the seq the way it sits in the packet
+		key := sender.SenderProbeKey{Raddr: from.AddrPort().Addr().As16(), Seq: binary.NativeEndian.Uint32(pkt[authSSeq:])}
+		var t4 uint64
+		if err := args.ArrivalsMap.LookupAndDelete(&key, &t4); err != nil {
+			// BPF never saw it come in(or it got evicted), there's no T4 to go with it
+			continue
+		}
+		s := sender.SenderSample{Seq: binary.BigEndian.Uint32(pkt[authSSeq:]), Echo: echoUnknownSeq, Raddr: key.Raddr}
+		t1 := toUnix(pkt[authST1:], tsFormat)
+		var sent sender.SenderSentProbe
+		if err := args.ProbesMap.LookupAndDelete(&key, &sent); err == nil {
+			s.Echo = echoOK
+			if sent.Wire.NtpSecs != binary.NativeEndian.Uint32(pkt[authST1:]) || sent.Wire.NtpFracs != binary.NativeEndian.Uint32(pkt[authST1+4:]) {
+				s.Echo = echoBadTS
+			}
+			t1 = sent.T1
+		}
+		// the reflector says which format it answered in, it should be ours
+		rfmt := ErrorEstimate(binary.BigEndian.Uint16(pkt[authErr:])).Format()
+		t2, t3 := toUnix(pkt[authT2:], rfmt), toUnix(pkt[authT3:], rfmt)
+		s.Near, s.Far, s.Rt = t2-t1, t4-t3, t4-t1
+		select {
+		case senderAuthSamples <- s:
+		default:
+		}
+	}
+}
+
+// reflector side: BPF lets the requests through to us, we check them and answer with a signed reply
+// T3 is stamped right before the write so it's a bit less precise than in unauthenticated mode
+func authReflect(ctx context.Context, args Args) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: args.S_port})
+	if err != nil {
+		return fmt.Errorf("Error binding: %w", err)
+	}
+	defer conn.Close()
+	// the egress program only lets our replies through untouched if they leave from the right port
+	out := conn
+	if args.ReflectSport != 0 && args.ReflectSport != args.S_port {
+		out, err = net.ListenUDP("udp", &net.UDPAddr{Port: args.ReflectSport})
+		if err != nil {
+			return fmt.Errorf("Error binding reply port: %w", err)
+		}
+		defer out.Close()
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		out.Close()
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("Error reading request: %w", err)
+		}
+		pkt := buf[:n]
+		// answering with the key the request came with keeps a sender that hasn't rotated yet going
+		signKey := verifyKeys(pkt)
+		if signKey == nil {
+			authFailed()
+			continue
+		}
+		// the reply goes out in whatever format the sender used
+		f := ErrorEstimate(binary.BigEndian.Uint16(pkt[authErr:])).Format()
+		reply := make([]byte, authLen)
+		key := reflector.ReflectorReflKey{Raddr: from.AddrPort().Addr().As16(), Seq: binary.NativeEndian.Uint32(pkt[authSeq:]), Port: uint16(from.Port)}
+		var arr reflector.ReflectorReflArrival
+		if err := args.ArrivalsMap.LookupAndDelete(&key, &arr); err == nil {
+			binary.NativeEndian.PutUint32(reply[authT2:], arr.T2.NtpSecs)
+			binary.NativeEndian.PutUint32(reply[authT2+4:], arr.T2.NtpFracs)
+			// BPF leaves it as NTP
+			if f == FormatPTP {
+				secs, fracs := fromUnix(toUnix(reply[authT2:], FormatNTP), f)
+				binary.BigEndian.PutUint32(reply[authT2:], secs)
+				binary.BigEndian.PutUint32(reply[authT2+4:], fracs)
+			}
+			reply[authTTL] = arr.Ttl
+		} else {
+			// BPF never saw it come in(or it got evicted), our own receive time is better than nothing
+			secs, fracs := timestampNow(f)
+			binary.BigEndian.PutUint32(reply[authT2:], secs)
+			binary.BigEndian.PutUint32(reply[authT2+4:], fracs)
+		}
+		// stateless: our seq is theirs
+		copy(reply[authSeq:authSeq+4], pkt[authSeq:authSeq+4])
+		if args.Stateful == true {
+			binary.BigEndian.PutUint32(reply[authSeq:], sessionSeq(args.SessionsMap, from))
+		}
+		copy(reply[authSSeq:authSSeq+4], pkt[authSeq:authSeq+4])
+		copy(reply[authST1:authST1+authTSLen], pkt[authT1:authT1+authTSLen])
+		secs, fracs := timestampNow(f)
+		binary.BigEndian.PutUint32(reply[authT3:], secs)
+		binary.BigEndian.PutUint32(reply[authT3+4:], fracs)
+		binary.BigEndian.PutUint16(reply[authErr:], uint16(currentErrorEstimate().WithFormat(f)))
+		sign(signKey, reply)
+		out.WriteToUDP(reply, from)
+		// same as what reflector_in puts on the ringbuf
+		select {
+		case refAuthSamples <- refSample{seq: binary.BigEndian.Uint32(pkt[authSeq:]), sam: float64(toUnix(reply[authT2:], f)-toUnix(pkt[authT1:], f)) * 1e-6}:
+		default:
+		}
+	}
+}
+
+// same as session_seq() in reflector.bpf.c, it's the same map so both paths stay in step
+func sessionSeq(m *ebpf.Map, from *net.UDPAddr) uint32 {
+	key := reflector.ReflectorSessKey{Raddr: from.AddrPort().Addr().As16(), Port: uint16(from.Port)}
+	// a new or evicted session isn't there and starts over from 0
+	var next uint32
+	m.Lookup(&key, &next)
+	m.Put(&key, next+1)
+	return next
+}
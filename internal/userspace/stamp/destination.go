@@ -0,0 +1,287 @@
+package stamp
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packets can arrive out of order so we can't rely on packet's seq
+// we do one session per reflector per sender run so we don't have to reinitialize these ever
+// it's a bit messy to do it this way but I honestly have no idea how to do it better and I've been thinking about this for weeks
+var dests = make(map[netip.Addr]*destination)
+var destOrder []*destination // same order as on the command line, for printing
+var agg rollup
+var mut sync.RWMutex
+
+// health gating: a reflector that stops responding would drag the aggregate loss/latency down with it
+// so after unhealthyAfter packets lost in a row we stop counting it towards the aggregate(it's still reported on its own)
+// and once it answers healthyAfter packets in a row we let it back in; unhealthyAfter=0 disables gating
+var unhealthyAfter, healthyAfter uint32
+
+// mirrors enum echo_check in sender.bpf.c
+const (
+	echoOK uint8 = iota
+	echoBadTS
+	echoUnknownSeq
+)
+
+// packet accounting, both per reflector and aggregate
+type packetStats struct {
+	total, count, lost uint32
+	// packets that came back with a sender block that doesn't match what we sent - non-compliant reflector
+	// these are accounted for(not lost) but kept out of the metrics since their one-way numbers can't be trusted
+	mismatch uint32
+}
+
+func (p *packetStats) accounted() uint32 {
+	return p.count + p.lost + p.mismatch
+}
+
+func (p *packetStats) String() string {
+	var percentage float64 = (float64(p.lost) / float64(p.total)) * 100
+	return fmt.Sprintf("Packets:   sent %-4d      received %-4d  lost %-4d      loss %4.2f%%    bad echo %-4d\n", p.total, p.count, p.lost, percentage, p.mismatch)
+}
+
+// an outstanding probe; we remember whether the reflector was healthy when we sent it
+// so that the aggregate always sees both ends of a packet's life or neither
+type probe struct {
+	timer *time.Timer
+	agg   bool
+}
+
+type destination struct {
+	addr    netip.Addr
+	stats   packetStats
+	met     metricsCollection
+	ipdv    ipdvCollection
+	packets map[uint32]*probe
+	healthy bool
+	streak  uint32 // consecutive losses while healthy, consecutive responses while not
+	// sequence range we sent, for Results
+	seqFirst, seqLast uint32
+	// pre-aggregated stuff for the metrics endpoint
+	near, far, rt latencyHist
+	loss          lossWindow
+}
+
+// everything that made it into the aggregate, i.e. was sent to a healthy reflector
+type rollup struct {
+	stats packetStats
+	met   metricsCollection
+}
+
+func addDestination(addr netip.Addr) {
+	mut.Lock()
+	defer mut.Unlock()
+	if dests[addr] != nil {
+		return
+	}
+	d := &destination{
+		addr:    addr,
+		met:     newMetricsCollection(),
+		packets: make(map[uint32]*probe),
+		healthy: true,
+		near:    newLatencyHist(),
+		far:     newLatencyHist(),
+		rt:      newLatencyHist(),
+		loss:    newLossWindow(),
+	}
+	dests[addr] = d
+	destOrder = append(destOrder, d)
+}
+
+// IDEA: we update metrics synchronously with samples arriving on the ringbuf
+// however, packet loss is asynchronous since we add packets when we send them and remove them when we get them back
+// the problem: metrics itself doesn't have core loop to execute stuff in
+// so it makes no sense to use goroutines or channels here, that's just more mess - where does this stuff happen or live?
+// so we call this from the packet sender
+func queuePacket(addr netip.Addr, seq uint32, timeout time.Duration) {
+	mut.Lock()
+	defer mut.Unlock()
+	d := dests[addr]
+	d.packets[seq] = &probe{timer: time.AfterFunc(timeout, func() { lostPacket(addr, seq) }), agg: d.healthy}
+	// 0 is as good a seq as any with --seq-start
+	if d.stats.total == 0 {
+		d.seqFirst = seq
+	}
+	d.stats.total++
+	d.seqLast = seq
+	if d.healthy == true {
+		agg.stats.total++
+	}
+}
+
+// this from the sample receiver; returns whether we were waiting for this packet and whether it counts towards the aggregate
+func validPacket(addr netip.Addr, seq uint32) (valid bool, inAgg bool) {
+	mut.Lock()
+	defer mut.Unlock()
+	d := dests[addr]
+	if d == nil || d.packets[seq] == nil {
+		return false, false
+	}
+	p := d.packets[seq]
+	p.timer.Stop()
+	delete(d.packets, seq)
+	d.responded()
+	return true, p.agg
+}
+
+// this as a timeout function
+func lostPacket(addr netip.Addr, seq uint32) {
+	mut.Lock()
+	defer mut.Unlock()
+	d := dests[addr]
+	p := d.packets[seq]
+	if p == nil {
+		return
+	}
+	delete(d.packets, seq)
+	d.stats.lost++
+	d.loss.add(time.Now(), true)
+	if p.agg == true {
+		agg.stats.lost++
+	}
+	d.timedOut()
+}
+
+// health bookkeeping, caller holds the lock
+func (d *destination) responded() {
+	if d.healthy == true {
+		d.streak = 0
+		return
+	}
+	d.streak++
+	if d.streak >= healthyAfter {
+		d.healthy = true
+		d.streak = 0
+	}
+}
+
+func (d *destination) timedOut() {
+	if unhealthyAfter == 0 {
+		return
+	}
+	if d.healthy == false {
+		d.streak = 0
+		return
+	}
+	d.streak++
+	if d.streak >= unhealthyAfter {
+		d.healthy = false
+		d.streak = 0
+	}
+}
+
+// a valid sample came back
+func recordSample(s sample, inAgg bool) {
+	mut.Lock()
+	defer mut.Unlock()
+	d := dests[s.Reflector]
+	d.stats.count++
+	d.met.UpdatemetricsCollection(s)
+	d.ipdv.update(s)
+	d.near.add(s.Near)
+	d.far.add(s.Far)
+	d.rt.add(s.RT)
+	d.loss.add(time.Now(), false)
+	if inAgg == true {
+		agg.stats.count++
+		agg.met.UpdatemetricsCollection(s)
+	}
+}
+
+// a sample came back but the reflector mangled our sender block
+func recordMismatch(addr netip.Addr, inAgg bool) {
+	mut.Lock()
+	defer mut.Unlock()
+	dests[addr].stats.mismatch++
+	dests[addr].loss.add(time.Now(), false)
+	if inAgg == true {
+		agg.stats.mismatch++
+	}
+}
+
+// we're done once every reflector got all its packets accounted for
+// set by send() once it stops for good, with --duration that's the only way to tell how many probes there are to wait for
+var sendDone atomic.Bool
+
+// how many probes send() sent every reflector
+var lastSent atomic.Uint32
+
+// the session's over once every probe is either back or timed out
+func sessionOver(count uint32) bool {
+	if count > 0 && sessionDone(count) == true {
+		return true
+	}
+	return sendDone.Load() == true && sessionDone(lastSent.Load()) == true
+}
+
+func sessionDone(count uint32) bool {
+	mut.RLock()
+	defer mut.RUnlock()
+	for _, d := range destOrder {
+		if d.stats.accounted() < count {
+			return false
+		}
+	}
+	return true
+}
+
+// amount of lines the report takes so we can redraw it in place
+func reportLines() int {
+	mut.RLock()
+	defer mut.RUnlock()
+	var lines int
+	if len(destOrder) == 1 {
+		lines = 4
+	} else {
+		lines = 5 * (len(destOrder) + 1)
+	}
+	if dropStats.enabled == true {
+		lines++
+	}
+	if authStats.enabled == true {
+		lines++
+	}
+	return lines
+}
+
+// renders the live report, moving the cursor back up over the previous one first
+func report() string {
+	var res strings.Builder
+	res.WriteString(strings.Repeat("\033[F", reportLines()))
+	mut.RLock()
+	defer mut.RUnlock()
+	if dropStats.enabled == true {
+		res.WriteString(dropsString())
+	}
+	if authStats.enabled == true {
+		res.WriteString(authString() + "\033[K\n")
+	}
+	// a single reflector looks exactly like it always did
+	if len(destOrder) == 1 {
+		res.WriteString(destOrder[0].stats.String())
+		res.WriteString(destOrder[0].met.String())
+		return res.String()
+	}
+	var healthy int
+	for _, d := range destOrder {
+		state := "healthy"
+		if d.healthy == false {
+			state = "UNHEALTHY - excluded from aggregate"
+		} else {
+			healthy++
+		}
+		fmt.Fprintf(&res, "Reflector %s (%s)\033[K\n", d.addr, state)
+		res.WriteString(d.stats.String())
+		res.WriteString(d.met.String())
+	}
+	fmt.Fprintf(&res, "Aggregate over %d/%d healthy reflectors\033[K\n", healthy, len(destOrder))
+	res.WriteString(agg.stats.String())
+	res.WriteString(agg.met.String())
+	return res.String()
+}
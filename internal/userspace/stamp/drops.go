@@ -0,0 +1,89 @@
+package stamp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+)
+
+// interface-level drops, so that when loss spikes you can tell right away whether it's us or the network
+// we show deltas since the session started, the absolute counters are meaningless here
+var dropStats struct {
+	enabled           bool
+	baseline, current netlink.Drops
+	// what was counted before the counters last started over, see netlink.Drops.Reset
+	carried netlink.Drops
+	err     error
+}
+
+// how often we poll netlink, there's no point doing it faster than a human can read
+const dropsInterval = time.Second
+
+// grabs the baseline, has to succeed before the session starts so that we fail early on a bad setup
+func initDrops(ifindex int) (*netlink.Conn, error) {
+	conn, err := netlink.Dial()
+	if err != nil {
+		return nil, err
+	}
+	d, err := conn.InterfaceDrops(ifindex)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading interface drops: %w", err)
+	}
+	mut.Lock()
+	dropStats.enabled = true
+	dropStats.baseline, dropStats.current = d, d
+	dropStats.carried = netlink.Drops{}
+	mut.Unlock()
+	return conn, nil
+}
+
+// polls netlink until the session's over, a failed read just marks the stats stale instead of bringing the session down
+func pollDrops(ctx context.Context, conn *netlink.Conn, ifindex int) {
+	defer conn.Close()
+	ticker := time.NewTicker(dropsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d, err := conn.InterfaceDrops(ifindex)
+		mut.Lock()
+		updateDrops(d, err)
+		mut.Unlock()
+	}
+}
+
+// takes in what the last poll read, caller holds the lock
+func updateDrops(d netlink.Drops, err error) {
+	dropStats.err = err
+	if err != nil {
+		return
+	}
+	if d.Reset(dropStats.current) == true {
+		fmt.Fprintf(os.Stderr, "Interface drop counters started over(qdisc replaced or link reset), counting on from here\n")
+		dropStats.carried = dropStats.carried.Add(dropStats.current.Sub(dropStats.baseline))
+		dropStats.baseline = d.Rebaseline(dropStats.current)
+	}
+	dropStats.current = d
+}
+
+// drops since the session started, resets and all; caller holds the lock
+func sessionDrops() netlink.Drops {
+	return dropStats.current.Sub(dropStats.baseline).Add(dropStats.carried)
+}
+
+// caller holds the lock
+func dropsString() string {
+	d := sessionDrops()
+	stale := ""
+	if dropStats.err != nil {
+		stale = " (stale: " + dropStats.err.Error() + ")"
+	}
+	return fmt.Sprintf("Local drops: rx %-4d tx %-4d nic missed %-4d qdisc %-4d%s\033[K\n", d.RxDropped, d.TxDropped, d.RxMissed, d.Qdisc, stale)
+}
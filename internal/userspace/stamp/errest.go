@@ -0,0 +1,119 @@
+package stamp
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorEstimate is the Error Estimate field that goes with every STAMP timestamp(RFC 8762 4.2.1, same as OWAMP's in RFC 4656 4.1.2):
+// S(synced to UTC), Z(the timestamps are PTP rather than NTP, see TimestampFormat), 6 bits of scale and 8 of multiplier, the error being
+// multiplier*2^(scale-32) seconds
+// KEEP IN SYNC with err_est in stamp.bpf.h
+type ErrorEstimate uint16
+
+const (
+	errEstSynced = 0x8000
+	errEstPTP    = 0x4000
+	errEstScale  = 0x3f00
+	errEstMult   = 0x00ff
+)
+
+// NewErrorEstimate encodes the smallest estimate that's at least err, anything below the NTP format's resolution goes as the smallest there is
+func NewErrorEstimate(err time.Duration, synced bool) ErrorEstimate {
+	// in units of 2^-32 seconds, halved until it fits the multiplier
+	units := math.Ceil(err.Seconds() * (1 << 32))
+	scale := 0
+	for units > errEstMult && scale < 63 {
+		units = math.Ceil(units / 2)
+		scale++
+	}
+	// the multiplier must not be zero
+	mult := uint16(math.Max(1, math.Min(units, errEstMult)))
+	e := ErrorEstimate(uint16(scale)<<8 | mult)
+	if synced == true {
+		e |= errEstSynced
+	}
+	return e
+}
+
+// Valid is false for a field that was never filled in: a zero multiplier isn't allowed, older reflectors(and we, before) leave it all zero
+func (e ErrorEstimate) Valid() bool {
+	return e&errEstMult != 0
+}
+
+// Synced is the S bit, whoever took the timestamp says its clock is synced to UTC
+func (e ErrorEstimate) Synced() bool {
+	return e&errEstSynced != 0
+}
+
+// Duration is how far off the timestamp might be, capped at what fits a time.Duration
+func (e ErrorEstimate) Duration() time.Duration {
+	scale := int(e&errEstScale) >> 8
+	secs := math.Ldexp(float64(e&errEstMult), scale-32)
+	if secs*1e9 >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(secs * 1e9)
+}
+
+// Format is the Z bit, the format of the timestamps the estimate goes with
+func (e ErrorEstimate) Format() TimestampFormat {
+	if e&errEstPTP != 0 {
+		return FormatPTP
+	}
+	return FormatNTP
+}
+
+// WithFormat is the same estimate for timestamps in f
+func (e ErrorEstimate) WithFormat(f TimestampFormat) ErrorEstimate {
+	e &^= errEstPTP
+	if f == FormatPTP {
+		e |= errEstPTP
+	}
+	return e
+}
+
+func (e ErrorEstimate) String() string {
+	if e.Valid() == false {
+		return "unknown"
+	}
+	if e.Synced() == true {
+		return fmt.Sprintf("±%v(synced)", e.Duration())
+	}
+	return fmt.Sprintf("±%v(unsynced)", e.Duration())
+}
+
+// TimestampFormat is how timestamps go on the wire(RFC 8762 4.2.1), the sender picks one and the reflector answers in the same
+// KEEP IN SYNC with enum ts_fmt in stamp.bpf.h
+type TimestampFormat uint8
+
+const (
+	// seconds since 1900 and 2^-32 fractions
+	FormatNTP TimestampFormat = iota
+	// PTPv2 truncated: seconds since 1970 and nanoseconds
+	FormatPTP
+)
+
+func (f TimestampFormat) String() string {
+	switch f {
+	case FormatNTP:
+		return "ntp"
+	case FormatPTP:
+		return "ptp"
+	}
+	return fmt.Sprintf("TimestampFormat(%d)", uint8(f))
+}
+
+// what our packets carry, set from Args.ErrorEstimate once a session starts and by whoever watches the clock after that
+var errEstimate atomic.Uint32
+
+// SetErrorEstimate changes the Error Estimate of the packets userspace builds mid-session, for when the clock's sync state changes
+func SetErrorEstimate(e ErrorEstimate) {
+	errEstimate.Store(uint32(e))
+}
+
+func currentErrorEstimate() ErrorEstimate {
+	return ErrorEstimate(errEstimate.Load())
+}
@@ -0,0 +1,119 @@
+package stamp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Grafana-friendly metrics endpoint: percentiles and windowed loss are computed here
+// so dashboards don't need heavy PromQL, it's plain Prometheus text format so anything can scrape it
+
+var lossWindows []time.Duration
+
+// how long we wait for in-flight scrapes when the session's over
+const exporterShutdown = 5 * time.Second
+
+// serves until the context is done, the listener is set up beforehand so that a taken port fails the session early
+func serveMetrics(ctx context.Context, ln net.Listener, iface string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, iface, time.Now())
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownctx, cancel := context.WithTimeout(context.Background(), exporterShutdown)
+		defer cancel()
+		srv.Shutdown(shutdownctx)
+	}()
+	if err := srv.Serve(ln); err != nil && errors.Is(err, http.ErrServerClosed) == false {
+		fmt.Fprintf(os.Stderr, "Error serving metrics: %v\n", err)
+	}
+}
+
+// Prometheus wants seconds, we keep milliseconds
+func promFloat(ms float64) string {
+	if math.IsNaN(ms) {
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", ms/1000)
+}
+
+// windows are labeled the way Prometheus writes durations: 30s, 5m, 1h
+func windowLabel(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+func writeMetrics(w io.Writer, iface string, now time.Time) {
+	var res strings.Builder
+	mut.RLock()
+	summaries := []struct {
+		name, help string
+		hist       func(d *destination) *latencyHist
+	}{
+		{"stamp_rtt_seconds", "Roundtrip delay(T4-T1)", func(d *destination) *latencyHist { return &d.rt }},
+		{"stamp_near_end_delay_seconds", "Sender to reflector one-way delay(T2-T1), needs clock sync", func(d *destination) *latencyHist { return &d.near }},
+		{"stamp_far_end_delay_seconds", "Reflector to sender one-way delay(T4-T3), needs clock sync", func(d *destination) *latencyHist { return &d.far }},
+	}
+	for _, sum := range summaries {
+		fmt.Fprintf(&res, "# HELP %s %s\n# TYPE %s summary\n", sum.name, sum.help, sum.name)
+		for _, d := range destOrder {
+			h := sum.hist(d)
+			labels := fmt.Sprintf("reflector=%q,interface=%q", d.addr.String(), iface)
+			for _, q := range quantiles {
+				fmt.Fprintf(&res, "%s{%s,quantile=\"%g\"} %s\n", sum.name, labels, q, promFloat(h.quantile(q)))
+			}
+			fmt.Fprintf(&res, "%s_sum{%s} %s\n", sum.name, labels, promFloat(h.sum))
+			fmt.Fprintf(&res, "%s_count{%s} %d\n", sum.name, labels, h.count)
+		}
+	}
+	fmt.Fprintf(&res, "# HELP stamp_loss_ratio Share of packets lost among those accounted for within the window\n# TYPE stamp_loss_ratio gauge\n")
+	for _, d := range destOrder {
+		for _, win := range lossWindows {
+			ratio := d.loss.ratio(now, win)
+			val := "NaN"
+			if math.IsNaN(ratio) == false {
+				val = fmt.Sprintf("%g", ratio)
+			}
+			fmt.Fprintf(&res, "stamp_loss_ratio{reflector=%q,interface=%q,window=%q} %s\n", d.addr.String(), iface, windowLabel(win), val)
+		}
+	}
+	fmt.Fprintf(&res, "# HELP stamp_reflector_healthy Whether the reflector currently counts towards the aggregate\n# TYPE stamp_reflector_healthy gauge\n")
+	for _, d := range destOrder {
+		var healthy int
+		if d.healthy == true {
+			healthy = 1
+		}
+		fmt.Fprintf(&res, "stamp_reflector_healthy{reflector=%q,interface=%q} %d\n", d.addr.String(), iface, healthy)
+	}
+	if authStats.enabled == true {
+		fmt.Fprintf(&res, "# HELP stamp_auth_failures_total Replies dropped for a bad or missing HMAC\n# TYPE stamp_auth_failures_total counter\n")
+		fmt.Fprintf(&res, "stamp_auth_failures_total{interface=%q} %d\n", iface, authStats.failures)
+		fmt.Fprintf(&res, "# HELP stamp_auth_previous_key_total Replies that checked out with the key from before the last rotation\n# TYPE stamp_auth_previous_key_total counter\n")
+		fmt.Fprintf(&res, "stamp_auth_previous_key_total{interface=%q} %d\n", iface, authStats.previous)
+	}
+	if dropStats.enabled == true {
+		d := sessionDrops()
+		fmt.Fprintf(&res, "# HELP stamp_interface_rx_drops_total Packets the kernel or driver dropped on the way in since the session started\n# TYPE stamp_interface_rx_drops_total counter\n")
+		fmt.Fprintf(&res, "stamp_interface_rx_drops_total{interface=%q} %d\n", iface, d.RxDropped)
+		fmt.Fprintf(&res, "# HELP stamp_interface_tx_drops_total Packets the kernel or driver dropped on the way out since the session started\n# TYPE stamp_interface_tx_drops_total counter\n")
+		fmt.Fprintf(&res, "stamp_interface_tx_drops_total{interface=%q} %d\n", iface, d.TxDropped)
+	}
+	mut.RUnlock()
+	io.WriteString(w, res.String())
+}
@@ -0,0 +1,42 @@
+package stamp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/viktordoronin/stamp-bpf/internal/userspace/netlink"
+)
+
+// the interface drops scraped across a counter reset, a failed poll keeps the last good reading
+func TestExporterDrops(t *testing.T) {
+	mut.Lock()
+	dropStats.enabled = true
+	dropStats.baseline, dropStats.current = netlink.Drops{RxDropped: 10, TxDropped: 4}, netlink.Drops{RxDropped: 10, TxDropped: 4}
+	dropStats.carried = netlink.Drops{}
+	updateDrops(netlink.Drops{RxDropped: 15, TxDropped: 6}, nil)
+	// the link bounced, rx starts over
+	updateDrops(netlink.Drops{RxDropped: 2, TxDropped: 7}, nil)
+	updateDrops(netlink.Drops{}, errors.New("netlink went away"))
+	mut.Unlock()
+	t.Cleanup(func() {
+		mut.Lock()
+		dropStats.enabled = false
+		mut.Unlock()
+	})
+
+	var buf strings.Builder
+	writeMetrics(&buf, "eth0", time.Now())
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE stamp_interface_rx_drops_total counter\n",
+		"stamp_interface_rx_drops_total{interface=\"eth0\"} 7\n",
+		"# TYPE stamp_interface_tx_drops_total counter\n",
+		"stamp_interface_tx_drops_total{interface=\"eth0\"} 3\n",
+	} {
+		if strings.Contains(out, want) == false {
+			t.Errorf("metrics don't have %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package stamp
+
+import "math"
+
+// RFC 3393 IPDV for one direction, going by seq: the difference between the delays of seq n-1 and n when both came back in that order.
+// Clock offset cancels out of it so the one-way directions make sense without synced clocks too.
+// Kept per reflector only, the aggregate mixes sessions and seqs next to each other there aren't packets next to each other
+type ipdvMetrics struct {
+	sum, max float64
+	pairs    uint32
+	// replies that came after a later seq, the pair they make with the one before them has no IPDV
+	reordered uint32
+	// the highest seq so far and its delay
+	head    uint32
+	last    float64
+	started bool
+}
+
+func (m *ipdvMetrics) update(seq uint32, v float64) {
+	switch {
+	case m.started == false:
+	case seq == m.head+1:
+		d := math.Abs(v - m.last)
+		m.sum += d
+		m.max = math.Max(m.max, d)
+		m.pairs++
+	case int32(seq-m.head) < 0:
+		m.reordered++
+		return
+	}
+	// a gap means a lost one in between, no pair either
+	m.started = true
+	m.head, m.last = seq, v
+}
+
+type ipdvCollection struct {
+	Near, Far, RT ipdvMetrics
+}
+
+func (col *ipdvCollection) update(s sample) {
+	col.Near.update(s.Seq, s.Near)
+	col.Far.update(s.Seq, s.Far)
+	col.RT.update(s.Seq, s.RT)
+}
+
+// PDV(RFC 5481) is relative to the minimum so it comes straight out of the metrics
+func delayVariation(m stampMetrics, ipdv ipdvMetrics) *DelayVariation {
+	v := DelayVariation{IPDVMax: ipdv.max, IPDVReordered: ipdv.reordered, PDVMean: m.Avg - m.Min, PDVMax: m.Max - m.Min}
+	if ipdv.pairs > 0 {
+		v.IPDVMean = ipdv.sum / float64(ipdv.pairs)
+	}
+	return &v
+}
@@ -3,78 +3,42 @@ package stamp
 import (
 	"fmt"
 	"math"
+	"net/netip"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/viktordoronin/stamp-bpf/internal/bpf/reflector"
 	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
 )
 
-// Packets can arrive out of order so we can't rely on packet's seq
-// we do one session per sender run so we don't have to reinitialize these ever
-// it's a bit messy to do it this way but I honestly have no idea how to do it better and I've been thinking about this for weeks
-var pktCount uint32 = 0
-var pktLost uint32 = 0
-var packets map[uint32]*time.Timer = make(map[uint32]*time.Timer)
-var mut sync.RWMutex
-var pktTotal uint32 = 0
-
-// IDEA: we update metrics synchronously with samples arriving on the ringbuf
-// however, packet loss is asynchronous since we add packets when we send them and remove them when we get them back
-// the problem: metrics itself doesn't have core loop to execute stuff in
-// so it makes no sense to use goroutines or channels here, that's just more mess - where does this stuff happen or live?
-// so we call this from the packet sender
-func queuePacket(seq uint32, timeout time.Duration) {
-	mut.Lock()
-	packets[seq] = time.AfterFunc(timeout, func() { lostPacket(seq) })
-	mut.Unlock()
-	pktTotal++
-}
-
-// this from the sample receiver
-func validPacket(seq uint32) bool {
-	mut.Lock()
-	defer mut.Unlock()
-	if packets[seq] != nil {
-		packets[seq].Stop()
-		delete(packets, seq)
-		return true
-	}
-	return false
-}
-
-// this as a timeout function
-func lostPacket(seq uint32) {
-	mut.Lock()
-	delete(packets, seq)
-	mut.Unlock()
-	pktLost++
-}
-
 // a Sample is a trio of directional latencies calculated from 4 timestamps
 // Samples are used once and discarded
 type sample struct {
 	Seq           uint32
 	Near, Far, RT float64
+	Reflector     netip.Addr
 }
 
 func newSample(s *sender.SenderSample) sample {
 	return sample{
-		Near: (float64)(s.Near) * 1e-6,
-		Far:  (float64)(s.Far) * 1e-6,
-		RT:   (float64)(s.Rt) * 1e-6,
-		Seq:  s.Seq,
+		Near:      (float64)(s.Near) * 1e-6,
+		Far:       (float64)(s.Far) * 1e-6,
+		RT:        (float64)(s.Rt) * 1e-6,
+		Seq:       s.Seq,
+		Reflector: addrFromBPF(s.Raddr),
 	}
 }
 
+// BPF side keeps every IP as 16 bytes with IPv4 mapped into IPv6, see load_raddr() in stamp.bpf.h
+func addrFromBPF(ip [16]uint8) netip.Addr {
+	return netip.AddrFrom16(ip).Unmap()
+}
+
 type refSample struct {
 	seq uint32
 	sam float64
 }
 
 func newRefSample(s *reflector.ReflectorSample) refSample {
-	pktCount++
 	return refSample{
 		seq: s.Seq,
 		sam: (float64)(s.Sam) * 1e-6,
@@ -85,6 +49,7 @@ func newRefSample(s *reflector.ReflectorSample) refSample {
 type stampMetrics struct {
 	Min, Max, Avg, Jitter, Last float64
 	jitterAbs                   float64
+	count                       uint32
 }
 
 func newMetricsRecord() stampMetrics {
@@ -93,6 +58,7 @@ func newMetricsRecord() stampMetrics {
 
 // we update our Metrics with each new Sample
 func (m *stampMetrics) updateMetrics(sample float64) {
+	m.count++
 	m.Last = sample
 	if m.Min != 0 {
 		m.Min = math.Min(m.Min, sample)
@@ -104,11 +70,11 @@ func (m *stampMetrics) updateMetrics(sample float64) {
 	// in order to dynamically recalculate average accounting for packet z, we have to reclaim original sum: sum=avg*2
 	// add the new sample and get the new average: (sum+z)/3
 	// full formula: avg=(oldavg*(pkts-1)+newpkt)/pkts
-	m.Avg = (m.Avg*(float64(pktCount)-1) + sample) / float64(pktCount)
+	m.Avg = (m.Avg*(float64(m.count)-1) + sample) / float64(m.count)
 	// we define jitter as average deviation from the average ping, expressed in percent
 	// no I don't know whether it makes sense or is even calculated correctly
 	diff := math.Abs(m.Avg - sample)
-	m.jitterAbs = (m.jitterAbs*(float64(pktCount)-1) + diff) / float64(pktCount)
+	m.jitterAbs = (m.jitterAbs*(float64(m.count)-1) + diff) / float64(m.count)
 	m.Jitter = m.jitterAbs / (m.Avg / 100)
 }
 func (m *stampMetrics) String() string {
@@ -120,16 +86,12 @@ type metricsCollection struct {
 	Near, Far, RT stampMetrics
 }
 
-func newMetricsCollection(sample sample) metricsCollection {
-	m := metricsCollection{Near: newMetricsRecord(), Far: newMetricsRecord(), RT: newMetricsRecord()}
-	m.UpdatemetricsCollection(sample)
-	pktCount = 0
-	return m
+func newMetricsCollection() metricsCollection {
+	return metricsCollection{Near: newMetricsRecord(), Far: newMetricsRecord(), RT: newMetricsRecord()}
 }
 
 // we can feed a sample to a collection and it will update itself
 func (col *metricsCollection) UpdatemetricsCollection(sample sample) {
-	pktCount++
 	col.RT.updateMetrics(sample.RT)
 	col.Far.updateMetrics(sample.Far)
 	col.Near.updateMetrics(sample.Near)
@@ -137,8 +99,6 @@ func (col *metricsCollection) UpdatemetricsCollection(sample sample) {
 
 func (col *metricsCollection) String() string {
 	var res strings.Builder
-	var percentage float64 = (float64(pktLost) / float64(pktTotal)) * 100
-	fmt.Fprintf(&res, "\033[F\033[F\033[F\033[FPackets:   sent %-4d      received %-4d  lost %-4d      loss %4.2f%%    \n", pktTotal, pktCount, pktLost, percentage)
 	fmt.Fprintf(&res, "Near-end:  %s\n", col.Near.String())
 	fmt.Fprintf(&res, "Far-end:   %s\n", col.Far.String())
 	fmt.Fprintf(&res, "Roundtrip: %s\n", col.RT.String())
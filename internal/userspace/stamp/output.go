@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cilium/ebpf/ringbuf"
@@ -24,44 +25,72 @@ func output(ctx context.Context, args Args) error {
 	//shorter intervals will look bad tho, which is why we shouldn't do it this way
 	ticker := time.NewTicker(args.Interval / 2)
 	var sample sender.SenderSample
-	var met metricsCollection = newMetricsCollection(newSample(&sample))
 	var hist stampHist
 	//this prints out the hist to a file, but only if we set --hist
 	if args.Hist == true {
 		histopts := histArgs{Bins: args.HistB, Floor: args.HistF, Ceil: args.HistC}
 		hist = newHistogram(histopts)
 	}
+	handle := func(sample *sender.SenderSample) {
+		s := newSample(sample)
+		if valid, inAgg := validPacket(s.Reflector, s.Seq); valid == true {
+			if sample.Echo != echoOK {
+				//reflector didn't echo our sender block back properly - count it and move on
+				recordMismatch(s.Reflector, inAgg)
+			} else {
+				//update metrics
+				recordSample(s, inAgg)
+				//histogram is an aggregate too so unhealthy reflectors stay out of it
+				if args.Hist == true && inAgg == true {
+					hist.updateHistogram(s.RT)
+				}
+				process(Measurement{Seq: s.Seq, Near: s.Near, Far: s.Far, RT: s.RT, Reflector: s.Reflector})
+			}
+		}
+	}
 	var record ringbuf.Record
-	fmt.Printf("\n\n\n\n")
-	for (pktCount+pktLost) < args.Count || args.Count == 0 {
+	if args.JSON == false {
+		fmt.Print(strings.Repeat("\n", reportLines()))
+	}
+	for sessionOver(args.Count) == false {
+		// stopping a JSON session early still gets you what it has so far
+		if ctx.Err() != nil {
+			if args.JSON == false {
+				return nil
+			}
+			break
+		}
+		// authenticated mode samples come from userspace instead of the ringbuf
 		select {
-		case <-ctx.Done():
-			return nil
+		case sample = <-senderAuthSamples:
+			handle(&sample)
 		default:
-		}
-		if rd.AvailableBytes() > 0 {
-			record, err = rd.Read()
-			//read a record
-			if err = binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &sample); err != nil {
-				return fmt.Errorf("Parsing ringbuf record: %w", err)
-			}
-			if validPacket(sample.Seq) == true {
-				//update metrics
-				met.UpdatemetricsCollection(newSample(&sample))
-				if args.Hist == true {
-					hist.updateHistogram(newSample(&sample).RT)
+			if rd.AvailableBytes() > 0 {
+				record, err = rd.Read()
+				//read a record
+				if err = binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &sample); err != nil {
+					return fmt.Errorf("Parsing ringbuf record: %w", err)
 				}
+				handle(&sample)
 			}
 		}
 		// print out metrics
-		fmt.Print(met.String())
-		<-ticker.C
+		if args.JSON == false {
+			fmt.Print(report())
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
 	}
-	// gotta print it before exit to print the last packet received
-	fmt.Print(met.String())
 	if args.Hist == true {
 		os.WriteFile(args.HistPath, []byte(hist.String()), 0644)
 	}
+	if args.JSON == true {
+		return writeResults(args.JSONOut)
+	}
+	// gotta print it before exit to print the last packet received
+	fmt.Print(report())
 	return nil
 }
 
@@ -80,6 +109,14 @@ func reflectorOutput(ctx context.Context, args Args) error {
 		histopts := histArgs{Bins: args.HistB, Floor: args.HistF, Ceil: args.HistC}
 		hist = newHistogram(histopts)
 	}
+	handle := func(s refSample) {
+		//update metrics
+		met.updateMetrics(s.sam)
+		if args.Hist == true {
+			hist.updateHistogram(s.sam)
+		}
+		process(Measurement{Seq: s.seq, Near: s.sam})
+	}
 	var record ringbuf.Record
 	for {
 		select {
@@ -87,20 +124,32 @@ func reflectorOutput(ctx context.Context, args Args) error {
 			return nil
 		default:
 		}
-		if rd.AvailableBytes() > 0 {
-			record, err = rd.Read()
-			//read a record
-			if err = binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &sample); err != nil {
-				return fmt.Errorf("Parsing ringbuf record: %w", err)
-			}
-			//update metrics
-			met.updateMetrics(newRefSample(&sample).sam)
-			if args.Hist == true {
-				hist.updateHistogram(newRefSample(&sample).sam)
+		// authenticated mode samples come from userspace instead of the ringbuf
+		select {
+		case s := <-refAuthSamples:
+			handle(s)
+		default:
+			if rd.AvailableBytes() > 0 {
+				record, err = rd.Read()
+				//read a record
+				if err = binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &sample); err != nil {
+					return fmt.Errorf("Parsing ringbuf record: %w", err)
+				}
+				handle(newRefSample(&sample))
 			}
 		}
 		// print out metrics
-		fmt.Printf("%s \r", met.String())
+		mut.RLock()
+		auth := ""
+		if authStats.enabled == true {
+			auth = "  " + authString()
+		}
+		if args.IfDrops == true {
+			fmt.Printf("%s%s  %s\033[F", met.String(), auth, dropsString())
+		} else {
+			fmt.Printf("%s%s \r", met.String(), auth)
+		}
+		mut.RUnlock()
 		//we can't make assumptions regarding session length on reflector side
 		//so we print a file every time we receive a packet
 		if args.Hist == true {
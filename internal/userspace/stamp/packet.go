@@ -5,51 +5,312 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type senderpacket struct {
 	Seq  uint32
 	Ts_s uint32
 	Ts_f uint32
-	MBZ  [32]byte
+	Err  ErrorEstimate
+	MBZ  [30]byte
+}
+
+// --tai-offset, 0 to go by detection
+var taiOffset int
+
+// TAICorrection is how many seconds to add to CLOCK_TAI for it to be offset seconds ahead of UTC
+func TAICorrection(offset int) int64 {
+	var tai, utc unix.Timespec
+	unix.ClockGettime(unix.CLOCK_TAI, &tai)
+	unix.ClockGettime(unix.CLOCK_REALTIME, &utc)
+	// rounded so a second ticking over between the two calls doesn't throw it off
+	diff := (tai.Nano() - utc.Nano() + 500000000) / 1000000000
+	return int64(offset) - diff
+}
+
+// sender only: what our timestamps go out in, from Args.TimestampFormat
+var tsFormat TimestampFormat
+
+// same conversion as timestamp() in stamp.bpf.h, including the leap second correction
+func timestampNow(f TimestampFormat) (secs, fracs uint32) {
+	var tai, utc unix.Timespec
+	unix.ClockGettime(unix.CLOCK_TAI, &tai)
+	unix.ClockGettime(unix.CLOCK_REALTIME, &utc)
+	ntps := uint64(tai.Sec)
+	if taiOffset != 0 {
+		ntps += uint64(TAICorrection(taiOffset))
+	} else if tai.Sec == utc.Sec {
+		ntps += 37
+	}
+	return fromUnix(ntps*1000000000+uint64(tai.Nsec), f)
 }
 
-func dialReflector(laddr, addr net.IP, s_port, d_port int) (*net.UDPConn, error) {
+// unix ns in either format, the TAI correction's already in
+func fromUnix(ns uint64, f TimestampFormat) (secs, fracs uint32) {
+	s, n := ns/1000000000, ns%1000000000
+	if f == FormatPTP {
+		return uint32(s), uint32(n)
+	}
+	return uint32(s + 2208988800), uint32((n << 32) / 1000000000)
+}
+
+// same as untimestamp() in stamp.bpf.h, b is the timestamp as it sits in the packet
+func toUnix(b []byte, f TimestampFormat) uint64 {
+	secs, fracs := uint64(binary.BigEndian.Uint32(b)), uint64(binary.BigEndian.Uint32(b[4:]))
+	if f == FormatPTP {
+		return secs*1000000000 + fracs
+	}
+	return (secs-2208988800)*1000000000 + (fracs*1000000000)>>32
+}
+
+// we talk to every reflector from the same source port so we can't dial each one separately, one unconnected socket it is
+// with rewrite routing picks the source address, BPF swaps it for laddr on the way out
+func listenSender(laddr net.IP, s_port int, rewrite bool) (*net.UDPConn, error) {
 	localaddr := net.UDPAddr{IP: laddr, Port: s_port}
-	var remoteaddr net.UDPAddr
-	remoteaddr = net.UDPAddr{IP: addr, Port: d_port}
-	conn, err := net.DialUDP("udp", &localaddr, &remoteaddr)
+	if rewrite == true {
+		localaddr.IP = nil
+	}
+	conn, err := net.ListenUDP("udp", &localaddr)
 	if err != nil {
-		return nil, fmt.Errorf("Error connecting: %w", err)
+		return nil, fmt.Errorf("Error binding: %w", err)
 	}
 	return conn, nil
 }
 
-func send(ctx context.Context, args Args) error {
-	//setup
-	conn, err := dialReflector(args.Localaddr, args.IP, args.S_port, args.D_port)
+// DSCP is the upper 6 bits of ToS/traffic class, the kernel leaves ECN alone
+func setDSCP(conn *net.UDPConn, dscp int, v6 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("Error setting DSCP: %w", err)
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if v6 == true {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, dscp<<2)
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, dscp<<2)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return fmt.Errorf("Error setting DSCP: %w", err)
+	}
+	return nil
+}
+
+// path MTU discovery all the way: DF on every probe and no local fragmenting, a probe too big for the path gets dropped on the way
+// and shows up as loss instead of quietly arriving in pieces
+func setDF(conn *net.UDPConn, v6 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("Error setting DF: %w", err)
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if v6 == true {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
 	if err != nil {
-		return fmt.Errorf("Error dialing reflector: %w", err)
+		return fmt.Errorf("Error setting DF: %w", err)
 	}
-	var seq uint32 = 1
-	var buff = make([]byte, 44)
+	return nil
+}
+
+func send(ctx context.Context, args Args, conn *net.UDPConn) error {
+	//setup
+	var remotes []*net.UDPAddr
+	for _, ip := range args.IPs {
+		remotes = append(remotes, &net.UDPAddr{IP: ip, Port: args.D_port})
+	}
+	// seq wraps around to 0 past 2^32-1 like it should, sent is what Count goes by
+	seq, sent := args.SeqStart, uint32(0)
+	var buff = make([]byte, 44+TLVLen(args))
+	appendTLVs(buff[44:], args)
 	ticker := time.NewTicker(args.Interval)
-	//send packets
-	for args.Count >= seq || args.Count == 0 {
+	// the output loop waits for everything we sent to be accounted for, then the session's over
+	defer func() {
+		lastSent.Store(sent)
+		sendDone.Store(true)
+	}()
+	var deadline time.Time
+	if args.Duration > 0 {
+		deadline = time.Now().Add(args.Duration)
+	}
+	//send packets - every reflector gets a packet with the same seq each tick, they're separate sessions regardless
+	for args.Count > sent || args.Count == 0 {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
 		}
-		_, err := binary.Encode(buff, binary.BigEndian, senderpacket{Seq: seq})
-		if err != nil {
-			return fmt.Errorf("Encode error: %w", err)
+		if args.Duration > 0 && time.Now().After(deadline) {
+			return nil
+		}
+		// padding changed mid-session, the TLVs in front of it stay as they were
+		if p := currentPadding(); p != args.PaddingBytes {
+			args.PaddingBytes = p
+			buff = make([]byte, 44+TLVLen(args))
+			appendTLVs(buff[44:], args)
+		}
+		// the HMAC covers T1 so the whole packet is on us
+		if len(args.AuthKey) > 0 {
+			buff = senderPacketAuth(seq)
+		} else if err := encodeSenderPacket(buff[:44], seq, args.Cgroup != ""); err != nil {
+			return err
+		}
+		for _, remote := range remotes {
+			conn.WriteToUDP(buff, remote)
+			queuePacket(remote.AddrPort().Addr().Unmap(), seq, args.Timeout)
 		}
-		conn.Write(buff)
-		queuePacket(seq, args.Timeout)
 		seq++
-		<-ticker.C
+		sent++
+		if args.Poisson == true {
+			time.Sleep(poissonInterval(args.Interval))
+		} else {
+			<-ticker.C
+		}
+	}
+	return nil
+}
+
+func encodeSenderPacket(buff []byte, seq uint32, cgroup bool) error {
+	// TCX mode has BPF write it next to T1, it's the same value
+	pkt := senderpacket{Seq: seq, Err: currentErrorEstimate().WithFormat(tsFormat)}
+	// cgroup programs can't write to the packet so T1 is on us, BPF notes the precise egress time on its own
+	if cgroup == true {
+		pkt.Ts_s, pkt.Ts_f = timestampNow(tsFormat)
+	}
+	_, err := binary.Encode(buff, binary.BigEndian, pkt)
+	if err != nil {
+		return fmt.Errorf("Encode error: %w", err)
 	}
 	return nil
 }
+
+// TLVs(RFC 8972 4): flags, type, length of what follows, then the value
+// Extra Padding(4.1) is just zeroes, Follow-Up Telemetry(4.7), Location(4.2) and Timestamp Information(4.3) go out empty for the reflector to fill in
+// KEEP IN SYNC with struct follow_up_tlv, the Location TLV and struct ts_info_tlv in stamp.bpf.h, they go in this order in front of the padding
+const (
+	tlvHdrLen        = 4
+	tlvExtraPadding  = 1
+	tlvLocation      = 2
+	tlvTimestampInfo = 3
+	tlvFollowUp      = 7
+	followUpLen      = 16
+	timestampInfoLen = 4
+	// location sub-TLVs, one destination and one source address of our own family
+	subTLVDstIPv4 = 3
+	subTLVDstIPv6 = 4
+	subTLVSrcIPv4 = 5
+	subTLVSrcIPv6 = 6
+)
+
+// the Location TLV's value: both ports, then the two address sub-TLVs
+func locationLen(v6 bool) int {
+	if v6 == true {
+		return 4 + 2*(tlvHdrLen+16)
+	}
+	return 4 + 2*(tlvHdrLen+4)
+}
+
+// PaddingLen is how much the Extra Padding TLV for this many bytes adds to the packet, header included; nothing for 0
+func PaddingLen(bytes int) int {
+	if bytes == 0 {
+		return 0
+	}
+	return tlvHdrLen + bytes
+}
+
+// PaddingForSize is how many bytes of Extra Padding make a probe's IP packet exactly size bytes along with everything else args asks for;
+// the IP header has no options(or extension headers) so it's 20 or 40 bytes
+func PaddingForSize(args Args, size int) (int, error) {
+	args.PaddingBytes = 0
+	l3 := 20
+	if args.Localaddr.To4() == nil {
+		l3 = 40
+	}
+	base := l3 + 8 + 44 + TLVLen(args)
+	rest := size - base
+	if rest == 0 {
+		return 0, nil
+	}
+	// the padding TLV's header takes 4 bytes before there's any padding at all
+	if rest < tlvHdrLen {
+		return 0, fmt.Errorf("Invalid packet size %d: has to be %d, or %d and up to fit a padding TLV", size, base, base+tlvHdrLen)
+	}
+	return rest - tlvHdrLen, nil
+}
+
+// what the probes userspace builds are padded with, set from Args.PaddingBytes once a session starts and by SetPadding after that
+var paddingBytes atomic.Int64
+
+// SetPadding changes the Extra Padding TLV of the probes mid-session, the next one goes out with it; it's on the caller to check it fits
+func SetPadding(bytes int) {
+	paddingBytes.Store(int64(bytes))
+}
+
+func currentPadding() int {
+	return int(paddingBytes.Load())
+}
+
+// TLVLen is how much every TLV the sender was asked for adds to the packet
+func TLVLen(args Args) int {
+	l := PaddingLen(args.PaddingBytes)
+	if args.FollowUp == true {
+		l += tlvHdrLen + followUpLen
+	}
+	if args.LocationTLV == true {
+		l += tlvHdrLen + locationLen(args.Localaddr.To4() == nil)
+	}
+	if args.TimestampInfo == true {
+		l += tlvHdrLen + timestampInfoLen
+	}
+	return l
+}
+
+// the TLVs go in once, only the base packet changes from probe to probe
+func appendTLVs(buff []byte, args Args) {
+	if args.FollowUp == true {
+		buff[1] = tlvFollowUp
+		binary.BigEndian.PutUint16(buff[2:], followUpLen)
+		buff = buff[tlvHdrLen+followUpLen:]
+	}
+	if args.LocationTLV == true {
+		v6 := args.Localaddr.To4() == nil
+		buff[1] = tlvLocation
+		binary.BigEndian.PutUint16(buff[2:], uint16(locationLen(v6)))
+		dst, src, alen := byte(subTLVDstIPv4), byte(subTLVSrcIPv4), 4
+		if v6 == true {
+			dst, src, alen = subTLVDstIPv6, subTLVSrcIPv6, 16
+		}
+		// ports stay zero, a reply that still has them that way came from a reflector that didn't fill it in
+		sub := buff[tlvHdrLen+4:]
+		sub[1] = dst
+		binary.BigEndian.PutUint16(sub[2:], uint16(alen))
+		sub = sub[tlvHdrLen+alen:]
+		sub[1] = src
+		binary.BigEndian.PutUint16(sub[2:], uint16(alen))
+		buff = buff[tlvHdrLen+locationLen(v6):]
+	}
+	if args.TimestampInfo == true {
+		buff[1] = tlvTimestampInfo
+		binary.BigEndian.PutUint16(buff[2:], timestampInfoLen)
+		buff = buff[tlvHdrLen+timestampInfoLen:]
+	}
+	if args.PaddingBytes > 0 {
+		buff[1] = tlvExtraPadding
+		binary.BigEndian.PutUint16(buff[2:], uint16(args.PaddingBytes))
+	}
+}
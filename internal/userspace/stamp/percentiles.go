@@ -0,0 +1,107 @@
+package stamp
+
+import (
+	"math"
+	"time"
+)
+
+// pre-aggregated stats for dashboards: latency percentiles and loss over sliding windows
+
+// latencies go into log-scale buckets, bucket i covers (pctBase^(i-1), pctBase^i] milliseconds
+// a percentile is reported as the geometric middle of its bucket so it's off by at most ~1% either way,
+// which is a lot better than what the network jitter lets you see anyway
+const pctBase = 1.02
+
+var pctLogBase = math.Log(pctBase)
+
+// the percentiles we publish
+var quantiles = []float64{0.5, 0.9, 0.95, 0.99, 0.999}
+
+type latencyHist struct {
+	buckets map[int]uint64
+	count   uint64
+	sum     float64 // ms
+}
+
+func newLatencyHist() latencyHist {
+	return latencyHist{buckets: make(map[int]uint64)}
+}
+
+func (h *latencyHist) add(ms float64) {
+	h.count++
+	h.sum += ms
+	// zero can't be log'd, treat anything under a nanosecond as the lowest bucket
+	if ms < 1e-6 {
+		ms = 1e-6
+	}
+	h.buckets[int(math.Ceil(math.Log(ms)/pctLogBase))]++
+}
+
+// returns the q-th quantile in ms, NaN when there's nothing to compute it from
+func (h *latencyHist) quantile(q float64) float64 {
+	if h.count == 0 {
+		return math.NaN()
+	}
+	// buckets are sparse so we walk them in order lowest to highest
+	lo, hi := math.MaxInt, math.MinInt
+	for i := range h.buckets {
+		lo = min(lo, i)
+		hi = max(hi, i)
+	}
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for i := lo; i <= hi; i++ {
+		seen += h.buckets[i]
+		if seen >= rank {
+			return math.Pow(pctBase, float64(i)-0.5)
+		}
+	}
+	return math.Pow(pctBase, float64(hi)-0.5)
+}
+
+// loss over sliding windows, kept as one slot per second
+// a packet lands in the slot of the second its fate was decided(came back or timed out)
+const maxLossWindow = time.Hour
+
+type lossSlot struct {
+	sec            int64
+	answered, lost uint32
+}
+
+type lossWindow struct {
+	slots []lossSlot
+}
+
+func newLossWindow() lossWindow {
+	return lossWindow{slots: make([]lossSlot, int(maxLossWindow/time.Second))}
+}
+
+func (w *lossWindow) add(now time.Time, lost bool) {
+	sec := now.Unix()
+	slot := &w.slots[sec%int64(len(w.slots))]
+	// slot still holds a second from a previous lap around the ring
+	if slot.sec != sec {
+		*slot = lossSlot{sec: sec}
+	}
+	if lost == true {
+		slot.lost++
+	} else {
+		slot.answered++
+	}
+}
+
+// loss ratio over the last d, NaN if no packets were accounted for in that time
+func (w *lossWindow) ratio(now time.Time, d time.Duration) float64 {
+	var answered, lost uint32
+	cutoff := now.Add(-d).Unix()
+	for _, slot := range w.slots {
+		if slot.sec > cutoff && slot.sec <= now.Unix() {
+			answered += slot.answered
+			lost += slot.lost
+		}
+	}
+	if answered+lost == 0 {
+		return math.NaN()
+	}
+	return float64(lost) / float64(answered+lost)
+}
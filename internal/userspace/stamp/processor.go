@@ -0,0 +1,51 @@
+package stamp
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// Measurement is a single valid sample as it leaves the collector, latencies are in milliseconds
+// on the sender all three directions are populated; the reflector only ever sees the near-end(sender->reflector) leg
+// so Far and RT are always zero there, and so is Reflector
+type Measurement struct {
+	Seq           uint32
+	Near, Far, RT float64
+	Reflector     netip.Addr
+}
+
+// Processor is a custom post-processing step that gets fed every valid measurement
+// ORDERING: processors are called in the order they were registered, after the built-in metrics and histogram are updated
+// THREADING: all processors are called synchronously from the collector goroutine, one measurement at a time,
+// so Process is never called concurrently with itself or other processors - but it also blocks the collector
+// while it runs, so if you need to do anything heavy(network, disk) hand the measurement off to your own goroutine
+type Processor interface {
+	Process(Measurement)
+}
+
+// ProcessorFunc lets you use a plain function as a Processor
+type ProcessorFunc func(Measurement)
+
+func (f ProcessorFunc) Process(m Measurement) {
+	f(m)
+}
+
+var processors []Processor
+var procMut sync.RWMutex
+
+// RegisterProcessor appends a processor to the pipeline
+// it's safe to call this at any time but processors registered mid-session will only see measurements from that point on
+func RegisterProcessor(p Processor) {
+	procMut.Lock()
+	processors = append(processors, p)
+	procMut.Unlock()
+}
+
+// runs the measurement through the whole pipeline, called by the collector
+func process(m Measurement) {
+	procMut.RLock()
+	defer procMut.RUnlock()
+	for _, p := range processors {
+		p.Process(m)
+	}
+}
@@ -0,0 +1,27 @@
+package stamp
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// every randomized component has to draw from here instead of the global math/rand
+// so that a run can be reproduced exactly by passing the same --seed
+var rng = rand.New(rand.NewPCG(0, 0))
+var rngMut sync.Mutex
+
+// Seed reseeds the shared source, call it once before starting the session
+func Seed(seed uint64) {
+	rngMut.Lock()
+	rng = rand.New(rand.NewPCG(seed, seed))
+	rngMut.Unlock()
+}
+
+// --poisson: the gaps between Poisson arrivals are exponentially distributed, mean is what they average out to
+// the shared source isn't safe for concurrent use on its own
+func poissonInterval(mean time.Duration) time.Duration {
+	rngMut.Lock()
+	defer rngMut.Unlock()
+	return time.Duration(rng.ExpFloat64() * float64(mean))
+}
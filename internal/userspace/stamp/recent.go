@@ -0,0 +1,84 @@
+package stamp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/viktordoronin/stamp-bpf/internal/bpf/sender"
+)
+
+// the sender BPF program keeps the last N raw measurements in an array map used as a ring
+// this is a cheap way to get recent history without running the full collector
+// each entry is 36 bytes which the kernel rounds up to 40, so the ring costs ~40*N bytes of kernel memory
+
+// reads the whole ring and returns entries ordered oldest to newest, empty slots are skipped
+func readRecent(m *ebpf.Map) ([]sender.SenderRawMeasurement, error) {
+	var res []sender.SenderRawMeasurement
+	var key uint32
+	var val sender.SenderRawMeasurement
+	iter := m.Iterate()
+	for iter.Next(&key, &val) {
+		// slots that were never written to are all zeroes
+		if val.T4 == 0 {
+			continue
+		}
+		res = append(res, val)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterating recent measurements: %w", err)
+	}
+	// the ring is written in arrival order so T4 gives us the order back
+	slices.SortFunc(res, func(a, b sender.SenderRawMeasurement) int {
+		switch {
+		case a.T4 < b.T4:
+			return -1
+		case a.T4 > b.T4:
+			return 1
+		}
+		return 0
+	})
+	return res, nil
+}
+
+// DumpRecent prints the recent measurements ring, oldest first
+func DumpRecent(w io.Writer, m *ebpf.Map) error {
+	recent, err := readRecent(m)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nLast %d measurements(timestamps in unix ns, latencies in ms):\n", len(recent))
+	fmt.Fprintf(w, "%-10s %-20s %-20s %-20s %-20s %10s %10s %10s\n", "seq", "t1", "t2", "t3", "t4", "near", "far", "rt")
+	for _, r := range recent {
+		// same as the sample math in sender.bpf.c, underflows on desync the same way too
+		near := float64(r.T2-r.T1) * 1e-6
+		far := float64(r.T4-r.T3) * 1e-6
+		rt := float64(r.T4-r.T1) * 1e-6
+		fmt.Fprintf(w, "%-10d %-20d %-20d %-20d %-20d %10.3f %10.3f %10.3f\n", r.Seq, r.T1, r.T2, r.T3, r.T4, near, far, rt)
+	}
+	return nil
+}
+
+// dumps the ring every time we get SIGUSR1
+func dumpOnSignal(ctx context.Context, m *ebpf.Map) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			if err := DumpRecent(os.Stdout, m); err != nil {
+				fmt.Fprintf(os.Stderr, "Error dumping recent measurements: %v\n", err)
+			}
+			// make room for the live metrics to redraw themselves below the dump
+			fmt.Printf("\n\n\n\n")
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package stamp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Results is what a finished session comes down to, --output json prints it once it's over
+// latencies are in ms and jitter in percent, same as the live report
+type Results struct {
+	Sessions []SessionResults `json:"sessions"`
+	// only with several reflectors, covers the ones that were healthy at the time
+	Aggregate *SessionResults `json:"aggregate,omitempty"`
+}
+
+// SessionResults is one reflector's session, or the aggregate over all of them
+type SessionResults struct {
+	Reflector string `json:"reflector,omitempty"`
+	Sent      uint32 `json:"sent"`
+	Received  uint32 `json:"received"`
+	Lost      uint32 `json:"lost"`
+	BadEcho   uint32 `json:"bad_echo"`
+	// percent of sent, same as the live report
+	Loss float64 `json:"loss_percent"`
+	// sequence numbers we sent, both ends included; the last one is below the first if they wrapped around 2^32,
+	// 0 and 0 if nothing went out
+	SeqFirst uint32         `json:"seq_first"`
+	SeqLast  uint32         `json:"seq_last"`
+	Near     LatencyResults `json:"near_end"`
+	Far      LatencyResults `json:"far_end"`
+	RT       LatencyResults `json:"roundtrip"`
+}
+
+// LatencyResults are the metrics for one direction
+type LatencyResults struct {
+	Min    float64 `json:"min_ms"`
+	Max    float64 `json:"max_ms"`
+	Avg    float64 `json:"avg_ms"`
+	Jitter float64 `json:"jitter_percent"`
+	// per reflector only, the aggregate doesn't have it
+	Variation *DelayVariation `json:"delay_variation,omitempty"`
+}
+
+// DelayVariation is RFC 3393 IPDV and RFC 5481 PDV for one direction, in ms
+type DelayVariation struct {
+	// mean and max of the absolute difference between the delays of seq n-1 and n, over the pairs that both came back in that order
+	IPDVMean float64 `json:"ipdv_mean_ms"`
+	IPDVMax  float64 `json:"ipdv_max_ms"`
+	// replies that came back after a later seq, IPDV is undefined for the pair they make with the one before them
+	IPDVReordered uint32 `json:"ipdv_reordered"`
+	// how far above the minimum the average and the worst reply were
+	PDVMean float64 `json:"pdv_mean_ms"`
+	PDVMax  float64 `json:"pdv_max_ms"`
+}
+
+func latencyResults(m stampMetrics) LatencyResults {
+	return LatencyResults{Min: m.Min, Max: m.Max, Avg: m.Avg, Jitter: m.Jitter}
+}
+
+// ipdv is nil for the aggregate
+func sessionResults(stats packetStats, met metricsCollection, ipdv *ipdvCollection, first, last uint32) SessionResults {
+	r := SessionResults{
+		Sent: stats.total, Received: stats.count, Lost: stats.lost, BadEcho: stats.mismatch,
+		SeqFirst: first, SeqLast: last,
+		Near: latencyResults(met.Near), Far: latencyResults(met.Far), RT: latencyResults(met.RT),
+	}
+	if ipdv != nil {
+		r.Near.Variation = delayVariation(met.Near, ipdv.Near)
+		r.Far.Variation = delayVariation(met.Far, ipdv.Far)
+		r.RT.Variation = delayVariation(met.RT, ipdv.RT)
+	}
+	if stats.total > 0 {
+		r.Loss = float64(stats.lost) / float64(stats.total) * 100
+	}
+	// an average of exactly 0 makes jitter 0/0, which JSON has no way to say
+	for _, l := range []*LatencyResults{&r.Near, &r.Far, &r.RT} {
+		if math.IsNaN(l.Jitter) == true {
+			l.Jitter = 0
+		}
+	}
+	return r
+}
+
+// snapshot of every session so far
+func results() Results {
+	mut.RLock()
+	defer mut.RUnlock()
+	var res Results
+	var first, last, most uint32
+	for _, d := range destOrder {
+		res.Sessions = append(res.Sessions, sessionResults(d.stats, d.met, &d.ipdv, d.seqFirst, d.seqLast))
+		res.Sessions[len(res.Sessions)-1].Reflector = d.addr.String()
+		// every reflector gets the same seq every tick, the one that got the most covers the rest
+		// and there's no min or max to take once they wrap
+		if d.stats.total > most {
+			first, last, most = d.seqFirst, d.seqLast, d.stats.total
+		}
+	}
+	if len(destOrder) > 1 {
+		a := sessionResults(agg.stats, agg.met, nil, first, last)
+		res.Aggregate = &a
+	}
+	return res
+}
+
+// nil goes to stdout
+func writeResults(w io.Writer) error {
+	if w == nil {
+		w = os.Stdout
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(results()); err != nil {
+		return fmt.Errorf("Error writing results: %w", err)
+	}
+	return nil
+}
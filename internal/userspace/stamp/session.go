@@ -3,8 +3,14 @@ package stamp
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cilium/ebpf"
@@ -12,20 +18,114 @@ import (
 )
 
 type Args struct {
-	Dev                 *net.Interface
-	Localaddr           net.IP
-	IP                  net.IP
-	S_port, D_port      int
-	Interval            time.Duration
-	Count               uint32
-	OutputMap           *ebpf.Map
-	Debug               bool
+	Dev *net.Interface
+	// every interface to attach to, Dev included and first; just Dev when empty
+	Devs           []*net.Interface
+	Localaddr      net.IP
+	IPs            []net.IP
+	S_port, D_port int
+	Interval       time.Duration
+	Count          uint32
+	Duration       time.Duration // sender only: stop sending after this long, whichever of it and Count comes first
+	OutputMap      *ebpf.Map
+	RecentMap      *ebpf.Map
+	ProbesMap      *ebpf.Map
+	ArrivalsMap    *ebpf.Map
+	SessionsMap    *ebpf.Map
+	Recent         uint32
+	DumpMaps       bool
+	Debug          bool
+	// 0 for no verifier log, 1 for branches, 2 for every instruction
+	VerifierLogLevel    uint32
 	Timeout             time.Duration
 	Hist                bool
 	HistB, HistF, HistC uint32
 	HistPath            string
 	Output              bool
 	Sync, PTP           bool
+	// health gating for multiple reflectors, see destination.go
+	UnhealthyAfter, HealthyAfter uint32
+	// sender only: seeds the randomized probe spacing of Poisson, see random.go
+	Seed uint64
+	// sender only: probes go out at exponentially distributed intervals averaging Interval instead of a fixed one
+	Poisson bool
+	// attach to this cgroup instead of the interface, sender only
+	Cgroup string
+	// reflector only: reply from this port instead of the one we were reached on, 0 to disable
+	ReflectSport int
+	// reflector only: send replies back with the request's ports as they came in instead of swapping them, for looking into NATs and firewalls
+	KeepPorts bool
+	// reflector only: IPv4 replies go out with a zero(disabled) UDP checksum instead of one fixed up for what we wrote
+	ZeroUDPCsum bool
+	// reflector only: keep a sequence per session-sender instead of echoing theirs
+	Stateful bool
+	// poll and print interface-level drop counters alongside the metrics
+	IfDrops bool
+	// sender only: serve pre-aggregated metrics here, loss ratio is published for each window
+	MetricsAddr string
+	LossWindows []time.Duration
+	// don't abort on a failed interface or target, skip it and note it down in Failed
+	KeepGoing bool
+	Failed    []error
+	// bpffs directory to pin the stats(and the reflector's sessions) under for a sidecar, see loader.LoaderConfig.StatsPinPath
+	StatsPinPath string
+	// take another run's programs off the interface instead of refusing to attach next to them, see loader.LoaderConfig.ReplaceAttached
+	ReplaceAttached bool
+	// shared key for authenticated mode, unauthenticated when empty
+	AuthKey []byte
+	// sender only: bytes of Extra Padding TLV(RFC 8972 4.1) behind every probe, 0 for none
+	PaddingBytes int
+	// sender only: IP packet size PaddingBytes was worked out for(see PaddingForSize), probes go out with DF; 0 for no particular size
+	PacketSize int
+	// reflector only: answer on the interface's first address of the other IP version too
+	DualStack bool
+	// reflector only: senders we answer, everyone if empty
+	AllowFrom []*net.IPNet
+	// reflector only: RX queues the NIC spreads requests over, more than 1 sizes the maps for that many CPUs hitting them at once
+	Queues int
+	// reflector only: glob of interface names(see loader.MatchInterfaces) the CLI attaches to on top of Devs,
+	// WatchAndReattach attaches to new ones matching it as they come up
+	DevPattern string
+	// reflector only: the CLI runs WatchAndReattach for DevPattern
+	WatchInterfaces bool
+	// reflector only: replies a second we send at most, requests over it are dropped; 0 for no limit
+	MaxReplyPPS uint32
+	// Follow-Up Telemetry TLV(RFC 8972 4.7): the sender makes room for it and reads it out, the reflector fills it in
+	FollowUp bool
+	// Location TLV(RFC 8972 4.2): the sender makes room for it and reads it out, the reflector fills in the ports and addresses it saw
+	LocationTLV bool
+	// Timestamp Information TLV(RFC 8972 4.3): the sender makes room for it and reads it out, the reflector fills in what its clock is synced to
+	// and how it took T2 and T3
+	TimestampInfo bool
+	// TAI-UTC offset in seconds to stamp with instead of detecting whether CLOCK_TAI has one, 0 to detect
+	TAIOffset int
+	// sender only: what our timestamps go out in, the Z bit of our Error Estimate says which; the reflector answers in the same
+	TimestampFormat TimestampFormat
+	// sender only: DSCP(0-63) to mark probes with, 0 leaves them as they are
+	DSCP int
+	// sender only: the socket isn't bound to Localaddr, BPF rewrites the source address of probes that go out from another one
+	RewriteSource bool
+	// Error Estimate(RFC 8762 4.2.1) of our clock for the packets userspace builds, from the loader handle's ErrorEstimate
+	ErrorEstimate ErrorEstimate
+	// take receive timestamps(T2 on the reflector, T4 on the sender) from the NIC when it has them
+	HWTimestamps bool
+	// find the IP header behind up to two VLAN tags still in the frame, TCX only
+	VLANAware bool
+	// reflector only: count requests to any address on the port and let them through without answering, for a tap or a SPAN port
+	Passive bool
+	// sender only: print Results as JSON to JSONOut(stdout when nil) once the session's over instead of the live report
+	JSON    bool
+	JSONOut io.Writer
+	// sender only: a CSV row per reply on stdout, written from the loader handle's Events() with loader.WriteCSV
+	CSV bool
+	// sender only: only every Nth reply makes it into the per-packet events(and so the CSV), 0 and 1 for all of them; the stats stay exact
+	SampleRate uint32
+	// sender only: sequence number of the first probe, they go up by one from there and wrap around to 0 past 2^32-1
+	SeqStart uint32
+	// copy out the first Capture frames the programs see of the session and write them to CapturePath as a pcap
+	// with the loader handle's DumpPackets, 0 is off
+	Capture     uint32
+	CapturePath string
 }
 
 func StartSession(args Args) {
@@ -35,22 +135,133 @@ func StartSession(args Args) {
 	} else {
 		cnt = fmt.Sprintf("%d", args.Count)
 	}
-	fmt.Printf("Stateless unauthenticated STAMP session between %s:%d and %s:%d\n%s packets sent at %.3fs interval with %.fs timeout\n\n", args.Localaddr.String(), args.S_port, args.IP.String(), args.D_port, cnt, args.Interval.Seconds(), args.Timeout.Seconds())
-	eg, ctx := errgroup.WithContext(context.Background())
-	eg.Go(func() error { return send(ctx, args) })
+	if args.Duration > 0 {
+		cnt += fmt.Sprintf("(for up to %s)", args.Duration)
+	}
+	var remotes []string
+	for _, ip := range args.IPs {
+		addr, _ := netip.AddrFromSlice(ip)
+		addDestination(addr)
+		remotes = append(remotes, net.JoinHostPort(ip.String(), fmt.Sprint(args.D_port)))
+	}
+	unhealthyAfter, healthyAfter = args.UnhealthyAfter, args.HealthyAfter
+	taiOffset = args.TAIOffset
+	tsFormat = args.TimestampFormat
+	SetErrorEstimate(args.ErrorEstimate)
+	SetPadding(args.PaddingBytes)
+	Seed(args.Seed)
+	mode := "unauthenticated"
+	if len(args.AuthKey) > 0 {
+		mode = "authenticated"
+	}
+	pacing := "interval"
+	if args.Poisson == true {
+		pacing = "average interval(Poisson)"
+	}
+	fmt.Printf("Stateless %s STAMP session between %s and %s\n%s packets sent at %.3fs %s with %.fs timeout\n\n", mode, net.JoinHostPort(args.Localaddr.String(), fmt.Sprint(args.S_port)), strings.Join(remotes, ", "), cnt, args.Interval.Seconds(), pacing, args.Timeout.Seconds())
+	if args.Debug == true {
+		fmt.Printf("Random seed: %d\n\n", args.Seed)
+	}
+	if len(args.Failed) > 0 {
+		fmt.Printf("Skipping %d of %d reflectors, see the end of the session for details\n\n", len(args.Failed), len(args.Failed)+len(args.IPs))
+	}
+	parent := context.Background()
+	// results only come out at the end, so being stopped has to end the session rather than the process
+	if args.JSON == true {
+		var stop context.CancelFunc
+		parent, stop = signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+	}
+	eg, ctx := errgroup.WithContext(parent)
+	// background helpers don't decide when the session's over so they live outside the errgroup
+	bgctx, stop := context.WithCancel(ctx)
+	defer stop()
+	if args.IfDrops == true {
+		conn, err := initDrops(args.Dev.Index)
+		if err != nil {
+			log.Fatalf("Error setting up interface drop counters: %v", err)
+		}
+		go pollDrops(bgctx, conn, args.Dev.Index)
+	}
+	if args.Recent > 0 {
+		go dumpOnSignal(bgctx, args.RecentMap)
+	}
+	if args.MetricsAddr != "" {
+		ln, err := net.Listen("tcp", args.MetricsAddr)
+		if err != nil {
+			log.Fatalf("Error setting up metrics endpoint: %v", err)
+		}
+		lossWindows = args.LossWindows
+		go serveMetrics(bgctx, ln, args.Dev.Name)
+	}
+	// one socket for the whole session, replies come back to it in authenticated mode
+	conn, err := listenSender(args.Localaddr, args.S_port, args.RewriteSource)
+	if err != nil {
+		log.Fatalf("Error setting up sender socket: %v", err)
+	}
+	defer conn.Close()
+	// full-size probes are there to find path MTU problems, a fragmented one would hide them
+	if args.PacketSize > 0 {
+		if err := setDF(conn, args.Localaddr.To4() == nil); err != nil {
+			log.Fatalf("Error setting up sender socket: %v", err)
+		}
+		fmt.Printf("Probes are %d-byte IP packets with DF set, a hop with a smaller MTU drops them and it shows up as loss\n\n", args.PacketSize)
+	}
+	// cgroup programs can't touch the packet so the socket does the marking
+	if args.Cgroup != "" && args.DSCP > 0 {
+		if err := setDSCP(conn, args.DSCP, args.Localaddr.To4() == nil); err != nil {
+			log.Fatalf("Error setting up sender socket: %v", err)
+		}
+	}
+	if len(args.AuthKey) > 0 {
+		enableAuthStats()
+		setAuthKey(args.AuthKey)
+		go authReceive(conn, args)
+	}
+	eg.Go(func() error { return send(ctx, args, conn) })
 	eg.Go(func() error { return output(ctx, args) })
 	if err := eg.Wait(); err != nil {
 		log.Fatalf("Error while running the STAMP session: %v", err)
 	}
+	if len(args.Failed) > 0 {
+		fmt.Printf("\nThese reflectors were skipped at startup:\n")
+		for _, err := range args.Failed {
+			fmt.Printf("  %v\n", err)
+		}
+	}
 }
 
 func RefSession(args Args) {
+	taiOffset = args.TAIOffset
+	SetErrorEstimate(args.ErrorEstimate)
+	if args.Stateful == true {
+		fmt.Println("Stateful mode, every session-sender gets its own sequence")
+	}
+	if args.Passive == true {
+		fmt.Println("Passive mode, requests are counted and nothing gets answered")
+	}
+	eg, ctx := errgroup.WithContext(context.Background())
+	// BPF can't sign replies so in authenticated mode we answer them ourselves
+	if len(args.AuthKey) > 0 {
+		fmt.Println("Authenticated mode, replies are signed in userspace")
+		enableAuthStats()
+		setAuthKey(args.AuthKey)
+		eg.Go(func() error { return authReflect(ctx, args) })
+	}
 	if args.Output == true {
 		fmt.Println("Printing out session metrics as they arrive")
-		eg, ctx := errgroup.WithContext(context.Background())
-		eg.Go(func() error { return reflectorOutput(ctx, args) })
-		if err := eg.Wait(); err != nil {
-			log.Fatalf("Error while running the STAMP session: %v", err)
+		bgctx, stop := context.WithCancel(ctx)
+		defer stop()
+		if args.IfDrops == true {
+			conn, err := initDrops(args.Dev.Index)
+			if err != nil {
+				log.Fatalf("Error setting up interface drop counters: %v", err)
+			}
+			go pollDrops(bgctx, conn, args.Dev.Index)
 		}
+		eg.Go(func() error { return reflectorOutput(ctx, args) })
+	}
+	if err := eg.Wait(); err != nil {
+		log.Fatalf("Error while running the STAMP session: %v", err)
 	}
 }